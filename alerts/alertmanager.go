@@ -0,0 +1,71 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Notifier delivers alerts. Alerts which have not resolved are given expiresAt
+// as their end time.
+type Notifier interface {
+	Notify(alerts []Alert, expiresAt time.Time) error
+}
+
+// postableAlert is an alert in the Alertmanager v2 API format.
+type postableAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// AlertmanagerNotifier posts alerts to an Alertmanager v2 API endpoint, such as
+// http://alertmanager:9093/api/v2/alerts.
+type AlertmanagerNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewAlertmanagerNotifier returns a notifier posting to url.
+func NewAlertmanagerNotifier(url string, timeout time.Duration) *AlertmanagerNotifier {
+	return &AlertmanagerNotifier{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (an *AlertmanagerNotifier) Notify(alerts []Alert, expiresAt time.Time) error {
+	postable := make([]postableAlert, len(alerts))
+	for i, alert := range alerts {
+		postable[i] = postableAlert{
+			Labels:      alert.Labels,
+			Annotations: alert.Annotations,
+			StartsAt:    alert.StartsAt,
+			EndsAt:      expiresAt,
+		}
+		if alert.EndsAt != nil {
+			postable[i].EndsAt = *alert.EndsAt
+		}
+	}
+
+	data, err := json.Marshal(postable)
+	if err != nil {
+		return err
+	}
+	resp, err := an.client.Post(an.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alertmanager returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package alerts
+
+import (
+	"encoding/json"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a fake Alertmanager recording the alerts posted to it.
+type receiver struct {
+	server *httptest.Server
+	// posts are the alerts of each successful post.
+	posts [][]postableAlert
+	// fail makes posts fail with 500.
+	fail bool
+	mtx  sync.Mutex
+}
+
+func newReceiver(t *testing.T) *receiver {
+	rcv := &receiver{}
+	rcv.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v2/alerts" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %s (%s)", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		rcv.mtx.Lock()
+		defer rcv.mtx.Unlock()
+		if rcv.fail {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		var alerts []postableAlert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			t.Errorf("could not decode posted alerts: %v", err)
+		}
+		rcv.posts = append(rcv.posts, alerts)
+	}))
+	t.Cleanup(rcv.server.Close)
+	return rcv
+}
+
+func (rcv *receiver) setFail(fail bool) {
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	rcv.fail = fail
+}
+
+// last returns the alerts of the last post and the number of posts.
+func (rcv *receiver) last() ([]postableAlert, int) {
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	if len(rcv.posts) == 0 {
+		return nil, 0
+	}
+	return rcv.posts[len(rcv.posts)-1], len(rcv.posts)
+}
+
+func TestAlertmanagerNotifier(t *testing.T) {
+	rcv := newReceiver(t)
+	notifier := NewAlertmanagerNotifier(rcv.server.URL+"/api/v2/alerts", 5*time.Second)
+
+	startsAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	endsAt := startsAt.Add(time.Hour)
+	expiresAt := startsAt.Add(2 * time.Hour)
+	alerts := []Alert{
+		{
+			Rule: "Offline", CallbackId: "host1", State: StateFiring,
+			Labels:      map[string]string{"alertname": "Offline", "callback_id": "host1"},
+			Annotations: map[string]string{"summary": "host1 is offline"},
+			StartsAt:    startsAt,
+		},
+		{
+			Rule: "Offline", CallbackId: "host2", State: StateResolved,
+			Labels:   map[string]string{"alertname": "Offline", "callback_id": "host2"},
+			StartsAt: startsAt,
+			EndsAt:   &endsAt,
+		},
+	}
+	if err := notifier.Notify(alerts, expiresAt); err != nil {
+		t.Fatal(err)
+	}
+
+	posted, _ := rcv.last()
+	if len(posted) != 2 {
+		t.Fatalf("posted %+v, want 2 alerts", posted)
+	}
+	if posted[0].Labels["callback_id"] != "host1" || posted[0].Annotations["summary"] != "host1 is offline" {
+		t.Errorf("firing alert posted as %+v", posted[0])
+	}
+	if !posted[0].StartsAt.Equal(startsAt) || !posted[0].EndsAt.Equal(expiresAt) {
+		t.Errorf("firing alert posted from %v to %v, want %v to %v", posted[0].StartsAt, posted[0].EndsAt, startsAt, expiresAt)
+	}
+	if !posted[1].EndsAt.Equal(endsAt) {
+		t.Errorf("resolved alert posted ending %v, want %v", posted[1].EndsAt, endsAt)
+	}
+
+	rcv.setFail(true)
+	if err := notifier.Notify(alerts, expiresAt); err == nil {
+		t.Error("Notify succeeded although the Alertmanager returned 500")
+	}
+}
+
+// TestPostableAlertFormat checks alerts are encoded with the field names of the
+// Alertmanager v2 API.
+func TestPostableAlertFormat(t *testing.T) {
+	data, err := json.Marshal(postableAlert{Labels: map[string]string{"alertname": "Offline"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"labels", "startsAt", "endsAt"} {
+		if _, found := fields[name]; !found {
+			t.Errorf("%s is missing from %s", name, data)
+		}
+	}
+}
+
+func TestReconnectAlertDelivery(t *testing.T) {
+	rcv := newReceiver(t)
+	rules := []Rule{{Name: "Flapping", Pattern: "host*", Reconnects: 2, Window: util.Duration(time.Minute)}}
+	e, err := New(Config{Interval: time.Minute, ResendInterval: time.Hour}, rules, connman.NewConnectionManager(1024),
+		NewAlertmanagerNotifier(rcv.server.URL+"/api/v2/alerts", 5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		e.recordRegistration("host1", now.Add(time.Duration(i)*time.Second))
+	}
+	e.recordRegistration("other", now)
+	e.notify(e.evaluate(now.Add(3 * time.Second)))
+
+	posted, posts := rcv.last()
+	if posts != 1 || len(posted) != 1 || posted[0].Labels["alertname"] != "Flapping" || posted[0].Labels["callback_id"] != "host1" {
+		t.Fatalf("posted %+v, want the firing alert of host1", posted)
+	}
+	if !posted[0].EndsAt.After(time.Now()) {
+		t.Errorf("firing alert posted ending %v, want it to expire in the future", posted[0].EndsAt)
+	}
+
+	// Nothing changed, so nothing is sent before the resend interval.
+	e.notify(e.evaluate(now.Add(4 * time.Second)))
+	if _, n := rcv.last(); n != 1 {
+		t.Errorf("%d posts, want no more until the alert changes", n)
+	}
+
+	// The registrations leave the window while the Alertmanager is down.
+	rcv.setFail(true)
+	resolvedAt := now.Add(2 * time.Minute)
+	e.notify(e.evaluate(resolvedAt))
+	if len(e.Alerts()) != 0 {
+		t.Errorf("firing alerts = %+v, want the alert resolved", e.Alerts())
+	}
+
+	// The resolution is delivered at the next evaluation.
+	rcv.setFail(false)
+	e.notify(e.evaluate(resolvedAt.Add(time.Minute)))
+	posted, posts = rcv.last()
+	if posts != 2 || len(posted) != 1 {
+		t.Fatalf("posted %+v in post %d, want the resolved alert retried", posted, posts)
+	}
+	if posted[0].Labels["callback_id"] != "host1" || !posted[0].EndsAt.Equal(resolvedAt) {
+		t.Errorf("resolved alert posted as %+v, want host1 ending %v", posted[0], resolvedAt)
+	}
+}
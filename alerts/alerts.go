@@ -0,0 +1,358 @@
+// alerts evaluates alert rules against the callback sessions of a connection
+// manager, and notifies an Alertmanager when alerts fire and resolve.
+
+package alerts
+
+import (
+	"fmt"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/go.log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alert states.
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Rule fires an alert for each callback ID matching Pattern which is offline
+// for longer than OfflineFor, or registers more than Reconnects times within
+// Window. Exactly one of OfflineFor and Reconnects is set.
+type Rule struct {
+	// Name is the alertname of alerts fired by the rule.
+	Name string `json:"name"`
+	// Pattern is a path.Match pattern of the callback IDs the rule applies to.
+	Pattern    string        `json:"pattern"`
+	OfflineFor util.Duration `json:"offline_for,omitempty"`
+	Reconnects int           `json:"reconnects,omitempty"`
+	Window     util.Duration `json:"window,omitempty"`
+	// Labels are added to the labels of alerts fired by the rule.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations are added to the annotations of alerts fired by the rule.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ErrInvalidRule is returned when an alert rule is malformed.
+type ErrInvalidRule struct {
+	name   string
+	reason string
+}
+
+func (err ErrInvalidRule) Error() string {
+	return fmt.Sprintf("invalid alert rule %q: %s", err.name, err.reason)
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return &ErrInvalidRule{r.Name, "name must not be blank"}
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return &ErrInvalidRule{r.Name, err.Error()}
+	}
+	if (r.OfflineFor > 0) == (r.Reconnects > 0) {
+		return &ErrInvalidRule{r.Name, "exactly one of offline_for and reconnects must be set"}
+	}
+	if r.Reconnects > 0 && r.Window <= 0 {
+		return &ErrInvalidRule{r.Name, "reconnects requires a window"}
+	}
+	return nil
+}
+
+func (r Rule) matches(callbackId string) bool {
+	matched, _ := path.Match(r.Pattern, callbackId)
+	return matched
+}
+
+// Alert is an alert fired by a rule for a callback ID.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	CallbackId  string            `json:"callback_id"`
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"starts_at"`
+	// EndsAt is set once the alert resolves.
+	EndsAt *time.Time `json:"ends_at,omitempty"`
+}
+
+type alertKey struct {
+	rule       string
+	callbackId string
+}
+
+// Config configures an Evaluator.
+type Config struct {
+	// Interval is how often rules are evaluated.
+	Interval time.Duration
+	// ResendInterval is how often firing alerts are sent again, so the
+	// Alertmanager does not resolve them itself.
+	ResendInterval time.Duration
+}
+
+// Evaluator continuously evaluates alert rules.
+type Evaluator struct {
+	config   Config
+	rules    []Rule
+	cm       *connman.ConnectionManager
+	notifier Notifier
+
+	// registrations are the recent registration times of each callback ID,
+	// oldest first.
+	registrations map[string][]time.Time
+	// maxWindow is the longest window of the reconnect rules.
+	maxWindow time.Duration
+
+	active map[alertKey]*Alert
+	// unsent are resolved alerts which could not be delivered yet.
+	unsent   []Alert
+	lastSent time.Time
+	mtx      sync.Mutex
+}
+
+// New validates rules and returns an Evaluator of them. notifier may be nil if
+// alerts are only to be listed.
+func New(config Config, rules []Rule, cm *connman.ConnectionManager, notifier Notifier) (*Evaluator, error) {
+	e := &Evaluator{
+		config:        config,
+		rules:         rules,
+		cm:            cm,
+		notifier:      notifier,
+		registrations: make(map[string][]time.Time),
+		active:        make(map[alertKey]*Alert),
+	}
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, &ErrInvalidRule{rule.Name, "duplicate rule name"}
+		}
+		names[rule.Name] = true
+		if window := time.Duration(rule.Window); rule.Reconnects > 0 && window > e.maxWindow {
+			e.maxWindow = window
+		}
+	}
+	return e, nil
+}
+
+// Alerts returns the firing alerts sorted by rule and callback ID.
+func (e *Evaluator) Alerts() []Alert {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	ret := make([]Alert, 0, len(e.active))
+	for _, alert := range e.active {
+		ret = append(ret, *alert)
+	}
+	sortAlerts(ret)
+	return ret
+}
+
+// Run evaluates the rules every interval until stopCh closes. Should be
+// launched as a go-routine.
+func (e *Evaluator) Run(stopCh <-chan struct{}) {
+	// Registrations are counted separately so events are not dropped while
+	// alerts are being delivered.
+	eventCh := e.cm.SubscribeCallbackEvents(64)
+	defer e.cm.UnsubscribeCallbackEvents(eventCh)
+	go func() {
+		for event := range eventCh {
+			if event.EventType == connman.EventConnected {
+				e.recordRegistration(event.CallbackId, event.ConnectedAt)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.notify(e.evaluate(time.Now()))
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (e *Evaluator) recordRegistration(callbackId string, at time.Time) {
+	if e.maxWindow == 0 {
+		return
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.registrations[callbackId] = append(e.registrations[callbackId], at)
+}
+
+// evaluate fires and resolves alerts, and returns the alerts to notify of, if
+// any.
+func (e *Evaluator) evaluate(now time.Time) []Alert {
+	sessions := e.cm.ListCallbackSessions().Sessions
+	records, err := e.cm.ListCallbackRecords()
+	if err != nil {
+		log.Errorln("Could not list callback records for alert evaluation:", err)
+		return nil
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.pruneRegistrations(now)
+
+	firing := make(map[alertKey]*Alert)
+	for _, rule := range e.rules {
+		if rule.OfflineFor > 0 {
+			for _, record := range records {
+				if _, online := sessions[record.CallbackId]; online || !rule.matches(record.CallbackId) {
+					continue
+				}
+				// Records of IDs which never registered, such as annotated or
+				// allocated ones, have no time to be offline since.
+				if record.LastSeen.IsZero() {
+					continue
+				}
+				if offlineFor := now.Sub(record.LastSeen); offlineFor > time.Duration(rule.OfflineFor) {
+					firing[alertKey{rule.Name, record.CallbackId}] = newAlert(rule, record.CallbackId, now,
+						fmt.Sprintf("%s has been offline since %s", record.CallbackId, record.LastSeen.Format(time.RFC3339)))
+				}
+			}
+			continue
+		}
+
+		for callbackId, times := range e.registrations {
+			if !rule.matches(callbackId) {
+				continue
+			}
+			count := 0
+			for _, t := range times {
+				if now.Sub(t) <= time.Duration(rule.Window) {
+					count++
+				}
+			}
+			if count > rule.Reconnects {
+				firing[alertKey{rule.Name, callbackId}] = newAlert(rule, callbackId, now,
+					fmt.Sprintf("%s registered %d times in the last %s", callbackId, count, time.Duration(rule.Window)))
+			}
+		}
+	}
+
+	changed := false
+	for key, alert := range firing {
+		if _, found := e.active[key]; found {
+			continue
+		}
+		log.With("rule", key.rule).With("callback_id", key.callbackId).Warnln("Alert firing.")
+		e.active[key] = alert
+		changed = true
+	}
+	for key, alert := range e.active {
+		if _, found := firing[key]; found {
+			continue
+		}
+		log.With("rule", key.rule).With("callback_id", key.callbackId).Infoln("Alert resolved.")
+		resolved := *alert
+		resolved.State = StateResolved
+		resolved.EndsAt = &now
+		e.unsent = append(e.unsent, resolved)
+		delete(e.active, key)
+		changed = true
+	}
+
+	if e.notifier == nil || (!changed && len(e.unsent) == 0 && now.Sub(e.lastSent) < e.config.ResendInterval) {
+		return nil
+	}
+
+	// Every firing alert is sent, along with the undelivered resolved alerts.
+	alerts := make([]Alert, 0, len(e.active)+len(e.unsent))
+	for _, alert := range e.active {
+		alerts = append(alerts, *alert)
+	}
+	alerts = append(alerts, e.unsent...)
+	e.unsent = nil
+	e.lastSent = now
+	sortAlerts(alerts)
+	return alerts
+}
+
+// notify delivers alerts returned by evaluate. Resolved alerts which could not
+// be delivered are retried at the next evaluation.
+func (e *Evaluator) notify(alerts []Alert) {
+	if len(alerts) == 0 {
+		return
+	}
+
+	// Firing alerts expire unless sent again, in case this server stops.
+	expiresAt := time.Now().Add(3 * maxDuration(e.config.Interval, e.config.ResendInterval))
+	if err := e.notifier.Notify(alerts, expiresAt); err != nil {
+		log.Errorln("Could not send alerts:", err)
+		e.mtx.Lock()
+		for _, alert := range alerts {
+			if alert.State == StateResolved {
+				e.unsent = append(e.unsent, alert)
+			}
+		}
+		e.lastSent = time.Time{}
+		e.mtx.Unlock()
+	}
+}
+
+// pruneRegistrations forgets registrations older than every reconnect rule
+// window. Must be called with mtx held.
+func (e *Evaluator) pruneRegistrations(now time.Time) {
+	for callbackId, times := range e.registrations {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) > e.maxWindow {
+			i++
+		}
+		if i == len(times) {
+			delete(e.registrations, callbackId)
+		} else {
+			e.registrations[callbackId] = times[i:]
+		}
+	}
+}
+
+func newAlert(rule Rule, callbackId string, now time.Time, summary string) *Alert {
+	labels := map[string]string{
+		"alertname":   rule.Name,
+		"callback_id": callbackId,
+	}
+	for k, v := range rule.Labels {
+		labels[k] = v
+	}
+	annotations := map[string]string{
+		"summary": summary,
+	}
+	for k, v := range rule.Annotations {
+		annotations[k] = v
+	}
+	return &Alert{
+		Rule:        rule.Name,
+		CallbackId:  callbackId,
+		State:       StateFiring,
+		Labels:      labels,
+		Annotations: annotations,
+		StartsAt:    now,
+	}
+}
+
+func sortAlerts(alerts []Alert) {
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].CallbackId < alerts[j].CallbackId
+	})
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
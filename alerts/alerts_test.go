@@ -0,0 +1,34 @@
+package alerts
+
+import (
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util"
+	"testing"
+	"time"
+)
+
+// TestOfflineNeverSeen checks IDs which have records but never registered do
+// not fire offline alerts.
+func TestOfflineNeverSeen(t *testing.T) {
+	now := time.Now()
+	store := connman.NewMemorySessionStore()
+	store.Replace([]connman.CallbackRecord{
+		{CallbackId: "offline", LastSeen: now.Add(-time.Hour)},
+		{CallbackId: "recent", LastSeen: now},
+		{CallbackId: "never-seen", Notes: "annotated before registering"},
+	})
+	cm := connman.NewConnectionManager(1024)
+	cm.SetSessionStore(store)
+
+	rules := []Rule{{Name: "Offline", Pattern: "*", OfflineFor: util.Duration(10 * time.Minute)}}
+	e, err := New(Config{}, rules, cm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.evaluate(now)
+
+	alerts := e.Alerts()
+	if len(alerts) != 1 || alerts[0].CallbackId != "offline" {
+		t.Errorf("firing alerts = %+v, want one for offline", alerts)
+	}
+}
@@ -0,0 +1,82 @@
+// admission implements operator approval and rejection of callback IDs.
+
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/go.log"
+	"io"
+	"net/http"
+)
+
+// ApproveRequest is the optional body of an approval.
+type ApproveRequest struct {
+	// Fingerprint is the source approved to register the ID: a principal, or
+	// a remote IP if authentication is disabled. Defaults to the source of the
+	// pending session, or the next source to register the ID.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ApprovePost approves a callback ID, activating its pending session.
+func ApprovePost(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		req := ApproveRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		principal := auth.PrincipalName(r)
+		record, err := settings.ConnectionManager.ApproveCallback(callbackId, req.Fingerprint, principal)
+		if err != nil {
+			log.Errorln("Could not update callback record:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		log.With("principal", principal).With("callback_id", callbackId).
+			With("fingerprint", record.Admission.Fingerprint).Infoln("Callback ID approved.")
+
+		writeJSON(w, &record)
+	}
+}
+
+// RejectPost rejects a callback ID, closing its pending session.
+func RejectPost(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		principal := auth.PrincipalName(r)
+		record, err := settings.ConnectionManager.RejectCallback(callbackId, principal)
+		if err != nil {
+			log.Errorln("Could not update callback record:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		log.With("principal", principal).With("callback_id", callbackId).Infoln("Callback ID rejected.")
+
+		writeJSON(w, &record)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+	w.Write(out)
+}
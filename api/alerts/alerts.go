@@ -0,0 +1,31 @@
+// alerts implements listing of the alerts fired by alert rules.
+
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+)
+
+// AlertsGet lists the firing alerts.
+func AlertsGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		out, err := json.Marshal(settings.Alerts.Alerts())
+		if err != nil {
+			log.Errorln(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+
+		w.Write(out)
+	}
+}
@@ -0,0 +1,126 @@
+// annotations implements operator set key/value metadata on callback IDs,
+// such as their owner or a ticket URL, kept whether or not they are online.
+
+package annotations
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apicommon"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+)
+
+const (
+	// maxRequestSize bounds the body of a request to set annotations.
+	maxRequestSize = 64 * 1024
+	// maxKeySize and maxValueSize bound each annotation, since annotations
+	// are copied into every listing and event of the callback ID.
+	maxKeySize   = 128
+	maxValueSize = 1024
+)
+
+// AnnotationsResponse is the annotations of a callback ID and their history.
+type AnnotationsResponse struct {
+	CallbackId  string                     `json:"callback_id"`
+	Annotations map[string]string          `json:"annotations"`
+	History     []connman.AnnotationChange `json:"history"`
+}
+
+func newResponse(callbackId string, record connman.CallbackRecord) AnnotationsResponse {
+	resp := AnnotationsResponse{
+		CallbackId:  callbackId,
+		Annotations: record.Annotations,
+		History:     record.AnnotationHistory,
+	}
+	if resp.Annotations == nil {
+		resp.Annotations = map[string]string{}
+	}
+	if resp.History == nil {
+		resp.History = []connman.AnnotationChange{}
+	}
+	return resp
+}
+
+// AnnotationsGet returns the annotations of a callback ID and their history.
+func AnnotationsGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+		record, _, err := settings.ConnectionManager.GetCallbackRecord(callbackId)
+		if err != nil {
+			log.Errorln("Could not get callback record:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		resp := newResponse(callbackId, record)
+		writeJSON(w, &resp)
+	}
+}
+
+// AnnotationsPut replaces the annotations of a callback ID with the JSON
+// object in the request body, of at most maxRequestSize bytes.
+func AnnotationsPut(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		annotations := map[string]string{}
+		body := http.MaxBytesReader(w, r.Body, maxRequestSize)
+		if err := json.NewDecoder(body).Decode(&annotations); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		for k, v := range annotations {
+			if k == "" {
+				http.Error(w, "annotation keys must not be blank", http.StatusBadRequest)
+				return
+			}
+			if len(k) > maxKeySize {
+				http.Error(w, fmt.Sprintf("annotation keys must be at most %d bytes", maxKeySize), http.StatusBadRequest)
+				return
+			}
+			if len(v) > maxValueSize {
+				http.Error(w, fmt.Sprintf("annotation %s must be at most %d bytes", k, maxValueSize), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Edits are attributed to the remote address if authentication is disabled.
+		editor := auth.PrincipalName(r)
+		if editor == "" {
+			editor = apicommon.RemoteIP(r)
+		}
+
+		record, err := settings.ConnectionManager.SetCallbackAnnotations(callbackId, annotations, editor)
+		if err != nil {
+			log.Errorln("Could not update callback record:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		log.With("principal", editor).With("callback_id", callbackId).Infoln("Callback annotations changed.")
+
+		resp := newResponse(callbackId, record)
+		writeJSON(w, &resp)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+	w.Write(out)
+}
@@ -0,0 +1,61 @@
+package annotations
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/connman"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func put(settings apisettings.APISettings, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/api/v1/callback/host1/annotations", strings.NewReader(body))
+	AnnotationsPut(settings)(w, r, httprouter.Params{{Key: "callbackId", Value: "host1"}})
+	return w
+}
+
+func TestAnnotationsPut(t *testing.T) {
+	settings := apisettings.APISettings{ConnectionManager: connman.NewConnectionManager(1024)}
+
+	w := put(settings, `{"owner": "team-db"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp AnnotationsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Annotations["owner"] != "team-db" || len(resp.History) != 1 || resp.History[0].By != "192.0.2.1" {
+		t.Errorf("response = %+v, want the annotation set by the remote address", resp)
+	}
+
+	for name, body := range map[string]string{
+		"invalid":       `["owner"]`,
+		"blank key":     `{"": "team-db"}`,
+		"long key":      `{"` + strings.Repeat("k", maxKeySize+1) + `": "team-db"}`,
+		"long value":    `{"owner": "` + strings.Repeat("v", maxValueSize+1) + `"}`,
+		"oversize body": `{"owner": "team-db"` + strings.Repeat(" ", maxRequestSize) + `}`,
+	} {
+		if w := put(settings, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	record, _, err := settings.ConnectionManager.GetCallbackRecord("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Annotations) != 1 || len(record.AnnotationHistory) != 1 {
+		t.Errorf("record = %+v, want refused requests to change nothing", record)
+	}
+
+	// Annotations of the maximum size are accepted.
+	w = put(settings, `{"`+strings.Repeat("k", maxKeySize)+`": "`+strings.Repeat("v", maxValueSize)+`"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d for annotations of the maximum size: %s", w.Code, w.Body)
+	}
+}
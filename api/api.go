@@ -2,21 +2,60 @@
 package api
 
 import (
+	"expvar"
 	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/admission"
+	"github.com/wrouesnel/callback/api/alerts"
+	"github.com/wrouesnel/callback/api/annotations"
 	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/api/bandwidth"
 	"github.com/wrouesnel/callback/api/callback"
 	"github.com/wrouesnel/callback/api/connect"
+	"github.com/wrouesnel/callback/api/hosts"
+	"github.com/wrouesnel/callback/api/internode"
+	"github.com/wrouesnel/callback/api/lease"
+	"github.com/wrouesnel/callback/api/migrate"
+	"github.com/wrouesnel/callback/api/netacl"
+	"github.com/wrouesnel/callback/api/records"
+	"github.com/wrouesnel/callback/api/state"
+	"github.com/wrouesnel/callback/api/throttle"
+	"github.com/wrouesnel/callback/api/tokens"
+	"github.com/wrouesnel/callback/api/usage"
+	"github.com/wrouesnel/callback/auth"
+	"net/http"
 )
 
 // Appends a new goboot-callback API to the supplied router.
 func NewAPI_v1(settings apisettings.APISettings, router *httprouter.Router) *httprouter.Router {
+	// routeClass wraps a handler in the network ACL, rate limits and token
+	// authentication of a class of routes. Network ACLs and per-IP limits are
+	// checked first so rejected clients never reach authentication.
+	routeClass := func(acl *netacl.ACL, limits *throttle.RouteLimits, scope auth.Scope) func(httprouter.Handle) httprouter.Handle {
+		return func(h httprouter.Handle) httprouter.Handle {
+			return netacl.Wrap(acl,
+				throttle.ByIP(limits,
+					auth.RequireScope(settings.TokenStore, scope,
+						throttle.ByPrincipal(limits, h))))
+		}
+	}
+	register := routeClass(settings.CallbackACL, settings.RegisterLimits, auth.ScopeRegister)
+	connectTo := routeClass(settings.ConnectACL, settings.ConnectLimits, auth.ScopeConnect)
+	list := routeClass(settings.ListACL, settings.ListLimits, auth.ScopeList)
+	// Without authentication or a listing ACL, only loopback clients may use
+	// administrative routes.
+	adminACL := settings.ListACL
+	if settings.TokenStore == nil && adminACL.Empty() {
+		adminACL = netacl.Loopback()
+	}
+	admin := routeClass(adminACL, settings.ListLimits, auth.ScopeAdmin)
+
 	// Event APIs
-	router.GET(settings.WrapPath("/api/v1/events/connect"), connect.Subscribe(settings))
-	router.GET(settings.WrapPath("/api/v1/events/callback"), callback.Subscribe(settings))
+	router.GET(settings.WrapPath("/api/v1/events/connect"), list(connect.Subscribe(settings)))
+	router.GET(settings.WrapPath("/api/v1/events/callback"), list(callback.Subscribe(settings)))
 
 	// Callback (reverse proxy) setup
-	router.GET(settings.WrapPath("/api/v1/callback/:callbackId"), callback.CallbackGet(settings))
-	router.GET(settings.WrapPath("/api/v1/callback"), callback.SessionsGet(settings))
+	router.GET(settings.WrapPath("/api/v1/callback/:callbackId"), register(callback.CallbackGet(settings)))
+	router.GET(settings.WrapPath("/api/v1/callback"), list(callback.SessionsGet(settings)))
 	//router.PUT("/callback/:identifier", plan.SetPlan(settings))
 	//router.DELETE("/callback/:identifier", plan.DeletePlan(settings))
 
@@ -24,8 +63,78 @@ func NewAPI_v1(settings apisettings.APISettings, router *httprouter.Router) *htt
 	//router.DELETE("/callback", plan.ClearPlans(settings))
 
 	// Connect setup
-	router.GET(settings.WrapPath("/api/v1/connect/:callbackId"), connect.ConnectGet(settings))
-	router.GET(settings.WrapPath("/api/v1/connect"), connect.SessionsGet(settings))
+	router.GET(settings.WrapPath("/api/v1/connect/:callbackId"), connectTo(connect.ConnectGet(settings)))
+	router.GET(settings.WrapPath("/api/v1/connect"), list(connect.SessionsGet(settings)))
+
+	// Token management (only available when authentication is enabled)
+	if settings.TokenStore != nil {
+		router.POST(settings.WrapPath("/api/v1/tokens"), admin(tokens.TokensPost(settings)))
+		router.GET(settings.WrapPath("/api/v1/tokens"), admin(tokens.TokensGet(settings)))
+		router.DELETE(settings.WrapPath("/api/v1/tokens/:tokenId"), admin(tokens.TokenDelete(settings)))
+	}
+
+	// Bandwidth limits
+	router.GET(settings.WrapPath("/api/v1/bandwidth"), admin(bandwidth.LimitsGet(settings)))
+	router.PUT(settings.WrapPath("/api/v1/bandwidth"), admin(bandwidth.LimitsPut(settings)))
+	router.PUT(settings.WrapPath("/api/v1/bandwidth/callback/:callbackId"), admin(bandwidth.CallbackLimitPut(settings)))
+	router.DELETE(settings.WrapPath("/api/v1/bandwidth/callback/:callbackId"), admin(bandwidth.CallbackLimitDelete(settings)))
+
+	// Approval of callback IDs held pending
+	router.POST(settings.WrapPath("/api/v1/callback/:callbackId/approve"), admin(admission.ApprovePost(settings)))
+	router.POST(settings.WrapPath("/api/v1/callback/:callbackId/reject"), admin(admission.RejectPost(settings)))
+
+	// Operator set states of callback IDs
+	router.PUT(settings.WrapPath("/api/v1/callback/:callbackId/state"), admin(state.StatePut(settings)))
+
+	// Operator set annotations of callback IDs
+	router.GET(settings.WrapPath("/api/v1/callback/:callbackId/annotations"), list(annotations.AnnotationsGet(settings)))
+	router.PUT(settings.WrapPath("/api/v1/callback/:callbackId/annotations"), admin(annotations.AnnotationsPut(settings)))
+
+	// Exclusive leases of callback IDs
+	router.POST(settings.WrapPath("/api/v1/callback/:callbackId/lease"), connectTo(lease.LeasePost(settings)))
+	router.GET(settings.WrapPath("/api/v1/callback/:callbackId/lease"), list(lease.LeaseGet(settings)))
+	router.DELETE(settings.WrapPath("/api/v1/callback/:callbackId/lease"), connectTo(lease.LeaseDelete(settings)))
+
+	// Records of callback IDs, kept after their sessions end
+	router.GET(settings.WrapPath("/api/v1/records"), list(records.RecordsGet(settings)))
+	router.GET(settings.WrapPath("/api/v1/records/:callbackId"), list(records.RecordGet(settings)))
+	router.PUT(settings.WrapPath("/api/v1/records/:callbackId/notes"), admin(records.NotesPut(settings)))
+	router.DELETE(settings.WrapPath("/api/v1/records/:callbackId"), admin(records.RecordDelete(settings)))
+
+	// Inventory of every callback ID seen, online or offline
+	router.GET(settings.WrapPath("/api/v1/hosts"), list(hosts.HostsGet(settings)))
+
+	// Alerts fired by alert rules
+	if settings.Alerts != nil {
+		router.GET(settings.WrapPath("/api/v1/alerts"), list(alerts.AlertsGet(settings)))
+	}
+
+	// Migration of callback sessions to another server
+	router.POST(settings.WrapPath("/api/v1/migrate"), admin(migrate.MigratePost(settings)))
+
+	// Usage reporting
+	if settings.UsageStore != nil {
+		router.GET(settings.WrapPath("/api/v1/usage"), admin(usage.UsageGet(settings)))
+	}
+
+	// Relayed connections from other cluster nodes. Authenticated by the cluster secret.
+	if settings.Cluster != nil {
+		router.GET(settings.WrapPath("/api/v1/cluster/connect/:callbackId"), internode.ConnectGet(settings))
+	}
+
+	// Readiness for load balancers. Not authenticated so health checks need no credentials.
+	router.GET(settings.WrapPath("/ready"), func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if settings.ConnectionManager.Draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ready\n"))
+	})
+
+	// Runtime counters (including rate limit rejections)
+	router.GET(settings.WrapPath("/debug/vars"), admin(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		expvar.Handler().ServeHTTP(w, r)
+	}))
 
 	return router
 }
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/api/netacl"
+	"github.com/wrouesnel/callback/connman"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestAdminLoopbackOnly checks administrative routes are not served to remote
+// clients when neither authentication nor the listing ACL restricts them.
+func TestAdminLoopbackOnly(t *testing.T) {
+	settings := apisettings.APISettings{ConnectionManager: connman.NewConnectionManager(1024)}
+	router := NewAPI_v1(settings, httprouter.New())
+
+	for _, route := range []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/debug/vars"},
+		{"GET", "/api/v1/bandwidth"},
+		{"PUT", "/api/v1/callback/host1/state"},
+		{"PUT", "/api/v1/callback/host1/annotations"},
+		{"POST", "/api/v1/callback/host1/approve"},
+		{"DELETE", "/api/v1/records/host1"},
+		{"POST", "/api/v1/migrate"},
+	} {
+		for _, tc := range []struct {
+			remoteAddr string
+			forbidden  bool
+		}{
+			{"127.0.0.1:1234", false},
+			{"[::1]:1234", false},
+			{"192.0.2.1:1234", true},
+		} {
+			r := httptest.NewRequest(route.method, route.path, nil)
+			r.RemoteAddr = tc.remoteAddr
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if forbidden := w.Code == http.StatusForbidden; forbidden != tc.forbidden {
+				t.Errorf("%s %s from %s: status %d", route.method, route.path, tc.remoteAddr, w.Code)
+			}
+		}
+	}
+
+	// Listing routes are not restricted.
+	r := httptest.NewRequest("GET", "/api/v1/callback", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("listing from a remote client: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// TestAdminListACL checks a listing ACL replaces the loopback default.
+func TestAdminListACL(t *testing.T) {
+	acl, err := netacl.Parse([]string{"192.0.2.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := apisettings.APISettings{ConnectionManager: connman.NewConnectionManager(1024), ListACL: acl}
+	router := NewAPI_v1(settings, httprouter.New())
+
+	for _, tc := range []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"127.0.0.1:1234", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/debug/vars", nil)
+		r.RemoteAddr = tc.remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.remoteAddr, w.Code, tc.want)
+		}
+	}
+}
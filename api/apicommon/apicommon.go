@@ -0,0 +1,130 @@
+// apicommon implements helpers shared by the API handlers.
+
+package apicommon
+
+import (
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/control"
+	"github.com/wrouesnel/callback/policy"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RemoteIP returns the IP address of the client of a request, without the
+// port. The forwarded middleware has already rewritten RemoteAddr for proxied
+// requests.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Labels parses session labels supplied as repeated label=key=value query
+// parameters.
+func Labels(r *http.Request) map[string]string {
+	values := r.URL.Query()["label"]
+	if len(values) == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string, len(values))
+	for _, kv := range values {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		} else {
+			labels[parts[0]] = ""
+		}
+	}
+	return labels
+}
+
+// Origin builds the connection manager origin of a request.
+func Origin(r *http.Request, labels map[string]string) connman.SessionOrigin {
+	return connman.SessionOrigin{
+		RemoteAddr: r.RemoteAddr,
+		Principal:  auth.PrincipalName(r),
+		Labels:     labels,
+
+		Capabilities:  control.Capabilities(r),
+		ReclaimSecret: r.Header.Get(control.ReclaimSecretHeader),
+	}
+}
+
+// ErrorStatus maps connection manager errors to HTTP status codes.
+func ErrorStatus(err error) int {
+	switch e := err.(type) {
+	case *connman.ErrSessionUnknown:
+		return http.StatusNotFound
+	case *connman.ErrSessionExists:
+		return http.StatusConflict
+	case *connman.ErrSessionDisconnected:
+		return http.StatusServiceUnavailable
+	case *connman.ErrDraining:
+		return http.StatusServiceUnavailable
+	case *connman.ErrRegistryUnavailable:
+		return http.StatusServiceUnavailable
+	case *connman.ErrSessionPending:
+		return http.StatusForbidden
+	case *connman.ErrRegistrationRejected:
+		return http.StatusForbidden
+	case *connman.ErrFlapping:
+		return http.StatusTooManyRequests
+	case *connman.ErrLeased:
+		return http.StatusLocked
+	case *connman.ErrNotLeased:
+		return http.StatusNotFound
+	case *connman.ErrClientsConnected:
+		return http.StatusConflict
+	case *connman.ErrOutsideSchedule:
+		return http.StatusForbidden
+	case *connman.ErrCallbackUnavailable:
+		return http.StatusServiceUnavailable
+	case *connman.ErrCallbackDisabled:
+		return http.StatusForbidden
+	case *connman.ErrInvalidState:
+		return http.StatusBadRequest
+	case *connman.ErrInvalidIdPattern:
+		return http.StatusBadRequest
+	case *connman.ErrAllocationFailed:
+		return http.StatusServiceUnavailable
+	case *connman.ErrReclaimDenied:
+		return http.StatusForbidden
+	case *connman.ErrQuotaExceeded:
+		if e.Global() {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// PolicyRequest builds the policy evaluation context of a request.
+func PolicyRequest(r *http.Request, action policy.Action, callbackId string, labels map[string]string) *policy.Request {
+	req := &policy.Request{
+		Action:     action,
+		CallbackId: callbackId,
+		RemoteAddr: RemoteIP(r),
+		Labels:     labels,
+		Time:       time.Now(),
+	}
+
+	if principal := auth.PrincipalFromRequest(r); principal != nil {
+		req.Principal = principal.Name
+		for _, scope := range principal.Scopes {
+			req.Scopes = append(req.Scopes, string(scope))
+		}
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0 {
+		req.ClientCert = true
+		req.ClientCertCN = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	return req
+}
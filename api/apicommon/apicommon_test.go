@@ -0,0 +1,31 @@
+package apicommon
+
+import (
+	"github.com/wrouesnel/callback/connman"
+	"net/http"
+	"testing"
+)
+
+func TestQuotaStatus(t *testing.T) {
+	for quota, want := range map[string]int{
+		connman.QuotaCallbackSessions:             http.StatusServiceUnavailable,
+		connman.QuotaClientSessions:               http.StatusServiceUnavailable,
+		connman.QuotaCallbackSessionsPerIP:        http.StatusTooManyRequests,
+		connman.QuotaCallbackSessionsPerPrincipal: http.StatusTooManyRequests,
+		connman.QuotaClientsPerCallback:           http.StatusTooManyRequests,
+		connman.QuotaStreamsPerSession:            http.StatusTooManyRequests,
+	} {
+		if status := ErrorStatus(&connman.ErrQuotaExceeded{Quota: quota, Limit: 1}); status != want {
+			t.Errorf("%s: status %d, want %d", quota, status, want)
+		}
+	}
+}
+
+func TestCallbackStateStatus(t *testing.T) {
+	if status := ErrorStatus(&connman.ErrCallbackUnavailable{CallbackId: "host1", State: connman.SessionDraining}); status != http.StatusServiceUnavailable {
+		t.Errorf("client of a draining callback: status %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if status := ErrorStatus(&connman.ErrCallbackDisabled{CallbackId: "host1"}); status != http.StatusForbidden {
+		t.Errorf("registration of a disabled callback: status %d, want %d", status, http.StatusForbidden)
+	}
+}
@@ -3,9 +3,21 @@
 package apisettings
 
 import (
+	"github.com/gorilla/websocket"
+	"github.com/wrouesnel/callback/alerts"
+	"github.com/wrouesnel/callback/api/netacl"
+	"github.com/wrouesnel/callback/api/throttle"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/cluster"
 	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/policy"
+	"github.com/wrouesnel/callback/usage"
+	"github.com/wrouesnel/callback/webhook"
+	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -17,6 +29,38 @@ const (
 type APISettings struct {
 	ConnectionManager *connman.ConnectionManager
 
+	// TokenStore authenticates API requests. Authentication is disabled if nil.
+	TokenStore *auth.TokenStore
+
+	// Policy decides registrations and connections. Everything is allowed if nil.
+	Policy *policy.Engine
+
+	// AdmissionWebhook is called to decide registrations. Not called if nil.
+	AdmissionWebhook *webhook.Webhook
+
+	// UsageStore accounts for client session traffic. Usage reporting is disabled if nil.
+	UsageStore *usage.Store
+
+	// Cluster is this node's cluster membership. nil if not clustered.
+	Cluster *cluster.Node
+
+	// Alerts evaluates alert rules. Alerting is disabled if nil.
+	Alerts *alerts.Evaluator
+
+	// Lease durations granted when none is requested, and at most.
+	LeaseDuration    time.Duration
+	MaxLeaseDuration time.Duration
+
+	// Network ACLs for registration, client connection and listing/event endpoints.
+	CallbackACL *netacl.ACL
+	ConnectACL  *netacl.ACL
+	ListACL     *netacl.ACL
+
+	// Request rate limits for registration, client connection and listing/event endpoints.
+	RegisterLimits *throttle.RouteLimits
+	ConnectLimits  *throttle.RouteLimits
+	ListLimits     *throttle.RouteLimits
+
 	// ContextPath is any URL-prefix being passed by a reverse proxy.
 	ContextPath string
 	StaticProxy *url.URL
@@ -27,6 +71,45 @@ type APISettings struct {
 
 	// Websocket Timeouts
 	HandshakeTimeout time.Duration
+
+	// AllowedOrigins are Origin header values (or path.Match patterns) which
+	// may open websockets in addition to same-origin requests and clients
+	// which send no Origin header.
+	AllowedOrigins []string
+}
+
+// Upgrader returns the websocket upgrader for API websocket endpoints.
+func (api *APISettings) Upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		HandshakeTimeout: api.HandshakeTimeout,
+		ReadBufferSize:   api.ReadBufferSize,
+		WriteBufferSize:  api.WriteBufferSize,
+		CheckOrigin:      api.checkOrigin,
+	}
+}
+
+// checkOrigin permits requests without an Origin header (non-browser clients),
+// same-origin requests and origins in the allowlist.
+func (api *APISettings) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range api.AllowedOrigins {
+		if matched, _ := path.Match(strings.ToLower(allowed), strings.ToLower(origin)); matched {
+			return true
+		}
+	}
+	return false
 }
 
 // WrapPath wraps a given URL string in the context path
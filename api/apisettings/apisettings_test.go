@@ -0,0 +1,104 @@
+package apisettings
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/wrouesnel/callback/util/websocketrwc"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	settings := &APISettings{
+		AllowedOrigins: []string{"https://console.example.com", "https://*.ops.example.com"},
+	}
+
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://callback.example.com", true},
+		{"https://CALLBACK.example.com", true},
+		{"https://console.example.com", true},
+		{"HTTPS://Console.Example.com", true},
+		{"https://syd.ops.example.com", true},
+		{"http://syd.ops.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://console.example.com.evil.com", false},
+		{"null", false},
+		{"://bad", false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://callback.example.com/api/v1/callback/host1", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := settings.checkOrigin(r); got != c.want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", c.origin, got, c.want)
+		}
+	}
+}
+
+func TestUpgraderRejectsOrigin(t *testing.T) {
+	settings := &APISettings{
+		HandshakeTimeout: time.Second,
+		AllowedOrigins:   []string{"https://console.example.com"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err, _ := websocketrwc.Upgrade(w, r, nil, settings.Upgrader())
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+	wsUrl := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(origin string) (*http.Response, error) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		ws, resp, err := websocket.DefaultDialer.Dial(wsUrl, header)
+		if err == nil {
+			ws.Close()
+		}
+		return resp, err
+	}
+
+	if _, err := dial(""); err != nil {
+		t.Errorf("dial without Origin failed: %v", err)
+	}
+	if _, err := dial("https://console.example.com"); err != nil {
+		t.Errorf("dial from allowed origin failed: %v", err)
+	}
+
+	resp, err := dial("https://evil.example.com")
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("dial from disallowed origin returned %v, want %v", err, websocket.ErrBadHandshake)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("dial from disallowed origin got status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestUpgrader(t *testing.T) {
+	settings := &APISettings{
+		ReadBufferSize:   1024,
+		WriteBufferSize:  2048,
+		HandshakeTimeout: 3 * time.Second,
+	}
+	upgrader := settings.Upgrader()
+	if upgrader.HandshakeTimeout != settings.HandshakeTimeout {
+		t.Errorf("HandshakeTimeout = %v, want %v", upgrader.HandshakeTimeout, settings.HandshakeTimeout)
+	}
+	if upgrader.ReadBufferSize != 1024 || upgrader.WriteBufferSize != 2048 {
+		t.Errorf("buffer sizes = %d/%d, want 1024/2048", upgrader.ReadBufferSize, upgrader.WriteBufferSize)
+	}
+	if upgrader.CheckOrigin == nil {
+		t.Error("CheckOrigin is not set")
+	}
+}
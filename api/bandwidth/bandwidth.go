@@ -0,0 +1,124 @@
+// bandwidth implements runtime management of proxy bandwidth limits.
+
+package bandwidth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util/ratelimit"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+)
+
+// LimitsGet returns the current bandwidth limits.
+func LimitsGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		limits := settings.ConnectionManager.GetBandwidthLimits()
+		writeJSON(w, &limits)
+	}
+}
+
+// LimitsPut replaces the bandwidth limits. Active sessions are throttled to
+// the new limits immediately.
+func LimitsPut(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		limits := connman.BandwidthLimits{}
+		if err := decode(r, &limits); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		settings.ConnectionManager.SetBandwidthLimits(limits)
+		log.With("principal", auth.PrincipalName(r)).Infoln("Bandwidth limits changed.")
+
+		limits = settings.ConnectionManager.GetBandwidthLimits()
+		writeJSON(w, &limits)
+	}
+}
+
+// callbackLimitRequest is the body of CallbackLimitPut. Both directions must
+// be given, so a mistyped request does not lift a limit.
+type callbackLimitRequest struct {
+	ToCallback *ratelimit.Rate `json:"to_callback"`
+	ToClient   *ratelimit.Rate `json:"to_client"`
+}
+
+// CallbackLimitPut overrides the shared bandwidth limit of a callback ID.
+// Rates are validated as they are decoded, so negative rates and bursts below
+// 1 are refused.
+func CallbackLimitPut(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		req := callbackLimitRequest{}
+		if err := decode(r, &req); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.ToCallback == nil || req.ToClient == nil {
+			http.Error(w, "to_callback and to_client must both be set", http.StatusBadRequest)
+			return
+		}
+		limit := connman.BandwidthLimit{ToCallback: *req.ToCallback, ToClient: *req.ToClient}
+
+		settings.ConnectionManager.SetCallbackBandwidthLimit(callbackId, &limit)
+		log.With("principal", auth.PrincipalName(r)).With("callback_id", callbackId).
+			Infoln("Callback bandwidth limit changed.")
+
+		writeJSON(w, &limit)
+	}
+}
+
+// CallbackLimitDelete removes the bandwidth limit override of a callback ID.
+func CallbackLimitDelete(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		settings.ConnectionManager.SetCallbackBandwidthLimit(callbackId, nil)
+		log.With("principal", auth.PrincipalName(r)).With("callback_id", callbackId).
+			Infoln("Callback bandwidth limit removed.")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decode decodes a request body into v, refusing unknown fields and trailing
+// data.
+func decode(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after the request")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+
+	w.Write(out)
+}
@@ -0,0 +1,43 @@
+package bandwidth
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/connman"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCallbackLimitPut(t *testing.T) {
+	cm := connman.NewConnectionManager(1024)
+	handler := CallbackLimitPut(apisettings.APISettings{ConnectionManager: cm})
+	params := httprouter.Params{{Key: "callbackId", Value: "host1"}}
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"to_callback": "65536", "to_client": "0"}`, http.StatusOK},
+		{`{"to_callback": "-1", "to_client": "0"}`, http.StatusBadRequest},
+		{`{"to_callback": "65536:0", "to_client": "0"}`, http.StatusBadRequest},
+		{`{"to_callback": "65536"}`, http.StatusBadRequest},
+		{`{"to_callback": "65536", "to_client": "0", "to_clients": "1"}`, http.StatusBadRequest},
+		{`{"to_callback": "65536", "to_client": "0"} {}`, http.StatusBadRequest},
+		{`{"to_callback": 65536, "to_client": "0"}`, http.StatusBadRequest},
+		{``, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("PUT", "/api/v1/bandwidth/callback/host1", strings.NewReader(tc.body)), params)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.body, w.Code, tc.want)
+		}
+	}
+
+	// Only the valid request changed the limit.
+	limit := cm.GetBandwidthLimits().Callbacks["host1"]
+	if limit.ToCallback.PerSecond != 65536 || !limit.ToClient.Unlimited() {
+		t.Errorf("limit of host1 = %+v", limit)
+	}
+}
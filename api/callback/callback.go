@@ -3,11 +3,17 @@ package callback
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apicommon"
 	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/control"
+	"github.com/wrouesnel/callback/policy"
 	"github.com/wrouesnel/callback/util/websocketrwc"
+	"github.com/wrouesnel/callback/webhook"
 	"github.com/wrouesnel/go.log"
+	"math"
 	"net/http"
 )
 
@@ -27,19 +33,74 @@ func CallbackGet(settings apisettings.APISettings) httprouter.Handle {
 
 		log.With("callbackid", callbackId)
 
-		var upgrader = websocket.Upgrader{
-			ReadBufferSize:  int(settings.ReadBufferSize),
-			WriteBufferSize: int(settings.WriteBufferSize),
+		labels := apicommon.Labels(r)
+
+		// An ID containing a wildcard asks for one to be allocated, which is
+		// then decided like any other registration. The ID is reserved until
+		// the registration is refused.
+		var allocatedId, secret string
+		if connman.IsIdPattern(callbackId) {
+			var aerr error
+			allocatedId, secret, aerr = settings.ConnectionManager.AllocateCallbackId(callbackId)
+			if aerr != nil {
+				log.Errorln("Could not allocate callback ID:", aerr)
+				http.Error(w, aerr.Error(), apicommon.ErrorStatus(aerr))
+				return
+			}
+			log.Infoln("Allocated callback ID:", allocatedId)
+			callbackId = allocatedId
+			defer func() {
+				if rerr := settings.ConnectionManager.ReleaseCallbackId(allocatedId); rerr != nil {
+					log.Errorln("Could not release allocated callback ID:", rerr)
+				}
+			}()
+		}
+
+		decision := settings.Policy.Evaluate(apicommon.PolicyRequest(r, policy.ActionRegister, callbackId, labels))
+		if !decision.Allowed() {
+			log.Infoln("Registration denied by policy:", decision)
+			http.Error(w, "registration denied by policy", http.StatusForbidden)
+			return
+		}
+
+		callbackId, labels, ok := reviewRegistration(settings, w, r, callbackId, labels)
+		if !ok {
+			return
 		}
 
-		incomingConn, uerr, doneCh := websocketrwc.Upgrade(w, r, nil, &upgrader)
+		// The registrant of an allocated ID is told what it is, and given the
+		// secret it must present to register it again. If the admission
+		// webhook chose another ID, the registrant was not allocated it.
+		allocated := allocatedId != "" && callbackId == allocatedId
+		if allocatedId != "" && !allocated {
+			log.Infoln("Admission webhook replaced allocated callback ID:", allocatedId)
+		}
+		origin := apicommon.Origin(r, labels)
+		responseHeader := http.Header{}
+		responseHeader.Set(control.CallbackIdHeader, callbackId)
+		if allocated {
+			origin.ReclaimSecret = secret
+			responseHeader.Set(control.ReclaimSecretHeader, secret)
+		}
+
+		// Reject before upgrading if the registration cannot succeed.
+		if cerr := settings.ConnectionManager.CheckCallbackConnection(callbackId, origin); cerr != nil {
+			log.Infoln("Registration rejected:", cerr)
+			if ferr, ok := cerr.(*connman.ErrFlapping); ok {
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(ferr.RetryAfter().Seconds()))))
+			}
+			http.Error(w, cerr.Error(), apicommon.ErrorStatus(cerr))
+			return
+		}
+
+		incomingConn, uerr, doneCh := websocketrwc.Upgrade(w, r, responseHeader, settings.Upgrader())
 		if uerr != nil {
 			log.Errorln("Websocket upgrade failed:", uerr)
 			return
 		}
 		log.Infoln("Connection upgrade successful.")
 
-		errCh := settings.ConnectionManager.CallbackConnection(callbackId, r.RemoteAddr, incomingConn, doneCh)
+		errCh := settings.ConnectionManager.CallbackConnection(callbackId, origin, incomingConn, doneCh)
 
 		err := <-errCh
 		if err != nil {
@@ -50,7 +111,61 @@ func CallbackGet(settings apisettings.APISettings) httprouter.Handle {
 	}
 }
 
-// SessionsGet returns a list of currently active callback sessions.
+// reviewRegistration asks the admission webhook, if configured, to decide a
+// registration. It returns the callback ID and labels to register with, which
+// the webhook may change, or writes the error response and returns false.
+func reviewRegistration(settings apisettings.APISettings, w http.ResponseWriter, r *http.Request, callbackId string, labels map[string]string) (string, map[string]string, bool) {
+	if settings.AdmissionWebhook == nil {
+		return callbackId, labels, true
+	}
+	log := log.With("remote_addr", r.RemoteAddr).With("callback_id", callbackId)
+
+	req := webhook.NewRequest(r, callbackId, apicommon.RemoteIP(r), auth.PrincipalName(r), labels, control.Capabilities(r))
+	review, err := settings.AdmissionWebhook.Review(req)
+	if err != nil {
+		if settings.AdmissionWebhook.FailOpen() {
+			log.Warnln("Allowing registration despite admission webhook failure:", err)
+			return callbackId, labels, true
+		}
+		log.Errorln("Registration rejected:", err)
+		http.Error(w, "admission webhook unavailable", http.StatusServiceUnavailable)
+		return "", nil, false
+	}
+	if !review.Allowed {
+		log.Infoln("Registration denied by admission webhook:", review.Reason)
+		http.Error(w, "registration denied by admission webhook: "+review.Reason, http.StatusForbidden)
+		return "", nil, false
+	}
+
+	if len(review.Labels) > 0 {
+		merged := make(map[string]string, len(labels)+len(review.Labels))
+		for k, v := range labels {
+			merged[k] = v
+		}
+		for k, v := range review.Labels {
+			merged[k] = v
+		}
+		labels = merged
+	}
+
+	if review.CallbackId != "" && review.CallbackId != callbackId {
+		log.Infoln("Admission webhook rewrote callback ID to:", review.CallbackId)
+		callbackId = review.CallbackId
+		// The policy must also allow the ID actually registered.
+		decision := settings.Policy.Evaluate(apicommon.PolicyRequest(r, policy.ActionRegister, callbackId, labels))
+		if !decision.Allowed() {
+			log.Infoln("Registration of rewritten callback ID denied by policy:", decision)
+			http.Error(w, "registration denied by policy", http.StatusForbidden)
+			return "", nil, false
+		}
+	}
+	return callbackId, labels, true
+}
+
+// SessionsGet returns a list of currently active callback sessions. The state
+// query parameter lists only sessions in that state, such as pending, and
+// filter parameters of the form annotation.<key>=<pattern>, as for hosts, only
+// sessions with matching annotations.
 func SessionsGet(settings apisettings.APISettings) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		defer r.Body.Close()
@@ -58,6 +173,25 @@ func SessionsGet(settings apisettings.APISettings) httprouter.Handle {
 		var err error
 
 		callbackSessions := settings.ConnectionManager.ListCallbackSessions()
+		if state := r.URL.Query().Get("state"); state != "" {
+			for callbackId, desc := range callbackSessions.Sessions {
+				if desc.State != state {
+					delete(callbackSessions.Sessions, callbackId)
+				}
+			}
+		}
+		for _, expr := range r.URL.Query()["filter"] {
+			f, ferr := parseSessionFilter(expr)
+			if ferr != nil {
+				http.Error(w, ferr.Error(), http.StatusBadRequest)
+				return
+			}
+			for callbackId, desc := range callbackSessions.Sessions {
+				if !f(&desc) {
+					delete(callbackSessions.Sessions, callbackId)
+				}
+			}
+		}
 
 		out, err := json.Marshal(&callbackSessions)
 		if err != nil {
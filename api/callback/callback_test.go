@@ -0,0 +1,99 @@
+package callback
+
+import (
+	"encoding/json"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/policy"
+	"github.com/wrouesnel/callback/webhook"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testSettings returns settings calling a webhook which replies with resp, or
+// fails if resp is nil.
+func testSettings(t *testing.T, resp *webhook.Response, failOpen bool) apisettings.APISettings {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if resp == nil {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	engine, err := policy.NewEngine(policy.Config{
+		Default: policy.EffectAllow,
+		Rules: []*policy.Rule{
+			{Name: "reserved", Actions: []policy.Action{policy.ActionRegister}, When: `glob(callback_id, "prod-*")`, Effect: policy.EffectDeny},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apisettings.APISettings{
+		Policy:           engine,
+		AdmissionWebhook: webhook.New(webhook.Config{URL: server.URL, Timeout: 5 * time.Second, FailOpen: failOpen}),
+	}
+}
+
+func TestReviewRegistration(t *testing.T) {
+	labels := map[string]string{"env": "test", "site": "mel"}
+	for _, tc := range []struct {
+		name     string
+		resp     *webhook.Response
+		failOpen bool
+		// status is the response status if the registration is refused.
+		status     int
+		callbackId string
+		labels     map[string]string
+	}{
+		{name: "allowed", resp: &webhook.Response{Allowed: true},
+			callbackId: "host1", labels: labels},
+		{name: "denied", resp: &webhook.Response{Allowed: false, Reason: "unknown"},
+			status: http.StatusForbidden},
+		{name: "labels merged", resp: &webhook.Response{Allowed: true, Labels: map[string]string{"site": "syd", "rack": "4"}},
+			callbackId: "host1", labels: map[string]string{"env": "test", "site": "syd", "rack": "4"}},
+		{name: "ID rewritten", resp: &webhook.Response{Allowed: true, CallbackId: "syd-host1"},
+			callbackId: "syd-host1", labels: labels},
+		{name: "rewritten ID denied by policy", resp: &webhook.Response{Allowed: true, CallbackId: "prod-host1"},
+			status: http.StatusForbidden},
+		{name: "fail closed", status: http.StatusServiceUnavailable},
+		{name: "fail open", failOpen: true,
+			callbackId: "host1", labels: labels},
+	} {
+		settings := testSettings(t, tc.resp, tc.failOpen)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/callback/host1", nil)
+
+		callbackId, registered, ok := reviewRegistration(settings, w, r, "host1", labels)
+		if tc.status != 0 {
+			if ok || w.Code != tc.status {
+				t.Errorf("%s: registration allowed %v with status %d, want refused with %d", tc.name, ok, w.Code, tc.status)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: registration refused with %d: %s", tc.name, w.Code, w.Body)
+			continue
+		}
+		if callbackId != tc.callbackId {
+			t.Errorf("%s: registered %s, want %s", tc.name, callbackId, tc.callbackId)
+		}
+		if len(registered) != len(tc.labels) {
+			t.Errorf("%s: registered with labels %v, want %v", tc.name, registered, tc.labels)
+		}
+		for k, v := range tc.labels {
+			if registered[k] != v {
+				t.Errorf("%s: registered with labels %v, want %v", tc.name, registered, tc.labels)
+				break
+			}
+		}
+	}
+
+	// The registrant's labels are not modified.
+	if labels["site"] != "mel" || len(labels) != 2 {
+		t.Errorf("registrant labels modified to %v", labels)
+	}
+}
@@ -0,0 +1,36 @@
+package callback
+
+import (
+	"fmt"
+	"github.com/wrouesnel/callback/connman"
+	"path"
+	"strings"
+)
+
+// sessionFilter reports whether a callback session matches.
+type sessionFilter func(desc *connman.CallbackSessionDesc) bool
+
+// parseSessionFilter parses a filter expression of the form
+// annotation.<key>=<pattern> or annotation.<key>!=<pattern>, as accepted by
+// the host inventory.
+func parseSessionFilter(expr string) (sessionFilter, error) {
+	idx := strings.Index(expr, "=")
+	if idx <= 0 {
+		return nil, fmt.Errorf("filter %q must be of the form annotation.<key>=<pattern>", expr)
+	}
+	field, op, pattern := expr[:idx], "=", expr[idx+1:]
+	if strings.HasSuffix(field, "!") {
+		field, op = strings.TrimSuffix(field, "!"), "!="
+	}
+	if !strings.HasPrefix(field, "annotation.") {
+		return nil, fmt.Errorf("unknown filter field: %s", field)
+	}
+	key := strings.TrimPrefix(field, "annotation.")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("filter %s: %v", field, err)
+	}
+	return func(desc *connman.CallbackSessionDesc) bool {
+		matched, _ := path.Match(pattern, desc.Annotations[key])
+		return matched == (op == "=")
+	}, nil
+}
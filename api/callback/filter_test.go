@@ -0,0 +1,40 @@
+package callback
+
+import (
+	"github.com/wrouesnel/callback/connman"
+	"testing"
+)
+
+func TestParseSessionFilter(t *testing.T) {
+	desc := &connman.CallbackSessionDesc{Annotations: map[string]string{"owner": "team-db"}}
+	for _, tc := range []struct {
+		expr    string
+		matches bool
+		invalid bool
+	}{
+		{expr: "annotation.owner=team-*", matches: true},
+		{expr: "annotation.owner=team-web", matches: false},
+		{expr: "annotation.owner!=team-web", matches: true},
+		{expr: "annotation.owner!=team-*", matches: false},
+		{expr: "annotation.customer=", matches: true},
+		{expr: "annotation.customer=*", matches: true},
+		{expr: "annotation.owner=[", invalid: true},
+		{expr: "owner=team-db", invalid: true},
+		{expr: "annotation.owner", invalid: true},
+	} {
+		f, err := parseSessionFilter(tc.expr)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%s: parsed an invalid filter", tc.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if f(desc) != tc.matches {
+			t.Errorf("%s: matched = %v, want %v", tc.expr, !tc.matches, tc.matches)
+		}
+	}
+}
@@ -3,9 +3,10 @@ package connect
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apicommon"
 	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/policy"
 	"github.com/wrouesnel/callback/util/websocketrwc"
 	"github.com/wrouesnel/go.log"
 	"net/http"
@@ -25,19 +26,36 @@ func ConnectGet(settings apisettings.APISettings) httprouter.Handle {
 
 		log.With("callbackid", callbackId)
 
-		var upgrader = websocket.Upgrader{
-			ReadBufferSize:  settings.ReadBufferSize,
-			WriteBufferSize: settings.WriteBufferSize,
+		// Connection rules are evaluated against the labels of the target session.
+		var labels map[string]string
+		if desc, found := settings.ConnectionManager.GetCallbackSession(callbackId); found {
+			labels = desc.Labels
 		}
 
-		incomingConn, uerr, doneCh := websocketrwc.Upgrade(w, r, nil, &upgrader)
+		decision := settings.Policy.Evaluate(apicommon.PolicyRequest(r, policy.ActionConnect, callbackId, labels))
+		if !decision.Allowed() {
+			log.Infoln("Connection denied by policy:", decision)
+			http.Error(w, "connection denied by policy", http.StatusForbidden)
+			return
+		}
+
+		origin := apicommon.Origin(r, nil)
+
+		// Reject before upgrading if the connection cannot succeed.
+		if cerr := settings.ConnectionManager.CheckClientConnection(callbackId, origin); cerr != nil {
+			log.Infoln("Connection rejected:", cerr)
+			http.Error(w, cerr.Error(), apicommon.ErrorStatus(cerr))
+			return
+		}
+
+		incomingConn, uerr, doneCh := websocketrwc.Upgrade(w, r, nil, settings.Upgrader())
 		if uerr != nil {
 			log.Errorln("Websocket upgrade failed:", uerr)
 			return
 		}
 
 		log.Infoln("Connection upgrade successful. Registering callback session.")
-		errCh := settings.ConnectionManager.ClientConnection(callbackId, r.RemoteAddr, incomingConn, doneCh)
+		errCh := settings.ConnectionManager.ClientConnection(callbackId, origin, incomingConn, doneCh)
 
 		err := <-errCh
 		if err != nil {
@@ -0,0 +1,161 @@
+package hosts
+
+import (
+	"fmt"
+	"github.com/wrouesnel/callback/connman"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filter reports whether a host matches.
+type filter func(host *Host) bool
+
+// ops are the comparison operators of filter expressions. Two character
+// operators are listed first so they are matched in preference.
+var ops = []string{">=", "<=", "!=", ">", "<", "="}
+
+// parseFilter parses a filter expression of the form <field><op><value>, such
+// as offline_for>24h or label.site=syd*.
+func parseFilter(expr string) (filter, error) {
+	idx, op := -1, ""
+	for _, candidate := range ops {
+		if i := strings.Index(expr, candidate); i > 0 && (idx == -1 || i < idx) {
+			idx, op = i, candidate
+		}
+	}
+	if idx == -1 {
+		return nil, fmt.Errorf("filter %q must be of the form <field><op><value>", expr)
+	}
+	field, value := expr[:idx], expr[idx+len(op):]
+
+	switch field {
+	case "offline_for":
+		return durationFilter(field, op, value, func(host *Host) (time.Duration, bool) {
+			if host.OfflineFor == nil {
+				return 0, false
+			}
+			return time.Duration(*host.OfflineFor), true
+		})
+	case "online_for":
+		return durationFilter(field, op, value, func(host *Host) (time.Duration, bool) {
+			if host.OnlineFor == nil {
+				return 0, false
+			}
+			return time.Duration(*host.OnlineFor), true
+		})
+	case "connected_time":
+		return durationFilter(field, op, value, func(host *Host) (time.Duration, bool) {
+			return time.Duration(host.ConnectedSeconds * float64(time.Second)), true
+		})
+	case "first_seen":
+		return timeFilter(field, op, value, func(host *Host) time.Time { return host.FirstSeen })
+	case "last_seen":
+		return timeFilter(field, op, value, func(host *Host) time.Time { return host.LastSeen })
+	case "online":
+		online, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %v", field, err)
+		}
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("filter %s only supports = and !=", field)
+		}
+		return func(host *Host) bool { return (host.Online == online) == (op == "=") }, nil
+	case "callback_id":
+		return stringFilter(field, op, value, func(host *Host) string { return host.CallbackId })
+	case "principal":
+		return stringFilter(field, op, value, func(host *Host) string { return host.Principal })
+	case "remote_addr":
+		return stringFilter(field, op, value, func(host *Host) string { return host.LastRemoteAddr })
+	case "node":
+		return stringFilter(field, op, value, func(host *Host) string { return host.LastNode })
+	case "disconnect_reason":
+		return stringFilter(field, op, value, func(host *Host) string { return host.LastDisconnectReason })
+	case "state":
+		return stringFilter(field, op, value, func(host *Host) string {
+			if host.State == "" {
+				return connman.SessionActive
+			}
+			return host.State
+		})
+	}
+
+	if strings.HasPrefix(field, "label.") {
+		key := strings.TrimPrefix(field, "label.")
+		return stringFilter(field, op, value, func(host *Host) string { return host.Labels[key] })
+	}
+	if strings.HasPrefix(field, "annotation.") {
+		key := strings.TrimPrefix(field, "annotation.")
+		return stringFilter(field, op, value, func(host *Host) string { return host.Annotations[key] })
+	}
+	return nil, fmt.Errorf("unknown filter field: %s", field)
+}
+
+// parseDuration parses a Go duration, additionally accepting a number of days
+// such as 7d.
+func parseDuration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// durationFilter compares a duration of the host. Hosts the duration does not
+// apply to never match.
+func durationFilter(field string, op string, value string, get func(host *Host) (time.Duration, bool)) (filter, error) {
+	d, err := parseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("filter %s: %v", field, err)
+	}
+	return func(host *Host) bool {
+		v, ok := get(host)
+		return ok && compare(op, int64(v), int64(d))
+	}, nil
+}
+
+// timeFilter compares an RFC3339 time of the host.
+func timeFilter(field string, op string, value string, get func(host *Host) time.Time) (filter, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("filter %s: %v", field, err)
+	}
+	return func(host *Host) bool {
+		return compare(op, get(host).UnixNano(), t.UnixNano())
+	}, nil
+}
+
+// stringFilter matches a string of the host against a glob pattern.
+func stringFilter(field string, op string, pattern string, get func(host *Host) string) (filter, error) {
+	if op != "=" && op != "!=" {
+		return nil, fmt.Errorf("filter %s only supports = and !=", field)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("filter %s: %v", field, err)
+	}
+	return func(host *Host) bool {
+		matched, _ := path.Match(pattern, get(host))
+		return matched == (op == "=")
+	}, nil
+}
+
+func compare(op string, a int64, b int64) bool {
+	switch op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case "!=":
+		return a != b
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,147 @@
+// hosts implements the host inventory, which lists every callback ID this
+// server has seen whether or not it is currently connected.
+
+package hosts
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Host is an entry of the host inventory. ConnectedSeconds includes the
+// current session of online hosts.
+type Host struct {
+	connman.CallbackRecord
+	Online bool `json:"online"`
+	// OnlineFor is how long the current session has been connected.
+	OnlineFor *util.Duration `json:"online_for,omitempty"`
+	// OfflineFor is how long since the host was last seen.
+	OfflineFor *util.Duration `json:"offline_for,omitempty"`
+	// Session is the current session of online hosts.
+	Session *connman.CallbackSessionDesc `json:"session,omitempty"`
+	// Flap is set if the callback ID is flapping.
+	Flap *connman.FlapStatus `json:"flap,omitempty"`
+}
+
+// HostsGet lists the host inventory, sorted by callback ID. Hosts are matched
+// against every filter query parameter given, each of the form
+// <field><op><value>. Supported fields are:
+//
+//	offline_for, online_for, connected_time - durations such as 90m, 24h or 7d
+//	first_seen, last_seen - RFC3339 times
+//	online - true or false
+//	callback_id, principal, remote_addr, node, disconnect_reason, label.<key> - glob patterns
+//
+// Durations and times support the operators =, !=, <, <=, > and >=. Other
+// fields support = and !=.
+func HostsGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		filters := []filter{}
+		for _, expr := range r.URL.Query()["filter"] {
+			f, err := parseFilter(expr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			filters = append(filters, f)
+		}
+
+		hosts, err := inventory(settings.ConnectionManager, time.Now())
+		if err != nil {
+			log.Errorln("Could not list callback records:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		ret := make([]Host, 0, len(hosts))
+	hostLoop:
+		for i := range hosts {
+			for _, f := range filters {
+				if !f(&hosts[i]) {
+					continue hostLoop
+				}
+			}
+			ret = append(ret, hosts[i])
+		}
+
+		out, err := json.Marshal(&ret)
+		if err != nil {
+			log.Errorln(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+
+		w.Write(out)
+	}
+}
+
+// inventory merges the stored callback records with the live sessions. Sessions
+// held elsewhere, such as on other cluster nodes or behind relays, have no
+// local record and are described by their session alone.
+func inventory(cm *connman.ConnectionManager, now time.Time) ([]Host, error) {
+	records, err := cm.ListCallbackRecords()
+	if err != nil {
+		return nil, err
+	}
+	sessions := cm.ListCallbackSessions().Sessions
+
+	hosts := make([]Host, 0, len(records))
+	for _, record := range records {
+		host := Host{CallbackRecord: record}
+		if desc, found := sessions[record.CallbackId]; found {
+			setOnline(&host, desc, now)
+			delete(sessions, record.CallbackId)
+		} else if !record.LastSeen.IsZero() {
+			// IDs which were allocated but have never connected have not
+			// been seen, so have no time offline.
+			offlineFor := util.Duration(now.Sub(record.LastSeen))
+			host.OfflineFor = &offlineFor
+		}
+		hosts = append(hosts, host)
+	}
+
+	for callbackId, desc := range sessions {
+		host := Host{CallbackRecord: connman.CallbackRecord{
+			CallbackId:      callbackId,
+			Principal:       desc.Principal,
+			Labels:          desc.Labels,
+			FirstSeen:       desc.ConnectedAt,
+			LastSeen:        desc.ConnectedAt,
+			LastConnectedAt: desc.ConnectedAt,
+			LastRemoteAddr:  desc.RemoteAddr,
+			LastNode:        desc.Node,
+		}}
+		setOnline(&host, desc, now)
+		hosts = append(hosts, host)
+	}
+
+	for i := range hosts {
+		if status, flapping := cm.GetFlapStatus(hosts[i].CallbackId); flapping {
+			hosts[i].Flap = &status
+		}
+	}
+
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].CallbackId < hosts[j].CallbackId })
+	return hosts, nil
+}
+
+func setOnline(host *Host, desc connman.CallbackSessionDesc, now time.Time) {
+	onlineFor := util.Duration(now.Sub(desc.ConnectedAt))
+	host.Online = true
+	host.OnlineFor = &onlineFor
+	host.ConnectedSeconds += time.Duration(onlineFor).Seconds()
+	host.Session = &desc
+}
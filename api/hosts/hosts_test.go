@@ -0,0 +1,166 @@
+package hosts
+
+import (
+	"github.com/hashicorp/yamux"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	offlineFor := util.Duration(48 * time.Hour)
+	offline := &Host{
+		CallbackRecord: connman.CallbackRecord{
+			CallbackId:       "syd-db-1",
+			Principal:        "ci",
+			Labels:           map[string]string{"site": "syd"},
+			Annotations:      map[string]string{"owner": "dba"},
+			FirstSeen:        now.Add(-30 * 24 * time.Hour),
+			LastSeen:         now.Add(-48 * time.Hour),
+			ConnectedSeconds: 3600,
+			LastNode:         "node1",
+		},
+		OfflineFor: &offlineFor,
+	}
+	onlineFor := util.Duration(10 * time.Minute)
+	online := &Host{
+		CallbackRecord: connman.CallbackRecord{
+			CallbackId: "mel-web-1",
+			FirstSeen:  now.Add(-time.Hour),
+			LastSeen:   now,
+			State:      connman.SessionPending,
+		},
+		Online:    true,
+		OnlineFor: &onlineFor,
+	}
+
+	for _, tc := range []struct {
+		expr    string
+		offline bool
+		online  bool
+	}{
+		{"offline_for>24h", true, false},
+		{"offline_for>=2d", true, false},
+		{"offline_for<24h", false, false},
+		{"online_for<1h", false, true},
+		{"online_for!=10m", false, false},
+		{"connected_time=1h", true, false},
+		{"first_seen<2026-01-01T00:00:00Z", true, false},
+		{"last_seen>=2026-01-02T03:04:05Z", false, true},
+		{"online=true", false, true},
+		{"online!=true", true, false},
+		{"callback_id=*-db-*", true, false},
+		{"callback_id!=*-db-*", false, true},
+		{"principal=ci", true, false},
+		{"node=node?", true, false},
+		{"label.site=syd", true, false},
+		{"label.site=", false, true},
+		{"annotation.owner=d*", true, false},
+		{"state=active", true, false},
+		{"state=pending", false, true},
+	} {
+		f, err := parseFilter(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if got := f(offline); got != tc.offline {
+			t.Errorf("%s matched the offline host: %v, want %v", tc.expr, got, tc.offline)
+		}
+		if got := f(online); got != tc.online {
+			t.Errorf("%s matched the online host: %v, want %v", tc.expr, got, tc.online)
+		}
+	}
+
+	for _, expr := range []string{
+		"offline_for",
+		"=24h",
+		"unknown=1",
+		"offline_for>soon",
+		"first_seen>yesterday",
+		"online<true",
+		"online=maybe",
+		"callback_id>a",
+		"callback_id=[",
+	} {
+		if _, err := parseFilter(expr); err == nil {
+			t.Errorf("%s: parsed, want an error", expr)
+		}
+	}
+}
+
+// testCallback registers callbackId with cm over an in-memory connection.
+func testCallback(t *testing.T, cm *connman.ConnectionManager, callbackId string) {
+	serverConn, callbackConn := net.Pipe()
+	doneCh := make(chan struct{})
+	t.Cleanup(func() {
+		callbackConn.Close()
+		close(doneCh)
+	})
+	resultCh := cm.CallbackConnection(callbackId, connman.SessionOrigin{RemoteAddr: "192.0.2.1:1234"}, serverConn, doneCh)
+	go func() {
+		for range resultCh {
+		}
+	}()
+	if _, err := yamux.Server(callbackConn, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, found := cm.GetCallbackSession(callbackId); found {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callback session was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	now := time.Now()
+	store := connman.NewMemorySessionStore()
+	store.Update("offline", func(record *connman.CallbackRecord) {
+		record.FirstSeen = now.Add(-24 * time.Hour)
+		record.LastSeen = now.Add(-2 * time.Hour)
+	})
+	// Allocated IDs have a record before they first connect.
+	store.Update("unused", func(record *connman.CallbackRecord) {})
+	cm := connman.NewConnectionManager(1024)
+	cm.SetSessionStore(store)
+	testCallback(t, cm, "online")
+
+	hosts, err := inventory(cm, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 3 {
+		t.Fatalf("inventory = %+v, want 3 hosts", hosts)
+	}
+
+	offline, online, unused := hosts[0], hosts[1], hosts[2]
+	if offline.CallbackId != "offline" || online.CallbackId != "online" || unused.CallbackId != "unused" {
+		t.Fatalf("hosts are %s, %s, %s, want sorted by callback ID", offline.CallbackId, online.CallbackId, unused.CallbackId)
+	}
+
+	if offline.Online || offline.OfflineFor == nil || time.Duration(*offline.OfflineFor) != 2*time.Hour+time.Minute {
+		t.Errorf("offline host = %+v, want offline for 2h1m", offline)
+	}
+
+	if !online.Online || online.Session == nil || online.OnlineFor == nil || online.OfflineFor != nil {
+		t.Errorf("online host = %+v, want online with its session", online)
+	} else if d := time.Duration(*online.OnlineFor); d < 50*time.Second || d > time.Minute {
+		t.Errorf("online host has been online for %v, want about 1m", d)
+	}
+	if online.ConnectedSeconds < 50 {
+		t.Errorf("online host has %v connected seconds, want the current session included", online.ConnectedSeconds)
+	}
+
+	if unused.Online || unused.OfflineFor != nil {
+		t.Errorf("unused host = %+v, want neither online nor offline for any time", unused)
+	}
+}
@@ -0,0 +1,53 @@
+// internode implements the API other cluster nodes relay client connections
+// through.
+
+package internode
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apicommon"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/util/websocketrwc"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+)
+
+// ConnectGet accepts a client connection relayed by another node. Requests are
+// authenticated by the cluster secret rather than API tokens, since the
+// relaying node has already authorized the client.
+func ConnectGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+		log := log.With("remote_addr", r.RemoteAddr).With("callback_id", callbackId)
+
+		origin, verr := settings.Cluster.VerifyRelay(r, callbackId)
+		if verr != nil {
+			log.Warnln("Rejected relayed connection:", verr)
+			http.Error(w, verr.Error(), http.StatusUnauthorized)
+			return
+		}
+		log = log.With("relay_node", origin.Node)
+
+		if cerr := settings.ConnectionManager.CheckClientConnection(callbackId, origin); cerr != nil {
+			log.Infoln("Relayed connection rejected:", cerr)
+			http.Error(w, cerr.Error(), apicommon.ErrorStatus(cerr))
+			return
+		}
+
+		incomingConn, uerr, doneCh := websocketrwc.Upgrade(w, r, nil, settings.Upgrader())
+		if uerr != nil {
+			log.Errorln("Websocket upgrade failed:", uerr)
+			return
+		}
+
+		log.Infoln("Accepted relayed client connection.")
+		err := <-settings.ConnectionManager.ClientConnection(callbackId, origin, incomingConn, doneCh)
+		if err != nil {
+			log.Errorln("Relayed session error:", err)
+		} else {
+			log.Infoln("Relayed session ended normally.")
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// lease implements exclusive leases of callback IDs, which stop other clients
+// connecting to them until the lease expires or is released.
+
+package lease
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apicommon"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/policy"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/go.log"
+	"io"
+	"net/http"
+	"time"
+)
+
+// LeaseRequest is the optional body of a lease request.
+type LeaseRequest struct {
+	// Duration of the lease. Defaults to the server's lease duration.
+	Duration util.Duration `json:"duration"`
+}
+
+// LeasePost acquires or renews a lease of a callback ID for the caller.
+func LeasePost(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		req := LeaseRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		duration := time.Duration(req.Duration)
+		if duration == 0 {
+			duration = settings.LeaseDuration
+		}
+		if duration < 0 {
+			http.Error(w, "lease duration must be positive", http.StatusBadRequest)
+			return
+		}
+		if settings.MaxLeaseDuration > 0 && duration > settings.MaxLeaseDuration {
+			http.Error(w, fmt.Sprintf("lease duration exceeds the maximum of %s", settings.MaxLeaseDuration), http.StatusBadRequest)
+			return
+		}
+
+		// Only callers allowed to connect to a callback may lease it.
+		var labels map[string]string
+		if desc, found := settings.ConnectionManager.GetCallbackSession(callbackId); found {
+			labels = desc.Labels
+		}
+		decision := settings.Policy.Evaluate(apicommon.PolicyRequest(r, policy.ActionConnect, callbackId, labels))
+		if !decision.Allowed() {
+			log.Infoln("Lease denied by policy:", decision)
+			http.Error(w, "connection denied by policy", http.StatusForbidden)
+			return
+		}
+
+		lease, err := settings.ConnectionManager.AcquireLease(callbackId, apicommon.Origin(r, nil), duration)
+		if err != nil {
+			log.Infoln("Lease refused:", err)
+			http.Error(w, err.Error(), apicommon.ErrorStatus(err))
+			return
+		}
+		log.With("holder", lease.Holder).With("callback_id", callbackId).
+			With("expires_at", lease.ExpiresAt).Infoln("Callback leased.")
+
+		writeJSON(w, &lease)
+	}
+}
+
+// LeaseGet returns the lease of a callback ID.
+func LeaseGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		lease, found := settings.ConnectionManager.GetLease(ps.ByName("callbackId"))
+		if !found {
+			http.Error(w, "callback is not leased", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, &lease)
+	}
+}
+
+// LeaseDelete releases the caller's lease of a callback ID. Admins may
+// release any lease with ?force=true.
+func LeaseDelete(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		force := r.URL.Query().Get("force") == "true"
+		if force {
+			if principal := auth.PrincipalFromRequest(r); principal != nil && !principal.HasScope(auth.ScopeAdmin) {
+				http.Error(w, "forcing release of a lease requires the admin scope", http.StatusForbidden)
+				return
+			}
+		}
+
+		lease, err := settings.ConnectionManager.ReleaseLease(callbackId, apicommon.Origin(r, nil), force)
+		if err != nil {
+			http.Error(w, err.Error(), apicommon.ErrorStatus(err))
+			return
+		}
+		log.With("principal", auth.PrincipalName(r)).With("holder", lease.Holder).
+			With("callback_id", callbackId).Infoln("Callback lease released.")
+
+		writeJSON(w, &lease)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+	w.Write(out)
+}
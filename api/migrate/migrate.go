@@ -0,0 +1,83 @@
+// migrate implements moving callback sessions to another server.
+
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultTimeout is how long callbacks are given to register with the target
+// if the request does not say.
+const DefaultTimeout = 30 * time.Second
+
+// Request is the body of a migration request.
+type Request struct {
+	// Target is the URL of the server to migrate to.
+	Target string `json:"target"`
+	// CallbackIds are the sessions to migrate. All sessions if empty.
+	CallbackIds []string `json:"callback_ids,omitempty"`
+	// Timeout is how long each callback is given to register with the target.
+	Timeout util.Duration `json:"timeout,omitempty"`
+}
+
+// MigratePost asks callback sessions to register with another server, and
+// closes each one after it has. Responds once every session has migrated or
+// timed out, with the result for each.
+func MigratePost(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		req := Request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+		target, err := url.Parse(req.Target)
+		if err != nil || target.Host == "" {
+			http.Error(w, "target must be an absolute server URL", http.StatusBadRequest)
+			return
+		}
+		switch target.Scheme {
+		case "http", "https", "ws", "wss":
+		default:
+			http.Error(w, "target must be an http, https, ws or wss URL", http.StatusBadRequest)
+			return
+		}
+		timeout := time.Duration(req.Timeout)
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+
+		log := log.With("principal", auth.PrincipalName(r)).With("target", req.Target)
+		log.Infoln("Migrating callback sessions:", req.CallbackIds)
+
+		results := settings.ConnectionManager.Migrate(req.CallbackIds, req.Target, timeout)
+
+		migrated := 0
+		for _, result := range results {
+			if result.Migrated {
+				migrated++
+			}
+		}
+		log.Infof("Migrated %d of %d callback sessions.", migrated, len(results))
+
+		out, err := json.Marshal(&results)
+		if err != nil {
+			log.Errorln(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+		w.Write(out)
+	}
+}
@@ -0,0 +1,119 @@
+// netacl implements CIDR allow/deny lists for API endpoints.
+
+package netacl
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apicommon"
+	"github.com/wrouesnel/go.log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ACL is a network access list. Deny entries take precedence over allow
+// entries. If there are no allow entries, every address not denied is allowed.
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Parse builds an ACL from lists of CIDRs. Each entry may itself be a comma
+// separated list. Bare IP addresses are treated as single host networks.
+func Parse(allow []string, deny []string) (*ACL, error) {
+	allowNets, err := parseNets(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseNets(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ACL{Allow: allowNets, Deny: denyNets}, nil
+}
+
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		for _, cidr := range strings.Split(entry, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr == "" {
+				continue
+			}
+			if !strings.Contains(cidr, "/") {
+				ip := net.ParseIP(cidr)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid network address: %s", cidr)
+				}
+				if ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, network)
+		}
+	}
+	return nets, nil
+}
+
+// Loopback returns an ACL permitting only loopback addresses.
+func Loopback() *ACL {
+	_, v4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, v6, _ := net.ParseCIDR("::1/128")
+	return &ACL{Allow: []*net.IPNet{v4, v6}}
+}
+
+// Empty returns true if the ACL has no entries and so permits everything.
+func (acl *ACL) Empty() bool {
+	return acl == nil || (len(acl.Allow) == 0 && len(acl.Deny) == 0)
+}
+
+// Permits returns true if ip is allowed by the ACL. A nil ACL permits
+// everything. An unparseable address is only permitted by an empty ACL.
+func (acl *ACL) Permits(ip net.IP) bool {
+	if acl.Empty() {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range acl.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(acl.Allow) == 0 {
+		return true
+	}
+	for _, network := range acl.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns a handler which rejects requests from addresses not permitted
+// by acl with 403 before invoking h.
+func Wrap(acl *ACL, h httprouter.Handle) httprouter.Handle {
+	if acl.Empty() {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		remoteIP := apicommon.RemoteIP(r)
+		if !acl.Permits(net.ParseIP(remoteIP)) {
+			log.With("remote_addr", r.RemoteAddr).With("path", r.URL.Path).
+				Infoln("Request rejected by network ACL")
+			http.Error(w, "client address not permitted", http.StatusForbidden)
+			return
+		}
+		h(w, r, ps)
+	}
+}
@@ -0,0 +1,82 @@
+package netacl
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPermits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allow   []string
+		deny    []string
+		ip      string
+		permits bool
+	}{
+		{"empty", nil, nil, "192.0.2.1", true},
+		{"empty unparseable", nil, nil, "", true},
+		{"allowed", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"not allowed", []string{"10.0.0.0/8"}, nil, "192.0.2.1", false},
+		{"deny only", nil, []string{"198.51.100.0/24"}, "192.0.2.1", true},
+		{"denied", nil, []string{"198.51.100.0/24"}, "198.51.100.7", false},
+		{"deny takes precedence", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.1.2.3", false},
+		{"allowed outside deny", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.2.0.1", true},
+		{"comma separated", []string{"10.0.0.0/8, 192.0.2.0/24"}, nil, "192.0.2.9", true},
+		{"bare ipv4", []string{"192.0.2.1"}, nil, "192.0.2.1", true},
+		{"bare ipv4 is a single host", []string{"192.0.2.1"}, nil, "192.0.2.2", false},
+		{"bare ipv6", []string{"2001:db8::1"}, nil, "2001:db8::1", true},
+		{"unparseable", []string{"10.0.0.0/8"}, nil, "", false},
+	} {
+		acl, err := Parse(tc.allow, tc.deny)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if permits := acl.Permits(net.ParseIP(tc.ip)); permits != tc.permits {
+			t.Errorf("%s: Permits(%s) = %v, want %v", tc.name, tc.ip, permits, tc.permits)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.0/x", "300.1.1.1"} {
+		if _, err := Parse([]string{entry}, nil); err == nil {
+			t.Errorf("allow entry %q was parsed", entry)
+		}
+		if _, err := Parse(nil, []string{entry}); err == nil {
+			t.Errorf("deny entry %q was parsed", entry)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	acl, err := Parse([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Wrap(acl, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {})
+
+	for remoteAddr, want := range map[string]int{
+		"10.0.0.1:1234":  http.StatusOK,
+		"192.0.2.1:1234": http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", remoteAddr, w.Code, want)
+		}
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	acl := Loopback()
+	for ip, want := range map[string]bool{"127.0.0.1": true, "127.1.2.3": true, "::1": true, "192.0.2.1": false, "2001:db8::1": false} {
+		if permits := acl.Permits(net.ParseIP(ip)); permits != want {
+			t.Errorf("Permits(%s) = %v, want %v", ip, permits, want)
+		}
+	}
+}
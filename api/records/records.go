@@ -0,0 +1,111 @@
+// records implements access to the stored records of callback IDs, which
+// outlive their sessions.
+
+package records
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+)
+
+// NotesRequest is the body of a notes update.
+type NotesRequest struct {
+	Notes string `json:"notes"`
+}
+
+// RecordsGet lists the records of every callback ID seen.
+func RecordsGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		records, err := settings.ConnectionManager.ListCallbackRecords()
+		if err != nil {
+			log.Errorln("Could not list callback records:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, &records)
+	}
+}
+
+// RecordGet returns the record of a callback ID.
+func RecordGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+		record, found, err := settings.ConnectionManager.GetCallbackRecord(callbackId)
+		if err != nil {
+			log.Errorln("Could not get callback record:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "callback ID has never registered", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, &record)
+	}
+}
+
+// NotesPut sets the operator notes of a callback ID.
+func NotesPut(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		req := NotesRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		record, err := settings.ConnectionManager.SetCallbackNotes(callbackId, req.Notes)
+		if err != nil {
+			log.Errorln("Could not update callback record:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		log.With("principal", auth.PrincipalName(r)).With("callback_id", callbackId).
+			Infoln("Callback notes changed.")
+
+		writeJSON(w, &record)
+	}
+}
+
+// RecordDelete forgets a callback ID.
+func RecordDelete(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+		if err := settings.ConnectionManager.DeleteCallbackRecord(callbackId); err != nil {
+			log.Errorln("Could not delete callback record:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		log.With("principal", auth.PrincipalName(r)).With("callback_id", callbackId).
+			Infoln("Callback record deleted.")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+	w.Write(out)
+}
@@ -0,0 +1,67 @@
+// state implements operator set states of callback IDs, which drain or
+// disable them.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apicommon"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+)
+
+// StateRequest is the body of a state change.
+type StateRequest struct {
+	// State is active, draining or disabled.
+	State string `json:"state"`
+	// Note explains the state to clients and other operators.
+	Note string `json:"note"`
+}
+
+// StatePut sets the state of a callback ID.
+func StatePut(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		callbackId := ps.ByName("callbackId")
+
+		req := StateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		principal := auth.PrincipalName(r)
+		record, err := settings.ConnectionManager.SetCallbackState(callbackId, req.State, req.Note, principal)
+		if err != nil {
+			if status := apicommon.ErrorStatus(err); status != http.StatusInternalServerError {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			log.Errorln("Could not update callback record:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		log.With("principal", principal).With("callback_id", callbackId).With("state", req.State).
+			Infoln("Callback state changed:", req.Note)
+
+		writeJSON(w, &record)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+	w.Write(out)
+}
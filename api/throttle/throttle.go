@@ -0,0 +1,79 @@
+// throttle implements request rate limiting for API endpoints.
+
+package throttle
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apicommon"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/util/ratelimit"
+	"github.com/wrouesnel/go.log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Rejected counts rejected requests keyed by route class and limiter type
+// (for example "connect_ip"). Published via expvar.
+var Rejected = expvar.NewMap("ratelimit_rejected_total")
+
+// RouteLimits holds the limiters of a class of routes.
+type RouteLimits struct {
+	// Class names the routes in logs and metrics.
+	Class string
+	// PerIP limits requests by remote IP address.
+	PerIP *ratelimit.Limiter
+	// PerPrincipal limits requests by authenticated principal.
+	PerPrincipal *ratelimit.Limiter
+}
+
+// ByIP returns a handler which rate limits requests by remote IP before
+// invoking h.
+func ByIP(limits *RouteLimits, h httprouter.Handle) httprouter.Handle {
+	if limits == nil || limits.PerIP == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if ok, retryAfter := limits.PerIP.Allow(apicommon.RemoteIP(r)); !ok {
+			reject(w, r, limits.Class, "ip", retryAfter)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// ByPrincipal returns a handler which rate limits requests by authenticated
+// principal before invoking h. Must be applied inside authentication.
+// Requests without a principal are not limited.
+func ByPrincipal(limits *RouteLimits, h httprouter.Handle) httprouter.Handle {
+	if limits == nil || limits.PerPrincipal == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		principal := auth.PrincipalName(r)
+		if principal != "" {
+			if ok, retryAfter := limits.PerPrincipal.Allow(principal); !ok {
+				reject(w, r, limits.Class, "principal", retryAfter)
+				return
+			}
+		}
+		h(w, r, ps)
+	}
+}
+
+// reject writes a 429 response and counts the rejection.
+func reject(w http.ResponseWriter, r *http.Request, class string, limiter string, retryAfter time.Duration) {
+	Rejected.Add(fmt.Sprintf("%s_%s", class, limiter), 1)
+
+	log.With("remote_addr", r.RemoteAddr).
+		With("principal", auth.PrincipalName(r)).
+		With("route_class", class).
+		Debugln("Request rate limited by", limiter)
+
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+}
@@ -0,0 +1,107 @@
+package throttle
+
+import (
+	"expvar"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/util/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func okHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+
+func serve(h httprouter.Handle, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, r, nil)
+	return w
+}
+
+// rejected returns the count of rejections of a route class and limiter type.
+func rejected(key string) int64 {
+	if count, ok := Rejected.Get(key).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func TestByIP(t *testing.T) {
+	limits := &RouteLimits{Class: "test", PerIP: ratelimit.NewLimiter(ratelimit.Rate{PerSecond: 1.0 / 60, Burst: 2})}
+	handler := ByIP(limits, okHandler)
+	request := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := serve(handler, request("192.0.2.1:1234")); w.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: status %d", i, w.Code)
+		}
+	}
+	before := rejected("test_ip")
+	w := serve(handler, request("192.0.2.1:5678"))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the burst: status %d, want 429", w.Code)
+	}
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 60 {
+		t.Errorf("Retry-After = %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+	}
+	if after := rejected("test_ip"); after != before+1 {
+		t.Errorf("rejections counted went from %d to %d, want one more", before, after)
+	}
+
+	// Other addresses have their own buckets.
+	if w := serve(handler, request("192.0.2.2:1234")); w.Code != http.StatusOK {
+		t.Errorf("another address: status %d", w.Code)
+	}
+}
+
+func TestByPrincipal(t *testing.T) {
+	ts, err := auth.NewTokenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := ts.Create("ci", []auth.Scope{auth.ScopeList}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := &RouteLimits{Class: "test", PerPrincipal: ratelimit.NewLimiter(ratelimit.Rate{PerSecond: 1.0 / 60, Burst: 1})}
+	handler := auth.RequireScope(ts, auth.ScopeList, ByPrincipal(limits, okHandler))
+	request := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	if w := serve(handler, request("192.0.2.1:1234")); w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	// The principal is limited whichever address it comes from.
+	w := serve(handler, request("192.0.2.2:1234"))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("second request: status %d, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Requests without a principal are not limited.
+	anonymous := ByPrincipal(limits, okHandler)
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		if w := serve(anonymous, r); w.Code != http.StatusOK {
+			t.Errorf("anonymous request %d: status %d", i, w.Code)
+		}
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	handler := ByIP(nil, ByPrincipal(&RouteLimits{}, okHandler))
+	for i := 0; i < 10; i++ {
+		if w := serve(handler, httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, w.Code)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package tokens
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+	"time"
+)
+
+// TokenRequest is the request body for creating a token.
+type TokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is a Go duration string. Blank means the token does not expire.
+	ExpiresIn string `json:"expires_in"`
+}
+
+// TokenResponse is returned on token creation and is the only time the token
+// secret is available.
+type TokenResponse struct {
+	Token          string `json:"token"`
+	auth.TokenDesc `json:",inline"`
+}
+
+// TokensPost creates a new named token.
+func TokensPost(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		log := log.With("remote_addr", r.RemoteAddr)
+
+		req := TokenRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		scopes := make([]auth.Scope, 0, len(req.Scopes))
+		for _, s := range req.Scopes {
+			scope, err := auth.ParseScope(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+
+		var ttl time.Duration
+		if req.ExpiresIn != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.ExpiresIn)
+			if err != nil || ttl <= 0 {
+				http.Error(w, "expires_in must be a positive duration", http.StatusBadRequest)
+				return
+			}
+		}
+
+		token, desc, err := settings.TokenStore.Create(req.Name, scopes, ttl, auth.PrincipalName(r))
+		if err != nil {
+			if _, ok := err.(*auth.ErrTokenNameRequired); ok {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Errorln("Could not create token:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		log.With("token_id", desc.Id).With("token_name", desc.Name).Infoln("Created API token.")
+
+		out, err := json.Marshal(&TokenResponse{Token: token, TokenDesc: desc})
+		if err != nil {
+			log.Errorln(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+		w.WriteHeader(http.StatusCreated)
+
+		w.Write(out)
+	}
+}
+
+// TokensGet lists the metadata of all managed tokens.
+func TokensGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		tokens := settings.TokenStore.List()
+
+		out, err := json.Marshal(&tokens)
+		if err != nil {
+			log.Errorln(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+
+		w.Write(out)
+	}
+}
+
+// TokenDelete revokes a token.
+func TokenDelete(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		tokenId := ps.ByName("tokenId")
+
+		if err := settings.TokenStore.Revoke(tokenId); err != nil {
+			if _, ok := err.(*auth.ErrTokenUnknown); ok {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			log.Errorln("Could not revoke token:", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		log.With("token_id", tokenId).Infoln("Revoked API token.")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,75 @@
+package tokens
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/auth"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTokensAPI(t *testing.T) {
+	ts, err := auth.NewTokenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := apisettings.APISettings{TokenStore: ts}
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"name": "ci", "scopes": ["root"]}`, http.StatusBadRequest},
+		{`{"name": "ci", "scopes": ["connect"], "expires_in": "-1h"}`, http.StatusBadRequest},
+		{`{"name": "", "scopes": ["connect"]}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		TokensPost(settings)(w, httptest.NewRequest("POST", "/api/v1/tokens", strings.NewReader(tc.body)), nil)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.body, w.Code, tc.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	TokensPost(settings)(w, httptest.NewRequest("POST", "/api/v1/tokens",
+		strings.NewReader(`{"name": "ci", "scopes": ["connect"], "expires_in": "1h"}`)), nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	created := TokenResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == "" || created.ExpiresAt == nil {
+		t.Errorf("created token = %+v", created)
+	}
+	if _, err := ts.Authenticate(created.Token); err != nil {
+		t.Errorf("created token does not authenticate: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	TokensGet(settings)(w, httptest.NewRequest("GET", "/api/v1/tokens", nil), nil)
+	if strings.Contains(w.Body.String(), created.Token) {
+		t.Error("token listing contains the token")
+	}
+	listed := []auth.TokenDesc{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Id != created.Id {
+		t.Errorf("listed %+v", listed)
+	}
+
+	params := httprouter.Params{{Key: "tokenId", Value: created.Id}}
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		w = httptest.NewRecorder()
+		TokenDelete(settings)(w, httptest.NewRequest("DELETE", "/api/v1/tokens/"+created.Id, nil), params)
+		if w.Code != want {
+			t.Errorf("delete: status %d, want %d", w.Code, want)
+		}
+	}
+}
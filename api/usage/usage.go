@@ -0,0 +1,152 @@
+// usage implements the usage reporting API.
+
+package usage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/usage"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultReportDuration is how far back reports go if from is not given.
+	defaultReportDuration = 30 * 24 * time.Hour
+)
+
+// Report is the serialization format of a usage report.
+type Report struct {
+	Period  usage.Period  `json:"period"`
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	GroupBy []string      `json:"group_by"`
+	Rows    []usage.Entry `json:"rows"`
+}
+
+// UsageGet reports usage. Query parameters:
+//
+//	from, to - RFC3339 times bounding the periods reported (default the last 30 days)
+//	period - hour, day or month (default day)
+//	group_by - comma separated list of callback_id and principal (default callback_id)
+//	format - json or csv (default json, or csv if the client accepts text/csv)
+func UsageGet(settings apisettings.APISettings) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		defer r.Body.Close()
+
+		query, err := parseQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report := Report{
+			Period:  query.Period,
+			From:    query.From,
+			To:      query.To,
+			GroupBy: query.GroupBy,
+			Rows:    settings.UsageStore.Query(query),
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			format = "csv"
+		}
+
+		switch format {
+		case "csv":
+			writeCSV(w, &report)
+		case "", "json":
+			out, err := json.Marshal(&report)
+			if err != nil {
+				log.Errorln(err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+
+			w.Write(out)
+		default:
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		}
+	}
+}
+
+// parseQuery reads the report query parameters.
+func parseQuery(r *http.Request) (usage.Query, error) {
+	params := r.URL.Query()
+
+	query := usage.Query{
+		Period:  usage.PeriodDay,
+		To:      time.Now().UTC(),
+		GroupBy: []string{usage.GroupByCallbackId},
+	}
+
+	if s := params.Get("period"); s != "" {
+		period, err := usage.ParsePeriod(s)
+		if err != nil {
+			return query, err
+		}
+		query.Period = period
+	}
+
+	if s := params.Get("to"); s != "" {
+		to, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return query, fmt.Errorf("to must be an RFC3339 time: %v", err)
+		}
+		query.To = to.UTC()
+	}
+
+	query.From = query.To.Add(-defaultReportDuration)
+	if s := params.Get("from"); s != "" {
+		from, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return query, fmt.Errorf("from must be an RFC3339 time: %v", err)
+		}
+		query.From = from.UTC()
+	}
+
+	if _, found := params["group_by"]; found {
+		groupBy, err := usage.ParseGroupBy(params.Get("group_by"))
+		if err != nil {
+			return query, err
+		}
+		query.GroupBy = groupBy
+	}
+
+	return query, nil
+}
+
+// writeCSV writes the report rows as CSV with a header row.
+func writeCSV(w http.ResponseWriter, report *Report) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"usage.csv\"")
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"period", "start", "callback_id", "principal", "bytes_out", "bytes_in", "sessions", "connected_seconds"})
+	for _, row := range report.Rows {
+		cw.Write([]string{
+			string(row.Period),
+			row.Start.Format(time.RFC3339),
+			row.CallbackId,
+			row.Principal,
+			strconv.FormatUint(row.BytesOut, 10),
+			strconv.FormatUint(row.BytesIn, 10),
+			strconv.FormatUint(row.Sessions, 10),
+			strconv.FormatFloat(row.ConnectedSeconds, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Errorln("Error writing usage CSV:", err)
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"github.com/julienschmidt/httprouter"
+	"github.com/wrouesnel/go.log"
+	"net/http"
+	"strings"
+)
+
+// principalKey is the request context key of the authenticated principal.
+type principalKey struct{}
+
+// TokenFromRequest extracts a presented token from a request. Tokens are
+// accepted as a bearer token, as the password of HTTP basic auth, or in the
+// access_token query parameter (for browser websocket and SSE clients which
+// cannot set headers).
+func TokenFromRequest(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// PrincipalFromRequest returns the principal a request was authenticated as.
+// Returns nil if authentication is disabled.
+func PrincipalFromRequest(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// PrincipalName returns the name of the principal of a request, or a blank
+// string if authentication is disabled.
+func PrincipalName(r *http.Request) string {
+	if principal := PrincipalFromRequest(r); principal != nil {
+		return principal.Name
+	}
+	return ""
+}
+
+// RequireScope wraps a handler so it is only invoked for requests carrying a
+// token with the given scope. If store is nil authentication is disabled and
+// all requests are passed through.
+func RequireScope(store *TokenStore, scope Scope, h httprouter.Handle) httprouter.Handle {
+	if store == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		log := log.With("remote_addr", r.RemoteAddr)
+
+		token := TokenFromRequest(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="callback"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		principal, err := store.Authenticate(token)
+		if err != nil {
+			log.Infoln("Rejected token:", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="callback", error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if !principal.HasScope(scope) {
+			log.With("principal", principal.Name).Infoln("Token lacks required scope:", scope)
+			http.Error(w, "token does not have the "+string(scope)+" scope", http.StatusForbidden)
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)), ps)
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireScope(t *testing.T) {
+	ts := newStore(t, "")
+	connect, _, err := ts.Create("ci", []Scope{ScopeConnect}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _, err := ts.Create("dashboard", []Scope{ScopeList}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var principal string
+	handler := RequireScope(ts, ScopeConnect, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		principal = PrincipalName(r)
+	})
+
+	for _, tc := range []struct {
+		name          string
+		setup         func(r *http.Request)
+		want          int
+		wantPrincipal string
+	}{
+		{"no token", func(r *http.Request) {}, http.StatusUnauthorized, ""},
+		{"invalid token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized, ""},
+		{"missing scope", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+list) }, http.StatusForbidden, ""},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+connect) }, http.StatusOK, "ci"},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("user", connect) }, http.StatusOK, "ci"},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "access_token=" + connect }, http.StatusOK, "ci"},
+	} {
+		principal = ""
+		r := httptest.NewRequest("GET", "/", nil)
+		tc.setup(r)
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+		if w.Code != tc.want || principal != tc.wantPrincipal {
+			t.Errorf("%s: status %d, principal %q, want %d, %q", tc.name, w.Code, principal, tc.want, tc.wantPrincipal)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without WWW-Authenticate", tc.name)
+		}
+	}
+}
+
+func TestRequireScopeDisabled(t *testing.T) {
+	called := false
+	handler := RequireScope(nil, ScopeAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		called = true
+		if PrincipalFromRequest(r) != nil {
+			t.Error("request has a principal without authentication")
+		}
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), nil)
+	if !called {
+		t.Error("handler was not called with authentication disabled")
+	}
+}
@@ -0,0 +1,353 @@
+// auth implements server-managed API tokens and the principals they identify.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/wrouesnel/callback/util"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenFileVersion is the on-disk format version of the token file.
+	tokenFileVersion = 1
+
+	tokenIdBytes     = 8
+	tokenSecretBytes = 32
+	tokenSaltBytes   = 16
+)
+
+// Scope is a permission which can be granted to a token.
+type Scope string
+
+const (
+	// ScopeList allows listing sessions and subscribing to event streams.
+	ScopeList = Scope("list")
+	// ScopeConnect allows client connections to callback sessions.
+	ScopeConnect = Scope("connect")
+	// ScopeRegister allows registering callback sessions.
+	ScopeRegister = Scope("register")
+	// ScopeAdmin allows everything, including token management.
+	ScopeAdmin = Scope("admin")
+)
+
+// ParseScope validates a scope name.
+func ParseScope(s string) (Scope, error) {
+	switch scope := Scope(s); scope {
+	case ScopeList, ScopeConnect, ScopeRegister, ScopeAdmin:
+		return scope, nil
+	default:
+		return "", &ErrInvalidScope{s}
+	}
+}
+
+type ErrInvalidScope struct {
+	scope string
+}
+
+func (err ErrInvalidScope) Error() string {
+	return "invalid token scope: " + err.scope
+}
+
+type ErrTokenUnknown struct{}
+
+func (err ErrTokenUnknown) Error() string {
+	return "token is not known"
+}
+
+type ErrTokenExpired struct {
+	tokenId string
+}
+
+func (err ErrTokenExpired) Error() string {
+	return "token has expired"
+}
+
+type ErrTokenNameRequired struct{}
+
+func (err ErrTokenNameRequired) Error() string {
+	return "token name must not be blank"
+}
+
+// Principal is the authenticated identity behind a request.
+type Principal struct {
+	// Name is the name of the token the request was authenticated with.
+	Name string `json:"name"`
+	// TokenId is the id of the token, blank for static tokens.
+	TokenId string `json:"token_id,omitempty"`
+	// Scopes granted to the principal.
+	Scopes []Scope `json:"scopes"`
+}
+
+// HasScope returns true if the principal has been granted scope. The admin
+// scope implies every other scope.
+func (p *Principal) HasScope(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenDesc is the public metadata of a token. The secret is never included.
+type TokenDesc struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []Scope    `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// expired returns true if the token is past its expiry time.
+func (td *TokenDesc) expired(now time.Time) bool {
+	return td.ExpiresAt != nil && !now.Before(*td.ExpiresAt)
+}
+
+// tokenRecord is the persisted form of a token.
+type tokenRecord struct {
+	TokenDesc
+	Salt string `json:"salt"`
+	Hash string `json:"hash"`
+}
+
+// tokenFile is the serialization format of the token file.
+type tokenFile struct {
+	Version int            `json:"version"`
+	Tokens  []*tokenRecord `json:"tokens"`
+}
+
+// staticToken is a token configured at startup which is never persisted.
+type staticToken struct {
+	principal Principal
+	salt      []byte
+	hash      []byte
+}
+
+// TokenStore holds API tokens. Only salted hashes of token secrets are kept,
+// in memory and on disk.
+type TokenStore struct {
+	// path of the token file. Tokens are not persisted if blank.
+	path string
+
+	tokens       map[string]*tokenRecord
+	staticTokens []staticToken
+	mtx          sync.RWMutex
+}
+
+// NewTokenStore initializes a token store, loading existing tokens from path
+// if it is not blank.
+func NewTokenStore(path string) (*TokenStore, error) {
+	ts := &TokenStore{
+		path:   path,
+		tokens: make(map[string]*tokenRecord),
+	}
+
+	if path == "" {
+		return ts, nil
+	}
+
+	stored := tokenFile{}
+	if _, err := util.ReadJSONFile(path, &stored); err != nil {
+		return nil, err
+	}
+	for _, record := range stored.Tokens {
+		ts.tokens[record.Id] = record
+	}
+
+	return ts, nil
+}
+
+// AddStaticToken registers a token supplied by configuration (such as the
+// bootstrap admin token). Static tokens cannot be listed or revoked.
+func (ts *TokenStore) AddStaticToken(name string, token string, scopes []Scope) {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+
+	salt := randomBytes(tokenSaltBytes)
+	ts.staticTokens = append(ts.staticTokens, staticToken{
+		principal: Principal{Name: name, Scopes: scopes},
+		salt:      salt,
+		hash:      hashSecret(salt, token),
+	})
+}
+
+// Create generates a new token. A zero ttl means the token does not expire.
+// The returned token string is the only time the secret is available.
+func (ts *TokenStore) Create(name string, scopes []Scope, ttl time.Duration, createdBy string) (string, TokenDesc, error) {
+	if name == "" {
+		return "", TokenDesc{}, &ErrTokenNameRequired{}
+	}
+
+	id := hex.EncodeToString(randomBytes(tokenIdBytes))
+	secret := base64.RawURLEncoding.EncodeToString(randomBytes(tokenSecretBytes))
+	salt := randomBytes(tokenSaltBytes)
+
+	record := &tokenRecord{
+		TokenDesc: TokenDesc{
+			Id:        id,
+			Name:      name,
+			Scopes:    scopes,
+			CreatedAt: time.Now().UTC(),
+			CreatedBy: createdBy,
+		},
+		Salt: hex.EncodeToString(salt),
+		Hash: hex.EncodeToString(hashSecret(salt, secret)),
+	}
+	if ttl > 0 {
+		expiresAt := record.CreatedAt.Add(ttl)
+		record.ExpiresAt = &expiresAt
+	}
+
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+
+	ts.tokens[id] = record
+	if err := ts.persist(); err != nil {
+		delete(ts.tokens, id)
+		return "", TokenDesc{}, err
+	}
+
+	return id + "." + secret, record.TokenDesc, nil
+}
+
+// List returns the metadata of all managed tokens ordered by creation time.
+func (ts *TokenStore) List() []TokenDesc {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+
+	ret := make([]TokenDesc, 0, len(ts.tokens))
+	for _, record := range ts.tokens {
+		ret = append(ret, record.TokenDesc)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+
+	return ret
+}
+
+// Revoke deletes a token by id.
+func (ts *TokenStore) Revoke(tokenId string) error {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+
+	record, found := ts.tokens[tokenId]
+	if !found {
+		return &ErrTokenUnknown{}
+	}
+
+	delete(ts.tokens, tokenId)
+	if err := ts.persist(); err != nil {
+		ts.tokens[tokenId] = record
+		return err
+	}
+	return nil
+}
+
+// Administrable returns true if a static or unexpired managed token has the
+// admin scope, so further tokens can be created.
+func (ts *TokenStore) Administrable() bool {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+
+	for _, st := range ts.staticTokens {
+		if st.principal.HasScope(ScopeAdmin) {
+			return true
+		}
+	}
+	now := time.Now()
+	for _, record := range ts.tokens {
+		principal := Principal{Scopes: record.Scopes}
+		if principal.HasScope(ScopeAdmin) && !record.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate resolves a presented token string to a principal.
+func (ts *TokenStore) Authenticate(token string) (*Principal, error) {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+
+	for _, st := range ts.staticTokens {
+		if subtle.ConstantTimeCompare(hashSecret(st.salt, token), st.hash) == 1 {
+			principal := st.principal
+			return &principal, nil
+		}
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, &ErrTokenUnknown{}
+	}
+
+	record, found := ts.tokens[parts[0]]
+	if !found {
+		return nil, &ErrTokenUnknown{}
+	}
+
+	salt, err := hex.DecodeString(record.Salt)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(record.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare(hashSecret(salt, parts[1]), hash) != 1 {
+		return nil, &ErrTokenUnknown{}
+	}
+
+	if record.expired(time.Now()) {
+		return nil, &ErrTokenExpired{record.Id}
+	}
+
+	return &Principal{
+		Name:    record.Name,
+		TokenId: record.Id,
+		Scopes:  record.Scopes,
+	}, nil
+}
+
+// persist writes the token file. Must be called with the write lock held.
+func (ts *TokenStore) persist() error {
+	if ts.path == "" {
+		return nil
+	}
+
+	stored := tokenFile{
+		Version: tokenFileVersion,
+		Tokens:  make([]*tokenRecord, 0, len(ts.tokens)),
+	}
+	for _, record := range ts.tokens {
+		stored.Tokens = append(stored.Tokens, record)
+	}
+
+	return util.WriteJSONFile(ts.path, &stored, 0600)
+}
+
+// hashSecret computes the salted hash of a token secret.
+func hashSecret(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// randomBytes reads n bytes from the system CSPRNG.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStore(t *testing.T, path string) *TokenStore {
+	ts, err := NewTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ts := newStore(t, path)
+
+	token, desc, err := ts.Create("ci", []Scope{ScopeConnect}, 0, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, desc.Id+".") {
+		t.Errorf("token %q does not start with its id %q", token, desc.Id)
+	}
+
+	principal, err := ts.Authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Name != "ci" || principal.TokenId != desc.Id || !principal.HasScope(ScopeConnect) {
+		t.Errorf("principal = %+v", principal)
+	}
+	if principal.HasScope(ScopeList) {
+		t.Error("connect token has the list scope")
+	}
+
+	for _, bad := range []string{"", desc.Id, desc.Id + ".wrong", "unknown." + strings.SplitN(token, ".", 2)[1]} {
+		if _, err := ts.Authenticate(bad); err == nil {
+			t.Errorf("token %q was accepted", bad)
+		} else if _, ok := err.(*ErrTokenUnknown); !ok {
+			t.Errorf("token %q: got %v, want ErrTokenUnknown", bad, err)
+		}
+	}
+
+	// Only a salted hash of the secret is persisted, and it still verifies
+	// once reloaded.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret := strings.SplitN(token, ".", 2)[1]; strings.Contains(string(data), secret) {
+		t.Error("token file contains the token secret")
+	}
+	if _, err := newStore(t, path).Authenticate(token); err != nil {
+		t.Errorf("token was not accepted after reloading: %v", err)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	ts := newStore(t, "")
+	token, desc, err := ts.Create("short", []Scope{ScopeList}, time.Millisecond, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.ExpiresAt == nil {
+		t.Fatal("token with a ttl has no expiry")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := ts.Authenticate(token); err == nil {
+		t.Error("expired token was accepted")
+	} else if _, ok := err.(*ErrTokenExpired); !ok {
+		t.Errorf("got %v, want ErrTokenExpired", err)
+	}
+
+	token, desc, err = ts.Create("forever", []Scope{ScopeList}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.ExpiresAt != nil {
+		t.Errorf("token without a ttl expires at %v", desc.ExpiresAt)
+	}
+	if _, err := ts.Authenticate(token); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ts := newStore(t, path)
+	token, desc, err := ts.Create("ci", []Scope{ScopeConnect}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Revoke(desc.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Authenticate(token); err == nil {
+		t.Error("revoked token was accepted")
+	}
+	if _, err := newStore(t, path).Authenticate(token); err == nil {
+		t.Error("revoked token was accepted after reloading")
+	}
+	if err := ts.Revoke(desc.Id); err == nil {
+		t.Error("revoking an unknown token succeeded")
+	} else if _, ok := err.(*ErrTokenUnknown); !ok {
+		t.Errorf("got %v, want ErrTokenUnknown", err)
+	}
+	if len(ts.List()) != 0 {
+		t.Errorf("revoked token is listed: %+v", ts.List())
+	}
+}
+
+func TestStaticToken(t *testing.T) {
+	ts := newStore(t, "")
+	ts.AddStaticToken("admin", "bootstrap", []Scope{ScopeAdmin})
+
+	principal, err := ts.Authenticate("bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, scope := range []Scope{ScopeList, ScopeConnect, ScopeRegister, ScopeAdmin} {
+		if !principal.HasScope(scope) {
+			t.Errorf("admin does not have the %s scope", scope)
+		}
+	}
+	if len(ts.List()) != 0 {
+		t.Error("static token is listed")
+	}
+}
+
+func TestCreateRequiresName(t *testing.T) {
+	if _, _, err := newStore(t, "").Create("", []Scope{ScopeList}, 0, ""); err == nil {
+		t.Error("token without a name was created")
+	}
+}
+
+func TestAdministrable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ts := newStore(t, path)
+	if ts.Administrable() {
+		t.Error("empty token store is administrable")
+	}
+	if _, _, err := ts.Create("ci", []Scope{ScopeConnect}, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ts.Administrable() {
+		t.Error("token store without an admin token is administrable")
+	}
+	if _, _, err := ts.Create("ops", []Scope{ScopeAdmin}, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !newStore(t, path).Administrable() {
+		t.Error("token file with an admin token is not administrable")
+	}
+
+	static := newStore(t, "")
+	static.AddStaticToken("admin", "bootstrap", []Scope{ScopeAdmin})
+	if !static.Administrable() {
+		t.Error("token store with a static admin token is not administrable")
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	if _, err := ParseScope("connect"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseScope("root"); err == nil {
+		t.Error("unknown scope was accepted")
+	}
+}
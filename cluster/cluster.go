@@ -0,0 +1,503 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util/websocketrwc"
+	"github.com/wrouesnel/go.log"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ConnectApiPath is the path nodes relay client connections to.
+	ConnectApiPath = "api/v1/cluster/connect"
+
+	// Headers authenticating a relayed connection.
+	NodeHeader      = "Callback-Cluster-Node"
+	TimestampHeader = "Callback-Cluster-Timestamp"
+	OriginHeader    = "Callback-Cluster-Origin"
+	SignatureHeader = "Callback-Cluster-Signature"
+
+	// maxClockSkew is how old (or new) a relayed connection's timestamp may be.
+	maxClockSkew = time.Minute
+)
+
+// Config configures a cluster node.
+type Config struct {
+	// NodeId uniquely names this node in the cluster.
+	NodeId string
+	// AdvertiseURL is the URL of this node's API which other nodes relay
+	// client connections to.
+	AdvertiseURL string
+	// Secret authenticates connections between nodes.
+	Secret string
+	// Heartbeat is how often the node refreshes its registry records. Records
+	// expire after three missed heartbeats.
+	Heartbeat time.Duration
+	// HandshakeTimeout bounds connecting to another node.
+	HandshakeTimeout time.Duration
+}
+
+// ErrNotHeld is returned when relaying to a callback session no live node holds.
+type ErrNotHeld struct {
+	callbackId string
+}
+
+func (err ErrNotHeld) Error() string {
+	return fmt.Sprintf("callback session not held by any node: %s", err.callbackId)
+}
+
+// ErrUnauthenticated is returned for relayed connections with a missing,
+// invalid or expired signature.
+type ErrUnauthenticated struct {
+	reason string
+}
+
+func (err ErrUnauthenticated) Error() string {
+	return "cluster authentication failed: " + err.reason
+}
+
+// event is the envelope for connection manager events published to the cluster.
+type event struct {
+	Node     string                           `json:"node"`
+	Callback *connman.CallbackConnectionEvent `json:"callback,omitempty"`
+	Client   *connman.ClientConnectionEvent   `json:"client,omitempty"`
+}
+
+// Node is the membership of a connection manager in a cluster. It implements
+// connman.Cluster.
+type Node struct {
+	config   Config
+	registry Registry
+	cm       *connman.ConnectionManager
+
+	// nodes is the last view of the live nodes (including this one).
+	nodes    map[string]NodeRecord
+	nodesMtx sync.RWMutex
+
+	// handedOver is non-zero while another process maintains the records of
+	// our node ID (see SetHandedOver).
+	handedOver int32
+}
+
+// NewNode joins cm to the cluster sharing registry.
+func NewNode(config Config, registry Registry, cm *connman.ConnectionManager) *Node {
+	n := &Node{
+		config:   config,
+		registry: registry,
+		cm:       cm,
+		nodes:    make(map[string]NodeRecord),
+	}
+	cm.SetCluster(n)
+	return n
+}
+
+func (n *Node) ttl() time.Duration {
+	return 3 * n.config.Heartbeat
+}
+
+// NodeId implements connman.Cluster.
+func (n *Node) NodeId() string {
+	return n.config.NodeId
+}
+
+// SetHandedOver stops (or resumes) the node writing its records to the
+// registry, as when a new process started by a listener handoff takes over
+// the node ID. The records then describe the new process, so they must not be
+// marked draining or have the sessions we close removed.
+func (n *Node) SetHandedOver(handedOver bool) {
+	var v int32
+	if handedOver {
+		v = 1
+	}
+	atomic.StoreInt32(&n.handedOver, v)
+}
+
+func (n *Node) isHandedOver() bool {
+	return atomic.LoadInt32(&n.handedOver) != 0
+}
+
+// liveNode returns the record of a live node.
+func (n *Node) liveNode(id string) (NodeRecord, bool) {
+	n.nodesMtx.RLock()
+	defer n.nodesMtx.RUnlock()
+	node, found := n.nodes[id]
+	return node, found
+}
+
+// LookupCallback implements connman.Cluster. Sessions held by draining or
+// failed nodes are not returned.
+func (n *Node) LookupCallback(callbackId string) (connman.CallbackSessionDesc, bool) {
+	desc, found, err := n.lookupCallback(callbackId)
+	if err != nil {
+		log.Errorln("Cluster registry lookup failed:", err)
+		return connman.CallbackSessionDesc{}, false
+	}
+	return desc, found
+}
+
+// CheckRemoteCallback implements connman.Cluster. Sessions migrating from
+// another node are not returned, so they can register here.
+func (n *Node) CheckRemoteCallback(callbackId string) (bool, error) {
+	desc, found, err := n.lookupCallback(callbackId)
+	return found && !desc.Migrating, err
+}
+
+func (n *Node) lookupCallback(callbackId string) (connman.CallbackSessionDesc, bool, error) {
+	session, found, err := n.registry.GetSession(callbackId)
+	if err != nil {
+		return connman.CallbackSessionDesc{}, false, err
+	}
+	if !found || session.NodeId == n.config.NodeId {
+		return connman.CallbackSessionDesc{}, false, nil
+	}
+	node, live := n.liveNode(session.NodeId)
+	if !live || node.Draining {
+		return connman.CallbackSessionDesc{}, false, nil
+	}
+	return session.Desc, true, nil
+}
+
+// RemoteCallbackSessions implements connman.Cluster.
+func (n *Node) RemoteCallbackSessions() map[string]connman.CallbackSessionDesc {
+	sessions, err := n.registry.Sessions()
+	if err != nil {
+		log.Errorln("Listing cluster sessions failed:", err)
+		return nil
+	}
+	ret := make(map[string]connman.CallbackSessionDesc, len(sessions))
+	for _, session := range sessions {
+		if session.NodeId == n.config.NodeId {
+			continue
+		}
+		if _, live := n.liveNode(session.NodeId); !live {
+			continue
+		}
+		ret[session.CallbackId] = session.Desc
+	}
+	return ret
+}
+
+// RemoteClientSessions implements connman.Cluster. The view is as of the last
+// heartbeat of each node.
+func (n *Node) RemoteClientSessions() []connman.ClientSessionDesc {
+	n.nodesMtx.RLock()
+	defer n.nodesMtx.RUnlock()
+
+	var ret []connman.ClientSessionDesc
+	for id, node := range n.nodes {
+		if id == n.config.NodeId {
+			continue
+		}
+		ret = append(ret, node.Clients...)
+	}
+	return ret
+}
+
+// DialCallback implements connman.Cluster by opening a signed websocket to the
+// node holding the callback session.
+func (n *Node) DialCallback(callbackId string, origin connman.SessionOrigin) (io.ReadWriteCloser, error) {
+	session, found, err := n.registry.GetSession(callbackId)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &ErrNotHeld{callbackId}
+	}
+	node, live := n.liveNode(session.NodeId)
+	if !live {
+		return nil, &ErrNotHeld{callbackId}
+	}
+
+	connectUrl, err := connectURL(node.URL, callbackId)
+	if err != nil {
+		return nil, err
+	}
+
+	originData, err := json.Marshal(&origin)
+	if err != nil {
+		return nil, err
+	}
+	encodedOrigin := base64.StdEncoding.EncodeToString(originData)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	headers := http.Header{}
+	headers.Set(NodeHeader, n.config.NodeId)
+	headers.Set(TimestampHeader, timestamp)
+	headers.Set(OriginHeader, encodedOrigin)
+	headers.Set(SignatureHeader, sign(n.config.Secret, n.config.NodeId, timestamp, callbackId, encodedOrigin))
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: n.config.HandshakeTimeout,
+	}
+	wconn, _, err := dialer.Dial(connectUrl, headers)
+	if err != nil {
+		return nil, err
+	}
+	return websocketrwc.WrapClientWebsocket(wconn)
+}
+
+// connectURL returns the websocket URL for relaying to callbackId at a node's
+// advertised URL.
+func connectURL(advertiseUrl string, callbackId string) (string, error) {
+	base, err := url.Parse(advertiseUrl)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	ref, err := url.Parse(ConnectApiPath + "/" + url.PathEscape(callbackId))
+	if err != nil {
+		return "", err
+	}
+	u := base.ResolveReference(ref)
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	return u.String(), nil
+}
+
+func sign(secret string, nodeId string, timestamp string, callbackId string, origin string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s|%s|%s|%s", nodeId, timestamp, callbackId, origin)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRelay authenticates a connection relayed from another node and
+// returns the origin of the client.
+func (n *Node) VerifyRelay(r *http.Request, callbackId string) (connman.SessionOrigin, error) {
+	nodeId := r.Header.Get(NodeHeader)
+	timestamp := r.Header.Get(TimestampHeader)
+	encodedOrigin := r.Header.Get(OriginHeader)
+	signature := r.Header.Get(SignatureHeader)
+
+	if nodeId == "" || timestamp == "" || encodedOrigin == "" || signature == "" {
+		return connman.SessionOrigin{}, &ErrUnauthenticated{"missing headers"}
+	}
+
+	expected := sign(n.config.Secret, nodeId, timestamp, callbackId, encodedOrigin)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return connman.SessionOrigin{}, &ErrUnauthenticated{"invalid signature"}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return connman.SessionOrigin{}, &ErrUnauthenticated{"invalid timestamp"}
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return connman.SessionOrigin{}, &ErrUnauthenticated{"expired timestamp"}
+	}
+
+	originData, err := base64.StdEncoding.DecodeString(encodedOrigin)
+	if err != nil {
+		return connman.SessionOrigin{}, &ErrUnauthenticated{"invalid origin"}
+	}
+	var origin connman.SessionOrigin
+	if err := json.Unmarshal(originData, &origin); err != nil {
+		return connman.SessionOrigin{}, &ErrUnauthenticated{"invalid origin"}
+	}
+	// The origin must name the relaying node so the connection is never relayed again.
+	origin.Node = nodeId
+	return origin, nil
+}
+
+// Run maintains the node's registry records and bridges connection manager
+// events with the cluster until stopCh closes. The node's records are removed
+// on exit.
+func (n *Node) Run(stopCh <-chan struct{}) {
+	callbackCh := n.cm.SubscribeCallbackEvents(64)
+	defer n.cm.UnsubscribeCallbackEvents(callbackCh)
+	clientCh := n.cm.SubscribeClientConnectionEvents(64)
+	defer n.cm.UnsubscribeClientConnectionEvents(clientCh)
+	eventCh := n.registry.Subscribe(stopCh)
+
+	n.heartbeat()
+	ticker := time.NewTicker(n.config.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			if n.isHandedOver() {
+				return
+			}
+			for callbackId := range n.cm.ListLocalCallbackSessions() {
+				if err := n.registry.DeleteSession(callbackId, n.config.NodeId); err != nil {
+					log.Errorln("Could not remove cluster session record:", err)
+				}
+			}
+			return
+		case <-ticker.C:
+			n.heartbeat()
+		case ev := <-callbackCh:
+			n.handleLocalCallbackEvent(ev)
+		case ev := <-clientCh:
+			// Only events for sessions on this node are published. Relayed
+			// events name the node they occurred on.
+			if ev.Node == n.config.NodeId {
+				n.publish(event{Node: n.config.NodeId, Client: &ev})
+			}
+		case data, ok := <-eventCh:
+			if !ok {
+				eventCh = nil
+				continue
+			}
+			n.handleClusterEvent(data)
+		}
+	}
+}
+
+func (n *Node) handleLocalCallbackEvent(ev connman.CallbackConnectionEvent) {
+	if ev.Node != n.config.NodeId {
+		return
+	}
+	if n.isHandedOver() {
+		n.publish(event{Node: n.config.NodeId, Callback: &ev})
+		return
+	}
+	switch ev.EventType {
+	case connman.EventDisconnected:
+		if err := n.registry.DeleteSession(ev.CallbackId, n.config.NodeId); err != nil {
+			log.Errorln("Could not remove cluster session record:", err)
+		}
+	default:
+		n.putSession(ev.CallbackId, ev.CallbackSessionDesc)
+	}
+	n.publish(event{Node: n.config.NodeId, Callback: &ev})
+}
+
+func (n *Node) handleClusterEvent(data []byte) {
+	var ev event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		log.Warnln("Ignoring invalid cluster event:", err)
+		return
+	}
+	if ev.Node == n.config.NodeId {
+		return
+	}
+	if ev.Callback != nil {
+		n.cm.RelayCallbackEvent(*ev.Callback)
+	}
+	if ev.Client != nil {
+		n.cm.RelayClientEvent(*ev.Client)
+	}
+}
+
+func (n *Node) publish(ev event) {
+	data, err := json.Marshal(&ev)
+	if err != nil {
+		log.Errorln("Could not encode cluster event:", err)
+		return
+	}
+	if err := n.registry.Publish(data); err != nil {
+		log.Errorln("Could not publish cluster event:", err)
+	}
+}
+
+func (n *Node) putSession(callbackId string, desc connman.CallbackSessionDesc) {
+	if err := n.PutCallback(callbackId, desc); err != nil {
+		log.Errorln("Could not update cluster session record:", err)
+	}
+}
+
+// PutCallback implements connman.Cluster. Nothing is written once the node
+// has been handed over.
+func (n *Node) PutCallback(callbackId string, desc connman.CallbackSessionDesc) error {
+	if n.isHandedOver() {
+		return nil
+	}
+	record := SessionRecord{
+		CallbackId: callbackId,
+		NodeId:     n.config.NodeId,
+		Desc:       desc,
+		UpdatedAt:  time.Now(),
+	}
+	return n.registry.PutSession(record, n.ttl())
+}
+
+// GetLease implements connman.Cluster.
+func (n *Node) GetLease(callbackId string) (*connman.Lease, error) {
+	lease, found, err := n.registry.GetLease(callbackId)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// SwapLease implements connman.Cluster.
+func (n *Node) SwapLease(callbackId string, current *connman.Lease, lease *connman.Lease) (bool, error) {
+	return n.registry.SwapLease(callbackId, current, lease)
+}
+
+// heartbeat refreshes this node's records and the view of other nodes. Once
+// handed over only the view is refreshed.
+func (n *Node) heartbeat() {
+	handedOver := n.isHandedOver()
+	self := NodeRecord{
+		Id:        n.config.NodeId,
+		URL:       n.config.AdvertiseURL,
+		Draining:  n.cm.Draining(),
+		Clients:   n.cm.ListLocalClientSessions(),
+		UpdatedAt: time.Now(),
+	}
+	if !handedOver {
+		if err := n.registry.PutNode(self, n.ttl()); err != nil {
+			log.Errorln("Cluster heartbeat failed:", err)
+			return
+		}
+	}
+
+	nodes, err := n.registry.Nodes()
+	if err != nil {
+		log.Errorln("Listing cluster nodes failed:", err)
+		return
+	}
+	view := make(map[string]NodeRecord, len(nodes))
+	for _, node := range nodes {
+		view[node.Id] = node
+	}
+	if !handedOver {
+		view[self.Id] = self
+	}
+
+	n.nodesMtx.Lock()
+	n.nodes = view
+	n.nodesMtx.Unlock()
+
+	if handedOver {
+		return
+	}
+
+	for callbackId, desc := range n.cm.ListLocalCallbackSessions() {
+		// Do not take over a session record held by another live node.
+		session, found, err := n.registry.GetSession(callbackId)
+		if err != nil {
+			log.Errorln("Cluster registry lookup failed:", err)
+			continue
+		}
+		if found && session.NodeId != n.config.NodeId {
+			if owner, live := view[session.NodeId]; live && !owner.Draining {
+				continue
+			}
+		}
+		n.putSession(callbackId, desc)
+	}
+}
@@ -0,0 +1,188 @@
+package cluster
+
+import (
+	"encoding/json"
+	"github.com/wrouesnel/callback/connman"
+	"testing"
+	"time"
+)
+
+func newTestNode(registry Registry, nodeId string) *Node {
+	n := NewNode(Config{NodeId: nodeId, Heartbeat: time.Minute}, registry, connman.NewConnectionManager(1024))
+	n.heartbeat()
+	return n
+}
+
+// TestCheckRemoteCallbackMigrating checks a session held by another node may
+// register here only while it is migrating.
+func TestCheckRemoteCallbackMigrating(t *testing.T) {
+	registry := NewMemoryRegistry()
+	node1 := newTestNode(registry, "node1")
+	node2 := newTestNode(registry, "node2")
+
+	if err := node1.PutCallback("host1", connman.CallbackSessionDesc{Node: "node1"}); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := node2.CheckRemoteCallback("host1"); err != nil || !held {
+		t.Errorf("CheckRemoteCallback = %v, %v, want held by node1", held, err)
+	}
+
+	if err := node1.PutCallback("host1", connman.CallbackSessionDesc{Node: "node1", Migrating: true}); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := node2.CheckRemoteCallback("host1"); err != nil || held {
+		t.Errorf("CheckRemoteCallback = %v, %v, want a migrating session not to be held", held, err)
+	}
+	// Clients are still relayed to the session until it has migrated.
+	if _, found := node2.LookupCallback("host1"); !found {
+		t.Error("LookupCallback did not find the migrating session")
+	}
+}
+
+// TestHandedOverNode checks a process which has handed its node ID over to a
+// new process leaves the records the new process writes alone.
+func TestHandedOverNode(t *testing.T) {
+	registry := NewMemoryRegistry()
+	parent := newTestNode(registry, "node1")
+	parent.SetHandedOver(true)
+	child := newTestNode(registry, "node1")
+
+	// The callback re-registers with the new process, then its old session
+	// with the parent ends.
+	if err := child.PutCallback("host1", connman.CallbackSessionDesc{Node: "node1"}); err != nil {
+		t.Fatal(err)
+	}
+	parent.handleLocalCallbackEvent(connman.CallbackConnectionEvent{
+		ConnManEventHeader:  connman.ConnManEventHeader{EventType: connman.EventDisconnected},
+		CallbackId:          "host1",
+		CallbackSessionDesc: connman.CallbackSessionDesc{Node: "node1"},
+	})
+	if err := parent.PutCallback("host1", connman.CallbackSessionDesc{Node: "node1", Migrating: true}); err != nil {
+		t.Fatal(err)
+	}
+	session, found, err := registry.GetSession("host1")
+	if err != nil || !found {
+		t.Fatalf("GetSession = %v, %v, want the record of the new process", found, err)
+	}
+	if session.Desc.Migrating {
+		t.Error("the parent overwrote the record of the new process")
+	}
+
+	// The parent drains without marking the node draining.
+	parent.cm.Drain(time.Second)
+	parent.heartbeat()
+	nodes, err := registry.Nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Draining {
+		t.Errorf("Nodes = %+v, want node1 not draining", nodes)
+	}
+
+	// A node which has not been handed over removes its records.
+	parent.SetHandedOver(false)
+	parent.handleLocalCallbackEvent(connman.CallbackConnectionEvent{
+		ConnManEventHeader:  connman.ConnManEventHeader{EventType: connman.EventDisconnected},
+		CallbackId:          "host1",
+		CallbackSessionDesc: connman.CallbackSessionDesc{Node: "node1"},
+	})
+	if _, found, _ := registry.GetSession("host1"); found {
+		t.Error("the session record was not removed")
+	}
+}
+
+// TestClusterLeases checks a lease granted by one node is enforced, and may be
+// renewed and released, through another.
+func TestClusterLeases(t *testing.T) {
+	registry := NewMemoryRegistry()
+	node1 := newTestNode(registry, "node1")
+	node2 := newTestNode(registry, "node2")
+	alice := connman.SessionOrigin{RemoteAddr: "192.0.2.1:1234", Principal: "alice"}
+	bob := connman.SessionOrigin{RemoteAddr: "192.0.2.2:1234", Principal: "bob"}
+
+	lease, err := node1.cm.AcquireLease("host1", alice, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := node2.cm.GetLease("host1"); !ok || found.Holder != "alice" {
+		t.Errorf("node2 has lease %+v, %v, want the lease of alice", found, ok)
+	}
+	if err := node2.cm.CheckClientConnection("host1", bob); err == nil {
+		t.Error("node2 permitted bob to connect to host1 leased by alice")
+	} else if _, ok := err.(*connman.ErrLeased); !ok {
+		t.Errorf("CheckClientConnection returned %v, want ErrLeased", err)
+	}
+	if _, err := node2.cm.AcquireLease("host1", bob, time.Minute); err == nil {
+		t.Error("node2 granted bob the lease held by alice")
+	}
+
+	renewed, err := node2.cm.AcquireLease("host1", alice, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed.AcquiredAt.Equal(lease.AcquiredAt) || !renewed.ExpiresAt.After(lease.ExpiresAt) {
+		t.Errorf("renewed lease = %+v, want %+v extended", renewed, lease)
+	}
+
+	if _, err := node2.cm.ReleaseLease("host1", bob, false); err == nil {
+		t.Error("bob released the lease of alice")
+	}
+	if _, err := node2.cm.ReleaseLease("host1", alice, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node1.cm.GetLease("host1"); ok {
+		t.Error("lease released through node2 was found by node1")
+	}
+	if _, err := node1.cm.AcquireLease("host1", bob, time.Minute); err != nil {
+		t.Errorf("bob could not lease host1 after it was released: %v", err)
+	}
+}
+
+func TestMemoryRegistrySwapLease(t *testing.T) {
+	registry := NewMemoryRegistry()
+	now := time.Now()
+	first := &connman.Lease{Holder: "alice", AcquiredAt: now, ExpiresAt: now.Add(time.Minute)}
+	second := &connman.Lease{Holder: "bob", AcquiredAt: now, ExpiresAt: now.Add(time.Minute)}
+
+	if swapped, err := registry.SwapLease("host1", nil, first); err != nil || !swapped {
+		t.Fatalf("SwapLease = %v, %v, want the first lease recorded", swapped, err)
+	}
+	// Another node recorded a lease since none was seen.
+	if swapped, _ := registry.SwapLease("host1", nil, second); swapped {
+		t.Error("SwapLease replaced a lease which was not current")
+	}
+	if swapped, _ := registry.SwapLease("host1", first, nil); !swapped {
+		t.Error("SwapLease did not remove the current lease")
+	}
+	if _, found, _ := registry.GetLease("host1"); found {
+		t.Error("removed lease was found")
+	}
+
+	expired := &connman.Lease{Holder: "alice", AcquiredAt: now, ExpiresAt: now.Add(-time.Second)}
+	registry.SwapLease("host2", nil, expired)
+	if _, found, _ := registry.GetLease("host2"); found {
+		t.Error("expired lease was found")
+	}
+}
+
+// TestEncodeLease checks a lease read back from Redis encodes to the value it
+// was stored as, which SwapLease compares.
+func TestEncodeLease(t *testing.T) {
+	zone := time.FixedZone("AEDT", 11*60*60)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 600, zone)
+	value, err := encodeLease(&connman.Lease{Holder: "alice", AcquiredAt: now, ExpiresAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lease connman.Lease
+	if err := json.Unmarshal([]byte(value), &lease); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := encodeLease(&lease); again != value {
+		t.Errorf("lease read back encodes to %s, want %s", again, value)
+	}
+	if blank, _ := encodeLease(nil); blank != "" {
+		t.Errorf("no lease encodes to %q", blank)
+	}
+}
@@ -0,0 +1,300 @@
+package cluster
+
+import (
+	"encoding/json"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/go.log"
+	"strconv"
+	"time"
+)
+
+const (
+	// redisKeyPrefix namespaces the keys of the registry.
+	redisKeyPrefix = "callback:"
+	// redisEventChannel is the pub/sub channel events are published on.
+	redisEventChannel = redisKeyPrefix + "events"
+
+	// redisDeleteSession deletes a session key only if it is held by the given node.
+	redisDeleteSession = `local v = redis.call('GET', KEYS[1])
+if v and cjson.decode(v).node_id == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+	// redisSwapLease replaces a lease key only if it still holds ARGV[1]
+	// (blank if there was none), deleting it if ARGV[2] is blank.
+	redisSwapLease = `local v = redis.call('GET', KEYS[1])
+if (v or '') ~= ARGV[1] then
+	return 0
+end
+if ARGV[2] == '' then
+	redis.call('DEL', KEYS[1])
+else
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+end
+return 1`
+)
+
+// RedisRegistry is a Registry stored in a Redis server (or any server which
+// speaks the Redis protocol and supports Lua scripting).
+type RedisRegistry struct {
+	pool *respPool
+}
+
+// NewRedisRegistry connects to the Redis server at url
+// (redis://[:password@]host[:port][/db]).
+func NewRedisRegistry(url string) (*RedisRegistry, error) {
+	opts, err := parseRedisURL(url)
+	if err != nil {
+		return nil, err
+	}
+	r := &RedisRegistry{
+		pool: &respPool{opts: opts, timeout: 5 * time.Second},
+	}
+	// Fail early if the server is unreachable.
+	if _, err := r.pool.do("PING"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func nodeKey(id string) string {
+	return redisKeyPrefix + "node:" + id
+}
+
+func sessionKey(callbackId string) string {
+	return redisKeyPrefix + "session:" + callbackId
+}
+
+func leaseKey(callbackId string) string {
+	return redisKeyPrefix + "lease:" + callbackId
+}
+
+// encodeLease returns the value of a lease key, or blank for nil. Times are
+// stored in UTC, so a lease read back encodes to the same value.
+func encodeLease(lease *connman.Lease) (string, error) {
+	if lease == nil {
+		return "", nil
+	}
+	stored := *lease
+	stored.AcquiredAt = stored.AcquiredAt.UTC()
+	stored.ExpiresAt = stored.ExpiresAt.UTC()
+	data, err := json.Marshal(stored)
+	return string(data), err
+}
+
+func (r *RedisRegistry) set(key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = r.pool.do("SET", key, string(data), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+// scan returns the values of all keys matching pattern.
+func (r *RedisRegistry) scan(pattern string) ([]string, error) {
+	var values []string
+	cursor := "0"
+	for {
+		reply, err := r.pool.do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, &ErrRedis{"unexpected SCAN reply"}
+		}
+		cursor, _ = parts[0].(string)
+		keys, _ := parts[1].([]interface{})
+
+		if len(keys) > 0 {
+			args := []string{"MGET"}
+			for _, key := range keys {
+				if s, ok := key.(string); ok {
+					args = append(args, s)
+				}
+			}
+			reply, err := r.pool.do(args...)
+			if err != nil {
+				return nil, err
+			}
+			items, _ := reply.([]interface{})
+			for _, item := range items {
+				// Keys which expired since the scan are nil.
+				if s, ok := item.(string); ok {
+					values = append(values, s)
+				}
+			}
+		}
+
+		if cursor == "0" || cursor == "" {
+			return values, nil
+		}
+	}
+}
+
+func (r *RedisRegistry) PutNode(node NodeRecord, ttl time.Duration) error {
+	return r.set(nodeKey(node.Id), node, ttl)
+}
+
+func (r *RedisRegistry) Nodes() ([]NodeRecord, error) {
+	values, err := r.scan(nodeKey("*"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]NodeRecord, 0, len(values))
+	for _, value := range values {
+		var node NodeRecord
+		if err := json.Unmarshal([]byte(value), &node); err != nil {
+			log.Warnln("Ignoring invalid cluster node record:", err)
+			continue
+		}
+		ret = append(ret, node)
+	}
+	return ret, nil
+}
+
+func (r *RedisRegistry) PutSession(session SessionRecord, ttl time.Duration) error {
+	return r.set(sessionKey(session.CallbackId), session, ttl)
+}
+
+func (r *RedisRegistry) DeleteSession(callbackId string, nodeId string) error {
+	_, err := r.pool.do("EVAL", redisDeleteSession, "1", sessionKey(callbackId), nodeId)
+	return err
+}
+
+func (r *RedisRegistry) GetSession(callbackId string) (SessionRecord, bool, error) {
+	reply, err := r.pool.do("GET", sessionKey(callbackId))
+	if err == errNil {
+		return SessionRecord{}, false, nil
+	}
+	if err != nil {
+		return SessionRecord{}, false, err
+	}
+	var session SessionRecord
+	if err := json.Unmarshal([]byte(reply.(string)), &session); err != nil {
+		return SessionRecord{}, false, err
+	}
+	return session, true, nil
+}
+
+func (r *RedisRegistry) Sessions() ([]SessionRecord, error) {
+	values, err := r.scan(sessionKey("*"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]SessionRecord, 0, len(values))
+	for _, value := range values {
+		var session SessionRecord
+		if err := json.Unmarshal([]byte(value), &session); err != nil {
+			log.Warnln("Ignoring invalid cluster session record:", err)
+			continue
+		}
+		ret = append(ret, session)
+	}
+	return ret, nil
+}
+
+func (r *RedisRegistry) GetLease(callbackId string) (connman.Lease, bool, error) {
+	reply, err := r.pool.do("GET", leaseKey(callbackId))
+	if err == errNil {
+		return connman.Lease{}, false, nil
+	}
+	if err != nil {
+		return connman.Lease{}, false, err
+	}
+	var lease connman.Lease
+	if err := json.Unmarshal([]byte(reply.(string)), &lease); err != nil {
+		return connman.Lease{}, false, err
+	}
+	return lease, true, nil
+}
+
+func (r *RedisRegistry) SwapLease(callbackId string, current *connman.Lease, lease *connman.Lease) (bool, error) {
+	currentValue, err := encodeLease(current)
+	if err != nil {
+		return false, err
+	}
+	value, err := encodeLease(lease)
+	if err != nil {
+		return false, err
+	}
+	// Expired leases are removed by the server.
+	ttl := int64(1)
+	if lease != nil && time.Until(lease.ExpiresAt) > time.Millisecond {
+		ttl = int64(time.Until(lease.ExpiresAt) / time.Millisecond)
+	}
+	reply, err := r.pool.do("EVAL", redisSwapLease, "1", leaseKey(callbackId), currentValue, value, strconv.FormatInt(ttl, 10))
+	if err != nil {
+		return false, err
+	}
+	swapped, _ := reply.(int64)
+	return swapped == 1, nil
+}
+
+func (r *RedisRegistry) Publish(data []byte) error {
+	_, err := r.pool.do("PUBLISH", redisEventChannel, string(data))
+	return err
+}
+
+// Subscribe holds a dedicated connection subscribed to the event channel,
+// reconnecting if it fails. Events published while disconnected are lost.
+func (r *RedisRegistry) Subscribe(stopCh <-chan struct{}) <-chan []byte {
+	ch := make(chan []byte, 64)
+
+	go func() {
+		defer close(ch)
+		for {
+			conn, err := dialRESP(r.pool.opts, r.pool.timeout)
+			if err == nil {
+				go func() {
+					<-stopCh
+					conn.Close()
+				}()
+				err = r.receiveEvents(conn, ch)
+				conn.Close()
+			}
+
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(time.Second):
+				log.Warnln("Cluster event subscription failed, reconnecting:", err)
+			}
+		}
+	}()
+	return ch
+}
+
+func (r *RedisRegistry) receiveEvents(conn *respConn, ch chan<- []byte) error {
+	if err := conn.send("SUBSCRIBE", redisEventChannel); err != nil {
+		return err
+	}
+	for {
+		reply, err := conn.receive()
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		if data, ok := parts[2].(string); ok {
+			select {
+			case ch <- []byte(data):
+			default:
+			}
+		}
+	}
+}
+
+func (r *RedisRegistry) Close() error {
+	r.pool.mtx.Lock()
+	defer r.pool.mtx.Unlock()
+	for _, c := range r.pool.idle {
+		c.Close()
+	}
+	r.pool.idle = nil
+	return nil
+}
@@ -0,0 +1,260 @@
+// cluster package implements membership of a group of callback servers which
+// share a session registry, so clients may connect to any node.
+
+package cluster
+
+import (
+	"github.com/wrouesnel/callback/connman"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeRecord is the state a node advertises to the cluster.
+type NodeRecord struct {
+	Id string `json:"id"`
+	// URL other nodes relay client connections to.
+	URL string `json:"url"`
+	// Draining nodes accept no new sessions.
+	Draining bool `json:"draining"`
+	// Client sessions proxied by the node.
+	Clients   []connman.ClientSessionDesc `json:"clients"`
+	UpdatedAt time.Time                   `json:"updated_at"`
+}
+
+// SessionRecord records which node holds a callback session.
+type SessionRecord struct {
+	CallbackId string                      `json:"callback_id"`
+	NodeId     string                      `json:"node_id"`
+	Desc       connman.CallbackSessionDesc `json:"desc"`
+	UpdatedAt  time.Time                   `json:"updated_at"`
+}
+
+// Registry is the shared store of cluster state. Records expire unless they
+// are put again within their TTL, so the records of nodes which fail are
+// removed.
+type Registry interface {
+	// PutNode creates or refreshes a node record.
+	PutNode(node NodeRecord, ttl time.Duration) error
+	// Nodes returns all live node records.
+	Nodes() ([]NodeRecord, error)
+	// PutSession creates or refreshes a session record.
+	PutSession(session SessionRecord, ttl time.Duration) error
+	// DeleteSession deletes a session record if it is held by nodeId.
+	DeleteSession(callbackId string, nodeId string) error
+	// GetSession returns the session record for callbackId.
+	GetSession(callbackId string) (SessionRecord, bool, error)
+	// Sessions returns all session records.
+	Sessions() ([]SessionRecord, error)
+	// GetLease returns the lease of callbackId. Leases are removed once they
+	// expire.
+	GetLease(callbackId string) (connman.Lease, bool, error)
+	// SwapLease replaces the lease of callbackId with lease, or deletes it if
+	// nil, only if the lease recorded is still current (nil for none). It
+	// returns false if it was not.
+	SwapLease(callbackId string, current *connman.Lease, lease *connman.Lease) (bool, error)
+	// Publish sends an event to every subscribed node, including this one.
+	Publish(data []byte) error
+	// Subscribe returns a channel of published events which is closed after
+	// stopCh closes.
+	Subscribe(stopCh <-chan struct{}) <-chan []byte
+	// Close releases resources held by the registry.
+	Close() error
+}
+
+// NewRegistry returns the registry named by url: "memory" or a redis:// URL.
+func NewRegistry(url string) (Registry, error) {
+	if url == "memory" {
+		return NewMemoryRegistry(), nil
+	}
+	if strings.HasPrefix(url, "redis://") {
+		return NewRedisRegistry(url)
+	}
+	return nil, &ErrUnknownRegistry{url}
+}
+
+// ErrUnknownRegistry is returned for unrecognised registry URLs.
+type ErrUnknownRegistry struct {
+	url string
+}
+
+func (err ErrUnknownRegistry) Error() string {
+	return "unknown cluster registry: " + err.url
+}
+
+type memoryNode struct {
+	record    NodeRecord
+	expiresAt time.Time
+}
+
+type memorySession struct {
+	record    SessionRecord
+	expiresAt time.Time
+}
+
+// sameLease returns true if a and b are the same lease, or both nil.
+func sameLease(a *connman.Lease, b *connman.Lease) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Holder == b.Holder && a.AcquiredAt.Equal(b.AcquiredAt) && a.ExpiresAt.Equal(b.ExpiresAt)
+}
+
+// MemoryRegistry is an in-process Registry. Nodes in the same process may
+// share one, which makes it a stand-in for a Redis server in development.
+type MemoryRegistry struct {
+	nodes       map[string]memoryNode
+	sessions    map[string]memorySession
+	leases      map[string]connman.Lease
+	subscribers map[chan []byte]struct{}
+	mtx         sync.Mutex
+}
+
+// NewMemoryRegistry returns an empty MemoryRegistry.
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		nodes:       make(map[string]memoryNode),
+		sessions:    make(map[string]memorySession),
+		leases:      make(map[string]connman.Lease),
+		subscribers: make(map[chan []byte]struct{}),
+	}
+}
+
+func (m *MemoryRegistry) PutNode(node NodeRecord, ttl time.Duration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.nodes[node.Id] = memoryNode{node, time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *MemoryRegistry) Nodes() ([]NodeRecord, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := time.Now()
+	ret := make([]NodeRecord, 0, len(m.nodes))
+	for id, node := range m.nodes {
+		if now.After(node.expiresAt) {
+			delete(m.nodes, id)
+			continue
+		}
+		ret = append(ret, node.record)
+	}
+	return ret, nil
+}
+
+func (m *MemoryRegistry) PutSession(session SessionRecord, ttl time.Duration) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.sessions[session.CallbackId] = memorySession{session, time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *MemoryRegistry) DeleteSession(callbackId string, nodeId string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if session, found := m.sessions[callbackId]; found && session.record.NodeId == nodeId {
+		delete(m.sessions, callbackId)
+	}
+	return nil
+}
+
+func (m *MemoryRegistry) GetSession(callbackId string) (SessionRecord, bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	session, found := m.sessions[callbackId]
+	if !found {
+		return SessionRecord{}, false, nil
+	}
+	if time.Now().After(session.expiresAt) {
+		delete(m.sessions, callbackId)
+		return SessionRecord{}, false, nil
+	}
+	return session.record, true, nil
+}
+
+func (m *MemoryRegistry) Sessions() ([]SessionRecord, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := time.Now()
+	ret := make([]SessionRecord, 0, len(m.sessions))
+	for id, session := range m.sessions {
+		if now.After(session.expiresAt) {
+			delete(m.sessions, id)
+			continue
+		}
+		ret = append(ret, session.record)
+	}
+	return ret, nil
+}
+
+// lease returns the unexpired lease of callbackId. Must be called with mtx held.
+func (m *MemoryRegistry) lease(callbackId string) (connman.Lease, bool) {
+	lease, found := m.leases[callbackId]
+	if found && !time.Now().Before(lease.ExpiresAt) {
+		delete(m.leases, callbackId)
+		return connman.Lease{}, false
+	}
+	return lease, found
+}
+
+func (m *MemoryRegistry) GetLease(callbackId string) (connman.Lease, bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	lease, found := m.lease(callbackId)
+	return lease, found, nil
+}
+
+func (m *MemoryRegistry) SwapLease(callbackId string, current *connman.Lease, lease *connman.Lease) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var recorded *connman.Lease
+	if existing, found := m.lease(callbackId); found {
+		recorded = &existing
+	}
+	if !sameLease(recorded, current) {
+		return false, nil
+	}
+	if lease == nil {
+		delete(m.leases, callbackId)
+	} else {
+		m.leases[callbackId] = *lease
+	}
+	return true, nil
+}
+
+// Publish delivers data to each subscriber. Slow subscribers miss events.
+func (m *MemoryRegistry) Publish(data []byte) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for sub := range m.subscribers {
+		select {
+		case sub <- data:
+		default:
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRegistry) Subscribe(stopCh <-chan struct{}) <-chan []byte {
+	ch := make(chan []byte, 64)
+	m.mtx.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mtx.Unlock()
+
+	go func() {
+		<-stopCh
+		m.mtx.Lock()
+		delete(m.subscribers, ch)
+		m.mtx.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *MemoryRegistry) Close() error {
+	return nil
+}
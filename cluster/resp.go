@@ -0,0 +1,214 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRedis is an error reply from a Redis server.
+type ErrRedis struct {
+	msg string
+}
+
+func (err ErrRedis) Error() string {
+	return "redis: " + err.msg
+}
+
+// errNil is returned for nil replies.
+var errNil = errors.New("redis: nil reply")
+
+// respConn is a minimal client for the Redis serialization protocol (RESP),
+// sufficient for the commands the registry uses. It is not safe for
+// concurrent use.
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisOptions are parsed from a redis:// URL.
+type redisOptions struct {
+	addr     string
+	password string
+	db       int
+}
+
+// parseRedisURL parses redis://[:password@]host[:port][/db].
+func parseRedisURL(s string) (redisOptions, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redisOptions{}, err
+	}
+	if u.Scheme != "redis" {
+		return redisOptions{}, fmt.Errorf("unsupported registry URL scheme: %q", u.Scheme)
+	}
+
+	opts := redisOptions{addr: u.Host}
+	if u.Port() == "" {
+		opts.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		if password, found := u.User.Password(); found {
+			opts.password = password
+		} else {
+			opts.password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		opts.db, err = strconv.Atoi(db)
+		if err != nil {
+			return redisOptions{}, fmt.Errorf("invalid redis database: %q", db)
+		}
+	}
+	return opts, nil
+}
+
+func dialRESP(opts redisOptions, timeout time.Duration) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", opts.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+
+	if opts.password != "" {
+		if _, err := c.do("AUTH", opts.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if opts.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(opts.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *respConn) Close() error {
+	return c.conn.Close()
+}
+
+// send writes a command without waiting for the reply.
+func (c *respConn) send(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return c.w.Flush()
+}
+
+// do sends a command and reads its reply.
+func (c *respConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.receive()
+}
+
+// receive reads a reply. Strings are returned as string, integers as int64,
+// arrays as []interface{} and nil replies as errNil.
+func (c *respConn) receive() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, &ErrRedis{line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := c.receive()
+			if err != nil && err != errNil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply: %q", line)
+	}
+}
+
+// respPool shares connections between concurrent callers.
+type respPool struct {
+	opts    redisOptions
+	timeout time.Duration
+	idle    []*respConn
+	mtx     sync.Mutex
+}
+
+// do runs a command on a pooled connection. Connections which fail are
+// discarded.
+func (p *respPool) do(args ...string) (interface{}, error) {
+	p.mtx.Lock()
+	var c *respConn
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mtx.Unlock()
+
+	if c == nil {
+		var err error
+		if c, err = dialRESP(p.opts, p.timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(p.timeout))
+	reply, err := c.do(args...)
+	if err != nil && err != errNil {
+		if _, ok := err.(*ErrRedis); !ok {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	p.mtx.Lock()
+	p.idle = append(p.idle, c)
+	p.mtx.Unlock()
+	return reply, err
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/wrouesnel/callback/control"
 	"github.com/wrouesnel/callback/util"
 	"github.com/wrouesnel/callback/util/websocketrwc"
 	"github.com/wrouesnel/go.log"
@@ -33,6 +34,7 @@ var (
 
 	basicUser = app.Flag("http.user", "Basic Authentication User to use for connection").Envar("CALLBACKPROXY_USER").String()
 	basicPassword = app.Flag("http.password", "Basic Authentication Password to use for connection").Envar("CALLBACKPROXY_PASSWORD").String()
+	apiToken      = app.Flag("token", "API token to authenticate to the callback server with").Envar("CALLBACK_TOKEN").String()
 
 	stripSuffix = app.Flag("strip-suffix", "Suffix to remove from the supplied callback ID").String()
 	stripPrefix = app.Flag("strip-prefix", "Prefix to remove from the supplied callback ID").String()
@@ -40,6 +42,7 @@ var (
 	inputCallbackId = app.Arg("callbackId", "ID of the endpoint on the callback server to connect to").String()
 
 	proxyBufferSize = app.Flag("proxy.buffer-size", "Size in bytes of connection buffers").Default("1024").Int()
+	maxMessageSize  = app.Flag("proxy.max-message-size", "Maximum size in bytes of a websocket message (0 is unlimited)").Default("1048576").Int64()
 
 	loglevel  = app.Flag("log-level", "Logging Level").Default("info").String()
 	logformat = app.Flag("log-format", "If set use a syslog logger or JSON logging. Example: logger:syslog?appname=bob&local=7 or logger:stdout?json=true. Defaults to stderr.").Default("logger:stderr").String()
@@ -68,6 +71,8 @@ func main() {
 		log.Fatalln("Cannot use a blank id")
 	}
 
+	websocketrwc.ReadLimit = *maxMessageSize
+
 	callbackId := *inputCallbackId
 	// Remove the given suffix
 	callbackId = strings.TrimSuffix(callbackId, *stripSuffix)
@@ -123,6 +128,12 @@ func main() {
 		log.Debugln("Setting HTTP basic auth.")
 		reqHeaders.Set("Authorization", "Basic " + basicAuthEncode(*basicUser, *basicPassword) )
 	}
+	if *apiToken != "" {
+		log.Debugln("Setting API token.")
+		reqHeaders.Set("Authorization", "Bearer "+*apiToken)
+	}
+	// Control messages warn of the server closing the session.
+	reqHeaders.Set(control.CapabilitiesHeader, control.CapabilityControl)
 
 	wconn, _, err := wDialer.Dial(apiUri.String(), reqHeaders)
 	if err != nil {
@@ -137,6 +148,17 @@ func main() {
 
 	log := log.With("remote_addr", wconn.RemoteAddr())
 
+	rwc.SetControlHandler(func(data []byte) {
+		msg, derr := control.Decode(data)
+		if derr != nil {
+			log.Errorln("Could not decode control message:", derr)
+			return
+		}
+		if msg.Type == control.MessageWarning {
+			log.Warnln("Server warning:", msg.Reason)
+		}
+	})
+
 	stdio := util.NewReadWriteCloser(os.Stdin, os.Stdout, func() error {
 		log.Infoln("Close called on stdio")
 		return nil
@@ -149,7 +171,16 @@ func main() {
 	go func() {
 		select {
 		case resultErr := <-resultCh:
-			if resultErr != nil {
+			if closeErr, ok := resultErr.(*websocket.CloseError); ok {
+				// The server tells us why it ended the session.
+				if closeErr.Code == websocket.CloseNormalClosure || closeErr.Code == websocket.CloseGoingAway {
+					log.Infoln("Connection closed by server:", closeErr.Text)
+					exitCh <- 0
+				} else {
+					log.Errorln("Connection closed by server:", closeErr.Text)
+					exitCh <- 1
+				}
+			} else if resultErr != nil {
 				if resultErr != io.EOF {
 					log.Errorln("Connection closed with error:", resultErr)
 					exitCh <- 1
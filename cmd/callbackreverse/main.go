@@ -5,17 +5,21 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
+	"github.com/wrouesnel/callback/control"
 	"github.com/wrouesnel/callback/util"
 	"github.com/wrouesnel/callback/util/websocketrwc"
 	"github.com/wrouesnel/go.log"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -25,6 +29,8 @@ var Version = "0.0.0.dev"
 
 const (
 	CallbackApiPath = "api/v1/callback"
+	// AutoId asks the server to allocate the callback ID.
+	AutoId = "auto"
 )
 
 var (
@@ -32,19 +38,36 @@ var (
 
 	callbackServer = app.Flag("server", "Callback Server to connect to").URL()
 	connectTimeout = app.Flag("timeout", "Connection timeout").Default("5s").Duration()
+	apiToken       = app.Flag("token", "API token to authenticate to the callback server with").Envar("CALLBACK_TOKEN").String()
 
 	forwardingAddress = app.Flag("connect", "Address and Port to forward to").String()
-	callbackId        = app.Flag("id", "Callback ID to register as").String()
+	callbackId        = app.Flag("id", "Callback ID to register as. \"auto\" or a pattern such as ci-* asks the server to allocate one").String()
+	idFile            = app.Flag("id-file", "File to write the registered callback ID to").String()
+	labels            = app.Flag("label", "Label to report for the callback session (repeatable)").PlaceHolder("KEY=VALUE").StringMap()
+
+	migrateAllow = app.Flag("migrate.allow", "Host pattern of servers the server may ask us to register with instead (repeatable). Defaults to the host of --server").Strings()
 
 	forever          = app.Flag("forever", "Automatically reconnect on disconnect").Default("true").Bool()
 	foreverReconnect = app.Flag("reconnect-interval", "Reconnect interval").Default("1s").Duration()
 
 	proxyBufferSize = app.Flag("proxy.buffer-size", "Size in bytes of connection buffers").Default("1024").Int()
+	maxMessageSize  = app.Flag("proxy.max-message-size", "Maximum size in bytes of a websocket message (0 is unlimited)").Default("1048576").Int64()
+	maxStreams      = app.Flag("max-streams", "Maximum number of concurrent forwarded connections (0 is unlimited)").Default("0").Int()
+	acceptBacklog   = app.Flag("mux.accept-backlog", "Maximum number of pending incoming connections").Default("256").Int()
 
 	loglevel  = app.Flag("log-level", "Logging Level").Default("info").String()
 	logformat = app.Flag("log-format", "If set use a syslog logger or JSON logging. Example: logger:syslog?appname=bob&local=7 or logger:stdout?json=true. Defaults to stderr.").Default("logger:stderr").String()
 )
 
+var (
+	// registeredId is the callback ID registrations are made with. It is
+	// replaced by the ID the server allocates, which is registered again with
+	// reclaimSecret.
+	registeredId  string
+	reclaimSecret string
+	registeredMtx sync.Mutex
+)
+
 func main() {
 	app.Version(Version)
 	kingpin.MustParse(app.Parse(os.Args[1:]))
@@ -63,6 +86,18 @@ func main() {
 	if *callbackId == "" {
 		log.Fatalln("Cannot use a blank id")
 	}
+	for _, pattern := range *migrateAllow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid --migrate.allow pattern %q: %v", pattern, err)
+		}
+	}
+
+	registeredId = *callbackId
+	if registeredId == AutoId {
+		registeredId = control.IdWildcard
+	}
+
+	websocketrwc.ReadLimit = *maxMessageSize
 
 	// Setup signal wait for shutdown
 	signalCh := make(chan os.Signal, 1)
@@ -75,41 +110,45 @@ func main() {
 		return
 	}()
 
-	if !strings.HasSuffix((*callbackServer).Path, "/") {
-		(*callbackServer).Path = fmt.Sprintf("%s/", (*callbackServer).Path)
-	}
-
-	apiUrl, err := url.Parse(fmt.Sprintf("%s/%s", CallbackApiPath, *callbackId))
-	if err != nil {
-		log.Fatalln("BUG: CallbackApiPath should always resolve")
-	}
-
-	apiUri := (*callbackServer).ResolveReference(apiUrl)
+	configuredUri, err := callbackApiUri(*callbackServer)
 	if err != nil {
-		log.Fatalln("Could not construct the callback API path from source URL:", (*callbackServer).String())
+		log.Fatalln("Could not construct the callback API path from source URL:", err)
 	}
+	log.Infoln("Callback Server Endpoint:", configuredUri)
 
-	log.Infoln("Callback Server Endpoint:", apiUri.String())
+	// server is the server we register with, which may redirect us from the configured one.
+	server := *callbackServer
 
-	// Ensure the scheme is set correctly
-	if apiUri.Scheme == "http" {
-		apiUri.Scheme = "ws"
-	}
-	if apiUri.Scheme == "https" {
-		apiUri.Scheme = "wss"
-	}
-	if apiUri.Scheme != "wss" && apiUri.Scheme != "ws" {
-		log.Fatalln("Unrecognized URI for remote endpoint:", apiUri.Scheme)
-	}
+	// reregisterCh is signalled when the server asks us to register again, such as when it is draining.
+	reregisterCh := make(chan struct{}, 1)
+	// migrateCh receives requests from the server to register with another server.
+	migrateCh := make(chan migrateRequest, 1)
 
 	exitCode := 0
+	exitCh, _ := forwardServer(server, shutdownCh, reregisterCh, migrateCh)
 reconnectLoop:
 	for {
-		exitCh := forwardServer(apiUri.String(), shutdownCh)
 		select {
 		case <-shutdownCh:
 			log.Infoln("Shutting down due to user request.")
 			break reconnectLoop
+		case <-reregisterCh:
+			// The existing session keeps serving its connections until the server closes it.
+			log.Infoln("Registering again at server request.")
+			exitCh, _ = forwardServer(server, shutdownCh, reregisterCh, migrateCh)
+			continue
+		case req := <-migrateCh:
+			// The existing session keeps serving until the new registration succeeds and the server closes it.
+			if newExitCh, targetUrl, merr := migrate(server, req.target, shutdownCh, reregisterCh, migrateCh); merr != nil {
+				log.Errorf("Could not migrate to %s, staying registered with %s: %v", req.target, server, merr)
+				req.reply(control.Message{Type: control.MessageMigrateFailed, Reason: merr.Error()})
+			} else {
+				log.Infoln("Migrated to server:", req.target)
+				req.reply(control.Message{Type: control.MessageMigrated})
+				server = targetUrl
+				exitCh = newExitCh
+			}
+			continue
 		case eerr := <-exitCh:
 			if eerr != nil {
 				log.Errorln("Disconnected due to error:", eerr)
@@ -120,16 +159,161 @@ reconnectLoop:
 				} else {
 					log.Infoln("Attempting to reconnect.")
 				}
+				// A server we were redirected to which cannot be reached is given up in favour of the
+				// configured server.
+				if _, dialFailed := eerr.(*dialError); dialFailed && server != *callbackServer {
+					log.Warnln("Could not reach migrated server. Falling back to:", configuredUri)
+					server = *callbackServer
+				}
 			}
 		}
 		time.Sleep(*foreverReconnect)
+		exitCh, _ = forwardServer(server, shutdownCh, reregisterCh, migrateCh)
 	}
 	os.Exit(exitCode)
 }
 
-// forwardServer implements the forwarding server.
-func forwardServer(apiUri string, shutdownCh <-chan struct{}) chan error {
-	exitCh := make(chan error)
+// callbackApiUri returns the websocket URL to register with a callback server at.
+func callbackApiUri(server *url.URL) (string, error) {
+	base := *server
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path = fmt.Sprintf("%s/", base.Path)
+	}
+
+	callbackId, _ := registration()
+	apiUrl, err := url.Parse(fmt.Sprintf("%s/%s", CallbackApiPath, callbackId))
+	if err != nil {
+		log.Fatalln("BUG: CallbackApiPath should always resolve")
+	}
+
+	apiUri := base.ResolveReference(apiUrl)
+
+	if len(*labels) > 0 {
+		query := apiUri.Query()
+		for k, v := range *labels {
+			query.Add("label", fmt.Sprintf("%s=%s", k, v))
+		}
+		apiUri.RawQuery = query.Encode()
+	}
+
+	// Ensure the scheme is set correctly
+	if apiUri.Scheme == "http" {
+		apiUri.Scheme = "ws"
+	}
+	if apiUri.Scheme == "https" {
+		apiUri.Scheme = "wss"
+	}
+	if apiUri.Scheme != "wss" && apiUri.Scheme != "ws" {
+		return "", fmt.Errorf("unrecognized URI for remote endpoint: %s", apiUri.Scheme)
+	}
+	return apiUri.String(), nil
+}
+
+// registration returns the callback ID to register with, and the secret to
+// reclaim it with if the server allocated it.
+func registration() (string, string) {
+	registeredMtx.Lock()
+	defer registeredMtx.Unlock()
+	return registeredId, reclaimSecret
+}
+
+// registered records the callback ID a registration was accepted as, from the
+// headers of the upgrade response. An ID allocated by the server replaces the
+// requested pattern, and is printed for scripts to read.
+func registered(header http.Header) {
+	registeredMtx.Lock()
+	defer registeredMtx.Unlock()
+
+	callbackId := header.Get(control.CallbackIdHeader)
+	if callbackId == "" {
+		// Servers without ID allocation don't report the ID.
+		callbackId = registeredId
+	}
+	if strings.Contains(registeredId, control.IdWildcard) {
+		registeredId = callbackId
+		reclaimSecret = header.Get(control.ReclaimSecretHeader)
+		log.Infoln("Server allocated callback ID:", callbackId)
+		fmt.Println(callbackId)
+	}
+
+	if *idFile != "" {
+		if err := ioutil.WriteFile(*idFile, []byte(callbackId+"\n"), os.FileMode(0644)); err != nil {
+			log.Errorln("Could not write callback ID file:", err)
+		}
+	}
+}
+
+// migrateRequest is a request from the server to register with another server.
+type migrateRequest struct {
+	target string
+	// reply sends the result to the server which made the request.
+	reply func(control.Message)
+}
+
+// migrate registers with the server at target instead of server, returning the
+// exit channel and server of the new registration once it has succeeded.
+func migrate(server *url.URL, target string, shutdownCh <-chan struct{}, reregisterCh chan<- struct{}, migrateCh chan<- migrateRequest) (chan error, *url.URL, error) {
+	targetUrl, err := url.Parse(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkMigrationTarget(server, targetUrl); err != nil {
+		return nil, nil, err
+	}
+	if _, err := callbackApiUri(targetUrl); err != nil {
+		return nil, nil, err
+	}
+
+	exitCh, registeredCh := forwardServer(targetUrl, shutdownCh, reregisterCh, migrateCh)
+	select {
+	case <-registeredCh:
+		return exitCh, targetUrl, nil
+	case eerr := <-exitCh:
+		return nil, nil, eerr
+	}
+}
+
+// checkMigrationTarget refuses to migrate to a server whose host is not allowed
+// by --migrate.allow, or from a TLS server to one without TLS.
+func checkMigrationTarget(server *url.URL, target *url.URL) error {
+	if secureScheme(server.Scheme) && !secureScheme(target.Scheme) {
+		return fmt.Errorf("refusing to migrate from %s to %s without TLS", server.Scheme, target.Scheme)
+	}
+
+	patterns := *migrateAllow
+	if len(patterns) == 0 {
+		patterns = []string{(*callbackServer).Hostname()}
+	}
+	host := strings.ToLower(target.Hostname())
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("migration target host %q is not allowed by --migrate.allow", target.Hostname())
+}
+
+// secureScheme returns true for schemes which use TLS.
+func secureScheme(scheme string) bool {
+	return scheme == "https" || scheme == "wss"
+}
+
+// dialError is returned when the callback server could not be registered with.
+type dialError struct {
+	err error
+}
+
+func (err dialError) Error() string {
+	return err.err.Error()
+}
+
+// forwardServer implements the forwarding server. reregisterCh is signalled
+// if the server asks for a new registration, and migrateCh receives requests
+// to register with another server. registeredCh is closed once registered.
+func forwardServer(server *url.URL, shutdownCh <-chan struct{}, reregisterCh chan<- struct{}, migrateCh chan<- migrateRequest) (exitCh chan error, registeredCh chan struct{}) {
+	// Buffered so a session which has been replaced can still exit.
+	exitCh = make(chan error, 1)
+	registeredCh = make(chan struct{})
 
 	wDialer := websocket.Dialer{
 		Proxy:            http.ProxyFromEnvironment,
@@ -137,16 +321,34 @@ func forwardServer(apiUri string, shutdownCh <-chan struct{}) chan error {
 		// TODO: what do you set the buffers to when you are going to mux over it
 	}
 
+	reqHeaders := http.Header{}
+	reqHeaders.Set(control.CapabilitiesHeader, strings.Join([]string{control.CapabilityControl, control.CapabilityMigrate}, ","))
+	if *apiToken != "" {
+		reqHeaders.Set("Authorization", "Bearer "+*apiToken)
+	}
+	// The ID is resolved at registration, so a server allocated ID is reclaimed.
+	_, secret := registration()
+	if secret != "" {
+		reqHeaders.Set(control.ReclaimSecretHeader, secret)
+	}
+	apiUri, err := callbackApiUri(server)
+	if err != nil {
+		deferredErr(exitCh, &dialError{err})
+		return exitCh, registeredCh
+	}
+
 	// Launch the listener
 	loopExiting := make(chan struct{})
 	go func() {
-		wconn, _, err := wDialer.Dial(apiUri, nil)
+		wconn, resp, err := wDialer.Dial(apiUri, reqHeaders)
 		if err != nil {
 			log.Errorln("Failed to connect to callback server:", err)
-			deferredErr(exitCh, err)
+			deferredErr(exitCh, &dialError{err})
 			return
 		}
 		defer wconn.Close()
+		registered(resp.Header)
+		close(registeredCh)
 
 		rwc, wrapErr := websocketrwc.WrapClientWebsocket(wconn)
 		if wrapErr != nil {
@@ -155,8 +357,44 @@ func forwardServer(apiUri string, shutdownCh <-chan struct{}) chan error {
 			return
 		}
 
+		rwc.SetControlHandler(func(data []byte) {
+			msg, derr := control.Decode(data)
+			if derr != nil {
+				log.Errorln("Could not decode control message:", derr)
+				return
+			}
+			switch msg.Type {
+			case control.MessageDrain:
+				log.Infoln("Server is draining:", msg.Reason)
+				select {
+				case reregisterCh <- struct{}{}:
+				default:
+				}
+			case control.MessageMigrate:
+				log.Infoln("Server requested migration to:", msg.Target)
+				reply := func(reply control.Message) {
+					data, eerr := control.Encode(reply)
+					if eerr == nil {
+						eerr = rwc.WriteControlMessage(data)
+					}
+					if eerr != nil {
+						log.Errorln("Could not reply to migration request:", eerr)
+					}
+				}
+				select {
+				case migrateCh <- migrateRequest{target: msg.Target, reply: reply}:
+				default:
+					reply(control.Message{Type: control.MessageMigrateFailed, Reason: "migration already in progress"})
+				}
+			default:
+				log.Debugln("Ignoring unknown control message:", msg.Type)
+			}
+		})
+
 		// Setup a yamux *server* on the websocket connection
-		muxServer, merr := yamux.Server(rwc, nil)
+		muxConfig := yamux.DefaultConfig()
+		muxConfig.AcceptBacklog = *acceptBacklog
+		muxServer, merr := yamux.Server(rwc, muxConfig)
 		if merr != nil {
 			log.Errorln("Could not setup mux session:", merr)
 			deferredErr(exitCh, err)
@@ -176,6 +414,17 @@ func forwardServer(apiUri string, shutdownCh <-chan struct{}) chan error {
 			return
 		}()
 
+		// streamSlots limits the number of concurrently forwarded connections.
+		var streamSlots chan struct{}
+		if *maxStreams > 0 {
+			streamSlots = make(chan struct{}, *maxStreams)
+		}
+		releaseSlot := func() {
+			if streamSlots != nil {
+				<-streamSlots
+			}
+		}
+
 		for {
 			incomingConn, aerr := muxServer.Accept()
 			if aerr != nil {
@@ -194,6 +443,18 @@ func forwardServer(apiUri string, shutdownCh <-chan struct{}) chan error {
 
 			log.Debugln("Accepting connection on mux")
 
+			if streamSlots != nil {
+				select {
+				case streamSlots <- struct{}{}:
+				default:
+					log.Warnln("Maximum concurrent connections reached. Rejecting connection.")
+					if icerr := incomingConn.Close(); icerr != nil {
+						log.Errorln("Error while closing incoming mux connection:", icerr)
+					}
+					continue
+				}
+			}
+
 			outgoingConn, oerr := net.Dial("tcp", *forwardingAddress)
 			if oerr != nil {
 				log.With("forwarding_addr", *forwardingAddress).
@@ -202,6 +463,7 @@ func forwardServer(apiUri string, shutdownCh <-chan struct{}) chan error {
 				if icerr := incomingConn.Close(); icerr != nil {
 					log.Errorln("Error while closing incoming mux connection:", icerr)
 				}
+				releaseSlot()
 				// No proxying - skip to continue accepting connections
 				continue
 			}
@@ -214,6 +476,7 @@ func forwardServer(apiUri string, shutdownCh <-chan struct{}) chan error {
 			errCh := util.HandleProxy(log, *proxyBufferSize, incomingConn, outgoingConn, shutdownCh, nil, nil)
 			go func() {
 				perr := <-errCh
+				releaseSlot()
 				if perr != nil {
 					if perr != io.EOF {
 						log.Errorln("Proxy connection terminated with error:", perr)
@@ -227,7 +490,7 @@ func forwardServer(apiUri string, shutdownCh <-chan struct{}) chan error {
 		}
 	}()
 
-	return exitCh
+	return exitCh, registeredCh
 }
 
 func deferredErr(errCh chan error, err error) {
@@ -2,19 +2,35 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/bakins/logrus-middleware"
+	"github.com/hashicorp/yamux"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
+	"github.com/wrouesnel/callback/alerts"
 	"github.com/wrouesnel/callback/api"
 	"github.com/wrouesnel/callback/api/apisettings"
+	"github.com/wrouesnel/callback/api/netacl"
+	"github.com/wrouesnel/callback/api/throttle"
 	"github.com/wrouesnel/callback/assets"
+	"github.com/wrouesnel/callback/auth"
+	"github.com/wrouesnel/callback/cluster"
 	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/policy"
+	"github.com/wrouesnel/callback/relay"
+	"github.com/wrouesnel/callback/sessionstore"
+	"github.com/wrouesnel/callback/usage"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/callback/util/ratelimit"
+	"github.com/wrouesnel/callback/util/websocketrwc"
+	"github.com/wrouesnel/callback/webhook"
 	"github.com/wrouesnel/go.log"
-	"github.com/wrouesnel/multihttp"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 	"github.com/stanvit/go-forwarded"
 	"net/http"
 )
@@ -22,6 +38,10 @@ import (
 // Version is set by the Makefile
 var Version = "0.0.0.dev"
 
+// recordRetentionInterval is how often callback records are checked against
+// --session-store.retention and --session-store.allocated-id-retention.
+const recordRetentionInterval = time.Minute
+
 var (
 	app = kingpin.New("callbackserver", "Callback Websocket Mediation Server")
 
@@ -29,10 +49,103 @@ var (
 	contextPath = app.Flag("http.context-path", "Subpath the application is being hosted under").Default("").String()
 	allowedForwardedNets = app.Flag("http.local-networks", "Comma separated list of local networks which can set Forwarded headers").Default("127.0.0.0/8").String()
 
+	tokenFile  = app.Flag("auth.token-file", "File to persist API token hashes in. Enables token authentication.").String()
+	adminToken = app.Flag("auth.admin-token", "Bootstrap token granted the admin scope. Enables token authentication.").Envar("CALLBACKSERVER_ADMIN_TOKEN").String()
+
+	policyFile = app.Flag("policy.file", "JSON file of rules deciding registrations and connections").String()
+
+	callbackAllow = app.Flag("acl.callback.allow", "Networks allowed to register callbacks (repeatable, comma separated)").Strings()
+	callbackDeny  = app.Flag("acl.callback.deny", "Networks denied from registering callbacks (repeatable, comma separated)").Strings()
+	connectAllow  = app.Flag("acl.connect.allow", "Networks allowed to connect to callbacks (repeatable, comma separated)").Strings()
+	connectDeny   = app.Flag("acl.connect.deny", "Networks denied from connecting to callbacks (repeatable, comma separated)").Strings()
+	listAllow     = app.Flag("acl.list.allow", "Networks allowed to use the listing, event and admin APIs (repeatable, comma separated)").Strings()
+	listDeny      = app.Flag("acl.list.deny", "Networks denied from the listing, event and admin APIs (repeatable, comma separated)").Strings()
+
+	registerIPRate        = app.Flag("ratelimit.register.ip", "Registration rate limit per remote IP as COUNT[/PERIOD][:BURST]").Default("0").String()
+	registerPrincipalRate = app.Flag("ratelimit.register.principal", "Registration rate limit per principal as COUNT[/PERIOD][:BURST]").Default("0").String()
+	connectIPRate         = app.Flag("ratelimit.connect.ip", "Connection rate limit per remote IP as COUNT[/PERIOD][:BURST]").Default("0").String()
+	connectPrincipalRate  = app.Flag("ratelimit.connect.principal", "Connection rate limit per principal as COUNT[/PERIOD][:BURST]").Default("0").String()
+	listIPRate            = app.Flag("ratelimit.list.ip", "Listing and event API rate limit per remote IP as COUNT[/PERIOD][:BURST]").Default("0").String()
+	listPrincipalRate     = app.Flag("ratelimit.list.principal", "Listing and event API rate limit per principal as COUNT[/PERIOD][:BURST]").Default("0").String()
+
+	maxCallbackSessions             = app.Flag("limits.callback-sessions", "Maximum number of callback sessions (0 is unlimited)").Default("0").Int()
+	maxCallbackSessionsPerIP        = app.Flag("limits.callback-sessions-per-ip", "Maximum number of callback sessions per remote IP (0 is unlimited)").Default("0").Int()
+	maxCallbackSessionsPerPrincipal = app.Flag("limits.callback-sessions-per-principal", "Maximum number of callback sessions per principal (0 is unlimited)").Default("0").Int()
+	maxClientsPerCallback           = app.Flag("limits.clients-per-callback", "Maximum number of concurrent clients per callback session (0 is unlimited)").Default("0").Int()
+	maxClientSessions               = app.Flag("limits.client-sessions", "Maximum number of client sessions (0 is unlimited)").Default("0").Int()
+
+	clientIdleTimeout   = app.Flag("session.client-idle-timeout", "Close client sessions which move no data for this long (0 is unlimited)").Default("0").Duration()
+	clientMaxDuration   = app.Flag("session.client-max-duration", "Maximum duration of a client session (0 is unlimited)").Default("0").Duration()
+	callbackMaxDuration = app.Flag("session.callback-max-duration", "Maximum duration of a callback session before it must re-register (0 is unlimited)").Default("0").Duration()
+	lifetimePolicyFile  = app.Flag("session.policy-file", "JSON file of per callback ID pattern session lifetime overrides").String()
+
+	scheduleFile = app.Flag("schedule.file", "JSON file of per callback ID pattern access schedules restricting when clients may connect").String()
+
+	requireApproval          = app.Flag("admission.require-approval", "Hold sessions of callback IDs pending until an admin approves them").Bool()
+	admissionWebhookURL      = app.Flag("admission.webhook-url", "URL of an admission webhook called to decide each registration").String()
+	admissionWebhookToken    = app.Flag("admission.webhook-token", "Bearer token sent to the admission webhook").Envar("CALLBACKSERVER_ADMISSION_WEBHOOK_TOKEN").String()
+	admissionWebhookTimeout  = app.Flag("admission.webhook-timeout", "Maximum time to wait for the admission webhook").Default("5s").Duration()
+	admissionWebhookFailOpen = app.Flag("admission.webhook-fail-open", "Allow registrations when the admission webhook fails instead of refusing them").Bool()
+
+	flapWindow          = app.Flag("flap.window", "Period registration churn is measured over to detect flapping callbacks (0 disables flap detection)").Default("10m").Duration()
+	flapThreshold       = app.Flag("flap.threshold", "Registrations of a callback ID within the flap window above which it is flapping (0 only detects ID conflicts)").Default("0").Int()
+	flapSourceThreshold = app.Flag("flap.source-threshold", "Repeated registrations from a single source within the flap window above which it is flapping (0 is unlimited)").Default("0").Int()
+	flapPenalty         = app.Flag("flap.penalty", "How long registrations are first refused once flapping is detected, doubling while it continues (0 only reports flapping)").Default("30s").Duration()
+	flapMaxPenalty      = app.Flag("flap.max-penalty", "Maximum time registrations are refused for flapping").Default("30m").Duration()
+
+	leaseDuration    = app.Flag("lease.duration", "Duration of callback leases which do not request one").Default("5m").Duration()
+	leaseMaxDuration = app.Flag("lease.max-duration", "Maximum duration of callback leases (0 is unlimited)").Default("1h").Duration()
+
+	bandwidthGlobalToCallback   = app.Flag("bandwidth.global.to-callback", "Bandwidth limit shared by all clients sending to callbacks in bytes as COUNT[/PERIOD][:BURST]").Default("0").String()
+	bandwidthGlobalToClient     = app.Flag("bandwidth.global.to-client", "Bandwidth limit shared by all callbacks sending to clients in bytes as COUNT[/PERIOD][:BURST]").Default("0").String()
+	bandwidthCallbackToCallback = app.Flag("bandwidth.callback.to-callback", "Bandwidth limit shared by the clients of each callback sending to it in bytes as COUNT[/PERIOD][:BURST]").Default("0").String()
+	bandwidthCallbackToClient   = app.Flag("bandwidth.callback.to-client", "Bandwidth limit of each callback sending to its clients in bytes as COUNT[/PERIOD][:BURST]").Default("0").String()
+	bandwidthClientToCallback   = app.Flag("bandwidth.client.to-callback", "Bandwidth limit of each client session sending to its callback in bytes as COUNT[/PERIOD][:BURST]").Default("0").String()
+	bandwidthClientToClient     = app.Flag("bandwidth.client.to-client", "Bandwidth limit of each client session receiving from its callback in bytes as COUNT[/PERIOD][:BURST]").Default("0").String()
+
+	usageFile            = app.Flag("usage.file", "File to persist client session usage accounting in").String()
+	usageCompactInterval = app.Flag("usage.compact-interval", "Interval at which expired usage is pruned and the usage file rewritten").Default("1h").Duration()
+	usageHourlyRetention = app.Flag("usage.hourly-retention", "How long hourly usage rollups are kept (0 is forever)").Default("720h").Duration()
+	usageDailyRetention  = app.Flag("usage.daily-retention", "How long daily usage rollups are kept (0 is forever)").Default("8760h").Duration()
+
+	sessionStoreFile      = app.Flag("session-store.file", "File to persist the records of callback IDs in").String()
+	sessionStoreRetention = app.Flag("session-store.retention", "How long the records of callback IDs which have not been seen are kept (0 is forever)").Default("0").Duration()
+	allocatedIdRetention  = app.Flag("session-store.allocated-id-retention", "How long server allocated callback IDs which have not been seen stay reserved (0 is forever)").Default("720h").Duration()
+
+	alertsRulesFile          = app.Flag("alerts.rules-file", "JSON file of alert rules. Alerting is disabled if unset.").String()
+	alertsAlertmanagerURL    = app.Flag("alerts.alertmanager-url", "Alertmanager v2 API endpoint to post alerts to, e.g. http://alertmanager:9093/api/v2/alerts").String()
+	alertsEvaluationInterval = app.Flag("alerts.evaluation-interval", "Interval at which alert rules are evaluated").Default("15s").Duration()
+	alertsResendInterval     = app.Flag("alerts.resend-interval", "Interval at which firing alerts are sent again to the Alertmanager").Default("1m").Duration()
+	alertsTimeout            = app.Flag("alerts.timeout", "Maximum time to post alerts to the Alertmanager").Default("10s").Duration()
+
 	staticProxy = app.Flag("debug.static-proxy", "URL of a proxy hosting static resources externally").URL()
 
 	proxyBufferSize  = app.Flag("proxy.buffer-size", "Size in bytes of connection buffers").Default("1024").Int()
 	handshakeTimeout = app.Flag("proxy.timeout", "Set maximum timeouts for connections").Default("3s").Duration()
+	maxMessageSize   = app.Flag("proxy.max-message-size", "Maximum size in bytes of a websocket message (0 is unlimited)").Default("1048576").Int64()
+
+	readHeaderTimeout = app.Flag("http.read-header-timeout", "Maximum time to read HTTP request headers").Default("10s").Duration()
+	idleTimeout       = app.Flag("http.idle-timeout", "Maximum time an idle keep-alive connection is kept open").Default("120s").Duration()
+	allowedOrigins    = app.Flag("http.allowed-origin", "Origin allowed to open websockets in addition to same-origin requests (repeatable, glob patterns allowed)").Strings()
+
+	muxMaxStreams    = app.Flag("mux.max-streams", "Maximum number of open mux streams per callback session (0 is unlimited)").Default("0").Int()
+	muxAcceptBacklog = app.Flag("mux.accept-backlog", "Maximum number of unaccepted streams a callback session may open towards the server").Default("16").Int()
+	muxStreamWindow  = app.Flag("mux.stream-window", "Maximum mux stream receive window in bytes").Default("262144").Uint32()
+
+	pidFile        = app.Flag("pid-file", "File to write the process ID to once serving").String()
+	handoffTimeout = app.Flag("handoff.timeout", "Maximum time to wait for a new process to start serving on SIGUSR2").Default("30s").Duration()
+	drainTimeout   = app.Flag("drain.timeout", "Maximum time to wait for client sessions to finish on shutdown").Default("30s").Duration()
+
+	clusterRegistry     = app.Flag("cluster.registry", "Shared session registry to cluster with: memory or redis://[:password@]host[:port][/db]. Not clustered if unset.").String()
+	clusterNodeId       = app.Flag("cluster.node-id", "Unique name of this node in the cluster (defaults to the hostname)").String()
+	clusterAdvertiseURL = app.Flag("cluster.advertise-url", "URL of this server other nodes relay client connections to").String()
+	clusterSecret       = app.Flag("cluster.secret", "Shared secret authenticating connections between nodes").Envar("CALLBACKSERVER_CLUSTER_SECRET").String()
+	clusterHeartbeat    = app.Flag("cluster.heartbeat", "Interval at which the node refreshes its registry records").Default("2s").Duration()
+
+	relayUpstream          = app.Flag("relay.upstream", "Upstream callback server to export callback sessions to. Not relaying if unset.").URL()
+	relayId                = app.Flag("relay.id", "Callback ID to register upstream as. Sessions are exported as <id>.<callback id>.").String()
+	relayToken             = app.Flag("relay.token", "API token to authenticate to the upstream server with").Envar("CALLBACKSERVER_RELAY_TOKEN").String()
+	relayReconnectInterval = app.Flag("relay.reconnect-interval", "Interval between attempts to reconnect to the upstream server").Default("1s").Duration()
 
 	loglevel  = app.Flag("log-level", "Logging Level").Default("info").String()
 	logformat = app.Flag("log-format", "If set use a syslog logger or JSON logging. Example: logger:syslog?appname=bob&local=7 or logger:stdout?json=true. Defaults to stderr.").Default("logger:stderr").String()
@@ -54,14 +167,270 @@ func main() {
 
 	log.Infoln("Starting connection manager")
 	connectionManager := connman.NewConnectionManager(*proxyBufferSize)
+	connectionManager.SetLimits(connman.Limits{
+		MaxCallbackSessions:             *maxCallbackSessions,
+		MaxCallbackSessionsPerIP:        *maxCallbackSessionsPerIP,
+		MaxCallbackSessionsPerPrincipal: *maxCallbackSessionsPerPrincipal,
+		MaxClientsPerCallback:           *maxClientsPerCallback,
+		MaxClientSessions:               *maxClientSessions,
+		MaxStreamsPerSession:            *muxMaxStreams,
+	})
+
+	var lifetimeOverrides []connman.LifetimePolicy
+	if *lifetimePolicyFile != "" {
+		log.Infoln("Loading session lifetime policy file:", *lifetimePolicyFile)
+		found, lerr := util.ReadJSONFile(*lifetimePolicyFile, &lifetimeOverrides)
+		if lerr != nil {
+			log.Fatalln("Could not load session lifetime policy file:", lerr)
+		}
+		if !found {
+			log.Fatalln("Session lifetime policy file does not exist:", *lifetimePolicyFile)
+		}
+	}
+	if lerr := connectionManager.SetLifetimePolicies(connman.LifetimePolicy{
+		ClientIdleTimeout:   util.Duration(*clientIdleTimeout),
+		ClientMaxDuration:   util.Duration(*clientMaxDuration),
+		CallbackMaxDuration: util.Duration(*callbackMaxDuration),
+	}, lifetimeOverrides); lerr != nil {
+		log.Fatalln("Invalid session lifetime policy:", lerr)
+	}
+
+	if *scheduleFile != "" {
+		log.Infoln("Loading access schedule file:", *scheduleFile)
+		var schedules []connman.Schedule
+		found, serr := util.ReadJSONFile(*scheduleFile, &schedules)
+		if serr != nil {
+			log.Fatalln("Could not load access schedule file:", serr)
+		}
+		if !found {
+			log.Fatalln("Access schedule file does not exist:", *scheduleFile)
+		}
+		if serr := connectionManager.SetSchedules(schedules); serr != nil {
+			log.Fatalln("Invalid access schedule:", serr)
+		}
+	}
+
+	connectionManager.SetRequireApproval(*requireApproval)
+
+	connectionManager.SetFlapPolicy(connman.FlapPolicy{
+		Window:          *flapWindow,
+		Threshold:       *flapThreshold,
+		SourceThreshold: *flapSourceThreshold,
+		Penalty:         *flapPenalty,
+		MaxPenalty:      *flapMaxPenalty,
+	})
+
+	connectionManager.SetBandwidthLimits(connman.BandwidthLimits{
+		Global:      mustBandwidthLimit("global", *bandwidthGlobalToCallback, *bandwidthGlobalToClient),
+		PerCallback: mustBandwidthLimit("callback", *bandwidthCallbackToCallback, *bandwidthCallbackToClient),
+		PerClient:   mustBandwidthLimit("client", *bandwidthClientToCallback, *bandwidthClientToClient),
+	})
+
+	usageStore, uerr := usage.NewStore(*usageFile, usage.Retention{
+		Hourly: *usageHourlyRetention,
+		Daily:  *usageDailyRetention,
+	})
+	if uerr != nil {
+		log.Fatalln("Could not load usage file:", uerr)
+	}
+	connectionManager.SetUsageRecorder(usageStore)
+	usageStopCh := make(chan struct{})
+	go usageStore.Run(*usageCompactInterval, usageStopCh)
+
+	// Records are loaded before the cluster node and relay start, so the
+	// sessions they establish are recorded.
+	sessionStoreStopCh := make(chan struct{})
+	var sessionStore *sessionstore.FileStore
+	if *sessionStoreFile != "" {
+		var serr error
+		sessionStore, serr = sessionstore.NewFileStore(*sessionStoreFile)
+		if serr != nil {
+			log.Fatalln("Could not load session store file:", serr)
+		}
+		connectionManager.SetSessionStore(sessionStore)
+	}
+	if *sessionStoreRetention > 0 || *allocatedIdRetention > 0 {
+		go connectionManager.RunRecordRetention(connman.RecordRetention{
+			Records:      *sessionStoreRetention,
+			AllocatedIds: *allocatedIdRetention,
+		}, recordRetentionInterval, sessionStoreStopCh)
+	}
+
+	var clusterNode *cluster.Node
+	clusterStopCh := make(chan struct{})
+	clusterDoneCh := make(chan struct{})
+	if *clusterRegistry != "" {
+		if *clusterAdvertiseURL == "" {
+			log.Fatalln("Must specify --cluster.advertise-url to cluster.")
+		}
+		if *clusterSecret == "" {
+			log.Fatalln("Must specify --cluster.secret to cluster.")
+		}
+		nodeId := *clusterNodeId
+		if nodeId == "" {
+			hostname, herr := os.Hostname()
+			if herr != nil {
+				log.Fatalln("Could not determine hostname for the cluster node ID:", herr)
+			}
+			nodeId = hostname
+		}
+
+		registry, rerr := cluster.NewRegistry(*clusterRegistry)
+		if rerr != nil {
+			log.Fatalln("Could not connect to the cluster registry:", rerr)
+		}
+		clusterNode = cluster.NewNode(cluster.Config{
+			NodeId:           nodeId,
+			AdvertiseURL:     *clusterAdvertiseURL,
+			Secret:           *clusterSecret,
+			Heartbeat:        *clusterHeartbeat,
+			HandshakeTimeout: *handshakeTimeout,
+		}, registry, connectionManager)
+		log.With("node_id", nodeId).Infoln("Joining cluster.")
+		go func() {
+			clusterNode.Run(clusterStopCh)
+			registry.Close()
+			close(clusterDoneCh)
+		}()
+	} else {
+		close(clusterDoneCh)
+	}
+
+	relayStopCh := make(chan struct{})
+	relayDoneCh := make(chan struct{})
+	if *relayUpstream != nil {
+		edgeRelay, rerr := relay.New(relay.Config{
+			Upstream:          *relayUpstream,
+			Id:                *relayId,
+			Token:             *relayToken,
+			HandshakeTimeout:  *handshakeTimeout,
+			ReconnectInterval: *relayReconnectInterval,
+		}, connectionManager)
+		if rerr != nil {
+			log.Fatalln("Invalid relay configuration:", rerr)
+		}
+		log.With("upstream", (*relayUpstream).String()).Infoln("Relaying callback sessions upstream as:", *relayId)
+		go func() {
+			edgeRelay.Run(relayStopCh)
+			close(relayDoneCh)
+		}()
+	} else {
+		close(relayDoneCh)
+	}
+
+	alertsStopCh := make(chan struct{})
+	var alertEvaluator *alerts.Evaluator
+	if *alertsRulesFile != "" {
+		var rules []alerts.Rule
+		log.Infoln("Loading alert rules file:", *alertsRulesFile)
+		found, rerr := util.ReadJSONFile(*alertsRulesFile, &rules)
+		if rerr != nil {
+			log.Fatalln("Could not load alert rules file:", rerr)
+		}
+		if !found {
+			log.Fatalln("Alert rules file does not exist:", *alertsRulesFile)
+		}
+		var notifier alerts.Notifier
+		if *alertsAlertmanagerURL != "" {
+			notifier = alerts.NewAlertmanagerNotifier(*alertsAlertmanagerURL, *alertsTimeout)
+		}
+		alertEvaluator, rerr = alerts.New(alerts.Config{
+			Interval:       *alertsEvaluationInterval,
+			ResendInterval: *alertsResendInterval,
+		}, rules, connectionManager, notifier)
+		if rerr != nil {
+			log.Fatalln("Invalid alert rules:", rerr)
+		}
+		go alertEvaluator.Run(alertsStopCh)
+	}
+
+	muxConfig := yamux.DefaultConfig()
+	muxConfig.AcceptBacklog = *muxAcceptBacklog
+	muxConfig.MaxStreamWindowSize = *muxStreamWindow
+	if merr := connectionManager.SetMuxConfig(muxConfig); merr != nil {
+		log.Fatalln("Invalid mux configuration:", merr)
+	}
+
+	websocketrwc.ReadLimit = *maxMessageSize
+
+	var tokenStore *auth.TokenStore
+	if *tokenFile != "" || *adminToken != "" {
+		log.Infoln("Token authentication enabled")
+		var terr error
+		tokenStore, terr = auth.NewTokenStore(*tokenFile)
+		if terr != nil {
+			log.Fatalln("Could not load token file:", terr)
+		}
+		if *adminToken != "" {
+			tokenStore.AddStaticToken("admin", *adminToken, []auth.Scope{auth.ScopeAdmin})
+		}
+		if !tokenStore.Administrable() {
+			log.Fatalln("The token file has no admin token, so no tokens could be created. Set --auth.admin-token to bootstrap one.")
+		}
+	} else {
+		log.Warnln("Token authentication is disabled. All API requests will be accepted.")
+	}
+
+	var policyEngine *policy.Engine
+	if *policyFile != "" {
+		log.Infoln("Loading policy file:", *policyFile)
+		var perr error
+		policyEngine, perr = policy.LoadEngine(*policyFile)
+		if perr != nil {
+			log.Fatalln("Could not load policy file:", perr)
+		}
+	}
+
+	var admissionWebhook *webhook.Webhook
+	if *admissionWebhookURL != "" {
+		log.Infoln("Registrations will be decided by admission webhook:", *admissionWebhookURL)
+		admissionWebhook = webhook.New(webhook.Config{
+			URL:      *admissionWebhookURL,
+			Token:    *admissionWebhookToken,
+			Timeout:  *admissionWebhookTimeout,
+			FailOpen: *admissionWebhookFailOpen,
+		})
+	}
+
+	callbackACL, aerr := netacl.Parse(*callbackAllow, *callbackDeny)
+	if aerr != nil {
+		log.Fatalln("Could not parse callback ACL:", aerr)
+	}
+	connectACL, aerr := netacl.Parse(*connectAllow, *connectDeny)
+	if aerr != nil {
+		log.Fatalln("Could not parse connect ACL:", aerr)
+	}
+	listACL, aerr := netacl.Parse(*listAllow, *listDeny)
+	if aerr != nil {
+		log.Fatalln("Could not parse list ACL:", aerr)
+	}
+
+	registerLimits := mustRouteLimits("register", *registerIPRate, *registerPrincipalRate)
+	connectLimits := mustRouteLimits("connect", *connectIPRate, *connectPrincipalRate)
+	listLimits := mustRouteLimits("list", *listIPRate, *listPrincipalRate)
 
 	settings := apisettings.APISettings{
 		ConnectionManager: connectionManager,
+		TokenStore:        tokenStore,
+		Policy:            policyEngine,
+		AdmissionWebhook:  admissionWebhook,
+		UsageStore:        usageStore,
+		Cluster:           clusterNode,
+		Alerts:            alertEvaluator,
+		LeaseDuration:     *leaseDuration,
+		MaxLeaseDuration:  *leaseMaxDuration,
+		CallbackACL:       callbackACL,
+		ConnectACL:        connectACL,
+		ListACL:           listACL,
+		RegisterLimits:    registerLimits,
+		ConnectLimits:     connectLimits,
+		ListLimits:        listLimits,
 		ContextPath:       *contextPath,
 		StaticProxy:       *staticProxy,
 		ReadBufferSize:    *proxyBufferSize,
 		WriteBufferSize:   *proxyBufferSize,
 		HandshakeTimeout:  *handshakeTimeout,
+		AllowedOrigins:    *allowedOrigins,
 	}
 
 	// Setup HTTP router
@@ -89,26 +458,161 @@ func main() {
 	handler = wrapper.Handler(handler)
 
 	log.Infoln("Starting web interface")
-	listeners, err := multihttp.Listen(*listenAddr, handler)
-	defer func() {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	listeners, err := util.InheritedListeners()
+	if err != nil {
+		log.Fatalln("Could not use inherited listeners:", err)
+	}
+	closeListeners := func() {
 		for _, l := range listeners {
 			if cerr := l.Close(); cerr != nil {
 				log.Errorln("Error while closing listeners (ignored):", cerr)
 			}
 		}
-	}()
-	if err != nil {
-		log.Panicln("Startup failed for a listener:", err)
+		listeners = nil
 	}
-	for _, addr := range *listenAddr {
-		log.Infoln("Listening on", addr)
+	defer closeListeners()
+
+	if len(listeners) > 0 {
+		// Sockets passed by systemd or a parent process replace --listen.addr.
+		util.ServeHTTP(listeners, server)
+		for _, l := range listeners {
+			log.Infoln("Listening on inherited socket", l.Addr())
+		}
+	} else {
+		listeners, err = util.ListenHTTP(*listenAddr, server)
+		if err != nil {
+			log.Panicln("Startup failed for a listener:", err)
+		}
+		for _, addr := range *listenAddr {
+			log.Infoln("Listening on", addr)
+		}
+	}
+
+	if *pidFile != "" {
+		if perr := ioutil.WriteFile(*pidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); perr != nil {
+			log.Errorln("Could not write PID file:", perr)
+		}
+	}
+
+	if nerr := util.NotifyHandoffReady(); nerr != nil {
+		log.Errorln("Could not notify parent process we are serving:", nerr)
 	}
 
 	// Setup signal wait for shutdown
 	shutdownCh := make(chan os.Signal, 1)
-	signal.Notify(shutdownCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(shutdownCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+
+	for {
+		sig := <-shutdownCh
+		if sig != syscall.SIGUSR2 {
+			log.Infoln("Draining on signal:", sig)
+			break
+		}
+
+		// Zero-downtime upgrade: a new process takes over the listening sockets and we drain.
+		log.Infoln("Handing listeners over to a new process on signal:", sig)
+		// The new process takes over the session store from what we last
+		// wrote. Usage is journaled by both processes, so we keep recording
+		// it while draining.
+		if sessionStore != nil {
+			if cerr := sessionStore.Close(); cerr != nil {
+				log.Errorln("Could not close session store before handoff:", cerr)
+			}
+		}
+		// The new process joins the cluster with our node ID, so we stop
+		// writing its records.
+		if clusterNode != nil {
+			clusterNode.SetHandedOver(true)
+		}
+		child, herr := util.StartHandoff(listeners, *handoffTimeout)
+		if herr != nil {
+			log.Errorln("Listener handoff failed. Continuing to serve:", herr)
+			if clusterNode != nil {
+				clusterNode.SetHandedOver(false)
+			}
+			if sessionStore != nil {
+				if rerr := sessionStore.Reopen(); rerr != nil {
+					log.Errorln("Could not reopen session store. Callback records are no longer persisted:", rerr)
+				}
+			}
+			continue
+		}
+		log.Infoln("New process is serving. Draining. PID:", child.Pid)
+		// Unix sockets are left in place for the new process.
+		closeListeners()
+		break
+	}
+
+	// Keep serving while draining so readiness checks and refusals are answered.
+	drainedCh := make(chan struct{})
+	go func() {
+		connectionManager.Drain(*drainTimeout)
+		close(drainedCh)
+	}()
 
-	sig := <-shutdownCh
-	log.Infoln("Terminating on signal:", sig)
+	select {
+	case <-drainedCh:
+		log.Infoln("Drain complete. Terminating.")
+	case sig := <-shutdownCh:
+		log.Warnln("Terminating without completing drain on signal:", sig)
+	}
+
+	close(relayStopCh)
+	<-relayDoneCh
+
+	close(clusterStopCh)
+	<-clusterDoneCh
+
+	close(alertsStopCh)
 
+	close(sessionStoreStopCh)
+	if sessionStore != nil {
+		if ferr := sessionStore.Close(); ferr != nil {
+			log.Errorln("Could not close session store:", ferr)
+		}
+	}
+
+	close(usageStopCh)
+	if ferr := usageStore.Close(); ferr != nil {
+		log.Errorln("Could not close usage file:", ferr)
+	}
+
+}
+
+// mustRouteLimits parses the rate limit flags of a class of routes.
+func mustRouteLimits(class string, ipRate string, principalRate string) *throttle.RouteLimits {
+	perIP, err := ratelimit.ParseRate(ipRate)
+	if err != nil {
+		log.Fatalf("Could not parse %s per-IP rate limit: %v", class, err)
+	}
+	perPrincipal, err := ratelimit.ParseRate(principalRate)
+	if err != nil {
+		log.Fatalf("Could not parse %s per-principal rate limit: %v", class, err)
+	}
+	return &throttle.RouteLimits{
+		Class:        class,
+		PerIP:        ratelimit.NewLimiter(perIP),
+		PerPrincipal: ratelimit.NewLimiter(perPrincipal),
+	}
+}
+
+// mustBandwidthLimit parses the bandwidth limit flags of a throttling level.
+func mustBandwidthLimit(level string, toCallback string, toClient string) connman.BandwidthLimit {
+	toCallbackRate, err := ratelimit.ParseRate(toCallback)
+	if err != nil {
+		log.Fatalf("Could not parse %s to-callback bandwidth limit: %v", level, err)
+	}
+	toClientRate, err := ratelimit.ParseRate(toClient)
+	if err != nil {
+		log.Fatalf("Could not parse %s to-client bandwidth limit: %v", level, err)
+	}
+	return connman.BandwidthLimit{
+		ToCallback: toCallbackRate,
+		ToClient:   toClientRate,
+	}
 }
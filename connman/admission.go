@@ -0,0 +1,208 @@
+package connman
+
+import (
+	"github.com/wrouesnel/go.log"
+	"time"
+)
+
+// Callback session states.
+const (
+	// SessionActive sessions accept client connections.
+	SessionActive = "active"
+	// SessionPending sessions are held until an operator approves their
+	// callback ID, and refuse client connections.
+	SessionPending = "pending"
+)
+
+// Admission decisions.
+const (
+	AdmissionApproved = "approved"
+	AdmissionRejected = "rejected"
+)
+
+// ReasonRejected is reported when a pending session is rejected by an operator.
+const ReasonRejected = "registration rejected"
+
+// Admission is an operator's decision on whether a callback ID may register.
+type Admission struct {
+	// Decision is approved or rejected.
+	Decision string `json:"decision"`
+	// Fingerprint is the source approved to register the ID. Blank if it
+	// will be set by the next registration.
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	DecidedAt   time.Time `json:"decided_at"`
+	DecidedBy   string    `json:"decided_by,omitempty"`
+}
+
+// ErrSessionPending is returned when connecting to a callback session which
+// is awaiting approval.
+type ErrSessionPending struct {
+	callbackId string
+}
+
+func (err ErrSessionPending) Error() string {
+	return "callback session is pending approval"
+}
+
+// ErrRegistrationRejected is returned when registering a callback ID an
+// operator has rejected.
+type ErrRegistrationRejected struct {
+	callbackId string
+}
+
+func (err ErrRegistrationRejected) Error() string {
+	return "registration of callback ID has been rejected"
+}
+
+// admissionFingerprint identifies the registrant of a callback ID: its
+// principal if authenticated, otherwise its remote IP.
+func admissionFingerprint(origin SessionOrigin) string {
+	if origin.Principal != "" {
+		return origin.Principal
+	}
+	return hostOf(origin.RemoteAddr)
+}
+
+// SetRequireApproval sets whether callback IDs must be approved by an operator
+// before clients may connect to them. Must be called before any sessions are
+// established.
+func (this *ConnectionManager) SetRequireApproval(require bool) {
+	this.requireApproval = require
+}
+
+// checkAdmission returns an error if registration of callbackId has been
+// rejected.
+func (this *ConnectionManager) checkAdmission(callbackId string) error {
+	if !this.requireApproval {
+		return nil
+	}
+	record, found, err := this.sessionStore.Get(callbackId)
+	if err != nil {
+		return err
+	}
+	if found && record.Admission != nil && record.Admission.Decision == AdmissionRejected {
+		return &ErrRegistrationRejected{callbackId}
+	}
+	return nil
+}
+
+// admit returns the state a new session of callbackId starts in. Sessions
+// are active if the ID was approved for the fingerprint of origin, and an
+// approval without a fingerprint is bound to the first registrant.
+func (this *ConnectionManager) admit(callbackId string, origin SessionOrigin) string {
+	if !this.requireApproval {
+		return SessionActive
+	}
+
+	fingerprint := admissionFingerprint(origin)
+	record, found, err := this.sessionStore.Get(callbackId)
+	if err != nil {
+		log.With("callback_id", callbackId).Errorln("Could not get callback record:", err)
+		return SessionPending
+	}
+	if !found || record.Admission == nil || record.Admission.Decision != AdmissionApproved {
+		return SessionPending
+	}
+	if record.Admission.Fingerprint != "" {
+		if record.Admission.Fingerprint == fingerprint {
+			return SessionActive
+		}
+		return SessionPending
+	}
+
+	// Bind the approval to this registrant, unless another has been first.
+	state := SessionPending
+	_, err = this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+		admission := record.Admission
+		if admission == nil || admission.Decision != AdmissionApproved {
+			return
+		}
+		if admission.Fingerprint == "" {
+			admission.Fingerprint = fingerprint
+		}
+		if admission.Fingerprint == fingerprint {
+			state = SessionActive
+		}
+	})
+	if err != nil {
+		log.With("callback_id", callbackId).Errorln("Could not update callback record:", err)
+	}
+	return state
+}
+
+// ApproveCallback approves a callback ID. If fingerprint is blank, the ID is
+// approved for the source of its pending session, or if there is none, for
+// the source which next registers it. A pending session of the ID from the
+// approved source is activated.
+func (this *ConnectionManager) ApproveCallback(callbackId string, fingerprint string, decidedBy string) (CallbackRecord, error) {
+	for {
+		// The session store is written without callbackMtx held, so a slow
+		// store does not stall other sessions.
+		this.callbackMtx.RLock()
+		session, found := this.callbackSessions[callbackId]
+		this.callbackMtx.RUnlock()
+
+		approved := fingerprint
+		if found && approved == "" && session.getState() == SessionPending {
+			approved = session.fingerprint
+		}
+
+		record, err := this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+			record.Admission = &Admission{
+				Decision:    AdmissionApproved,
+				Fingerprint: approved,
+				DecidedAt:   time.Now(),
+				DecidedBy:   decidedBy,
+			}
+		})
+		if err != nil {
+			return record, err
+		}
+
+		// The session may have been replaced while the record was updated.
+		this.callbackMtx.Lock()
+		session, found = this.callbackSessions[callbackId]
+		if !found || session.getState() != SessionPending {
+			this.callbackMtx.Unlock()
+			return record, nil
+		}
+		if session.fingerprint == approved {
+			session.setState(SessionActive)
+			session.log.Infoln("Callback session approved.")
+			this.publishCallbackConnectionEvent(EventUpdated, AdmissionApproved, callbackId, session.copyDesc())
+			this.callbackMtx.Unlock()
+			return record, nil
+		}
+		this.callbackMtx.Unlock()
+
+		// A session registered while an approval for the next registrant was
+		// recorded, so approve its source instead.
+		if approved != "" {
+			return record, nil
+		}
+	}
+}
+
+// RejectCallback rejects a callback ID, refusing further registrations and
+// closing its session if it is pending.
+func (this *ConnectionManager) RejectCallback(callbackId string, decidedBy string) (CallbackRecord, error) {
+	record, err := this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+		record.Admission = &Admission{
+			Decision:  AdmissionRejected,
+			DecidedAt: time.Now(),
+			DecidedBy: decidedBy,
+		}
+	})
+	if err != nil {
+		return record, err
+	}
+
+	this.callbackMtx.RLock()
+	session, found := this.callbackSessions[callbackId]
+	this.callbackMtx.RUnlock()
+	if found && session.getState() == SessionPending {
+		session.log.Infoln("Callback session rejected. Disconnecting.")
+		session.DisconnectWithReason(CloseCodePolicyViolation, ReasonRejected)
+	}
+	return record, nil
+}
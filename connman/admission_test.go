@@ -0,0 +1,144 @@
+package connman
+
+import (
+	"testing"
+	"time"
+)
+
+// sessionState returns the state of the session of callbackId.
+func sessionState(t *testing.T, cm *ConnectionManager, callbackId string) string {
+	desc, found := cm.GetCallbackSession(callbackId)
+	if !found {
+		t.Fatalf("%s has no session", callbackId)
+	}
+	return desc.State
+}
+
+// waitDisconnected waits for the session of callbackId to end, returning the
+// reason.
+func waitDisconnected(t *testing.T, eventCh <-chan CallbackConnectionEvent, callbackId string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-eventCh:
+			if event.EventType == EventDisconnected && event.CallbackId == callbackId {
+				return event.Reason
+			}
+		case <-timeout:
+			t.Fatalf("session of %s did not end", callbackId)
+		}
+	}
+}
+
+// disconnect ends the session of callbackId and waits for it to be removed.
+func disconnect(t *testing.T, cm *ConnectionManager, eventCh <-chan CallbackConnectionEvent, callbackId string) {
+	if err := cm.DisconnectCallbackConnection(callbackId); err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnected(t, eventCh, callbackId)
+}
+
+func TestApprovePending(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	cm.SetRequireApproval(true)
+	testCallback(t, cm, "host1")
+
+	if state := sessionState(t, cm, "host1"); state != SessionPending {
+		t.Fatalf("new session is %s, want %s", state, SessionPending)
+	}
+	select {
+	case err := <-testClient(t, cm, "host1"):
+		if _, ok := err.(*ErrSessionPending); !ok {
+			t.Fatalf("client connection returned %v, want session pending", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client connection to a pending session was not refused")
+	}
+
+	record, err := cm.ApproveCallback("host1", "", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admission := record.Admission; admission == nil || admission.Decision != AdmissionApproved ||
+		admission.Fingerprint != "192.0.2.1" || admission.DecidedBy != "operator" {
+		t.Errorf("admission = %+v, want approved for the pending session by operator", record.Admission)
+	}
+	if state := sessionState(t, cm, "host1"); state != SessionActive {
+		t.Errorf("approved session is %s, want %s", state, SessionActive)
+	}
+	if err := cm.CheckClientConnection("host1", SessionOrigin{}); err != nil {
+		t.Errorf("client connection to the approved session refused: %v", err)
+	}
+}
+
+func TestApproveOtherSource(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	cm.SetRequireApproval(true)
+	testCallback(t, cm, "host1")
+
+	// Approving another source leaves the session pending.
+	if _, err := cm.ApproveCallback("host1", "198.51.100.7", "operator"); err != nil {
+		t.Fatal(err)
+	}
+	if state := sessionState(t, cm, "host1"); state != SessionPending {
+		t.Errorf("session from an unapproved source is %s, want %s", state, SessionPending)
+	}
+}
+
+func TestAdmitOnReconnect(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	cm.SetRequireApproval(true)
+	eventCh := cm.SubscribeCallbackEvents(64)
+	defer cm.UnsubscribeCallbackEvents(eventCh)
+
+	// An approval made before the ID registers binds to the first registrant.
+	if _, err := cm.ApproveCallback("host1", "", "operator"); err != nil {
+		t.Fatal(err)
+	}
+	testCallback(t, cm, "host1")
+	if state := sessionState(t, cm, "host1"); state != SessionActive {
+		t.Fatalf("session of the first registrant is %s, want %s", state, SessionActive)
+	}
+	record, _, err := cm.GetCallbackRecord("host1")
+	if err != nil || record.Admission == nil || record.Admission.Fingerprint != "192.0.2.1" {
+		t.Fatalf("admission = %+v, %v, want bound to the first registrant", record.Admission, err)
+	}
+
+	// The same source is admitted again when it reconnects.
+	disconnect(t, cm, eventCh, "host1")
+	testCallbackOrigin(t, cm, "host1", SessionOrigin{RemoteAddr: "192.0.2.1:5678"})
+	if state := sessionState(t, cm, "host1"); state != SessionActive {
+		t.Errorf("session of the approved source is %s, want %s", state, SessionActive)
+	}
+
+	// Another source is held pending.
+	disconnect(t, cm, eventCh, "host1")
+	testCallbackOrigin(t, cm, "host1", SessionOrigin{RemoteAddr: "198.51.100.7:1234"})
+	if state := sessionState(t, cm, "host1"); state != SessionPending {
+		t.Errorf("session of another source is %s, want %s", state, SessionPending)
+	}
+}
+
+func TestReject(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	cm.SetRequireApproval(true)
+	eventCh := cm.SubscribeCallbackEvents(64)
+	defer cm.UnsubscribeCallbackEvents(eventCh)
+	testCallback(t, cm, "host1")
+
+	record, err := cm.RejectCallback("host1", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Admission == nil || record.Admission.Decision != AdmissionRejected {
+		t.Errorf("admission = %+v, want rejected", record.Admission)
+	}
+	if reason := waitDisconnected(t, eventCh, "host1"); reason != ReasonRejected {
+		t.Errorf("pending session closed with %q, want %q", reason, ReasonRejected)
+	}
+
+	err = cm.CheckCallbackConnection("host1", SessionOrigin{RemoteAddr: "192.0.2.1:1234"})
+	if _, ok := err.(*ErrRegistrationRejected); !ok {
+		t.Errorf("registration of a rejected ID returned %v, want rejected", err)
+	}
+}
@@ -0,0 +1,158 @@
+package connman
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/wrouesnel/callback/control"
+	"strings"
+	"time"
+)
+
+const (
+	// allocatedIdBytes is the randomness of allocated ID suffixes.
+	allocatedIdBytes = 5
+	// allocateAttempts bounds retries of colliding allocations.
+	allocateAttempts = 10
+	// reclaimSecretBytes is the randomness of reclaim secrets.
+	reclaimSecretBytes = 32
+)
+
+// ErrInvalidIdPattern is returned when allocating a callback ID from a
+// malformed pattern.
+type ErrInvalidIdPattern struct {
+	Pattern string
+}
+
+func (err ErrInvalidIdPattern) Error() string {
+	return fmt.Sprintf("invalid callback ID pattern %q: must contain a single %s", err.Pattern, control.IdWildcard)
+}
+
+// ErrAllocationFailed is returned when no unused callback ID could be found
+// for a pattern.
+type ErrAllocationFailed struct {
+	Pattern string
+}
+
+func (err ErrAllocationFailed) Error() string {
+	return fmt.Sprintf("could not allocate an unused callback ID for %q", err.Pattern)
+}
+
+// ErrReclaimDenied is returned when registering a server allocated callback ID
+// without its reclaim secret.
+type ErrReclaimDenied struct {
+	CallbackId string
+}
+
+func (err ErrReclaimDenied) Error() string {
+	return fmt.Sprintf("callback ID %s was allocated to another registrant", err.CallbackId)
+}
+
+// IsIdPattern returns true if callbackId asks for an ID to be allocated.
+func IsIdPattern(callbackId string) bool {
+	return strings.Contains(callbackId, control.IdWildcard)
+}
+
+// AllocateCallbackId reserves an unused callback ID for pattern, which
+// contains a single control.IdWildcard, returning it and the secret later
+// registrations of the ID must present. The reservation is kept once the ID
+// has registered; until then it should be released if the registration
+// fails.
+func (this *ConnectionManager) AllocateCallbackId(pattern string) (string, string, error) {
+	if strings.Count(pattern, control.IdWildcard) != 1 {
+		return "", "", &ErrInvalidIdPattern{pattern}
+	}
+
+	b := make([]byte, reclaimSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	reserve := func(record *CallbackRecord) {
+		record.Reservation = &Reservation{
+			SecretHash:  hashReclaimSecret(secret),
+			AllocatedAt: time.Now(),
+		}
+	}
+
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < allocateAttempts; i++ {
+		b := make([]byte, allocatedIdBytes)
+		if _, err := rand.Read(b); err != nil {
+			return "", "", err
+		}
+		callbackId := strings.Replace(pattern, control.IdWildcard, strings.ToLower(encoding.EncodeToString(b)), 1)
+
+		if this.callbackIdConnected(callbackId) {
+			continue
+		}
+		// Creating the record reserves the ID, so concurrent allocations
+		// cannot both be given it.
+		created, err := this.sessionStore.Create(callbackId, reserve)
+		if err != nil {
+			return "", "", err
+		}
+		if created {
+			return callbackId, secret, nil
+		}
+	}
+	return "", "", &ErrAllocationFailed{pattern}
+}
+
+// callbackIdConnected returns true if callbackId is connected to this server
+// or another node of the cluster.
+func (this *ConnectionManager) callbackIdConnected(callbackId string) bool {
+	this.callbackMtx.RLock()
+	_, _, found := this.resolveCallback(callbackId)
+	this.callbackMtx.RUnlock()
+	if found {
+		return true
+	}
+	if this.cluster != nil {
+		if _, remote := this.cluster.LookupCallback(callbackId); remote {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleaseCallbackId releases the reservation of an allocated callback ID
+// which has never registered, such as when its registration was refused.
+func (this *ConnectionManager) ReleaseCallbackId(callbackId string) error {
+	record, found, err := this.sessionStore.Get(callbackId)
+	if err != nil || !found {
+		return err
+	}
+	if record.Reservation == nil || !record.LastConnectedAt.IsZero() {
+		return nil
+	}
+	return this.sessionStore.Delete(callbackId)
+}
+
+// checkReclaim returns an ErrReclaimDenied if callbackId was allocated and
+// origin does not present its reclaim secret.
+func (this *ConnectionManager) checkReclaim(callbackId string, origin SessionOrigin) error {
+	record, found, err := this.sessionStore.Get(callbackId)
+	if err != nil {
+		return err
+	}
+	if !found || record.Reservation == nil {
+		return nil
+	}
+	hash := hashReclaimSecret(origin.ReclaimSecret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(record.Reservation.SecretHash)) != 1 {
+		return &ErrReclaimDenied{callbackId}
+	}
+	return nil
+}
+
+// hashReclaimSecret returns the stored form of a reclaim secret. Secrets are
+// random, so are not salted.
+func hashReclaimSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,86 @@
+package connman
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAllocateCallbackId(t *testing.T) {
+	cm := NewConnectionManager(1024)
+
+	callbackId, secret, err := cm.AllocateCallbackId("ci-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(callbackId, "ci-") || len(callbackId) <= len("ci-") || IsIdPattern(callbackId) {
+		t.Errorf("allocated %q for pattern ci-*", callbackId)
+	}
+	if secret == "" {
+		t.Fatal("no reclaim secret was issued")
+	}
+
+	// The ID is reserved as soon as it is allocated.
+	record, found, err := cm.GetCallbackRecord(callbackId)
+	if err != nil || !found || record.Reservation == nil {
+		t.Fatalf("record of allocated ID = %+v, %v, %v; want a reservation", record, found, err)
+	}
+	if err := cm.CheckCallbackConnection(callbackId, SessionOrigin{}); err == nil {
+		t.Error("registration without the reclaim secret was permitted")
+	} else if _, ok := err.(*ErrReclaimDenied); !ok {
+		t.Errorf("registration without the reclaim secret returned %v, want ErrReclaimDenied", err)
+	}
+	if err := cm.CheckCallbackConnection(callbackId, SessionOrigin{ReclaimSecret: "wrong"}); err == nil {
+		t.Error("registration with the wrong reclaim secret was permitted")
+	}
+	if err := cm.CheckCallbackConnection(callbackId, SessionOrigin{ReclaimSecret: secret}); err != nil {
+		t.Errorf("registration with the reclaim secret was refused: %v", err)
+	}
+
+	other, _, err := cm.AllocateCallbackId("ci-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == callbackId {
+		t.Errorf("allocated %q twice", callbackId)
+	}
+
+	for _, pattern := range []string{"ci", "ci-*-*"} {
+		if _, _, err := cm.AllocateCallbackId(pattern); err == nil {
+			t.Errorf("allocated an ID for invalid pattern %q", pattern)
+		}
+	}
+}
+
+func TestReleaseCallbackId(t *testing.T) {
+	cm := NewConnectionManager(1024)
+
+	unused, _, err := cm.AllocateCallbackId("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.ReleaseCallbackId(unused); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := cm.GetCallbackRecord(unused); found {
+		t.Error("reservation of an ID which never registered was kept")
+	}
+
+	used, secret, err := cm.AllocateCallbackId("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCallbackOrigin(t, cm, used, SessionOrigin{RemoteAddr: "192.0.2.1:1234", ReclaimSecret: secret})
+	if err := cm.ReleaseCallbackId(used); err != nil {
+		t.Fatal(err)
+	}
+	if record, found, _ := cm.GetCallbackRecord(used); !found || record.Reservation == nil {
+		t.Error("reservation of an ID which registered was released")
+	}
+
+	// IDs which were not allocated are not released.
+	cm.SetCallbackNotes("static", "kept")
+	cm.ReleaseCallbackId("static")
+	if _, found, _ := cm.GetCallbackRecord("static"); !found {
+		t.Error("record of a static ID was released")
+	}
+}
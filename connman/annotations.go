@@ -0,0 +1,96 @@
+package connman
+
+import (
+	"github.com/wrouesnel/go.log"
+	"sort"
+	"time"
+)
+
+// maxAnnotationHistory is the number of annotation changes kept per callback ID.
+const maxAnnotationHistory = 50
+
+// AnnotationChange records an edit of the annotations of a callback ID.
+type AnnotationChange struct {
+	At time.Time `json:"at"`
+	By string    `json:"by,omitempty"`
+	// Set are the annotations added or changed, with their new values.
+	Set map[string]string `json:"set,omitempty"`
+	// Removed are the keys of the annotations removed.
+	Removed []string `json:"removed,omitempty"`
+}
+
+// diffAnnotations returns the change from old to new, and false if there is
+// none.
+func diffAnnotations(old map[string]string, new map[string]string) (AnnotationChange, bool) {
+	change := AnnotationChange{}
+	for k, v := range new {
+		if oldValue, found := old[k]; !found || oldValue != v {
+			if change.Set == nil {
+				change.Set = make(map[string]string)
+			}
+			change.Set[k] = v
+		}
+	}
+	for k := range old {
+		if _, found := new[k]; !found {
+			change.Removed = append(change.Removed, k)
+		}
+	}
+	sort.Strings(change.Removed)
+	return change, change.Set != nil || change.Removed != nil
+}
+
+// SetCallbackAnnotations replaces the annotations of a callback ID, recording
+// the change in its history. The annotations of a connected session of the ID
+// change immediately.
+func (this *ConnectionManager) SetCallbackAnnotations(callbackId string, annotations map[string]string, changedBy string) (CallbackRecord, error) {
+	// Annotations are shared by session descriptions, so are never modified
+	// once set.
+	copied := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		copied[k] = v
+	}
+	if len(copied) == 0 {
+		copied = nil
+	}
+
+	changed := false
+	record, err := this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+		change, found := diffAnnotations(record.Annotations, copied)
+		if !found {
+			return
+		}
+		changed = true
+		change.At = time.Now()
+		change.By = changedBy
+		record.Annotations = copied
+		record.AnnotationHistory = append(record.AnnotationHistory, change)
+		if n := len(record.AnnotationHistory); n > maxAnnotationHistory {
+			record.AnnotationHistory = record.AnnotationHistory[n-maxAnnotationHistory:]
+		}
+	})
+	if err != nil || !changed {
+		return record, err
+	}
+
+	this.callbackMtx.RLock()
+	session, found := this.callbackSessions[callbackId]
+	this.callbackMtx.RUnlock()
+	if found {
+		session.setAnnotations(copied)
+		this.publishCallbackConnectionEvent(EventUpdated, "annotations changed", callbackId, session.copyDesc())
+	}
+	return record, nil
+}
+
+// callbackAnnotations returns the stored annotations of a callback ID.
+func (this *ConnectionManager) callbackAnnotations(callbackId string) map[string]string {
+	record, found, err := this.sessionStore.Get(callbackId)
+	if err != nil {
+		log.With("callback_id", callbackId).Errorln("Could not get callback record:", err)
+	}
+	if !found {
+		return nil
+	}
+	return record.Annotations
+}
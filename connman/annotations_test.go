@@ -0,0 +1,107 @@
+package connman
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffAnnotations(t *testing.T) {
+	old := map[string]string{"owner": "team-db", "ticket": "INC-1", "site": "syd"}
+	change, changed := diffAnnotations(old, map[string]string{"owner": "team-web", "site": "syd", "customer": "acme"})
+	if !changed {
+		t.Fatal("no change found")
+	}
+	if want := map[string]string{"owner": "team-web", "customer": "acme"}; !reflect.DeepEqual(change.Set, want) {
+		t.Errorf("set %v, want %v", change.Set, want)
+	}
+	if want := []string{"ticket"}; !reflect.DeepEqual(change.Removed, want) {
+		t.Errorf("removed %v, want %v", change.Removed, want)
+	}
+
+	if _, changed := diffAnnotations(old, map[string]string{"owner": "team-db", "ticket": "INC-1", "site": "syd"}); changed {
+		t.Error("identical annotations changed")
+	}
+	if change, _ := diffAnnotations(old, nil); !reflect.DeepEqual(change.Removed, []string{"owner", "site", "ticket"}) {
+		t.Errorf("removing all annotations removed %v", change.Removed)
+	}
+}
+
+func TestSetCallbackAnnotations(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	eventCh := cm.SubscribeCallbackEvents(16)
+	defer cm.UnsubscribeCallbackEvents(eventCh)
+	testCallback(t, cm, "host1")
+
+	before := time.Now()
+	if _, err := cm.SetCallbackAnnotations("host1", map[string]string{"owner": "team-db", "ticket": "INC-1"}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := cm.SetCallbackAnnotations("host1", map[string]string{"owner": "team-web"}, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"owner": "team-web"}; !reflect.DeepEqual(record.Annotations, want) {
+		t.Errorf("annotations = %v, want %v", record.Annotations, want)
+	}
+	if len(record.AnnotationHistory) != 2 {
+		t.Fatalf("history = %+v, want 2 changes", record.AnnotationHistory)
+	}
+	first, second := record.AnnotationHistory[0], record.AnnotationHistory[1]
+	if first.By != "alice" || len(first.Set) != 2 || first.Removed != nil || first.At.Before(before) {
+		t.Errorf("first change = %+v, want both annotations set by alice", first)
+	}
+	if second.By != "bob" || !reflect.DeepEqual(second.Set, map[string]string{"owner": "team-web"}) ||
+		!reflect.DeepEqual(second.Removed, []string{"ticket"}) {
+		t.Errorf("second change = %+v, want owner changed and ticket removed by bob", second)
+	}
+
+	// Setting the same annotations is not a change.
+	record, err = cm.SetCallbackAnnotations("host1", map[string]string{"owner": "team-web"}, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.AnnotationHistory) != 2 {
+		t.Errorf("history = %+v, want no change recorded", record.AnnotationHistory)
+	}
+
+	// The connected session is updated.
+	if desc, _ := cm.GetCallbackSession("host1"); !reflect.DeepEqual(desc.Annotations, map[string]string{"owner": "team-web"}) {
+		t.Errorf("session annotations = %v", desc.Annotations)
+	}
+	updates := 0
+	for updates < 2 {
+		select {
+		case event := <-eventCh:
+			if event.EventType == EventUpdated && event.Reason == "annotations changed" {
+				updates++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d updates published, want 2", updates)
+		}
+	}
+}
+
+func TestAnnotationHistoryTruncated(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	var record CallbackRecord
+	for i := 0; i < maxAnnotationHistory+10; i++ {
+		var err error
+		record, err = cm.SetCallbackAnnotations("host1", map[string]string{"revision": fmt.Sprint(i)}, fmt.Sprint("editor-", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(record.AnnotationHistory) != maxAnnotationHistory {
+		t.Fatalf("history has %d changes, want %d", len(record.AnnotationHistory), maxAnnotationHistory)
+	}
+	// The most recent changes are kept.
+	if by := record.AnnotationHistory[0].By; by != "editor-10" {
+		t.Errorf("oldest change kept is by %s, want editor-10", by)
+	}
+	if by := record.AnnotationHistory[maxAnnotationHistory-1].By; by != fmt.Sprint("editor-", maxAnnotationHistory+9) {
+		t.Errorf("latest change is by %s", by)
+	}
+}
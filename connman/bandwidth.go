@@ -0,0 +1,177 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/util/ratelimit"
+	"sync"
+)
+
+// BandwidthLimit is a pair of byte rates, one for each direction of a client
+// session. Zero rates are unlimited.
+type BandwidthLimit struct {
+	// ToCallback limits data sent by clients to the callback session.
+	ToCallback ratelimit.Rate `json:"to_callback"`
+	// ToClient limits data sent by the callback session to clients.
+	ToClient ratelimit.Rate `json:"to_client"`
+}
+
+// BandwidthLimits configures proxy bandwidth throttling. Each level has its
+// own token buckets, and data must be admitted by every level.
+type BandwidthLimits struct {
+	// Global is shared by all client sessions.
+	Global BandwidthLimit `json:"global"`
+	// PerCallback is shared by all client sessions of a callback session.
+	PerCallback BandwidthLimit `json:"per_callback"`
+	// Callbacks overrides PerCallback for specific callback IDs.
+	Callbacks map[string]BandwidthLimit `json:"callbacks,omitempty"`
+	// PerClient applies to each client session.
+	PerClient BandwidthLimit `json:"per_client"`
+}
+
+// perCallback returns the shared limit of a callback ID.
+func (bl BandwidthLimits) perCallback(callbackId string) BandwidthLimit {
+	if limit, found := bl.Callbacks[callbackId]; found {
+		return limit
+	}
+	return bl.PerCallback
+}
+
+// bandwidthBuckets holds the token buckets of one level of throttling.
+type bandwidthBuckets struct {
+	toCallback *ratelimit.Bucket
+	toClient   *ratelimit.Bucket
+	// refs counts the client sessions using shared buckets.
+	refs int
+}
+
+func newBandwidthBuckets(limit BandwidthLimit) *bandwidthBuckets {
+	return &bandwidthBuckets{
+		toCallback: ratelimit.NewBucket(limit.ToCallback),
+		toClient:   ratelimit.NewBucket(limit.ToClient),
+	}
+}
+
+func (bb *bandwidthBuckets) setLimit(limit BandwidthLimit) {
+	bb.toCallback.SetRate(limit.ToCallback)
+	bb.toClient.SetRate(limit.ToClient)
+}
+
+// bandwidthThrottle tracks the buckets of active client sessions so limits
+// can be changed at runtime.
+type bandwidthThrottle struct {
+	limits    BandwidthLimits
+	global    *bandwidthBuckets
+	callbacks map[string]*bandwidthBuckets
+	clients   map[uint64]*bandwidthBuckets
+	mtx       sync.Mutex
+}
+
+func newBandwidthThrottle() *bandwidthThrottle {
+	return &bandwidthThrottle{
+		global:    newBandwidthBuckets(BandwidthLimit{}),
+		callbacks: make(map[string]*bandwidthBuckets),
+		clients:   make(map[uint64]*bandwidthBuckets),
+	}
+}
+
+// acquire returns the buckets a client session must pass data through in
+// each direction.
+func (bt *bandwidthThrottle) acquire(callbackId string, sessionId uint64) (toCallback, toClient ratelimit.Buckets) {
+	bt.mtx.Lock()
+	defer bt.mtx.Unlock()
+
+	shared, found := bt.callbacks[callbackId]
+	if !found {
+		shared = newBandwidthBuckets(bt.limits.perCallback(callbackId))
+		bt.callbacks[callbackId] = shared
+	}
+	shared.refs++
+
+	client := newBandwidthBuckets(bt.limits.PerClient)
+	bt.clients[sessionId] = client
+
+	toCallback = ratelimit.Buckets{client.toCallback, shared.toCallback, bt.global.toCallback}
+	toClient = ratelimit.Buckets{client.toClient, shared.toClient, bt.global.toClient}
+	return toCallback, toClient
+}
+
+// release discards the buckets of a finished client session.
+func (bt *bandwidthThrottle) release(callbackId string, sessionId uint64) {
+	bt.mtx.Lock()
+	defer bt.mtx.Unlock()
+
+	delete(bt.clients, sessionId)
+	if shared, found := bt.callbacks[callbackId]; found {
+		shared.refs--
+		if shared.refs <= 0 {
+			delete(bt.callbacks, callbackId)
+		}
+	}
+}
+
+// setLimits applies new limits, including to active sessions.
+func (bt *bandwidthThrottle) setLimits(limits BandwidthLimits) {
+	bt.mtx.Lock()
+	defer bt.mtx.Unlock()
+	bt.applyLimits(limits)
+}
+
+// applyLimits must be called with the lock held.
+func (bt *bandwidthThrottle) applyLimits(limits BandwidthLimits) {
+	callbacks := make(map[string]BandwidthLimit, len(limits.Callbacks))
+	for callbackId, limit := range limits.Callbacks {
+		callbacks[callbackId] = limit
+	}
+	limits.Callbacks = callbacks
+
+	bt.limits = limits
+	bt.global.setLimit(limits.Global)
+	for callbackId, shared := range bt.callbacks {
+		shared.setLimit(limits.perCallback(callbackId))
+	}
+	for _, client := range bt.clients {
+		client.setLimit(limits.PerClient)
+	}
+}
+
+// setCallbackLimit sets or, if limit is nil, removes the override of a
+// callback ID.
+func (bt *bandwidthThrottle) setCallbackLimit(callbackId string, limit *BandwidthLimit) {
+	bt.mtx.Lock()
+	defer bt.mtx.Unlock()
+
+	limits := bt.limits
+	callbacks := make(map[string]BandwidthLimit, len(limits.Callbacks)+1)
+	for id, l := range limits.Callbacks {
+		callbacks[id] = l
+	}
+	if limit != nil {
+		callbacks[callbackId] = *limit
+	} else {
+		delete(callbacks, callbackId)
+	}
+	limits.Callbacks = callbacks
+	bt.applyLimits(limits)
+}
+
+func (bt *bandwidthThrottle) getLimits() BandwidthLimits {
+	bt.mtx.Lock()
+	defer bt.mtx.Unlock()
+	return bt.limits
+}
+
+// SetBandwidthLimits replaces the proxy bandwidth limits. Active sessions are
+// throttled to the new limits immediately.
+func (this *ConnectionManager) SetBandwidthLimits(limits BandwidthLimits) {
+	this.bandwidth.setLimits(limits)
+}
+
+// GetBandwidthLimits returns the current proxy bandwidth limits.
+func (this *ConnectionManager) GetBandwidthLimits() BandwidthLimits {
+	return this.bandwidth.getLimits()
+}
+
+// SetCallbackBandwidthLimit overrides the shared bandwidth limit of a single
+// callback ID. A nil limit removes the override.
+func (this *ConnectionManager) SetCallbackBandwidthLimit(callbackId string, limit *BandwidthLimit) {
+	this.bandwidth.setCallbackLimit(callbackId, limit)
+}
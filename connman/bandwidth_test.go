@@ -0,0 +1,131 @@
+package connman
+
+import (
+	"github.com/hashicorp/yamux"
+	"github.com/wrouesnel/callback/util/ratelimit"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCallback registers callbackId with cm, counting the bytes its
+// streams receive from clients.
+func countingCallback(t *testing.T, cm *ConnectionManager, callbackId string) *uint64 {
+	serverConn, callbackConn := net.Pipe()
+	doneCh := make(chan struct{})
+	var doneOnce sync.Once
+	t.Cleanup(func() {
+		callbackConn.Close()
+		doneOnce.Do(func() { close(doneCh) })
+	})
+
+	resultCh := cm.CallbackConnection(callbackId, SessionOrigin{RemoteAddr: "192.0.2.1:1234"}, serverConn, doneCh)
+	go func() {
+		for range resultCh {
+		}
+		doneOnce.Do(func() { close(doneCh) })
+	}()
+
+	muxServer, err := yamux.Server(callbackConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := new(uint64)
+	go func() {
+		for {
+			stream, err := muxServer.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := stream.Read(buf)
+					atomic.AddUint64(received, uint64(n))
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, found := cm.GetCallbackSession(callbackId); found {
+			return received
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callback session was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// floodingClient connects a client to callbackId which sends as fast as it
+// is allowed to until the test ends.
+func floodingClient(t *testing.T, cm *ConnectionManager, callbackId string) {
+	serverConn, clientConn := net.Pipe()
+	doneCh := make(chan struct{})
+	t.Cleanup(func() {
+		clientConn.Close()
+		close(doneCh)
+	})
+	errCh := cm.ClientConnection(callbackId, SessionOrigin{RemoteAddr: "198.51.100.1:4321"}, serverConn, doneCh)
+	go func() {
+		for range errCh {
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := clientConn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	go io.Copy(ioutil.Discard, clientConn)
+}
+
+// throughput returns the bytes counted by received over period.
+func throughput(received *uint64, period time.Duration) uint64 {
+	start := atomic.LoadUint64(received)
+	time.Sleep(period)
+	return atomic.LoadUint64(received) - start
+}
+
+func TestBandwidthThrottling(t *testing.T) {
+	const limited = 16 * 1024
+
+	cm := NewConnectionManager(1024)
+	cm.SetBandwidthLimits(BandwidthLimits{
+		PerCallback: BandwidthLimit{ToCallback: ratelimit.Rate{PerSecond: limited, Burst: 1024}},
+	})
+	received := countingCallback(t, cm, "host1")
+	floodingClient(t, cm, "host1")
+
+	// The session is throttled to the shared limit of the callback.
+	if n := throughput(received, time.Second); n < limited/4 || n > limited*3/2 {
+		t.Fatalf("received %d bytes in 1s, want about %d", n, limited)
+	}
+
+	// A per-ID override takes effect on the running session.
+	cm.SetCallbackBandwidthLimit("host1", &BandwidthLimit{ToCallback: ratelimit.Rate{PerSecond: 64 * limited, Burst: 1024}})
+	time.Sleep(100 * time.Millisecond)
+	if n := throughput(received, time.Second); n < 8*limited {
+		t.Fatalf("received %d bytes in 1s after raising the limit, want more than %d", n, 8*limited)
+	}
+
+	// As do new limits, which replace the override.
+	cm.SetBandwidthLimits(BandwidthLimits{
+		PerClient: BandwidthLimit{ToCallback: ratelimit.Rate{PerSecond: limited, Burst: 1024}},
+	})
+	time.Sleep(200 * time.Millisecond)
+	if n := throughput(received, time.Second); n > limited*3/2 {
+		t.Fatalf("received %d bytes in 1s after lowering the limit, want about %d", n, limited)
+	}
+}
@@ -0,0 +1,137 @@
+package connman
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/go.log"
+	"io"
+	"sync/atomic"
+)
+
+// Cluster is implemented by cluster membership to give the connection manager
+// a cluster-wide view of sessions, and to relay client connections to
+// callback sessions held by other nodes.
+type Cluster interface {
+	// NodeId names this node in session descriptions.
+	NodeId() string
+	// LookupCallback returns the description of a callback session held by
+	// another node which can accept clients.
+	LookupCallback(callbackId string) (CallbackSessionDesc, bool)
+	// CheckRemoteCallback returns true if another node holds a callback
+	// session of callbackId, like LookupCallback, or an error if that could
+	// not be determined.
+	CheckRemoteCallback(callbackId string) (bool, error)
+	// RemoteCallbackSessions returns the callback sessions held by other nodes.
+	RemoteCallbackSessions() map[string]CallbackSessionDesc
+	// RemoteClientSessions returns the client sessions of other nodes.
+	RemoteClientSessions() []ClientSessionDesc
+	// DialCallback opens a client connection to a callback session held by
+	// another node.
+	DialCallback(callbackId string, origin SessionOrigin) (io.ReadWriteCloser, error)
+	// PutCallback records a callback session held by this node in the
+	// registry before returning. Other nodes accept registrations of a
+	// session recorded as migrating.
+	PutCallback(callbackId string, desc CallbackSessionDesc) error
+	// GetLease returns the lease of callbackId recorded in the registry, which
+	// may have expired, or nil.
+	GetLease(callbackId string) (*Lease, error)
+	// SwapLease records lease as the lease of callbackId, or removes it if
+	// nil, only if the lease recorded is still current (nil if there was
+	// none). It returns false if another node changed it first.
+	SwapLease(callbackId string, current *Lease, lease *Lease) (bool, error)
+}
+
+// ErrRegistryUnavailable is returned when registering a callback ID while the
+// cluster registry cannot be consulted, since another node may hold it.
+type ErrRegistryUnavailable struct {
+	err error
+}
+
+func (err ErrRegistryUnavailable) Error() string {
+	return "cluster registry unavailable: " + err.err.Error()
+}
+
+// SetCluster joins the connection manager to a cluster. Must be called before
+// any sessions are established.
+func (this *ConnectionManager) SetCluster(cluster Cluster) {
+	this.cluster = cluster
+	this.nodeId = cluster.NodeId()
+}
+
+// ListLocalCallbackSessions returns the callback sessions held by this node,
+// including those exported by relays.
+func (this *ConnectionManager) ListLocalCallbackSessions() map[string]CallbackSessionDesc {
+	this.callbackMtx.RLock()
+	ret := this.exportedSessions()
+	for k, v := range this.callbackSessions {
+		ret[k] = v.copyDesc()
+	}
+	this.callbackMtx.RUnlock()
+
+	this.withLeases(ret)
+	return ret
+}
+
+// ListLocalClientSessions returns the client sessions proxied by this node.
+func (this *ConnectionManager) ListLocalClientSessions() []ClientSessionDesc {
+	this.clientMtx.RLock()
+	defer this.clientMtx.RUnlock()
+
+	ret := make([]ClientSessionDesc, 0, len(this.clientSessions))
+	for _, v := range this.clientSessions {
+		ret = append(ret, v.copy())
+	}
+	return ret
+}
+
+// RelayCallbackEvent publishes a callback event which occurred on another
+// node to local subscribers.
+func (this *ConnectionManager) RelayCallbackEvent(event CallbackConnectionEvent) {
+	this.publishCallbackConnectionEvent(event.EventType, event.Reason, event.CallbackId, event.CallbackSessionDesc)
+}
+
+// RelayClientEvent publishes a client event which occurred on another node to
+// local subscribers.
+func (this *ConnectionManager) RelayClientEvent(event ClientConnectionEvent) {
+	this.publishClientConnectionEvent(event.EventType, event.Reason, event.ClientSessionDesc)
+}
+
+// relayClientConnection proxies a client to a callback session held by another
+// node. The owning node accounts for the session, so it is not recorded here.
+func (this *ConnectionManager) relayClientConnection(callbackId string, origin SessionOrigin, incomingConn io.ReadWriteCloser, doneCh <-chan struct{}) error {
+	log := log.With("remote_addr", origin.RemoteAddr).With("callback_id", callbackId)
+
+	origin.Node = this.nodeId
+	remoteConn, err := this.cluster.DialCallback(callbackId, origin)
+	if err != nil {
+		log.Errorln("Relaying to the owning node failed:", err)
+		sendCloseReason(incomingConn, CloseCodeGoingAway, "callback session unavailable")
+		util.LogErr(log, incomingConn.Close())
+		return err
+	}
+	log.Infoln("Relaying client connection to the owning node.")
+
+	var bytesOut, bytesIn uint64
+	remoteConn = &closeForwarder{remoteConn, incomingConn}
+	perr := <-util.HandleProxy(log, this.proxyBufferSize, incomingConn, remoteConn, doneCh, &bytesOut, &bytesIn)
+	if _, ok := perr.(*websocket.CloseError); ok || perr == io.EOF {
+		perr = nil
+	}
+	log.Infoln("Relayed client disconnected. Bytes out:", atomic.LoadUint64(&bytesOut), "Bytes in:", atomic.LoadUint64(&bytesIn))
+	return perr
+}
+
+// closeForwarder passes the reason the owning node closed a relayed session
+// on to the client.
+type closeForwarder struct {
+	io.ReadWriteCloser
+	peer io.ReadWriteCloser
+}
+
+func (cf *closeForwarder) Read(p []byte) (int, error) {
+	n, err := cf.ReadWriteCloser.Read(p)
+	if closeErr, ok := err.(*websocket.CloseError); ok {
+		sendCloseReason(cf.peer, closeErr.Code, closeErr.Text)
+	}
+	return n, err
+}
@@ -0,0 +1,114 @@
+package connman
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeCluster is a Cluster whose registry holds no sessions, fails with err,
+// or blocks until unblockCh closes. Descriptions put are kept in puts.
+type fakeCluster struct {
+	err       error
+	unblockCh chan struct{}
+	puts      []CallbackSessionDesc
+}
+
+func (c *fakeCluster) NodeId() string { return "node1" }
+
+func (c *fakeCluster) LookupCallback(callbackId string) (CallbackSessionDesc, bool) {
+	return CallbackSessionDesc{}, false
+}
+
+func (c *fakeCluster) CheckRemoteCallback(callbackId string) (bool, error) {
+	if c.unblockCh != nil {
+		<-c.unblockCh
+	}
+	return false, c.err
+}
+
+func (c *fakeCluster) RemoteCallbackSessions() map[string]CallbackSessionDesc { return nil }
+
+func (c *fakeCluster) RemoteClientSessions() []ClientSessionDesc { return nil }
+
+func (c *fakeCluster) DialCallback(callbackId string, origin SessionOrigin) (io.ReadWriteCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeCluster) PutCallback(callbackId string, desc CallbackSessionDesc) error {
+	c.puts = append(c.puts, desc)
+	return c.err
+}
+
+func (c *fakeCluster) GetLease(callbackId string) (*Lease, error) { return nil, c.err }
+
+func (c *fakeCluster) SwapLease(callbackId string, current *Lease, lease *Lease) (bool, error) {
+	return c.err == nil, c.err
+}
+
+func TestRegistryErrorRefusesRegistration(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	cm.SetCluster(&fakeCluster{err: errors.New("registry down")})
+
+	if err := cm.CheckCallbackConnection("host1", SessionOrigin{}); err == nil {
+		t.Error("CheckCallbackConnection permitted a registration without the registry")
+	} else if _, ok := err.(*ErrRegistryUnavailable); !ok {
+		t.Errorf("CheckCallbackConnection returned %v, want ErrRegistryUnavailable", err)
+	}
+
+	serverConn, callbackConn := net.Pipe()
+	defer callbackConn.Close()
+	select {
+	case err := <-cm.CallbackConnection("host1", SessionOrigin{}, serverConn, nil):
+		if _, ok := err.(*ErrRegistryUnavailable); !ok {
+			t.Errorf("CallbackConnection returned %v, want ErrRegistryUnavailable", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("registration was not refused")
+	}
+	if _, found := cm.GetCallbackSession("host1"); found {
+		t.Error("callback session was registered")
+	}
+}
+
+// TestSlowRegistry checks a registration waiting on the registry does not
+// hold up other users of the session table.
+func TestSlowRegistry(t *testing.T) {
+	cluster := &fakeCluster{unblockCh: make(chan struct{})}
+	cm := NewConnectionManager(1024)
+	cm.SetCluster(cluster)
+
+	serverConn, callbackConn := net.Pipe()
+	t.Cleanup(func() { callbackConn.Close() })
+	resultCh := cm.CallbackConnection("host1", SessionOrigin{}, serverConn, nil)
+
+	listed := make(chan struct{})
+	go func() {
+		cm.ListLocalCallbackSessions()
+		cm.GetCallbackSession("host2")
+		close(listed)
+	}()
+	select {
+	case <-listed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session table was locked while the registry was consulted")
+	}
+
+	close(cluster.unblockCh)
+	go func() {
+		for range resultCh {
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, found := cm.GetCallbackSession("host1"); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callback session was not registered once the registry answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
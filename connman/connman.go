@@ -4,6 +4,7 @@ package connman
 
 import (
 	"github.com/hashicorp/yamux"
+	"github.com/wrouesnel/callback/control"
 	"github.com/wrouesnel/callback/util"
 	"github.com/wrouesnel/go.log"
 	"io"
@@ -46,16 +47,84 @@ type ConnectionManager struct {
 	callbackSessions map[string]*callbackSession
 	callbackMtx      sync.RWMutex
 
-	clientSessions map[string]*ClientSessionDesc
-	clientMtx      sync.RWMutex
+	// clientSessions is keyed by a per-session sequence number, since a callback
+	// session may have many clients.
+	clientSessions       map[uint64]*ClientSessionDesc
+	clientSessionCounter uint64
+	clientMtx            sync.RWMutex
 
-	clientSubscribers      map[<-chan ClientSessionDesc]chan<- ClientSessionDesc
+	clientSubscribers      map[<-chan ClientConnectionEvent]chan<- ClientConnectionEvent
 	clientSubscribersMutex sync.RWMutex
 
-	callbackSubscribers      map[<-chan CallbackSessionDesc]chan<- CallbackSessionDesc
+	callbackSubscribers      map[<-chan CallbackConnectionEvent]chan<- CallbackConnectionEvent
 	callbackSubscribersMutex sync.RWMutex
 
 	proxyBufferSize int
+
+	// limits holds the quotas enforced on new sessions.
+	limits    Limits
+	limitsMtx sync.RWMutex
+
+	// muxConfig configures new yamux sessions. nil uses the yamux defaults.
+	muxConfig *yamux.Config
+
+	// lifetime policies applied to new sessions (protected by limitsMtx)
+	lifetimeGlobal    LifetimePolicy
+	lifetimeOverrides []LifetimePolicy
+
+	// bandwidth throttles proxied client sessions.
+	bandwidth *bandwidthThrottle
+
+	// draining is set once Drain is called, after which new sessions are refused.
+	draining int32
+
+	// cluster is set if this node is part of a cluster, and nodeId names it.
+	cluster Cluster
+	nodeId  string
+
+	// usageRecorder is told about every finished client session.
+	usageRecorder UsageRecorder
+
+	// sessionStore keeps the records of callback IDs.
+	sessionStore SessionStore
+
+	// flap tracks registration churn and throttles flapping callbacks.
+	flap *flapDetector
+
+	// requireApproval holds sessions of unapproved callback IDs pending.
+	requireApproval bool
+
+	// schedules restrict when clients may connect (protected by limitsMtx).
+	schedules []*Schedule
+}
+
+// UsageRecorder accounts for finished client sessions.
+type UsageRecorder interface {
+	// RecordClientSession is called once for every client session which was
+	// proxied, after it ends, from the goroutine of the ending session. It may
+	// block briefly, such as to sync the usage to disk.
+	RecordClientSession(desc ClientSessionDesc, disconnectedAt time.Time)
+}
+
+// SessionOrigin describes who established a session.
+type SessionOrigin struct {
+	// RemoteAddr is informational and should be any relevant string which
+	// identifies the connection origin.
+	RemoteAddr string
+	// Principal is the authenticated identity which established the session,
+	// blank if authentication is disabled.
+	Principal string
+	// Labels are key/value metadata reported for the session.
+	Labels map[string]string
+	// Capabilities are the optional protocol features supported by a callback
+	// session (see the control package).
+	Capabilities []string
+	// Node is the cluster node which relayed the session, blank if the
+	// connection was made directly.
+	Node string
+	// ReclaimSecret is presented by registrations of server allocated
+	// callback IDs.
+	ReclaimSecret string
 }
 
 // ClientSessionDesc holds connection information for a client session.
@@ -67,8 +136,11 @@ type ClientSessionDesc struct {
 	ConnectedAt time.Time `json:"connected_at"`
 	// Connection details
 	RemoteAddr string `json:"remote_addr"`
+	Principal  string `json:"principal,omitempty"`
 	// Connection Target
 	CallbackId string `json:"callback_id"`
+	// Cluster node proxying the session
+	Node string `json:"node,omitempty"`
 }
 
 // copy makes a thread-safe copy ClientSessionDesc.
@@ -79,7 +151,9 @@ func (cb *ClientSessionDesc) copy() ClientSessionDesc {
 
 	result.ConnectedAt = cb.ConnectedAt
 	result.RemoteAddr = cb.RemoteAddr
+	result.Principal = cb.Principal
 	result.CallbackId = cb.CallbackId
+	result.Node = cb.Node
 	return result
 }
 
@@ -89,7 +163,28 @@ type CallbackSessionDesc struct {
 	// Establishment time
 	ConnectedAt time.Time `json:"connected_at"`
 	// Connection details
-	RemoteAddr string `json:"remote_addr"`
+	RemoteAddr string            `json:"remote_addr"`
+	Principal  string            `json:"principal,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// Optional protocol features supported by the callback
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Cluster node holding the session
+	Node string `json:"node,omitempty"`
+	// Relay session the session is exported by
+	Relay string `json:"relay,omitempty"`
+	// State is active, pending if awaiting approval, or the state an operator
+	// set on the callback
+	State string `json:"state"`
+	// Operator note explaining the state
+	StateNote string `json:"state_note,omitempty"`
+	// Annotations set by operators on the callback ID
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Flapping state of the callback ID when the session registered
+	Flap *FlapStatus `json:"flap,omitempty"`
+	// Lease granting a client exclusive connect rights
+	Lease *Lease `json:"lease,omitempty"`
+	// Migrating is set while the callback registers with another server
+	Migrating bool `json:"migrating,omitempty"`
 	// Number of clients
 	NumClients uint32 `json:"num_clients"`
 }
@@ -107,6 +202,8 @@ const (
 type ConnManEventHeader struct {
 	EventType   EventType `json:"event_type"`
 	SequenceNum uint32    `json:"sequence_num"`
+	// Reason describes why the event occurred, such as why a session was closed.
+	Reason string `json:"reason,omitempty"`
 }
 
 // ClientConnectionEvent is emitted when an event pertaining to client connections occurs
@@ -118,6 +215,7 @@ type ClientConnectionEvent struct {
 // CallbackConnectionEvent is emitted when an event pertaining to callabck connections occurs
 type CallbackConnectionEvent struct {
 	ConnManEventHeader  `json:",inline"`
+	CallbackId          string `json:"callback_id"`
 	CallbackSessionDesc `json:",inline"`
 }
 
@@ -141,6 +239,10 @@ type callbackSession struct {
 	log log.Logger
 	// muxClient holds the yamux client session. This is the actual callback connection.
 	muxClient *yamux.Session
+	// conn is the underlying connection the mux runs over.
+	conn io.ReadWriteCloser
+	// closeReason records why the session was disconnected.
+	closeReason string
 	// resultCh holds the channel which communicates connection failure/termination
 	// to the underlying websocket. We send an error when we fail to connect,
 	// to signal the underlying request to finish and allow a reset.
@@ -151,6 +253,100 @@ type callbackSession struct {
 	mtx sync.Mutex
 	// desc holds the public accounting data for the session
 	desc CallbackSessionDesc
+	// numClients is the number of connected client sessions (accessed
+	// atomically). It is kept out of desc so desc can be copied safely.
+	numClients uint32
+	// exports holds the sessions exported by a relay. nil if the session is not a relay.
+	exports *relayExports
+	// control receives control messages from the session. nil if it does not send them.
+	control *sessionControl
+	// state is the admission state of the session (protected by mtx).
+	state string
+	// callbackState is the operator set state of the callback and stateNote
+	// explains it (protected by mtx).
+	callbackState string
+	stateNote     string
+	// annotations are the operator set annotations of the callback, replaced
+	// rather than modified (protected by mtx).
+	annotations map[string]string
+	// fingerprint identifies the registrant for admission.
+	fingerprint string
+	// migrating is set while the callback registers with another server
+	// (protected by mtx).
+	migrating bool
+}
+
+// getState returns the admission state of the session.
+func (cbs *callbackSession) getState() string {
+	defer cbs.mtx.Unlock()
+	cbs.mtx.Lock()
+	return cbs.state
+}
+
+// setState changes the admission state of the session.
+func (cbs *callbackSession) setState(state string) {
+	defer cbs.mtx.Unlock()
+	cbs.mtx.Lock()
+	cbs.state = state
+}
+
+// getCallbackState returns the operator set state of the callback and its note.
+func (cbs *callbackSession) getCallbackState() (string, string) {
+	defer cbs.mtx.Unlock()
+	cbs.mtx.Lock()
+	return cbs.callbackState, cbs.stateNote
+}
+
+// setCallbackState changes the operator set state of the callback.
+func (cbs *callbackSession) setCallbackState(state string, note string) {
+	defer cbs.mtx.Unlock()
+	cbs.mtx.Lock()
+	cbs.callbackState = state
+	cbs.stateNote = note
+}
+
+// setAnnotations replaces the annotations of the callback.
+func (cbs *callbackSession) setAnnotations(annotations map[string]string) {
+	defer cbs.mtx.Unlock()
+	cbs.mtx.Lock()
+	cbs.annotations = annotations
+}
+
+// getAnnotations returns the annotations of the callback, which must not be
+// modified.
+func (cbs *callbackSession) getAnnotations() map[string]string {
+	defer cbs.mtx.Unlock()
+	cbs.mtx.Lock()
+	return cbs.annotations
+}
+
+// isMigrating returns true while the callback registers with another server.
+func (cbs *callbackSession) isMigrating() bool {
+	defer cbs.mtx.Unlock()
+	cbs.mtx.Lock()
+	return cbs.migrating
+}
+
+// getCloseReason returns why the session was disconnected.
+func (cbs *callbackSession) getCloseReason() string {
+	defer cbs.mtx.Unlock()
+	cbs.mtx.Lock()
+	return cbs.closeReason
+}
+
+// copyDesc makes a thread-safe copy of the session description.
+func (cbs *callbackSession) copyDesc() CallbackSessionDesc {
+	desc := cbs.desc
+	desc.NumClients = atomic.LoadUint32(&cbs.numClients)
+	desc.State = cbs.getState()
+	callbackState, note := cbs.getCallbackState()
+	if desc.State == SessionActive && callbackState != "" {
+		desc.State = callbackState
+	}
+	desc.StateNote = note
+	desc.Annotations = cbs.getAnnotations()
+	desc.Migrating = cbs.isMigrating()
+	return desc
 }
 
 // shutdownWatch monitors the given channel for closure, and triggers the clean up of the callbackSession.
@@ -175,17 +371,31 @@ func (cbs *callbackSession) GetShutdownChannel() <-chan struct{} {
 // Disconnect manually requests a callback session to end. The effect is that resultCh is closed, which should
 // signal the underlying connection to terminate. We attempt a mux clean up before hand, but its not guaranteed.
 func (cbs *callbackSession) Disconnect() {
-	defer cbs.mtx.Unlock()
-	cbs.mtx.Lock()
+	cbs.DisconnectWithReason(0, ReasonConnectionClosed)
+}
 
+// DisconnectWithReason ends the session as Disconnect does, recording reason. If code is non-zero and the
+// underlying connection supports it the reason is sent to the peer first.
+func (cbs *callbackSession) DisconnectWithReason(code int, reason string) {
+	cbs.mtx.Lock()
 	if cbs.doneCh == nil {
+		cbs.mtx.Unlock()
 		log.Debugln("Session close already sent.")
 		return
 	}
+	cbs.closeReason = reason
+	doneCh := cbs.doneCh
+	cbs.doneCh = nil
+	cbs.mtx.Unlock()
+
+	// The close frame is written without mtx held, so a peer which is slow to
+	// read it does not block readers of the session's state.
+	if code != 0 {
+		sendCloseReason(cbs.conn, code, reason)
+	}
 
 	// Close the doneCh to signal watchers we're shutting down
-	close(cbs.doneCh)
-	cbs.doneCh = nil
+	close(doneCh)
 
 	// Close the channel mux
 	err := cbs.muxClient.Close()
@@ -202,26 +412,64 @@ func (cbs *callbackSession) Disconnect() {
 func NewConnectionManager(proxyBufferSize int) *ConnectionManager {
 	return &ConnectionManager{
 		callbackSessions: make(map[string]*callbackSession),
-		clientSessions:   make(map[string]*ClientSessionDesc),
+		clientSessions:   make(map[uint64]*ClientSessionDesc),
 
-		clientSubscribers:   make(map[<-chan ClientSessionDesc]chan<- ClientSessionDesc),
-		callbackSubscribers: make(map[<-chan CallbackSessionDesc]chan<- CallbackSessionDesc),
+		clientSubscribers:   make(map[<-chan ClientConnectionEvent]chan<- ClientConnectionEvent),
+		callbackSubscribers: make(map[<-chan CallbackConnectionEvent]chan<- CallbackConnectionEvent),
 
 		proxyBufferSize: proxyBufferSize,
+
+		bandwidth: newBandwidthThrottle(),
+
+		sessionStore: NewMemorySessionStore(),
+
+		flap: newFlapDetector(),
 	}
 }
 
+// SetUsageRecorder sets the recorder told about finished client sessions.
+// Must be called before any sessions are established.
+func (this *ConnectionManager) SetUsageRecorder(recorder UsageRecorder) {
+	this.usageRecorder = recorder
+}
+
+// SetMuxConfig sets the yamux configuration used for new callback sessions.
+// Must be called before any sessions are established.
+func (this *ConnectionManager) SetMuxConfig(config *yamux.Config) error {
+	if config != nil {
+		if err := yamux.VerifyConfig(config); err != nil {
+			return err
+		}
+	}
+	this.muxConfig = config
+	return nil
+}
+
 // ListCallbackSessions returns a list of the callback session descriptions
 // currently enabled.
 func (this *ConnectionManager) ListCallbackSessions() *CallbackSessionList {
 	this.callbackMtx.RLock()
-	defer this.callbackMtx.RUnlock()
-
 	ret := make(map[string]CallbackSessionDesc, len(this.callbackSessions))
 
 	for k, v := range this.callbackSessions {
-		ret[k] = v.desc
+		ret[k] = v.copyDesc()
+	}
+	for k, v := range this.exportedSessions() {
+		if _, found := ret[k]; !found {
+			ret[k] = v
+		}
+	}
+
+	if this.cluster != nil {
+		for k, v := range this.cluster.RemoteCallbackSessions() {
+			if _, found := ret[k]; !found {
+				ret[k] = v
+			}
+		}
 	}
+	this.callbackMtx.RUnlock()
+
+	this.withLeases(ret)
 
 	return &CallbackSessionList{
 		SequenceNum: atomic.LoadUint32(&this.callbackSessionEventCounter),
@@ -231,20 +479,20 @@ func (this *ConnectionManager) ListCallbackSessions() *CallbackSessionList {
 
 // SubscribeCallbackEvents returns a channel which yields a stream of events when callback clients
 // connect and disconnect.
-func (this *ConnectionManager) SubscribeCallbackEvents(buffer int) <-chan CallbackSessionDesc {
+func (this *ConnectionManager) SubscribeCallbackEvents(buffer int) <-chan CallbackConnectionEvent {
 	this.callbackSubscribersMutex.Lock()
 	defer this.callbackSubscribersMutex.Unlock()
 
-	ch := make(chan CallbackSessionDesc, buffer)
-	writeCh := (chan<- CallbackSessionDesc)(ch)
-	readCh := (<-chan CallbackSessionDesc)(ch)
+	ch := make(chan CallbackConnectionEvent, buffer)
+	writeCh := (chan<- CallbackConnectionEvent)(ch)
+	readCh := (<-chan CallbackConnectionEvent)(ch)
 	this.callbackSubscribers[readCh] = writeCh
 
 	return readCh
 }
 
 // UnsubscribeCallbackEvents closes a callback events channel for a consumer.
-func (this *ConnectionManager) UnsubscribeCallbackEvents(ch <-chan CallbackSessionDesc) {
+func (this *ConnectionManager) UnsubscribeCallbackEvents(ch <-chan CallbackConnectionEvent) {
 	this.callbackSubscribersMutex.Lock()
 	defer this.callbackSubscribersMutex.Unlock()
 	writeCh, ok := this.callbackSubscribers[ch]
@@ -255,16 +503,50 @@ func (this *ConnectionManager) UnsubscribeCallbackEvents(ch <-chan CallbackSessi
 	delete(this.callbackSubscribers, ch)
 }
 
+// GetCallbackSession returns the description of a single active callback session.
+func (this *ConnectionManager) GetCallbackSession(callbackId string) (CallbackSessionDesc, bool) {
+	desc, found := this.getCallbackSession(callbackId)
+	if found {
+		// Looked up without the session table locked, since leases may be kept
+		// in the cluster registry.
+		desc.Lease = this.lookupLease(callbackId, time.Now())
+	}
+	return desc, found
+}
+
+func (this *ConnectionManager) getCallbackSession(callbackId string) (CallbackSessionDesc, bool) {
+	this.callbackMtx.RLock()
+	defer this.callbackMtx.RUnlock()
+
+	session, exportId, found := this.resolveCallback(callbackId)
+	if !found {
+		if this.cluster != nil {
+			return this.cluster.LookupCallback(callbackId)
+		}
+		return CallbackSessionDesc{}, false
+	}
+	if exportId != "" {
+		export, _ := session.exports.get(exportId)
+		desc := exportDesc(callbackId[:len(callbackId)-len(exportId)-len(RelaySeparator)], session.copyDesc(), export)
+		desc.Annotations = this.callbackAnnotations(callbackId)
+		return desc, true
+	}
+	return session.copyDesc(), true
+}
+
 // ListClientSessions returns a list of the callback session descriptions
 // currently enabled.
 func (this *ConnectionManager) ListClientSessions() *ClientSessionList {
 	this.clientMtx.RLock()
 	defer this.clientMtx.RUnlock()
 
-	ret := make([]ClientSessionDesc, len(this.clientSessions))
-	i := 0
+	ret := make([]ClientSessionDesc, 0, len(this.clientSessions))
 	for _, v := range this.clientSessions {
-		ret[i] = v.copy()
+		ret = append(ret, v.copy())
+	}
+
+	if this.cluster != nil {
+		ret = append(ret, this.cluster.RemoteClientSessions()...)
 	}
 
 	return &ClientSessionList{
@@ -275,20 +557,20 @@ func (this *ConnectionManager) ListClientSessions() *ClientSessionList {
 
 // SubscribeCallbackEvents returns a channel which yields a stream of events when callback clients
 // connect and disconnect.
-func (this *ConnectionManager) SubscribeClientConnectionEvents(buffer int) <-chan ClientSessionDesc {
+func (this *ConnectionManager) SubscribeClientConnectionEvents(buffer int) <-chan ClientConnectionEvent {
 	this.clientSubscribersMutex.Lock()
 	defer this.clientSubscribersMutex.Unlock()
 
-	ch := make(chan ClientSessionDesc, buffer)
-	writeCh := (chan<- ClientSessionDesc)(ch)
-	readCh := (<-chan ClientSessionDesc)(ch)
+	ch := make(chan ClientConnectionEvent, buffer)
+	writeCh := (chan<- ClientConnectionEvent)(ch)
+	readCh := (<-chan ClientConnectionEvent)(ch)
 	this.clientSubscribers[readCh] = writeCh
 
 	return readCh
 }
 
 // UnsubscribeCallbackEvents closes a callback events channel for a consumer.
-func (this *ConnectionManager) UnsubscribeClientConnectionEvents(ch <-chan ClientSessionDesc) {
+func (this *ConnectionManager) UnsubscribeClientConnectionEvents(ch <-chan ClientConnectionEvent) {
 	this.clientSubscribersMutex.Lock()
 	defer this.clientSubscribersMutex.Unlock()
 	writeCh, ok := this.clientSubscribers[ch]
@@ -299,87 +581,208 @@ func (this *ConnectionManager) UnsubscribeClientConnectionEvents(ch <-chan Clien
 	delete(this.clientSubscribers, ch)
 }
 
-// internal function for publishing an event record to all subscribers
-//func (this *ConnectionManager) publishClientConnectionEvent(data ClientSessionDesc) {
-//	this.clientSubscribersMutex.RLock()
-//	defer this.clientSubscribersMutex.RUnlock()
-//
-//	for _, sub := range this.clientSubscribers {
-//		select {
-//		case sub <- event:
-//			continue
-//		default:
-//			continue
-//		}
-//	}
-//
-//	// Increment the event sequence number
-//	atomic.AddUint32(&this.clientSessionEventCounter, 1)
-//}
+// publishClientConnectionEvent publishes an event record to all client event
+// subscribers. Slow subscribers miss events, which they can detect from the
+// sequence number.
+func (this *ConnectionManager) publishClientConnectionEvent(eventType EventType, reason string, data ClientSessionDesc) {
+	this.clientSubscribersMutex.RLock()
+	defer this.clientSubscribersMutex.RUnlock()
+
+	event := ClientConnectionEvent{
+		ConnManEventHeader: ConnManEventHeader{
+			EventType:   eventType,
+			SequenceNum: atomic.AddUint32(&this.clientSessionEventCounter, 1),
+			Reason:      reason,
+		},
+		ClientSessionDesc: data,
+	}
+
+	for _, sub := range this.clientSubscribers {
+		select {
+		case sub <- event:
+			continue
+		default:
+			continue
+		}
+	}
+}
+
+// publishCallbackConnectionEvent publishes an event record to all callback
+// event subscribers.
+func (this *ConnectionManager) publishCallbackConnectionEvent(eventType EventType, reason string, callbackId string, data CallbackSessionDesc) {
+	this.callbackSubscribersMutex.RLock()
+	defer this.callbackSubscribersMutex.RUnlock()
+
+	event := CallbackConnectionEvent{
+		ConnManEventHeader: ConnManEventHeader{
+			EventType:   eventType,
+			SequenceNum: atomic.AddUint32(&this.callbackSessionEventCounter, 1),
+			Reason:      reason,
+		},
+		CallbackId:          callbackId,
+		CallbackSessionDesc: data,
+	}
+
+	for _, sub := range this.callbackSubscribers {
+		select {
+		case sub <- event:
+			continue
+		default:
+			continue
+		}
+	}
+}
 
 // CallbackConnection sets up a new callback connection using the given
-// callbackId and an incomingConn object. The remoteAddr is informational and
-// should be any relevant string which identifies the callback origin.
+// callbackId and an incomingConn object. The origin describes who is
+// registering the callback.
 // doneCh is optional, but recommended, and should be a channel which will close
 // when the underlying connection is disconnected (this allows pre-emptive
 // detection of connection failure).
-func (this *ConnectionManager) CallbackConnection(callbackId string, remoteAddr string, incomingConn io.ReadWriteCloser, doneCh <-chan struct{}) <-chan error {
-	log := log.With("remote_addr", remoteAddr).With("callback_id", callbackId)
+func (this *ConnectionManager) CallbackConnection(callbackId string, origin SessionOrigin, incomingConn io.ReadWriteCloser, doneCh <-chan struct{}) <-chan error {
+	log := log.With("remote_addr", origin.RemoteAddr).With("callback_id", callbackId)
 	resultCh := make(chan error)
 
 	go func() {
-		this.callbackMtx.Lock()
-		defer this.callbackMtx.Unlock()
-
-		if callbackSession, found := this.callbackSessions[callbackId]; found {
-			// Is the session closed?
-			if !callbackSession.muxClient.IsClosed() {
-				log.Errorln("Callback session already exists and is active.")
-				if ierr := incomingConn.Close(); ierr != nil {
-					log.Errorln("Error closing websocket connection:", ierr)
-				}
-				resultCh <- &ErrSessionExists{callbackId}
-				return
+		reject := func(err error) {
+			log.Errorln("Rejecting callback session:", err)
+			if ierr := incomingConn.Close(); ierr != nil {
+				log.Errorln("Error closing websocket connection:", ierr)
 			}
+			resultCh <- err
+		}
+
+		// The cluster registry is consulted, and the session store written,
+		// without callbackMtx held so they do not stall other sessions.
+		if rerr := this.checkRemoteCallback(callbackId); rerr != nil {
+			reject(rerr)
+			return
+		}
+		state := this.admit(callbackId, origin)
+
+		this.callbackMtx.Lock()
+
+		// Check the session does not already exist and quotas permit it.
+		if cerr := this.checkCallbackConnection(callbackId, origin); cerr != nil {
+			this.callbackMtx.Unlock()
+			reject(cerr)
+			return
+		}
+		if _, found := this.callbackSessions[callbackId]; found {
 			log.Debugln("Callback session exists but was closed. Recreating.")
 		}
 
+		flapStatus, throttled := this.flap.record(callbackId, origin, time.Now())
+		if flapStatus != nil {
+			log.Warnln("Callback is flapping:", flapStatus.Reason)
+		}
+
+		// An approval made since admit found no pending session to activate.
+		if state == SessionPending {
+			state = this.admit(callbackId, origin)
+		}
+		if state == SessionPending {
+			log.Infoln("Callback ID is not approved. Holding session pending approval.")
+		}
+		callbackState, stateNote := this.callbackState(callbackId)
+		annotations := this.callbackAnnotations(callbackId)
+
+		sessionData := CallbackSessionDesc{
+			ConnectedAt: time.Now(),
+			RemoteAddr:  origin.RemoteAddr,
+			Principal:   origin.Principal,
+			Labels:      origin.Labels,
+
+			Capabilities: origin.Capabilities,
+			Node:         this.nodeId,
+			Flap:         flapStatus,
+			State:        state,
+		}
+
+		// Control messages from the callback must be watched for before the mux starts reading.
+		sessionCtl := this.watchControl(callbackId, incomingConn, sessionData)
+		var exports *relayExports
+		if sessionCtl != nil {
+			exports = sessionCtl.exports
+		}
+
 		// Setup a mux session on the websocket
 		log.Debugln("Setting up mux connection")
-		muxSession, merr := yamux.Client(incomingConn, nil)
+		muxSession, merr := yamux.Client(incomingConn, this.muxConfig)
 		if merr != nil {
+			this.callbackMtx.Unlock()
 			log.Errorln("Could not setup mux session:", merr)
 			resultCh <- merr
 			return
 		}
 
-		sessionData := CallbackSessionDesc{
-			ConnectedAt: time.Now(),
-			RemoteAddr:  remoteAddr,
-		}
-
 		newSession := &callbackSession{
 			log:       log,
 			muxClient: muxSession,
+			conn:      incomingConn,
 			resultCh:  resultCh,
 			doneCh:    make(chan struct{}),
 			desc:      sessionData,
+			exports:   exports,
+			control:   sessionCtl,
+
+			state:         state,
+			fingerprint:   admissionFingerprint(origin),
+			callbackState: callbackState,
+			stateNote:     stateNote,
+			annotations:   annotations,
 		}
 
 		log.Debugln("Starting shutdown channel monitoring")
 		newSession.startShutdownWatch(doneCh)
 
 		this.callbackSessions[callbackId] = newSession
+		this.callbackMtx.Unlock()
+
+		this.recordCallbackConnected(callbackId, sessionData)
+		this.publishCallbackConnectionEvent(EventConnected, "", callbackId, newSession.copyDesc())
+		if throttled != nil {
+			log.Warnln("Throttling registrations:", throttled)
+			this.publishCallbackConnectionEvent(EventUpdated, throttled.Error(), callbackId, newSession.copyDesc())
+		}
+
+		// Force periodic re-registration if the lifetime policy requires it.
+		var maxDurationTimer *time.Timer
+		if maxDuration := time.Duration(this.lifetimePolicy(callbackId).CallbackMaxDuration); maxDuration > 0 {
+			maxDurationTimer = time.AfterFunc(maxDuration, func() {
+				log.Infoln("Callback session reached maximum duration. Disconnecting.")
+				newSession.DisconnectWithReason(CloseCodePolicyViolation, ReasonCallbackMaxDuration)
+			})
+		}
 
 		// When the channel shuts down it should be automatically removed from the connection manager
 		go func() {
 			<-doneCh
+			if maxDurationTimer != nil {
+				maxDurationTimer.Stop()
+			}
 			log.Infoln("Cleaning up finished callback session.")
-			defer this.callbackMtx.Unlock()
 			this.callbackMtx.Lock()
 
-			delete(this.callbackSessions, callbackId)
+			// Only remove the session if it has not already been replaced.
+			if this.callbackSessions[callbackId] == newSession {
+				delete(this.callbackSessions, callbackId)
+			}
+			this.callbackMtx.Unlock()
 			log.Debugln("Callback session removed from manager.")
+
+			reason := newSession.getCloseReason()
+			if reason == "" {
+				reason = ReasonConnectionClosed
+			}
+			this.recordCallbackDisconnected(callbackId, sessionData, time.Now(), reason)
+			this.publishCallbackConnectionEvent(EventDisconnected, reason, callbackId, newSession.copyDesc())
+			if exports != nil {
+				for _, export := range exports.list() {
+					this.publishCallbackConnectionEvent(EventDisconnected, reason, callbackId+RelaySeparator+export.Id,
+						exportDesc(callbackId, sessionData, export))
+				}
+			}
 		}()
 
 		log.Infoln("Established callback mux session.")
@@ -405,15 +808,39 @@ func (this *ConnectionManager) DisconnectCallbackConnection(callbackId string) e
 
 // ClientConnection attempts to connect to the callback reverse proxy session given by callbackId.
 // Blocks until the connection is finished (should be called by a goroutine).
-func (this *ConnectionManager) ClientConnection(callbackId string, remoteAddr string, incomingConn io.ReadWriteCloser, doneCh <-chan struct{}) <-chan error {
-	log := log.With("remote_addr", remoteAddr).With("callback_id", callbackId)
+func (this *ConnectionManager) ClientConnection(callbackId string, origin SessionOrigin, incomingConn io.ReadWriteCloser, doneCh <-chan struct{}) <-chan error {
+	log := log.With("remote_addr", origin.RemoteAddr).With("callback_id", callbackId)
 	errCh := make(chan error)
 
 	go func() {
+		// Leases are shared by the cluster, so are enforced before relaying.
+		if lerr := this.checkLease(callbackId, origin); lerr != nil {
+			log.Errorln("Rejecting client session:", lerr)
+			errCh <- lerr
+			close(errCh)
+			return
+		}
+		if serr := this.checkSchedule(callbackId); serr != nil {
+			log.Errorln("Rejecting client session:", serr)
+			errCh <- serr
+			close(errCh)
+			return
+		}
+
 		this.callbackMtx.RLock()
 
 		// Check if we have a session with that name
-		session, found := this.callbackSessions[callbackId]
+		session, exportId, found := this.resolveCallback(callbackId)
+		if !found && this.cluster != nil && origin.Node == "" {
+			// Another node may hold it. Connections relayed from another node are never relayed again.
+			this.callbackMtx.RUnlock()
+			if _, remote := this.cluster.LookupCallback(callbackId); remote {
+				errCh <- this.relayClientConnection(callbackId, origin, incomingConn, doneCh)
+				close(errCh)
+				return
+			}
+			this.callbackMtx.RLock()
+		}
 		if !found {
 			log.Errorln("Requested callback session does not exist.")
 			errCh <- error(&ErrSessionUnknown{callbackId})
@@ -424,6 +851,19 @@ func (this *ConnectionManager) ClientConnection(callbackId string, remoteAddr st
 		this.callbackMtx.RUnlock()
 		log.Debugln("Found callback session.")
 
+		if session.getState() == SessionPending {
+			log.Errorln("Requested callback session is pending approval.")
+			errCh <- error(&ErrSessionPending{callbackId})
+			close(errCh)
+			return
+		}
+		if serr := this.checkClientState(callbackId, session, exportId); serr != nil {
+			log.Errorln("Rejecting client session:", serr)
+			errCh <- serr
+			close(errCh)
+			return
+		}
+
 		// Session found, check its not shutting down...
 		callbackDoneCh := session.GetShutdownChannel()
 		if callbackDoneCh == nil {
@@ -434,64 +874,141 @@ func (this *ConnectionManager) ClientConnection(callbackId string, remoteAddr st
 		}
 		log.Debugln("Session is still active.")
 
-		// Session seems to be alive, try and dial it. If we fail here we just give up.
-		reverseConnection, err := session.muxClient.Open()
-		if err != nil {
-			log.Errorln("Establishing reverse connection failed:", err)
-			errCh <- err
-			close(errCh)
-			return
-		}
-		log.Debugln("Opened reverse connection over mux.")
-
 		// Setup session metadata.
 		sessionData := &ClientSessionDesc{
 			ConnectedAt: time.Now(),
-			RemoteAddr:  remoteAddr,
+			RemoteAddr:  origin.RemoteAddr,
+			Principal:   origin.Principal,
 			CallbackId:  callbackId,
+			Node:        this.nodeId,
 			BytesOut:    0,
 			BytesIn:     0,
 		}
 
-		// Add the session to the session list.
+		// Check quotas and add the session to the session list. The session is
+		// registered before dialing so concurrent connections are counted.
 		this.clientMtx.Lock()
-		this.clientSessions[callbackId] = sessionData
+		if qerr := this.checkClientConnection(session); qerr != nil {
+			this.clientMtx.Unlock()
+			log.Errorln("Rejecting client session:", qerr)
+			errCh <- qerr
+			close(errCh)
+			return
+		}
+		sessionId := atomic.AddUint64(&this.clientSessionCounter, 1)
+		this.clientSessions[sessionId] = sessionData
+		// Increment target sessions connected session count
+		atomic.AddUint32(&session.numClients, 1)
 		this.clientMtx.Unlock()
 		log.Debugln("Added session metadata.")
 
-		// Increment target sessions connected session count
-		atomic.AddUint32(&session.desc.NumClients, 1)
+		removeSession := func() {
+			this.clientMtx.Lock()
+			delete(this.clientSessions, sessionId)
+			this.clientMtx.Unlock()
+
+			// Decrement target session connected count. Even if the session has disappeared by now, this reference
+			// will mean we have something to write to (which will then be GC'd out of existence).
+			atomic.AddUint32(&session.numClients, ^uint32(0))
+		}
+
+		// Session seems to be alive, try and dial it. If we fail here we just give up.
+		reverseConnection, err := session.muxClient.Open()
+		if err != nil {
+			log.Errorln("Establishing reverse connection failed:", err)
+			removeSession()
+			errCh <- err
+			close(errCh)
+			return
+		}
+		log.Debugln("Opened reverse connection over mux.")
+
+		// Tell a relay which of its sessions the stream is for.
+		if exportId != "" {
+			header := control.StreamHeader{CallbackId: exportId, RemoteAddr: origin.RemoteAddr, Principal: origin.Principal}
+			if herr := control.WriteStreamHeader(reverseConnection, header); herr != nil {
+				log.Errorln("Could not send stream header to relay:", herr)
+				util.LogErr(log, reverseConnection.Close())
+				removeSession()
+				errCh <- herr
+				close(errCh)
+				return
+			}
+		}
+		this.publishClientConnectionEvent(EventConnected, "", sessionData.copy())
 
-		// shutdownCh needs to combine the client's websocket status and the callback sessions connection status to
-		// ensure prompt shutdown of the session is either fails.
+		// shutdownCh is closed when the session is being ended by either side or the server, and stopCh when
+		// proxying has finished.
 		shutdownCh := make(chan struct{})
+		stopCh := make(chan struct{})
+
+		// closer ends the session by closing both connections, which unblocks the proxy pipes. The reason is
+		// sent to the client if the session is being ended by the server.
+		closer := &sessionCloser{closeFn: func(reason string) {
+			log.Infoln("Closing client session:", reason)
+			close(shutdownCh)
+			if reason != ReasonClientDisconnected {
+				code := CloseCodePolicyViolation
+				if reason == ReasonCallbackEnded {
+					code = CloseCodeGoingAway
+				}
+				sendCloseReason(incomingConn, code, reason)
+				util.LogErr(log, incomingConn.Close())
+			}
+			util.LogErr(log, reverseConnection.Close())
+		}}
+
+		// Combine the client's websocket status and the callback sessions connection status to ensure prompt
+		// shutdown of the session if either fails.
 		go func() {
 			select {
 			case <-doneCh:
 				log.Infoln("Client underlying connection closed.")
+				closer.close(ReasonClientDisconnected)
 			case <-callbackDoneCh:
 				log.Infoln("Callback session ended.")
+				closer.close(ReasonCallbackEnded)
+			case <-stopCh:
+				return
 			}
-			close(shutdownCh)
 		}()
 
+		// Enforce the lifetime policy of the session.
+		go watchClientLifetime(this.lifetimePolicy(callbackId), sessionData, closer, stopCh)
+		go this.watchClientSchedule(this.schedule(callbackId), origin, incomingConn, sessionData, closer, stopCh)
+
 		log.Infoln("Client connected to session. Starting proxying.")
 		// Start the proxy session.
-		errCh := util.HandleProxy(log, this.proxyBufferSize, incomingConn, reverseConnection, shutdownCh, &sessionData.BytesOut, &sessionData.BytesIn)
-		cerr := <-errCh
-		if cerr != io.EOF || cerr != nil {
+		toCallback, toClient := this.bandwidth.acquire(callbackId, sessionId)
+		proxyErrCh := util.HandleThrottledProxy(log, this.proxyBufferSize, incomingConn, reverseConnection, shutdownCh,
+			&sessionData.BytesOut, &sessionData.BytesIn, toCallback, toClient)
+		cerr := <-proxyErrCh
+		if cerr != nil && cerr != io.EOF {
 			log.Errorln("Client disconnected from session due to error.")
+		} else {
+			cerr = nil
 		}
 
+		close(stopCh)
+		this.bandwidth.release(callbackId, sessionId)
 		log.Infoln("Client disconnected.")
 
-		this.clientMtx.Lock()
-		delete(this.clientSessions, callbackId)
-		this.clientMtx.Unlock()
+		// The session is accounted before it is removed, so a drain waiting
+		// for client sessions to finish waits for their usage to be recorded.
+		finalDesc := sessionData.copy()
+		if this.usageRecorder != nil {
+			this.usageRecorder.RecordClientSession(finalDesc, time.Now())
+		}
+		removeSession()
+
+		reason := closer.Reason()
+		if reason == "" {
+			reason = ReasonConnectionClosed
+		}
+		this.publishClientConnectionEvent(EventDisconnected, reason, finalDesc)
 
-		// Decrement target session connected count. Even if the session has disappeared by now, this reference
-		// will mean we have something to write to (which will then be GC'd out of existence).
-		atomic.AddUint32(&session.desc.NumClients, ^uint32(0))
+		errCh <- cerr
+		close(errCh)
 	}()
 
 	return errCh
@@ -0,0 +1,67 @@
+package connman
+
+import (
+	"github.com/hashicorp/yamux"
+	"github.com/wrouesnel/go.log"
+	"net"
+	"testing"
+	"time"
+)
+
+// stalledConn is a connection whose peer does not read the close frame until
+// unblockCh closes.
+type stalledConn struct {
+	net.Conn
+	sendingCh chan struct{}
+	unblockCh chan struct{}
+}
+
+func (c *stalledConn) SendClose(code int, reason string) error {
+	close(c.sendingCh)
+	<-c.unblockCh
+	return nil
+}
+
+// TestDisconnectStalledPeer checks the state of a session being closed can be
+// read while the close frame is written to a peer which is slow to read it.
+func TestDisconnectStalledPeer(t *testing.T) {
+	serverConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+	conn := &stalledConn{Conn: serverConn, sendingCh: make(chan struct{}), unblockCh: make(chan struct{})}
+	muxClient, err := yamux.Client(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCh := make(chan error, 1)
+	cbs := &callbackSession{
+		log:       log.With("callback_id", "host1"),
+		muxClient: muxClient,
+		conn:      conn,
+		resultCh:  resultCh,
+		doneCh:    make(chan struct{}),
+	}
+
+	go cbs.DisconnectWithReason(CloseCodeGoingAway, "going away")
+	<-conn.sendingCh
+
+	readCh := make(chan string)
+	go func() { readCh <- cbs.getCloseReason() }()
+	select {
+	case reason := <-readCh:
+		if reason != "going away" {
+			t.Errorf("close reason = %q, want %q", reason, "going away")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session state was locked while the close frame was written")
+	}
+	if cbs.GetShutdownChannel() != nil {
+		t.Error("session is not shutting down")
+	}
+
+	close(conn.unblockCh)
+	select {
+	case <-resultCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not finish closing")
+	}
+}
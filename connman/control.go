@@ -0,0 +1,62 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/control"
+	"github.com/wrouesnel/go.log"
+)
+
+// controlReceiver is implemented by connections which can receive control
+// messages alongside the mux (such as websocketrwc.Conn).
+type controlReceiver interface {
+	SetControlHandler(handler func([]byte))
+}
+
+// sessionControl holds the state of control messages received from a callback
+// session.
+type sessionControl struct {
+	// exports holds the sessions exported by a relay. nil if the session is not a relay.
+	exports *relayExports
+	// replies receives replies to control messages sent to the session.
+	replies chan control.Message
+}
+
+// watchControl receives control messages from a callback session which
+// supports them. Returns nil if the session does not. Must be called before
+// the connection is read from.
+func (this *ConnectionManager) watchControl(callbackId string, conn interface{}, desc CallbackSessionDesc) *sessionControl {
+	if !control.HasCapability(desc.Capabilities, control.CapabilityControl) {
+		return nil
+	}
+	receiver, ok := conn.(controlReceiver)
+	if !ok {
+		return nil
+	}
+
+	sc := &sessionControl{replies: make(chan control.Message, 1)}
+	if control.HasCapability(desc.Capabilities, control.CapabilityRelay) {
+		sc.exports = &relayExports{sessions: make(map[string]control.Export)}
+	}
+
+	receiver.SetControlHandler(func(data []byte) {
+		msg, err := control.Decode(data)
+		if err != nil {
+			log.With("callback_id", callbackId).Errorln("Could not decode control message from callback:", err)
+			return
+		}
+		switch msg.Type {
+		case control.MessageExports:
+			if sc.exports != nil {
+				this.updateExports(callbackId, desc, sc.exports, msg.Exports)
+			}
+		case control.MessageMigrated, control.MessageMigrateFailed:
+			// Replies nobody is waiting for are dropped.
+			select {
+			case sc.replies <- msg:
+			default:
+			}
+		default:
+			log.With("callback_id", callbackId).Debugln("Ignoring unknown control message from callback:", msg.Type)
+		}
+	})
+	return sc
+}
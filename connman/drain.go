@@ -0,0 +1,122 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/control"
+	"github.com/wrouesnel/go.log"
+	"sync/atomic"
+	"time"
+)
+
+// ReasonServerShutdown is reported when sessions are closed by a drain.
+const ReasonServerShutdown = "server shutting down"
+
+// drainCloseTimeout bounds how long a drain waits for client sessions to be
+// accounted once their callback sessions are closed.
+const drainCloseTimeout = 5 * time.Second
+
+// ErrDraining is returned for new sessions while the connection manager is
+// draining.
+type ErrDraining struct{}
+
+func (err ErrDraining) Error() string {
+	return "server is draining"
+}
+
+// controlSender is implemented by connections which can carry control
+// messages alongside the mux (such as websocketrwc.Conn).
+type controlSender interface {
+	WriteControlMessage(p []byte) error
+}
+
+// sendControl sends a control message to a callback session, if it supports
+// them.
+func (cbs *callbackSession) sendControl(msg control.Message) bool {
+	if !control.HasCapability(cbs.desc.Capabilities, control.CapabilityControl) {
+		return false
+	}
+	sender, ok := cbs.conn.(controlSender)
+	if !ok {
+		return false
+	}
+
+	data, err := control.Encode(msg)
+	if err != nil {
+		cbs.log.Errorln("Could not encode control message:", err)
+		return false
+	}
+	if err := sender.WriteControlMessage(data); err != nil {
+		cbs.log.Errorln("Could not send control message:", err)
+		return false
+	}
+	return true
+}
+
+// Draining returns true once Drain has been called.
+func (this *ConnectionManager) Draining() bool {
+	return atomic.LoadInt32(&this.draining) != 0
+}
+
+// Drain stops the connection manager accepting new sessions, asks connected
+// callbacks to register elsewhere, and waits up to timeout for client
+// sessions to finish before closing every callback session. Blocks until all
+// sessions are closed.
+func (this *ConnectionManager) Drain(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&this.draining, 0, 1) {
+		return
+	}
+	log.Infoln("Draining connection manager.")
+
+	this.callbackMtx.RLock()
+	sessions := make([]*callbackSession, 0, len(this.callbackSessions))
+	for _, session := range this.callbackSessions {
+		sessions = append(sessions, session)
+	}
+	this.callbackMtx.RUnlock()
+
+	for _, session := range sessions {
+		if session.sendControl(control.Message{Type: control.MessageDrain, Reason: ReasonServerShutdown}) {
+			session.log.Debugln("Asked callback session to register elsewhere.")
+		}
+	}
+
+	this.waitClientSessions(time.Now().Add(timeout))
+
+	this.callbackMtx.RLock()
+	sessions = sessions[:0]
+	for _, session := range this.callbackSessions {
+		sessions = append(sessions, session)
+	}
+	this.callbackMtx.RUnlock()
+
+	log.Infoln("Closing callback sessions:", len(sessions))
+	for _, session := range sessions {
+		if err := session.muxClient.GoAway(); err != nil {
+			session.log.Debugln("Could not send mux go away:", err)
+		}
+		session.DisconnectWithReason(CloseCodeGoingAway, ReasonServerShutdown)
+	}
+
+	// Client sessions end with their callbacks. Wait for their usage to be
+	// recorded before the process exits.
+	if !this.waitClientSessions(time.Now().Add(drainCloseTimeout)) {
+		log.Warnln("Client sessions were not accounted before the drain ended.")
+	}
+}
+
+// waitClientSessions waits until no client sessions remain or deadline
+// passes, returning false if sessions remain.
+func (this *ConnectionManager) waitClientSessions(deadline time.Time) bool {
+	for {
+		this.clientMtx.RLock()
+		remaining := len(this.clientSessions)
+		this.clientMtx.RUnlock()
+		if remaining == 0 {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		log.Debugln("Waiting for client sessions to finish:", remaining)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,51 @@
+package connman
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowRecorder is a UsageRecorder which takes a while to record sessions, as
+// one syncing to disk might.
+type slowRecorder struct {
+	mtx      sync.Mutex
+	sessions []ClientSessionDesc
+}
+
+func (r *slowRecorder) RecordClientSession(desc ClientSessionDesc, disconnectedAt time.Time) {
+	time.Sleep(200 * time.Millisecond)
+	r.mtx.Lock()
+	r.sessions = append(r.sessions, desc)
+	r.mtx.Unlock()
+}
+
+// TestDrainRecordsUsage checks client sessions closed by a drain are
+// accounted before it returns.
+func TestDrainRecordsUsage(t *testing.T) {
+	recorder := &slowRecorder{}
+	cm := NewConnectionManager(1024)
+	cm.SetUsageRecorder(recorder)
+	testCallback(t, cm, "host1")
+	clientCh := testClient(t, cm, "host1")
+	go func() {
+		for range clientCh {
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cm.waitClientSessions(time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatal("client session was not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cm.Drain(0)
+
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+	if len(recorder.sessions) != 1 || recorder.sessions[0].CallbackId != "host1" {
+		t.Errorf("recorded %v, want the session of host1", recorder.sessions)
+	}
+}
@@ -0,0 +1,274 @@
+package connman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlapPolicy configures detection and throttling of callback IDs which
+// register repeatedly, such as when a host's link keeps dropping or two hosts
+// are configured with the same ID. A zero Window disables flap detection.
+type FlapPolicy struct {
+	// Window is the period registration churn is measured over.
+	Window time.Duration
+	// Threshold is the number of registrations of an ID within Window above
+	// which it is flapping. Zero only detects ID conflicts.
+	Threshold int
+	// SourceThreshold is the number of repeated registrations from a single
+	// source within Window above which the source is flapping. Zero disables
+	// per-source detection.
+	SourceThreshold int
+	// Penalty is how long registrations are first refused once flapping is
+	// detected. It doubles each time flapping continues, up to MaxPenalty.
+	// Zero only reports flapping.
+	Penalty    time.Duration
+	MaxPenalty time.Duration
+}
+
+// FlapStatus describes a flapping callback ID.
+type FlapStatus struct {
+	// Registrations is the number of registrations within the flap window.
+	Registrations int `json:"registrations"`
+	// Conflict lists the sources an ID alternates between when it is
+	// registered by more than one host.
+	Conflict []string `json:"conflict,omitempty"`
+	// Reason describes why the ID is flapping.
+	Reason string `json:"reason"`
+	// ThrottledUntil is when registrations are accepted again, if throttled.
+	ThrottledUntil *time.Time `json:"throttled_until,omitempty"`
+}
+
+// ErrFlapping is returned when registrations of a callback ID or from a
+// source are throttled because they are flapping.
+type ErrFlapping struct {
+	// Subject is the callback ID or source which is throttled.
+	Subject string
+	Reason  string
+	Until   time.Time
+}
+
+func (err ErrFlapping) Error() string {
+	return fmt.Sprintf("registration of %s throttled until %s: %s", err.Subject, err.Until.Format(time.RFC3339), err.Reason)
+}
+
+// RetryAfter returns how long until registrations are accepted again.
+func (err ErrFlapping) RetryAfter() time.Duration {
+	return time.Until(err.Until)
+}
+
+// churn tracks the recent registrations of a callback ID or source.
+type churn struct {
+	times []time.Time
+	// sources of each registration, recorded for callback IDs only.
+	sources        []string
+	penalty        time.Duration
+	throttledUntil time.Time
+	reason         string
+	conflict       []string
+}
+
+// prune forgets registrations older than window, and reports whether the
+// churn can be forgotten entirely.
+func (c *churn) prune(now time.Time, window time.Duration) bool {
+	i := 0
+	for i < len(c.times) && now.Sub(c.times[i]) > window {
+		i++
+	}
+	c.times = c.times[i:]
+	if c.sources != nil {
+		c.sources = c.sources[i:]
+	}
+	return len(c.times) == 0 && !now.Before(c.throttledUntil)
+}
+
+// throttle penalizes the churn for flapping, returning the error further
+// registrations are refused with. Returns nil if penalties are disabled.
+func (c *churn) throttle(subject string, now time.Time, policy FlapPolicy) *ErrFlapping {
+	if policy.Penalty <= 0 {
+		return nil
+	}
+	if c.penalty == 0 {
+		c.penalty = policy.Penalty
+	} else {
+		c.penalty *= 2
+	}
+	if policy.MaxPenalty > 0 && c.penalty > policy.MaxPenalty {
+		c.penalty = policy.MaxPenalty
+	}
+	c.throttledUntil = now.Add(c.penalty)
+	return &ErrFlapping{subject, c.reason, c.throttledUntil}
+}
+
+func (c *churn) status(now time.Time) FlapStatus {
+	status := FlapStatus{
+		Registrations: len(c.times),
+		Conflict:      c.conflict,
+		Reason:        c.reason,
+	}
+	if now.Before(c.throttledUntil) {
+		until := c.throttledUntil
+		status.ThrottledUntil = &until
+	}
+	return status
+}
+
+// flapDetector tracks registration churn per callback ID and per source.
+type flapDetector struct {
+	policy  FlapPolicy
+	ids     map[string]*churn
+	sources map[string]*churn
+	mtx     sync.Mutex
+}
+
+func newFlapDetector() *flapDetector {
+	return &flapDetector{
+		ids:     make(map[string]*churn),
+		sources: make(map[string]*churn),
+	}
+}
+
+// sourceFingerprint identifies where a registration came from.
+func sourceFingerprint(origin SessionOrigin) string {
+	host := hostOf(origin.RemoteAddr)
+	if origin.Principal != "" {
+		return origin.Principal + "@" + host
+	}
+	return host
+}
+
+// check returns an ErrFlapping if registrations of callbackId or from origin
+// are throttled.
+func (fd *flapDetector) check(callbackId string, origin SessionOrigin, now time.Time) error {
+	fd.mtx.Lock()
+	defer fd.mtx.Unlock()
+	if fd.policy.Window <= 0 {
+		return nil
+	}
+	if c, found := fd.ids[callbackId]; found && now.Before(c.throttledUntil) {
+		return &ErrFlapping{callbackId, c.reason, c.throttledUntil}
+	}
+	source := sourceFingerprint(origin)
+	if c, found := fd.sources[source]; found && now.Before(c.throttledUntil) {
+		return &ErrFlapping{source, c.reason, c.throttledUntil}
+	}
+	return nil
+}
+
+// record counts a registration of callbackId from origin. It returns the flap
+// status of the ID, which is nil if it is not flapping, and the error further
+// registrations are refused with if a throttle was started.
+func (fd *flapDetector) record(callbackId string, origin SessionOrigin, now time.Time) (*FlapStatus, *ErrFlapping) {
+	fd.mtx.Lock()
+	defer fd.mtx.Unlock()
+	if fd.policy.Window <= 0 {
+		return nil, nil
+	}
+	fd.prune(now)
+
+	source := sourceFingerprint(origin)
+	id, found := fd.ids[callbackId]
+	if !found {
+		id = &churn{sources: []string{}}
+		fd.ids[callbackId] = id
+	}
+	repeated := len(id.times) > 0
+	id.times = append(id.times, now)
+	id.sources = append(id.sources, source)
+
+	var throttled *ErrFlapping
+	if conflict := alternatingSources(id.sources); conflict != nil {
+		id.conflict = conflict
+		id.reason = "ID conflict between " + strings.Join(conflict, " and ")
+		throttled = id.throttle(callbackId, now, fd.policy)
+	} else if fd.policy.Threshold > 0 && len(id.times) > fd.policy.Threshold {
+		id.conflict = nil
+		id.reason = fmt.Sprintf("%d registrations in %s", len(id.times), fd.policy.Window)
+		throttled = id.throttle(callbackId, now, fd.policy)
+	}
+
+	// Sources are only charged for IDs registering again, so many hosts
+	// behind one address can all register once.
+	if repeated && fd.policy.SourceThreshold > 0 {
+		src, found := fd.sources[source]
+		if !found {
+			src = &churn{}
+			fd.sources[source] = src
+		}
+		src.times = append(src.times, now)
+		if len(src.times) > fd.policy.SourceThreshold {
+			src.reason = fmt.Sprintf("%d repeated registrations from %s in %s", len(src.times), source, fd.policy.Window)
+			if err := src.throttle(source, now, fd.policy); err != nil && throttled == nil {
+				throttled = err
+			}
+		}
+	}
+
+	if id.reason == "" {
+		return nil, throttled
+	}
+	status := id.status(now)
+	return &status, throttled
+}
+
+// status returns the flap status of a callback ID, if it is flapping.
+func (fd *flapDetector) status(callbackId string, now time.Time) (FlapStatus, bool) {
+	fd.mtx.Lock()
+	defer fd.mtx.Unlock()
+	c, found := fd.ids[callbackId]
+	if !found || c.reason == "" {
+		return FlapStatus{}, false
+	}
+	return c.status(now), true
+}
+
+// prune forgets churn which has settled. Must be called with mtx held.
+func (fd *flapDetector) prune(now time.Time) {
+	for callbackId, c := range fd.ids {
+		if c.prune(now, fd.policy.Window) {
+			delete(fd.ids, callbackId)
+		}
+	}
+	for source, c := range fd.sources {
+		if c.prune(now, fd.policy.Window) {
+			delete(fd.sources, source)
+		}
+	}
+}
+
+// alternatingSources returns the sources of an ID's registrations if they
+// switched back and forth, such as A, B, A, rather than the ID moving once.
+func alternatingSources(sources []string) []string {
+	switches := 0
+	distinct := map[string]bool{}
+	for i, source := range sources {
+		distinct[source] = true
+		if i > 0 && source != sources[i-1] {
+			switches++
+		}
+	}
+	if switches < 2 {
+		return nil
+	}
+	ret := make([]string, 0, len(distinct))
+	for source := range distinct {
+		ret = append(ret, source)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// SetFlapPolicy configures flap detection. Churn already recorded is kept.
+func (this *ConnectionManager) SetFlapPolicy(policy FlapPolicy) {
+	this.flap.mtx.Lock()
+	defer this.flap.mtx.Unlock()
+	this.flap.policy = policy
+}
+
+// GetFlapStatus returns the flap status of a callback ID, if it is flapping,
+// whether or not it is connected.
+func (this *ConnectionManager) GetFlapStatus(callbackId string) (FlapStatus, bool) {
+	return this.flap.status(callbackId, time.Now())
+}
@@ -0,0 +1,183 @@
+package connman
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	originA = SessionOrigin{RemoteAddr: "192.0.2.1:1234"}
+	originB = SessionOrigin{RemoteAddr: "192.0.2.2:1234"}
+)
+
+func newTestFlapDetector(policy FlapPolicy) *flapDetector {
+	fd := newFlapDetector()
+	fd.policy = policy
+	return fd
+}
+
+func TestAlternatingSources(t *testing.T) {
+	for _, tc := range []struct {
+		sources []string
+		want    []string
+	}{
+		{nil, nil},
+		{[]string{"a"}, nil},
+		{[]string{"a", "a", "a"}, nil},
+		// Moving once is not a conflict.
+		{[]string{"a", "a", "b", "b"}, nil},
+		{[]string{"a", "b", "a"}, []string{"a", "b"}},
+		{[]string{"b", "b", "a", "a", "b"}, []string{"a", "b"}},
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c"}},
+	} {
+		if got := alternatingSources(tc.sources); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("alternatingSources(%v) = %v, want %v", tc.sources, got, tc.want)
+		}
+	}
+}
+
+func TestFlapThreshold(t *testing.T) {
+	fd := newTestFlapDetector(FlapPolicy{
+		Window:     5 * time.Minute,
+		Threshold:  3,
+		Penalty:    10 * time.Second,
+		MaxPenalty: 30 * time.Second,
+	})
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if status, throttled := fd.record("host1", originA, t0.Add(time.Duration(i)*time.Second)); status != nil || throttled != nil {
+			t.Fatalf("registration %d: %+v, %v, want not flapping", i+1, status, throttled)
+		}
+	}
+
+	// The penalty doubles while flapping continues, up to the maximum.
+	at := t0.Add(3 * time.Second)
+	for i, penalty := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		status, throttled := fd.record("host1", originA, at)
+		if status == nil || status.Registrations != 4+i {
+			t.Fatalf("flapping registration %d: status %+v, want %d registrations", i+1, status, 4+i)
+		}
+		if throttled == nil || throttled.Subject != "host1" || !throttled.Until.Equal(at.Add(penalty)) {
+			t.Fatalf("flapping registration %d: throttled %v, want until %v", i+1, throttled, at.Add(penalty))
+		}
+		if status.ThrottledUntil == nil || !status.ThrottledUntil.Equal(throttled.Until) {
+			t.Errorf("flapping registration %d: status throttled until %v, want %v", i+1, status.ThrottledUntil, throttled.Until)
+		}
+
+		if err := fd.check("host1", originB, at.Add(penalty-time.Millisecond)); err == nil {
+			t.Errorf("flapping registration %d: check permitted a registration before the penalty ended", i+1)
+		}
+		at = at.Add(penalty)
+		if err := fd.check("host1", originA, at); err != nil {
+			t.Errorf("flapping registration %d: check refused a registration after the penalty: %v", i+1, err)
+		}
+	}
+
+	// Other IDs are not throttled.
+	if err := fd.check("host2", originB, t0.Add(4*time.Second)); err != nil {
+		t.Errorf("check refused another ID: %v", err)
+	}
+}
+
+func TestFlapConflict(t *testing.T) {
+	fd := newTestFlapDetector(FlapPolicy{Window: time.Minute, Penalty: time.Minute})
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	fd.record("host1", originA, t0)
+	if status, _ := fd.record("host1", originB, t0.Add(time.Second)); status != nil {
+		t.Fatalf("moving once is flapping: %+v", status)
+	}
+	status, throttled := fd.record("host1", originA, t0.Add(2*time.Second))
+	if status == nil || !reflect.DeepEqual(status.Conflict, []string{"192.0.2.1", "192.0.2.2"}) {
+		t.Fatalf("status = %+v, want a conflict between both sources", status)
+	}
+	if status.Reason != "ID conflict between 192.0.2.1 and 192.0.2.2" {
+		t.Errorf("reason = %q", status.Reason)
+	}
+	if throttled == nil || !throttled.Until.Equal(t0.Add(2*time.Second+time.Minute)) {
+		t.Errorf("throttled = %v, want throttled for the penalty", throttled)
+	}
+	if reported, flapping := fd.status("host1", t0.Add(3*time.Second)); !flapping || reported.Reason != status.Reason {
+		t.Errorf("status = %+v, %v, want the conflict reported", reported, flapping)
+	}
+}
+
+func TestFlapSourceThreshold(t *testing.T) {
+	fd := newTestFlapDetector(FlapPolicy{Window: time.Minute, SourceThreshold: 2, Penalty: time.Minute})
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	originC := SessionOrigin{RemoteAddr: "192.0.2.1:5678", Principal: "ci"}
+
+	// Many IDs registering once from a source are not flapping.
+	for _, id := range []string{"host1", "host2", "host3", "host4"} {
+		if _, throttled := fd.record(id, originA, t0); throttled != nil {
+			t.Fatalf("first registration of %s throttled: %v", id, throttled)
+		}
+	}
+
+	// Registering again is charged to the source.
+	for i, id := range []string{"host1", "host2"} {
+		if _, throttled := fd.record(id, originA, t0.Add(time.Second)); throttled != nil {
+			t.Fatalf("repeated registration %d throttled: %v", i+1, throttled)
+		}
+	}
+	_, throttled := fd.record("host3", originA, t0.Add(time.Second))
+	if throttled == nil || throttled.Subject != "192.0.2.1" {
+		t.Fatalf("throttled = %v, want the source throttled", throttled)
+	}
+
+	if err := fd.check("new", originA, t0.Add(2*time.Second)); err == nil {
+		t.Error("check permitted a registration from the throttled source")
+	}
+	// The same address with a principal is a different source.
+	if err := fd.check("new", originC, t0.Add(2*time.Second)); err != nil {
+		t.Errorf("check refused another source: %v", err)
+	}
+	if err := fd.check("new", originB, t0.Add(2*time.Second)); err != nil {
+		t.Errorf("check refused another source: %v", err)
+	}
+}
+
+func TestFlapPruning(t *testing.T) {
+	fd := newTestFlapDetector(FlapPolicy{Window: time.Minute, Threshold: 1, Penalty: 5 * time.Minute})
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	fd.record("host1", originA, t0)
+	if _, throttled := fd.record("host1", originA, t0.Add(time.Second)); throttled == nil {
+		t.Fatal("second registration was not throttled")
+	}
+
+	// Churn is kept while throttled, even once it leaves the window.
+	fd.record("host2", originB, t0.Add(2*time.Minute))
+	if _, found := fd.ids["host1"]; !found {
+		t.Error("throttled churn was pruned")
+	}
+	if _, flapping := fd.status("host1", t0.Add(2*time.Minute)); !flapping {
+		t.Error("throttled ID is not flapping")
+	}
+
+	fd.record("host2", originB, t0.Add(10*time.Minute))
+	if _, found := fd.ids["host1"]; found {
+		t.Error("settled churn was not pruned")
+	}
+	if _, flapping := fd.status("host1", t0.Add(10*time.Minute)); flapping {
+		t.Error("settled ID is still flapping")
+	}
+	if len(fd.ids["host2"].times) != 1 {
+		t.Errorf("host2 has %d registrations in the window, want 1", len(fd.ids["host2"].times))
+	}
+}
+
+func TestFlapDisabled(t *testing.T) {
+	fd := newTestFlapDetector(FlapPolicy{Threshold: 1, Penalty: time.Minute})
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if status, throttled := fd.record("host1", originA, t0); status != nil || throttled != nil {
+			t.Fatalf("registration %d: %+v, %v, want flap detection disabled", i+1, status, throttled)
+		}
+	}
+	if err := fd.check("host1", originA, t0); err != nil {
+		t.Errorf("check refused a registration with flap detection disabled: %v", err)
+	}
+}
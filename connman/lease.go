@@ -0,0 +1,286 @@
+package connman
+
+import (
+	"fmt"
+	"github.com/wrouesnel/go.log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lease grants a holder exclusive rights to connect to a callback ID until
+// it expires.
+type Lease struct {
+	// Holder is the principal holding the lease, or its remote IP if
+	// authentication is disabled.
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ErrLeased is returned when a callback ID is leased by another holder.
+type ErrLeased struct {
+	CallbackId string
+	Holder     string
+	Until      time.Time
+}
+
+func (err ErrLeased) Error() string {
+	return fmt.Sprintf("callback %s is leased by %s until %s", err.CallbackId, err.Holder, err.Until.Format(time.RFC3339))
+}
+
+// ErrNotLeased is returned when releasing a callback ID which is not leased.
+type ErrNotLeased struct {
+	callbackId string
+}
+
+func (err ErrNotLeased) Error() string {
+	return "callback is not leased"
+}
+
+// ErrClientsConnected is returned when leasing a callback ID which others
+// have client sessions to.
+type ErrClientsConnected struct {
+	CallbackId string
+	// Holders of the client sessions, named like lease holders.
+	Holders []string
+}
+
+func (err ErrClientsConnected) Error() string {
+	return fmt.Sprintf("callback %s has client sessions of %s which must end before it can be leased", err.CallbackId, strings.Join(err.Holders, ", "))
+}
+
+// active returns the lease if it has not expired by now.
+func (lease *Lease) active(now time.Time) *Lease {
+	if lease == nil || !now.Before(lease.ExpiresAt) {
+		return nil
+	}
+	copied := *lease
+	return &copied
+}
+
+// lookupLease returns the unexpired lease of callbackId, or nil if there is
+// none or it could not be looked up.
+func (this *ConnectionManager) lookupLease(callbackId string, now time.Time) *Lease {
+	lease, err := this.currentLease(callbackId, now)
+	if err != nil {
+		log.With("callback_id", callbackId).Errorln("Could not look up lease:", err)
+		return nil
+	}
+	return lease
+}
+
+// currentLease returns the unexpired lease of callbackId, or nil. Leases are
+// kept in the cluster registry if clustered, so every node enforces them, and
+// otherwise in the callback record.
+func (this *ConnectionManager) currentLease(callbackId string, now time.Time) (*Lease, error) {
+	if this.cluster != nil {
+		lease, err := this.cluster.GetLease(callbackId)
+		if err != nil {
+			return nil, &ErrRegistryUnavailable{err}
+		}
+		return lease.active(now), nil
+	}
+
+	record, found, err := this.sessionStore.Get(callbackId)
+	if err != nil || !found {
+		return nil, err
+	}
+	return record.Lease.active(now), nil
+}
+
+// updateLease replaces the unexpired lease of callbackId, which is nil if
+// there is none, with the lease update returns, or nil to remove it. Nothing
+// is changed if update returns an error. update may be called again if
+// another node changes the lease first.
+func (this *ConnectionManager) updateLease(callbackId string, now time.Time, update func(current *Lease) (*Lease, error)) error {
+	if this.cluster == nil {
+		var lerr error
+		_, err := this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+			lease, err := update(record.Lease.active(now))
+			if err != nil {
+				lerr = err
+				return
+			}
+			record.Lease = lease
+		})
+		if err != nil {
+			return err
+		}
+		return lerr
+	}
+
+	for {
+		recorded, err := this.cluster.GetLease(callbackId)
+		if err != nil {
+			return &ErrRegistryUnavailable{err}
+		}
+		lease, err := update(recorded.active(now))
+		if err != nil {
+			return err
+		}
+		swapped, err := this.cluster.SwapLease(callbackId, recorded, lease)
+		if err != nil {
+			return &ErrRegistryUnavailable{err}
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// clientHolders returns the holders of client sessions to callbackId other
+// than holder, sorted.
+func (this *ConnectionManager) clientHolders(callbackId string, holder string) []string {
+	seen := make(map[string]bool)
+	holders := []string{}
+	for _, client := range this.ListClientSessions().Sessions {
+		if client.CallbackId != callbackId {
+			continue
+		}
+		clientHolder := admissionFingerprint(SessionOrigin{RemoteAddr: client.RemoteAddr, Principal: client.Principal})
+		if clientHolder != holder && !seen[clientHolder] {
+			seen[clientHolder] = true
+			holders = append(holders, clientHolder)
+		}
+	}
+	sort.Strings(holders)
+	return holders
+}
+
+// AcquireLease grants origin exclusive rights to connect to callbackId for
+// duration. A lease already held by origin is renewed. A new lease is refused
+// while others have client sessions to the ID. The ID need not be connected.
+func (this *ConnectionManager) AcquireLease(callbackId string, origin SessionOrigin, duration time.Duration) (Lease, error) {
+	holder := admissionFingerprint(origin)
+	now := time.Now()
+
+	// Checked before the lease is taken, so a client connecting in between
+	// keeps its session until it ends.
+	holders := this.clientHolders(callbackId, holder)
+
+	var lease Lease
+	var renewed bool
+	err := this.updateLease(callbackId, now, func(current *Lease) (*Lease, error) {
+		if current != nil && current.Holder != holder {
+			return nil, &ErrLeased{callbackId, current.Holder, current.ExpiresAt}
+		}
+		if current == nil && len(holders) > 0 {
+			return nil, &ErrClientsConnected{callbackId, holders}
+		}
+		renewed = current != nil
+		if current == nil {
+			current = &Lease{Holder: holder, AcquiredAt: now}
+		}
+		current.ExpiresAt = now.Add(duration)
+		lease = *current
+		return current, nil
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+
+	reason := fmt.Sprintf("leased by %s until %s", holder, lease.ExpiresAt.Format(time.RFC3339))
+	if renewed {
+		reason = fmt.Sprintf("lease by %s renewed until %s", holder, lease.ExpiresAt.Format(time.RFC3339))
+	}
+	this.publishLeaseEvent(callbackId, reason)
+	return lease, nil
+}
+
+// ReleaseLease releases the lease of callbackId held by origin. If force is
+// set the lease is released whoever holds it.
+func (this *ConnectionManager) ReleaseLease(callbackId string, origin SessionOrigin, force bool) (Lease, error) {
+	holder := admissionFingerprint(origin)
+	now := time.Now()
+	current, err := this.currentLease(callbackId, now)
+	if err != nil {
+		return Lease{}, err
+	}
+	if current == nil {
+		// Do not create a record for an ID which was never leased.
+		return Lease{}, &ErrNotLeased{callbackId}
+	}
+
+	var lease Lease
+	err = this.updateLease(callbackId, now, func(current *Lease) (*Lease, error) {
+		if current == nil {
+			return nil, &ErrNotLeased{callbackId}
+		}
+		if current.Holder != holder && !force {
+			return nil, &ErrLeased{callbackId, current.Holder, current.ExpiresAt}
+		}
+		lease = *current
+		return nil, nil
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+
+	this.publishLeaseEvent(callbackId, fmt.Sprintf("lease by %s released", lease.Holder))
+	return lease, nil
+}
+
+// GetLease returns the lease of callbackId, if any.
+func (this *ConnectionManager) GetLease(callbackId string) (Lease, bool) {
+	if lease := this.lookupLease(callbackId, time.Now()); lease != nil {
+		return *lease, true
+	}
+	return Lease{}, false
+}
+
+// checkLease returns an ErrLeased if callbackId is leased by someone other
+// than origin, or an error if its lease could not be looked up.
+func (this *ConnectionManager) checkLease(callbackId string, origin SessionOrigin) error {
+	lease, err := this.currentLease(callbackId, time.Now())
+	if err != nil {
+		return err
+	}
+	if lease != nil && lease.Holder != admissionFingerprint(origin) {
+		return &ErrLeased{callbackId, lease.Holder, lease.ExpiresAt}
+	}
+	return nil
+}
+
+// withLeases attaches leases to session descriptions.
+func (this *ConnectionManager) withLeases(descs map[string]CallbackSessionDesc) {
+	now := time.Now()
+	if this.cluster != nil {
+		for callbackId, desc := range descs {
+			desc.Lease = this.lookupLease(callbackId, now)
+			descs[callbackId] = desc
+		}
+		return
+	}
+
+	records, err := this.sessionStore.List()
+	if err != nil {
+		log.Errorln("Could not list callback records:", err)
+		return
+	}
+	for _, record := range records {
+		if desc, found := descs[record.CallbackId]; found {
+			desc.Lease = record.Lease.active(now)
+			descs[record.CallbackId] = desc
+		}
+	}
+}
+
+// publishLeaseEvent publishes an update for the session of callbackId, if it
+// is connected to this node, when its lease changes.
+func (this *ConnectionManager) publishLeaseEvent(callbackId string, reason string) {
+	this.callbackMtx.RLock()
+	session, exportId, found := this.resolveCallback(callbackId)
+	this.callbackMtx.RUnlock()
+	if !found {
+		return
+	}
+
+	desc := session.copyDesc()
+	if exportId != "" {
+		export, _ := session.exports.get(exportId)
+		desc = exportDesc(callbackId[:len(callbackId)-len(exportId)-len(RelaySeparator)], desc, export)
+	}
+	desc.Lease = this.lookupLease(callbackId, time.Now())
+	this.publishCallbackConnectionEvent(EventUpdated, reason, callbackId, desc)
+}
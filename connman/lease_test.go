@@ -0,0 +1,113 @@
+package connman
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAcquireLease(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	alice := SessionOrigin{RemoteAddr: "192.0.2.1:1234", Principal: "alice"}
+	bob := SessionOrigin{RemoteAddr: "192.0.2.2:1234", Principal: "bob"}
+
+	lease, err := cm.AcquireLease("host1", alice, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := cm.AcquireLease("host1", alice, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed.AcquiredAt.Equal(lease.AcquiredAt) || !renewed.ExpiresAt.After(lease.ExpiresAt) {
+		t.Errorf("renewed lease = %+v, want %+v extended", renewed, lease)
+	}
+
+	if _, err := cm.AcquireLease("host1", bob, time.Minute); err == nil {
+		t.Error("lease held by alice was granted to bob")
+	} else if _, ok := err.(*ErrLeased); !ok {
+		t.Errorf("AcquireLease returned %v, want ErrLeased", err)
+	}
+	if err := cm.checkLease("host1", bob); err == nil {
+		t.Error("bob may connect to host1 leased by alice")
+	}
+	if err := cm.checkLease("host1", alice); err != nil {
+		t.Errorf("alice may not connect to her leased host1: %v", err)
+	}
+
+	// Leases are kept in the callback record.
+	record, found, err := cm.sessionStore.Get("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || record.Lease == nil || record.Lease.Holder != "alice" {
+		t.Errorf("record = %+v, want the lease of alice", record)
+	}
+
+	if _, err := cm.ReleaseLease("host1", bob, false); err == nil {
+		t.Error("bob released the lease of alice")
+	}
+	if _, err := cm.ReleaseLease("host1", alice, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := cm.GetLease("host1"); found {
+		t.Error("released lease was found")
+	}
+	if _, err := cm.AcquireLease("host1", bob, time.Minute); err != nil {
+		t.Errorf("bob could not lease host1 after it was released: %v", err)
+	}
+}
+
+func TestExpiredLease(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	alice := SessionOrigin{RemoteAddr: "192.0.2.1:1234", Principal: "alice"}
+	bob := SessionOrigin{RemoteAddr: "192.0.2.2:1234", Principal: "bob"}
+
+	if _, err := cm.AcquireLease("host1", alice, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, found := cm.GetLease("host1"); found {
+		t.Error("expired lease was found")
+	}
+	if _, err := cm.AcquireLease("host1", bob, time.Minute); err != nil {
+		t.Errorf("bob could not lease host1 after the lease of alice expired: %v", err)
+	}
+}
+
+// TestLeaseRefusedWhileClientsConnected checks a lease is refused while
+// others have client sessions to the ID, naming them.
+func TestLeaseRefusedWhileClientsConnected(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	testCallback(t, cm, "host1")
+	errCh := testClient(t, cm, "host1")
+	go func() {
+		for range errCh {
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cm.ListClientSessions().Sessions) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client session was not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err := cm.AcquireLease("host1", SessionOrigin{RemoteAddr: "192.0.2.1:1234", Principal: "alice"}, time.Minute)
+	cerr, ok := err.(*ErrClientsConnected)
+	if !ok {
+		t.Fatalf("AcquireLease returned %v, want ErrClientsConnected", err)
+	}
+	if want := []string{"198.51.100.1"}; !reflect.DeepEqual(cerr.Holders, want) {
+		t.Errorf("holders = %v, want %v", cerr.Holders, want)
+	}
+
+	// The client itself may lease the ID it is connected to.
+	if _, err := cm.AcquireLease("host1", SessionOrigin{RemoteAddr: "198.51.100.1:5678"}, time.Minute); err != nil {
+		t.Errorf("connected client could not lease host1: %v", err)
+	}
+	if _, err := cm.AcquireLease("host2", SessionOrigin{RemoteAddr: "192.0.2.1:1234", Principal: "alice"}, time.Minute); err != nil {
+		t.Errorf("lease of another ID was refused: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/util"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Close reasons reported to clients and in events.
+const (
+	ReasonClientDisconnected  = "client disconnected"
+	ReasonCallbackEnded       = "callback session ended"
+	ReasonConnectionClosed    = "connection closed"
+	ReasonIdleTimeout         = "idle timeout"
+	ReasonClientMaxDuration   = "maximum client session duration reached"
+	ReasonCallbackMaxDuration = "maximum callback session duration reached"
+)
+
+// Websocket close codes used when the server closes a session.
+const (
+	CloseCodeGoingAway       = 1001
+	CloseCodePolicyViolation = 1008
+)
+
+// reasonSender is implemented by connections which can tell the peer why they
+// are being closed (such as websocketrwc.Conn).
+type reasonSender interface {
+	SendClose(code int, reason string) error
+}
+
+// sendCloseReason tells the peer of conn why it is being closed, if possible.
+func sendCloseReason(conn interface{}, code int, reason string) {
+	if rs, ok := conn.(reasonSender); ok {
+		rs.SendClose(code, reason)
+	}
+}
+
+// LifetimePolicy limits how long sessions may live. Zero values are unlimited.
+type LifetimePolicy struct {
+	// Pattern is a path.Match pattern of the callback IDs the policy applies
+	// to. Ignored for the global policy.
+	Pattern string `json:"pattern"`
+	// ClientIdleTimeout closes client sessions which have moved no bytes in
+	// either direction for this long.
+	ClientIdleTimeout util.Duration `json:"client_idle_timeout"`
+	// ClientMaxDuration closes client sessions after this long.
+	ClientMaxDuration util.Duration `json:"client_max_duration"`
+	// CallbackMaxDuration closes callback sessions after this long, forcing
+	// them to re-register.
+	CallbackMaxDuration util.Duration `json:"callback_max_duration"`
+}
+
+// merge returns the policy with non-zero fields of override applied.
+func (lp LifetimePolicy) merge(override LifetimePolicy) LifetimePolicy {
+	if override.ClientIdleTimeout != 0 {
+		lp.ClientIdleTimeout = override.ClientIdleTimeout
+	}
+	if override.ClientMaxDuration != 0 {
+		lp.ClientMaxDuration = override.ClientMaxDuration
+	}
+	if override.CallbackMaxDuration != 0 {
+		lp.CallbackMaxDuration = override.CallbackMaxDuration
+	}
+	return lp
+}
+
+// SetLifetimePolicies sets the global lifetime policy and per callback ID
+// pattern overrides. The first override matching a callback ID has its
+// non-zero fields applied over the global policy. Policies apply to sessions
+// established after the call.
+func (this *ConnectionManager) SetLifetimePolicies(global LifetimePolicy, overrides []LifetimePolicy) error {
+	for _, override := range overrides {
+		if _, err := path.Match(override.Pattern, ""); err != nil {
+			return err
+		}
+	}
+
+	this.limitsMtx.Lock()
+	defer this.limitsMtx.Unlock()
+	this.lifetimeGlobal = global
+	this.lifetimeOverrides = overrides
+	return nil
+}
+
+// lifetimePolicy returns the effective lifetime policy of a callback ID.
+func (this *ConnectionManager) lifetimePolicy(callbackId string) LifetimePolicy {
+	this.limitsMtx.RLock()
+	defer this.limitsMtx.RUnlock()
+
+	for _, override := range this.lifetimeOverrides {
+		if matched, _ := path.Match(override.Pattern, callbackId); matched {
+			return this.lifetimeGlobal.merge(override)
+		}
+	}
+	return this.lifetimeGlobal
+}
+
+// sessionCloser closes a session once, remembering why.
+type sessionCloser struct {
+	reason string
+	mtx    sync.Mutex
+	// closeFn performs the close. It is only called for the first close.
+	closeFn func(reason string)
+}
+
+// close closes the session with reason, if it has not already been closed.
+func (sc *sessionCloser) close(reason string) {
+	sc.mtx.Lock()
+	if sc.reason != "" {
+		sc.mtx.Unlock()
+		return
+	}
+	sc.reason = reason
+	sc.mtx.Unlock()
+
+	sc.closeFn(reason)
+}
+
+// Reason returns why the session was closed, or a blank string.
+func (sc *sessionCloser) Reason() string {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	return sc.reason
+}
+
+// watchClientLifetime closes a client session with closer when it exceeds
+// policy. Returns when stopCh is closed.
+func watchClientLifetime(policy LifetimePolicy, desc *ClientSessionDesc, closer *sessionCloser, stopCh <-chan struct{}) {
+	idleTimeout := time.Duration(policy.ClientIdleTimeout)
+	maxDuration := time.Duration(policy.ClientMaxDuration)
+	if idleTimeout <= 0 && maxDuration <= 0 {
+		return
+	}
+
+	var maxDurationCh <-chan time.Time
+	if maxDuration > 0 {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+		maxDurationCh = timer.C
+	}
+
+	var idleCheckCh <-chan time.Time
+	if idleTimeout > 0 {
+		interval := idleTimeout / 10
+		if interval < 100*time.Millisecond {
+			interval = 100 * time.Millisecond
+		}
+		if interval > 10*time.Second {
+			interval = 10 * time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		idleCheckCh = ticker.C
+	}
+
+	lastTotal := uint64(0)
+	lastActivity := time.Now()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-maxDurationCh:
+			closer.close(ReasonClientMaxDuration)
+			return
+		case now := <-idleCheckCh:
+			total := atomic.LoadUint64(&desc.BytesIn) + atomic.LoadUint64(&desc.BytesOut)
+			if total != lastTotal {
+				lastTotal = total
+				lastActivity = now
+			} else if now.Sub(lastActivity) >= idleTimeout {
+				closer.close(ReasonIdleTimeout)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/util"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLifetimePolicies(t *testing.T) {
+	cm := NewConnectionManager(1024)
+
+	global := LifetimePolicy{
+		ClientIdleTimeout:   util.Duration(time.Minute),
+		ClientMaxDuration:   util.Duration(time.Hour),
+		CallbackMaxDuration: util.Duration(24 * time.Hour),
+	}
+	overrides := []LifetimePolicy{
+		{Pattern: "db-*", ClientIdleTimeout: util.Duration(time.Second)},
+		{Pattern: "db-*", ClientMaxDuration: util.Duration(time.Second)},
+		{Pattern: "web-?", CallbackMaxDuration: util.Duration(time.Second)},
+	}
+	if err := cm.SetLifetimePolicies(global, overrides); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		callbackId string
+		want       LifetimePolicy
+	}{
+		{"db-1", LifetimePolicy{
+			ClientIdleTimeout:   util.Duration(time.Second),
+			ClientMaxDuration:   util.Duration(time.Hour),
+			CallbackMaxDuration: util.Duration(24 * time.Hour),
+		}},
+		{"web-1", LifetimePolicy{
+			ClientIdleTimeout:   util.Duration(time.Minute),
+			ClientMaxDuration:   util.Duration(time.Hour),
+			CallbackMaxDuration: util.Duration(time.Second),
+		}},
+		{"web-10", global},
+		{"other", global},
+	} {
+		if got := cm.lifetimePolicy(tc.callbackId); got != tc.want {
+			t.Errorf("lifetimePolicy(%q) = %+v, want %+v", tc.callbackId, got, tc.want)
+		}
+	}
+
+	if err := cm.SetLifetimePolicies(LifetimePolicy{}, []LifetimePolicy{{Pattern: "["}}); err == nil {
+		t.Error("SetLifetimePolicies accepted an invalid pattern")
+	}
+	if got := cm.lifetimePolicy("db-1"); got.ClientIdleTimeout != util.Duration(time.Second) {
+		t.Error("an invalid pattern replaced the existing policies")
+	}
+}
+
+// watchTestClient runs watchClientLifetime in the background, returning the
+// closer, the session description and a channel receiving the close reason.
+func watchTestClient(t *testing.T, policy LifetimePolicy) (*ClientSessionDesc, chan string, chan struct{}) {
+	desc := &ClientSessionDesc{}
+	reasonCh := make(chan string, 1)
+	closer := &sessionCloser{closeFn: func(reason string) { reasonCh <- reason }}
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		watchClientLifetime(policy, desc, closer, stopCh)
+		close(doneCh)
+	}()
+	t.Cleanup(func() {
+		select {
+		case <-stopCh:
+		default:
+			close(stopCh)
+		}
+		<-doneCh
+	})
+	return desc, reasonCh, stopCh
+}
+
+func TestWatchClientLifetime(t *testing.T) {
+	t.Run("idle timeout", func(t *testing.T) {
+		_, reasonCh, _ := watchTestClient(t, LifetimePolicy{ClientIdleTimeout: util.Duration(200 * time.Millisecond)})
+		select {
+		case reason := <-reasonCh:
+			if reason != ReasonIdleTimeout {
+				t.Errorf("closed with %q, want %q", reason, ReasonIdleTimeout)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("idle session was not closed")
+		}
+	})
+
+	t.Run("activity", func(t *testing.T) {
+		desc, reasonCh, stopCh := watchTestClient(t, LifetimePolicy{ClientIdleTimeout: util.Duration(300 * time.Millisecond)})
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			atomic.AddUint64(&desc.BytesIn, 1)
+			select {
+			case reason := <-reasonCh:
+				t.Fatalf("active session was closed with %q", reason)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		close(stopCh)
+	})
+
+	t.Run("max duration", func(t *testing.T) {
+		desc, reasonCh, _ := watchTestClient(t, LifetimePolicy{
+			ClientIdleTimeout: util.Duration(time.Minute),
+			ClientMaxDuration: util.Duration(200 * time.Millisecond),
+		})
+		atomic.AddUint64(&desc.BytesOut, 1)
+		select {
+		case reason := <-reasonCh:
+			if reason != ReasonClientMaxDuration {
+				t.Errorf("closed with %q, want %q", reason, ReasonClientMaxDuration)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("session was not closed at its maximum duration")
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		_, reasonCh, stopCh := watchTestClient(t, LifetimePolicy{ClientMaxDuration: util.Duration(200 * time.Millisecond)})
+		close(stopCh)
+		select {
+		case reason := <-reasonCh:
+			t.Fatalf("stopped session was closed with %q", reason)
+		case <-time.After(500 * time.Millisecond):
+		}
+	})
+}
+
+func TestClientIdleDisconnect(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	if err := cm.SetLifetimePolicies(LifetimePolicy{}, []LifetimePolicy{
+		{Pattern: "host1", ClientIdleTimeout: util.Duration(200 * time.Millisecond)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	eventCh := cm.SubscribeClientConnectionEvents(16)
+	defer cm.UnsubscribeClientConnectionEvents(eventCh)
+
+	testCallback(t, cm, "host1")
+	errCh := testClient(t, cm, "host1")
+	go func() {
+		for range errCh {
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-eventCh:
+			if event.EventType != EventDisconnected {
+				continue
+			}
+			if event.Reason != ReasonIdleTimeout {
+				t.Fatalf("client disconnected with %q, want %q", event.Reason, ReasonIdleTimeout)
+			}
+			return
+		case <-timeout:
+			t.Fatal("idle client was not disconnected")
+		}
+	}
+}
+
+func TestCallbackMaxDuration(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	if err := cm.SetLifetimePolicies(LifetimePolicy{CallbackMaxDuration: util.Duration(200 * time.Millisecond)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	eventCh := cm.SubscribeCallbackEvents(16)
+	defer cm.UnsubscribeCallbackEvents(eventCh)
+
+	testCallback(t, cm, "host1")
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-eventCh:
+			if event.EventType != EventDisconnected || event.CallbackId != "host1" {
+				continue
+			}
+			if event.Reason != ReasonCallbackMaxDuration {
+				t.Fatalf("callback disconnected with %q, want %q", event.Reason, ReasonCallbackMaxDuration)
+			}
+			if _, found := cm.GetCallbackSession("host1"); found {
+				t.Error("callback session is still registered")
+			}
+			return
+		case <-timeout:
+			t.Fatal("callback was not disconnected at its maximum duration")
+		}
+	}
+}
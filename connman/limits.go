@@ -0,0 +1,230 @@
+package connman
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Limits configures the quotas enforced by the connection manager. Zero values
+// are unlimited.
+type Limits struct {
+	// MaxCallbackSessions is the maximum number of callback sessions.
+	MaxCallbackSessions int
+	// MaxCallbackSessionsPerIP is the maximum number of callback sessions
+	// registered from a single remote IP.
+	MaxCallbackSessionsPerIP int
+	// MaxCallbackSessionsPerPrincipal is the maximum number of callback sessions
+	// registered by a single principal.
+	MaxCallbackSessionsPerPrincipal int
+	// MaxClientsPerCallback is the maximum number of concurrent client sessions
+	// to a single callback session.
+	MaxClientsPerCallback int
+	// MaxClientSessions is the maximum number of client sessions.
+	MaxClientSessions int
+	// MaxStreamsPerSession is the maximum number of open mux streams on a
+	// single callback session, including streams still being torn down.
+	MaxStreamsPerSession int
+}
+
+// Quota names reported by ErrQuotaExceeded.
+const (
+	QuotaCallbackSessions             = "max_callback_sessions"
+	QuotaCallbackSessionsPerIP        = "max_callback_sessions_per_ip"
+	QuotaCallbackSessionsPerPrincipal = "max_callback_sessions_per_principal"
+	QuotaClientsPerCallback           = "max_clients_per_callback"
+	QuotaClientSessions               = "max_client_sessions"
+	QuotaStreamsPerSession            = "max_streams_per_session"
+)
+
+// ErrQuotaExceeded is returned when establishing a session would exceed a
+// configured limit.
+type ErrQuotaExceeded struct {
+	// Quota is the name of the exceeded limit.
+	Quota string
+	Limit int
+}
+
+func (err ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("quota exceeded: %s (limit %d)", err.Quota, err.Limit)
+}
+
+// Global returns true if the exceeded quota is server-wide rather than
+// attributable to a single client.
+func (err ErrQuotaExceeded) Global() bool {
+	return err.Quota == QuotaCallbackSessions || err.Quota == QuotaClientSessions
+}
+
+// SetLimits replaces the quotas of the connection manager. Existing sessions
+// are not affected.
+func (this *ConnectionManager) SetLimits(limits Limits) {
+	this.limitsMtx.Lock()
+	defer this.limitsMtx.Unlock()
+	this.limits = limits
+}
+
+// GetLimits returns the current quotas of the connection manager.
+func (this *ConnectionManager) GetLimits() Limits {
+	this.limitsMtx.RLock()
+	defer this.limitsMtx.RUnlock()
+	return this.limits
+}
+
+// CheckCallbackConnection returns the error CallbackConnection would fail
+// with for a new session, allowing callers to reject registrations before
+// accepting the underlying connection. The check is repeated by
+// CallbackConnection.
+func (this *ConnectionManager) CheckCallbackConnection(callbackId string, origin SessionOrigin) error {
+	if err := this.checkRemoteCallback(callbackId); err != nil {
+		return err
+	}
+	this.callbackMtx.RLock()
+	defer this.callbackMtx.RUnlock()
+	return this.checkCallbackConnection(callbackId, origin)
+}
+
+// checkRemoteCallback returns an ErrSessionExists if another node of the
+// cluster holds callbackId. Registrations are refused if the registry cannot
+// be consulted. It calls the registry, so must not be called with callbackMtx
+// held.
+func (this *ConnectionManager) checkRemoteCallback(callbackId string) error {
+	if this.cluster == nil {
+		return nil
+	}
+	found, err := this.cluster.CheckRemoteCallback(callbackId)
+	if err != nil {
+		return &ErrRegistryUnavailable{err}
+	}
+	if found {
+		return &ErrSessionExists{callbackId}
+	}
+	return nil
+}
+
+// checkCallbackConnection checks the registration against the sessions of
+// this node. Must be called with callbackMtx held.
+func (this *ConnectionManager) checkCallbackConnection(callbackId string, origin SessionOrigin) error {
+	if this.Draining() {
+		return &ErrDraining{}
+	}
+
+	if err := this.flap.check(callbackId, origin, time.Now()); err != nil {
+		return err
+	}
+	if err := this.checkAdmission(callbackId); err != nil {
+		return err
+	}
+	if err := this.checkCallbackState(callbackId); err != nil {
+		return err
+	}
+	if err := this.checkReclaim(callbackId, origin); err != nil {
+		return err
+	}
+
+	if callbackSession, found := this.callbackSessions[callbackId]; found {
+		if !callbackSession.muxClient.IsClosed() {
+			return &ErrSessionExists{callbackId}
+		}
+	}
+	limits := this.GetLimits()
+
+	originIP := hostOf(origin.RemoteAddr)
+	total, perIP, perPrincipal := 0, 0, 0
+	for id, session := range this.callbackSessions {
+		if id == callbackId {
+			// Closed session about to be replaced.
+			continue
+		}
+		total++
+		if hostOf(session.desc.RemoteAddr) == originIP {
+			perIP++
+		}
+		if origin.Principal != "" && session.desc.Principal == origin.Principal {
+			perPrincipal++
+		}
+	}
+
+	if limits.MaxCallbackSessions > 0 && total >= limits.MaxCallbackSessions {
+		return &ErrQuotaExceeded{QuotaCallbackSessions, limits.MaxCallbackSessions}
+	}
+	if limits.MaxCallbackSessionsPerIP > 0 && perIP >= limits.MaxCallbackSessionsPerIP {
+		return &ErrQuotaExceeded{QuotaCallbackSessionsPerIP, limits.MaxCallbackSessionsPerIP}
+	}
+	if limits.MaxCallbackSessionsPerPrincipal > 0 && perPrincipal >= limits.MaxCallbackSessionsPerPrincipal {
+		return &ErrQuotaExceeded{QuotaCallbackSessionsPerPrincipal, limits.MaxCallbackSessionsPerPrincipal}
+	}
+	return nil
+}
+
+// CheckClientConnection returns the error ClientConnection would fail with
+// for a new client session, allowing callers to reject connections before
+// accepting the underlying connection. The check is repeated by
+// ClientConnection.
+func (this *ConnectionManager) CheckClientConnection(callbackId string, origin SessionOrigin) error {
+	if this.Draining() {
+		return &ErrDraining{}
+	}
+	if err := this.checkLease(callbackId, origin); err != nil {
+		return err
+	}
+	if err := this.checkSchedule(callbackId); err != nil {
+		return err
+	}
+
+	this.callbackMtx.RLock()
+	session, exportId, found := this.resolveCallback(callbackId)
+	this.callbackMtx.RUnlock()
+	if !found {
+		if this.cluster != nil && origin.Node == "" {
+			if _, remote := this.cluster.LookupCallback(callbackId); remote {
+				// The owning node checks its own quotas.
+				return nil
+			}
+		}
+		return &ErrSessionUnknown{callbackId}
+	}
+	if session.GetShutdownChannel() == nil {
+		return &ErrSessionDisconnected{callbackId}
+	}
+	if session.getState() == SessionPending {
+		return &ErrSessionPending{callbackId}
+	}
+	if err := this.checkClientState(callbackId, session, exportId); err != nil {
+		return err
+	}
+
+	this.clientMtx.RLock()
+	defer this.clientMtx.RUnlock()
+	return this.checkClientConnection(session)
+}
+
+// checkClientConnection must be called with clientMtx held.
+func (this *ConnectionManager) checkClientConnection(session *callbackSession) error {
+	if this.Draining() {
+		return &ErrDraining{}
+	}
+
+	limits := this.GetLimits()
+
+	if limits.MaxClientSessions > 0 && len(this.clientSessions) >= limits.MaxClientSessions {
+		return &ErrQuotaExceeded{QuotaClientSessions, limits.MaxClientSessions}
+	}
+	numClients := int(atomic.LoadUint32(&session.numClients))
+	if limits.MaxClientsPerCallback > 0 && numClients >= limits.MaxClientsPerCallback {
+		return &ErrQuotaExceeded{QuotaClientsPerCallback, limits.MaxClientsPerCallback}
+	}
+	if limits.MaxStreamsPerSession > 0 && session.muxClient.NumStreams() >= limits.MaxStreamsPerSession {
+		return &ErrQuotaExceeded{QuotaStreamsPerSession, limits.MaxStreamsPerSession}
+	}
+	return nil
+}
+
+// hostOf strips the port from an address if it has one.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
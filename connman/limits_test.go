@@ -0,0 +1,230 @@
+package connman
+
+import (
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCallback registers callbackId with cm over an in-memory connection,
+// returning the mux session of the callback side, which accepts streams and
+// holds them open until the test ends.
+func testCallback(t *testing.T, cm *ConnectionManager, callbackId string) *yamux.Session {
+	return testCallbackOrigin(t, cm, callbackId, SessionOrigin{RemoteAddr: "192.0.2.1:1234"})
+}
+
+// testCallbackOrigin registers callbackId from origin like testCallback.
+func testCallbackOrigin(t *testing.T, cm *ConnectionManager, callbackId string, origin SessionOrigin) *yamux.Session {
+	serverConn, callbackConn := net.Pipe()
+	doneCh := make(chan struct{})
+	var doneOnce sync.Once
+	t.Cleanup(func() {
+		callbackConn.Close()
+		doneOnce.Do(func() { close(doneCh) })
+	})
+
+	// As the websocket handler does, the connection ends once the session
+	// result is returned.
+	resultCh := cm.CallbackConnection(callbackId, origin, serverConn, doneCh)
+	go func() {
+		for range resultCh {
+		}
+		doneOnce.Do(func() { close(doneCh) })
+	}()
+
+	muxServer, err := yamux.Server(callbackConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			stream, err := muxServer.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, stream)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, found := cm.GetCallbackSession(callbackId); found {
+			return muxServer
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callback session was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testClient connects a client to callbackId, returning its result channel.
+func testClient(t *testing.T, cm *ConnectionManager, callbackId string) <-chan error {
+	serverConn, clientConn := net.Pipe()
+	doneCh := make(chan struct{})
+	t.Cleanup(func() {
+		clientConn.Close()
+		close(doneCh)
+	})
+	return cm.ClientConnection(callbackId, SessionOrigin{RemoteAddr: "198.51.100.1:4321"}, serverConn, doneCh)
+}
+
+func TestMaxStreamsPerSession(t *testing.T) {
+	const maxStreams = 3
+
+	cm := NewConnectionManager(1024)
+	cm.SetLimits(Limits{MaxStreamsPerSession: maxStreams})
+	muxServer := testCallback(t, cm, "host1")
+
+	var errChs []<-chan error
+	for i := 0; i < maxStreams; i++ {
+		errChs = append(errChs, testClient(t, cm, "host1"))
+	}
+
+	// Wait for the permitted streams to be opened to the callback.
+	deadline := time.Now().Add(5 * time.Second)
+	for muxServer.NumStreams() < maxStreams {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams were opened, want %d", muxServer.NumStreams(), maxStreams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, errCh := range errChs {
+		select {
+		case err := <-errCh:
+			t.Fatalf("client %d ended early: %v", i, err)
+		default:
+		}
+	}
+
+	select {
+	case err := <-testClient(t, cm, "host1"):
+		qerr, ok := err.(*ErrQuotaExceeded)
+		if !ok || qerr.Quota != QuotaStreamsPerSession || qerr.Limit != maxStreams {
+			t.Fatalf("client %d returned %v, want %s quota exceeded", maxStreams+1, err, QuotaStreamsPerSession)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client %d was not refused", maxStreams+1)
+	}
+
+	if err := cm.CheckClientConnection("host1", SessionOrigin{}); err == nil {
+		t.Error("CheckClientConnection permitted a stream over the limit")
+	}
+	if n := muxServer.NumStreams(); n != maxStreams {
+		t.Errorf("callback has %d streams, want %d", n, maxStreams)
+	}
+}
+
+func TestMaxClientsPerCallback(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	cm.SetLimits(Limits{MaxClientsPerCallback: 1})
+	testCallback(t, cm, "host1")
+
+	first := testClient(t, cm, "host1")
+	deadline := time.Now().Add(5 * time.Second)
+	for cm.CheckClientConnection("host1", SessionOrigin{}) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("first client was not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-testClient(t, cm, "host1"):
+		if qerr, ok := err.(*ErrQuotaExceeded); !ok || qerr.Quota != QuotaClientsPerCallback {
+			t.Fatalf("second client returned %v, want %s quota exceeded", err, QuotaClientsPerCallback)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second client was not refused")
+	}
+	select {
+	case err := <-first:
+		t.Fatalf("first client ended: %v", err)
+	default:
+	}
+}
+
+func TestCallbackQuotas(t *testing.T) {
+	alice := func(addr string) SessionOrigin { return SessionOrigin{RemoteAddr: addr, Principal: "alice"} }
+	bob := func(addr string) SessionOrigin { return SessionOrigin{RemoteAddr: addr, Principal: "bob"} }
+
+	for _, tc := range []struct {
+		name   string
+		limits Limits
+		// registered are the origins of the sessions host0, host1...
+		registered []SessionOrigin
+		origin     SessionOrigin
+		// quota is the quota the registration exceeds, if any.
+		quota string
+	}{
+		{"total", Limits{MaxCallbackSessions: 2}, []SessionOrigin{alice("192.0.2.1:1"), bob("192.0.2.2:1")}, bob("192.0.2.3:1"), QuotaCallbackSessions},
+		{"under total", Limits{MaxCallbackSessions: 3}, []SessionOrigin{alice("192.0.2.1:1"), bob("192.0.2.2:1")}, bob("192.0.2.3:1"), ""},
+		{"per ip", Limits{MaxCallbackSessionsPerIP: 2}, []SessionOrigin{alice("192.0.2.1:1"), bob("192.0.2.1:2")}, SessionOrigin{RemoteAddr: "192.0.2.1:3"}, QuotaCallbackSessionsPerIP},
+		{"per ip other address", Limits{MaxCallbackSessionsPerIP: 2}, []SessionOrigin{alice("192.0.2.1:1"), bob("192.0.2.1:2")}, alice("192.0.2.2:1"), ""},
+		{"per principal", Limits{MaxCallbackSessionsPerPrincipal: 2}, []SessionOrigin{alice("192.0.2.1:1"), alice("192.0.2.2:1")}, alice("192.0.2.3:1"), QuotaCallbackSessionsPerPrincipal},
+		{"per principal other principal", Limits{MaxCallbackSessionsPerPrincipal: 2}, []SessionOrigin{alice("192.0.2.1:1"), alice("192.0.2.2:1")}, bob("192.0.2.3:1"), ""},
+		{"per principal anonymous", Limits{MaxCallbackSessionsPerPrincipal: 1}, []SessionOrigin{{RemoteAddr: "192.0.2.1:1"}}, SessionOrigin{RemoteAddr: "192.0.2.2:1"}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cm := NewConnectionManager(1024)
+			for i, origin := range tc.registered {
+				testCallbackOrigin(t, cm, fmt.Sprintf("host%d", i), origin)
+			}
+			cm.SetLimits(tc.limits)
+
+			err := cm.CheckCallbackConnection("new", tc.origin)
+			if tc.quota == "" {
+				if err != nil {
+					t.Errorf("registration refused: %v", err)
+				}
+				return
+			}
+			if qerr, ok := err.(*ErrQuotaExceeded); !ok || qerr.Quota != tc.quota {
+				t.Errorf("CheckCallbackConnection returned %v, want %s exceeded", err, tc.quota)
+			}
+		})
+	}
+}
+
+func TestMaxClientSessions(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	cm.SetLimits(Limits{MaxClientSessions: 1})
+	testCallback(t, cm, "host1")
+	testCallback(t, cm, "host2")
+	go func() {
+		for range testClient(t, cm, "host1") {
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cm.CheckClientConnection("host2", SessionOrigin{}) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("first client was not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err := cm.CheckClientConnection("host2", SessionOrigin{})
+	if qerr, ok := err.(*ErrQuotaExceeded); !ok || qerr.Quota != QuotaClientSessions {
+		t.Errorf("CheckClientConnection returned %v, want %s exceeded", err, QuotaClientSessions)
+	}
+}
+
+func TestQuotaGlobal(t *testing.T) {
+	for quota, global := range map[string]bool{
+		QuotaCallbackSessions:             true,
+		QuotaClientSessions:               true,
+		QuotaCallbackSessionsPerIP:        false,
+		QuotaCallbackSessionsPerPrincipal: false,
+		QuotaClientsPerCallback:           false,
+		QuotaStreamsPerSession:            false,
+	} {
+		if (ErrQuotaExceeded{Quota: quota}).Global() != global {
+			t.Errorf("%s: Global() = %v, want %v", quota, !global, global)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/control"
+	"github.com/wrouesnel/go.log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReasonMigrated is reported when a session is closed after registering with
+// another server.
+const ReasonMigrated = "migrated to another server"
+
+// MigrationResult is the outcome of migrating a callback session.
+type MigrationResult struct {
+	CallbackId string `json:"callback_id"`
+	Migrated   bool   `json:"migrated"`
+	// Error describes why the session was not migrated.
+	Error string `json:"error,omitempty"`
+}
+
+// Migrate asks callback sessions to register with the server at target, and
+// closes each session once it reports it has done so. If callbackIds is empty
+// every callback session held by this server is migrated. Sessions which do
+// not reply within timeout are left connected. Blocks until every session has
+// replied or timed out. In a cluster the target may be another node, which
+// accepts the registration while this node still holds the session.
+func (this *ConnectionManager) Migrate(callbackIds []string, target string, timeout time.Duration) []MigrationResult {
+	this.callbackMtx.RLock()
+	if len(callbackIds) == 0 {
+		for callbackId := range this.callbackSessions {
+			callbackIds = append(callbackIds, callbackId)
+		}
+		sort.Strings(callbackIds)
+	}
+	sessions := make([]*callbackSession, len(callbackIds))
+	for i, callbackId := range callbackIds {
+		sessions[i] = this.callbackSessions[callbackId]
+	}
+	this.callbackMtx.RUnlock()
+
+	results := make([]MigrationResult, len(callbackIds))
+	wg := sync.WaitGroup{}
+	for i := range callbackIds {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = MigrationResult{CallbackId: callbackIds[i]}
+			if err := sessions[i].migrate(callbackIds[i], target, timeout, this.cluster); err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].Migrated = true
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// ErrMigrationFailed is returned when a callback session could not be migrated.
+type ErrMigrationFailed struct {
+	reason string
+}
+
+func (err ErrMigrationFailed) Error() string {
+	return "migration failed: " + err.reason
+}
+
+// migrate asks the session to register with target and closes it once it has.
+// cbs may be nil if the session does not exist. cluster is nil if the
+// connection manager is not clustered.
+func (cbs *callbackSession) migrate(callbackId string, target string, timeout time.Duration, cluster Cluster) error {
+	if cbs == nil {
+		return &ErrSessionUnknown{callbackId}
+	}
+	doneCh := cbs.GetShutdownChannel()
+	if doneCh == nil {
+		return &ErrSessionDisconnected{callbackId}
+	}
+	if cbs.control == nil || !control.HasCapability(cbs.desc.Capabilities, control.CapabilityMigrate) {
+		return &ErrMigrationFailed{"callback does not support migration"}
+	}
+
+	// Other nodes refuse to register a session held here unless it is
+	// recorded as migrating. If the migration fails, the flag is cleared and
+	// the record corrected by the next heartbeat: writing it here could
+	// replace the record of a registration made after the timeout.
+	if err := cbs.setMigrating(callbackId, true, cluster); err != nil {
+		cbs.setMigrating(callbackId, false, nil)
+		return &ErrMigrationFailed{"could not record the migration in the cluster registry: " + err.Error()}
+	}
+	migrated := false
+	defer func() {
+		if !migrated {
+			cbs.setMigrating(callbackId, false, nil)
+		}
+	}()
+
+	// Discard any stale reply to an earlier request which timed out.
+	select {
+	case <-cbs.control.replies:
+	default:
+	}
+
+	if !cbs.sendControl(control.Message{Type: control.MessageMigrate, Target: target}) {
+		return &ErrMigrationFailed{"could not send migration request"}
+	}
+	cbs.log.Infoln("Asked callback session to migrate to:", target)
+
+	select {
+	case reply := <-cbs.control.replies:
+		if reply.Type != control.MessageMigrated {
+			cbs.log.Warnln("Callback session could not migrate:", reply.Reason)
+			return &ErrMigrationFailed{reply.Reason}
+		}
+	case <-doneCh:
+		return &ErrSessionDisconnected{callbackId}
+	case <-time.After(timeout):
+		return &ErrMigrationFailed{"timed out waiting for the callback to register with the target"}
+	}
+
+	migrated = true
+	log.With("callback_id", callbackId).Infoln("Callback session migrated. Closing.")
+	cbs.DisconnectWithReason(CloseCodeGoingAway, ReasonMigrated)
+	return nil
+}
+
+// setMigrating marks the session as migrating or not, and records it in the
+// cluster registry if cluster is not nil.
+func (cbs *callbackSession) setMigrating(callbackId string, migrating bool, cluster Cluster) error {
+	cbs.mtx.Lock()
+	cbs.migrating = migrating
+	cbs.mtx.Unlock()
+	if cluster == nil {
+		return nil
+	}
+	return cluster.PutCallback(callbackId, cbs.copyDesc())
+}
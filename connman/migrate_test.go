@@ -0,0 +1,56 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/control"
+	"github.com/wrouesnel/go.log"
+	"io"
+	"testing"
+	"time"
+)
+
+// replyingConn is a callback connection which replies to migration requests
+// with reply, recording whether the session was marked migrating when asked.
+type replyingConn struct {
+	cbs       *callbackSession
+	reply     control.Message
+	migrating bool
+}
+
+func (c *replyingConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (c *replyingConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *replyingConn) Close() error                { return nil }
+
+func (c *replyingConn) WriteControlMessage(p []byte) error {
+	c.migrating = c.cbs.isMigrating()
+	c.cbs.control.replies <- c.reply
+	return nil
+}
+
+// TestMigrateMarksCluster checks a migrating session is recorded as such in
+// the cluster registry before the callback is asked to register elsewhere,
+// and is no longer once the migration fails.
+func TestMigrateMarksCluster(t *testing.T) {
+	cluster := &fakeCluster{}
+	conn := &replyingConn{reply: control.Message{Type: control.MessageMigrateFailed, Reason: "refused"}}
+	cbs := &callbackSession{
+		log:     log.With("callback_id", "host1"),
+		conn:    conn,
+		doneCh:  make(chan struct{}),
+		desc:    CallbackSessionDesc{Capabilities: []string{control.CapabilityControl, control.CapabilityMigrate}},
+		control: &sessionControl{replies: make(chan control.Message, 1)},
+	}
+	conn.cbs = cbs
+
+	if err := cbs.migrate("host1", "http://node2/", time.Second, cluster); err == nil {
+		t.Fatal("migration refused by the callback succeeded")
+	}
+	if !conn.migrating {
+		t.Error("session was not migrating when the callback was asked to migrate")
+	}
+	if len(cluster.puts) != 1 || !cluster.puts[0].Migrating {
+		t.Errorf("registry puts = %+v, want one migrating session", cluster.puts)
+	}
+	if cbs.isMigrating() {
+		t.Error("session is still migrating after the migration failed")
+	}
+}
@@ -0,0 +1,126 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/control"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RelaySeparator joins the callback ID of a relay to the IDs of the sessions
+// it exports. A relay registered as "site1" exporting "host42" is reached as
+// "site1.host42".
+const RelaySeparator = "."
+
+// relayExports holds the callback sessions exported by a relay session.
+type relayExports struct {
+	sessions map[string]control.Export
+	mtx      sync.RWMutex
+}
+
+// get returns an exported session.
+func (re *relayExports) get(id string) (control.Export, bool) {
+	re.mtx.RLock()
+	defer re.mtx.RUnlock()
+	export, found := re.sessions[id]
+	return export, found
+}
+
+// list returns the exported sessions sorted by ID.
+func (re *relayExports) list() []control.Export {
+	re.mtx.RLock()
+	defer re.mtx.RUnlock()
+	ret := make([]control.Export, 0, len(re.sessions))
+	for _, export := range re.sessions {
+		ret = append(ret, export)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Id < ret[j].Id })
+	return ret
+}
+
+// replace sets the exported sessions, returning the exports which were added
+// and removed.
+func (re *relayExports) replace(exports []control.Export) (added []control.Export, removed []control.Export) {
+	re.mtx.Lock()
+	defer re.mtx.Unlock()
+
+	sessions := make(map[string]control.Export, len(exports))
+	for _, export := range exports {
+		sessions[export.Id] = export
+		if _, found := re.sessions[export.Id]; !found {
+			added = append(added, export)
+		}
+	}
+	for id, export := range re.sessions {
+		if _, found := sessions[id]; !found {
+			removed = append(removed, export)
+		}
+	}
+	re.sessions = sessions
+	return added, removed
+}
+
+// updateExports replaces the sessions exported by a relay session, publishing
+// events for the sessions exported and withdrawn.
+func (this *ConnectionManager) updateExports(callbackId string, relay CallbackSessionDesc, exports *relayExports, updated []control.Export) {
+	added, removed := exports.replace(updated)
+	for _, export := range added {
+		this.publishCallbackConnectionEvent(EventConnected, "", callbackId+RelaySeparator+export.Id, exportDesc(callbackId, relay, export))
+	}
+	for _, export := range removed {
+		this.publishCallbackConnectionEvent(EventDisconnected, ReasonConnectionClosed, callbackId+RelaySeparator+export.Id, exportDesc(callbackId, relay, export))
+	}
+}
+
+// exportDesc describes a session exported by the relay session relayId.
+func exportDesc(relayId string, relay CallbackSessionDesc, export control.Export) CallbackSessionDesc {
+	return CallbackSessionDesc{
+		ConnectedAt: export.ConnectedAt,
+		RemoteAddr:  relay.RemoteAddr,
+		Principal:   relay.Principal,
+		Labels:      export.Labels,
+		Node:        relay.Node,
+		Relay:       relayId,
+		State:       relay.State,
+	}
+}
+
+// resolveCallback finds the session serving callbackId: a session registered
+// with that ID, or a relay session exporting it. exportId is the ID the relay
+// knows the session by, and is blank if the session is not relayed. Must be
+// called with callbackMtx held.
+func (this *ConnectionManager) resolveCallback(callbackId string) (session *callbackSession, exportId string, found bool) {
+	if session, found := this.callbackSessions[callbackId]; found {
+		return session, "", true
+	}
+
+	// Relays may be chained, so try the longest relay ID first.
+	for i := strings.LastIndex(callbackId, RelaySeparator); i > 0; i = strings.LastIndex(callbackId[:i], RelaySeparator) {
+		session, found := this.callbackSessions[callbackId[:i]]
+		if !found || session.exports == nil {
+			continue
+		}
+		exportId := callbackId[i+len(RelaySeparator):]
+		if _, exported := session.exports.get(exportId); exported {
+			return session, exportId, true
+		}
+	}
+	return nil, "", false
+}
+
+// exportedSessions returns the descriptions of sessions exported by relays,
+// by their full callback ID. Must be called with callbackMtx held.
+func (this *ConnectionManager) exportedSessions() map[string]CallbackSessionDesc {
+	ret := make(map[string]CallbackSessionDesc)
+	for relayId, session := range this.callbackSessions {
+		if session.exports == nil {
+			continue
+		}
+		for _, export := range session.exports.list() {
+			desc := exportDesc(relayId, session.copyDesc(), export)
+			desc.Annotations = this.callbackAnnotations(relayId + RelaySeparator + export.Id)
+			ret[relayId+RelaySeparator+export.Id] = desc
+		}
+	}
+	return ret
+}
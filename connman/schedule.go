@@ -0,0 +1,289 @@
+package connman
+
+import (
+	"fmt"
+	"github.com/wrouesnel/callback/control"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/go.log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReasonScheduleClosed is reported when a client session is closed because
+// the access window of its callback closed.
+const ReasonScheduleClosed = "access window closed"
+
+// Schedule restricts when clients may connect to callback IDs matching
+// Pattern to a set of weekly windows.
+type Schedule struct {
+	Name string `json:"name"`
+	// Pattern is a path.Match pattern of the callback IDs the schedule
+	// applies to.
+	Pattern string `json:"pattern"`
+	// Timezone the windows are in. Defaults to UTC.
+	Timezone string   `json:"timezone"`
+	Windows  []Window `json:"windows"`
+	// DisconnectOnClose closes client sessions when their window closes.
+	DisconnectOnClose bool `json:"disconnect_on_close"`
+	// Warning is how long before closing client sessions they are warned.
+	Warning util.Duration `json:"warning"`
+
+	loc *time.Location
+}
+
+// Window is a period of the week during which clients may connect.
+type Window struct {
+	// Days the window opens on, such as "mon" or "Monday". Every day if empty.
+	Days []string `json:"days"`
+	// Start and End are times of day as HH:MM. A window ending at or before
+	// its start closes the next day.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	days  [7]bool
+	start int
+	end   int
+}
+
+// ErrOutsideSchedule is returned when connecting to a callback outside the
+// access windows of its schedule.
+type ErrOutsideSchedule struct {
+	CallbackId string
+	Schedule   string
+	// OpensAt is when the next window opens, zero if none will.
+	OpensAt time.Time
+}
+
+func (err ErrOutsideSchedule) Error() string {
+	if err.OpensAt.IsZero() {
+		return fmt.Sprintf("callback %s may not be connected to outside schedule %q: no window is scheduled", err.CallbackId, err.Schedule)
+	}
+	return fmt.Sprintf("callback %s may not be connected to outside schedule %q: next window opens at %s",
+		err.CallbackId, err.Schedule, err.OpensAt.Format(time.RFC3339))
+}
+
+// parseTimeOfDay parses HH:MM into minutes after midnight. 24:00 is allowed
+// as the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	var hour, minute int
+	if n, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil || n != 2 {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// parseWeekday parses a full or three letter day name.
+func parseWeekday(s string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if strings.EqualFold(s, name) || strings.EqualFold(s, name[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+func (w *Window) compile() error {
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return err
+	}
+	if len(w.Days) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	}
+	for _, s := range w.Days {
+		day, err := parseWeekday(s)
+		if err != nil {
+			return err
+		}
+		w.days[day] = true
+	}
+	return nil
+}
+
+func (s *Schedule) compile() error {
+	if _, err := path.Match(s.Pattern, ""); err != nil {
+		return err
+	}
+	s.loc = time.UTC
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return err
+		}
+		s.loc = loc
+	}
+	for i := range s.Windows {
+		if err := s.Windows[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interval is a single occurrence of a window.
+type interval struct {
+	start time.Time
+	end   time.Time
+}
+
+// at returns whether a window of the schedule is open at t, and when it
+// closes. If none is open, opensAt is when the next window opens within a
+// week, zero if none does. Overlapping and adjoining windows are treated as
+// one.
+func (s *Schedule) at(t time.Time) (open bool, closesAt time.Time, opensAt time.Time) {
+	t = t.In(s.loc)
+	var intervals []interval
+	for offset := -1; offset <= 8; offset++ {
+		date := time.Date(t.Year(), t.Month(), t.Day()+offset, 0, 0, 0, 0, s.loc)
+		for _, w := range s.Windows {
+			if !w.days[date.Weekday()] {
+				continue
+			}
+			end := w.end
+			if end <= w.start {
+				end += 24 * 60
+			}
+			intervals = append(intervals, interval{
+				start: time.Date(date.Year(), date.Month(), date.Day(), 0, w.start, 0, 0, s.loc),
+				end:   time.Date(date.Year(), date.Month(), date.Day(), 0, end, 0, 0, s.loc),
+			})
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+
+	var merged []interval
+	for _, iv := range intervals {
+		if n := len(merged); n > 0 && !iv.start.After(merged[n-1].end) {
+			if iv.end.After(merged[n-1].end) {
+				merged[n-1].end = iv.end
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+
+	for _, iv := range merged {
+		if !iv.end.After(t) {
+			continue
+		}
+		if !iv.start.After(t) {
+			return true, iv.end, time.Time{}
+		}
+		return false, time.Time{}, iv.start
+	}
+	return false, time.Time{}, time.Time{}
+}
+
+// SetSchedules sets the access schedules of callback IDs. The first schedule
+// matching a callback ID applies, and IDs matching none may always be
+// connected to. Schedules apply to client sessions established after the call.
+func (this *ConnectionManager) SetSchedules(schedules []Schedule) error {
+	compiled := make([]*Schedule, 0, len(schedules))
+	for i := range schedules {
+		schedule := schedules[i]
+		if schedule.Name == "" {
+			schedule.Name = fmt.Sprintf("schedule-%d", i)
+		}
+		if err := schedule.compile(); err != nil {
+			return fmt.Errorf("schedule %q: %v", schedule.Name, err)
+		}
+		compiled = append(compiled, &schedule)
+	}
+
+	this.limitsMtx.Lock()
+	defer this.limitsMtx.Unlock()
+	this.schedules = compiled
+	return nil
+}
+
+// schedule returns the schedule of a callback ID, or nil.
+func (this *ConnectionManager) schedule(callbackId string) *Schedule {
+	this.limitsMtx.RLock()
+	defer this.limitsMtx.RUnlock()
+
+	for _, schedule := range this.schedules {
+		if matched, _ := path.Match(schedule.Pattern, callbackId); matched {
+			return schedule
+		}
+	}
+	return nil
+}
+
+// checkSchedule returns an ErrOutsideSchedule if clients may not connect to
+// callbackId now.
+func (this *ConnectionManager) checkSchedule(callbackId string) error {
+	schedule := this.schedule(callbackId)
+	if schedule == nil {
+		return nil
+	}
+	if open, _, opensAt := schedule.at(time.Now()); !open {
+		return &ErrOutsideSchedule{callbackId, schedule.Name, opensAt}
+	}
+	return nil
+}
+
+// watchClientSchedule closes a client session with closer when the access
+// window of its callback closes, warning the client beforehand. Returns when
+// stopCh is closed.
+func (this *ConnectionManager) watchClientSchedule(schedule *Schedule, origin SessionOrigin, conn interface{},
+	desc *ClientSessionDesc, closer *sessionCloser, stopCh <-chan struct{}) {
+	if schedule == nil || !schedule.DisconnectOnClose {
+		return
+	}
+
+	warning := time.Duration(schedule.Warning)
+	warned := false
+	for {
+		now := time.Now()
+		open, closesAt, _ := schedule.at(now)
+		if !open {
+			closer.close(ReasonScheduleClosed)
+			return
+		}
+
+		wake := closesAt
+		if !warned && warning > 0 {
+			if warnAt := closesAt.Add(-warning); warnAt.After(now) {
+				wake = warnAt
+			} else {
+				this.warnClient(origin, conn, desc, fmt.Sprintf("access window of schedule %q closes at %s",
+					schedule.Name, closesAt.Format(time.RFC3339)))
+				warned = true
+			}
+		}
+
+		timer := time.NewTimer(wake.Sub(now))
+		select {
+		case <-stopCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// warnClient tells a client its session will be closed, with a control
+// message if it supports them, and in a client event.
+func (this *ConnectionManager) warnClient(origin SessionOrigin, conn interface{}, desc *ClientSessionDesc, reason string) {
+	log := log.With("remote_addr", desc.RemoteAddr).With("callback_id", desc.CallbackId)
+	log.Infoln("Warning client session:", reason)
+	if control.HasCapability(origin.Capabilities, control.CapabilityControl) {
+		if sender, ok := conn.(controlSender); ok {
+			if data, err := control.Encode(control.Message{Type: control.MessageWarning, Reason: reason}); err == nil {
+				util.LogErr(log, sender.WriteControlMessage(data))
+			}
+		}
+	}
+	this.publishClientConnectionEvent(EventUpdated, reason, desc.copy())
+}
@@ -0,0 +1,177 @@
+package connman
+
+import (
+	"github.com/wrouesnel/callback/util"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSchedule(t *testing.T, timezone string, windows ...Window) *Schedule {
+	s := &Schedule{Name: "test", Pattern: "*", Timezone: timezone, Windows: windows}
+	if err := s.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScheduleAt(t *testing.T) {
+	utc := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		windows  []Window
+		at       time.Time
+		open     bool
+		closesAt time.Time
+		opensAt  time.Time
+	}{
+		// 2026-01-05 is a Monday.
+		{"open", []Window{{Days: []string{"mon"}, Start: "09:00", End: "17:00"}},
+			utc(5, 10, 0), true, utc(5, 17, 0), time.Time{}},
+		{"closes at the end", []Window{{Days: []string{"mon"}, Start: "09:00", End: "17:00"}},
+			utc(5, 17, 0), false, time.Time{}, utc(12, 9, 0)},
+		{"opens later today", []Window{{Days: []string{"Monday"}, Start: "09:00", End: "17:00"}},
+			utc(5, 8, 0), false, time.Time{}, utc(5, 9, 0)},
+		{"opens next week", []Window{{Days: []string{"mon"}, Start: "09:00", End: "17:00"}},
+			utc(9, 18, 0), false, time.Time{}, utc(12, 9, 0)},
+		{"overnight, before midnight", []Window{{Start: "22:00", End: "06:00"}},
+			utc(5, 23, 0), true, utc(6, 6, 0), time.Time{}},
+		{"overnight, after midnight", []Window{{Start: "22:00", End: "06:00"}},
+			utc(5, 3, 0), true, utc(5, 6, 0), time.Time{}},
+		{"overnight, closed", []Window{{Start: "22:00", End: "06:00"}},
+			utc(5, 12, 0), false, time.Time{}, utc(5, 22, 0)},
+		{"overnight from a day", []Window{{Days: []string{"fri"}, Start: "22:00", End: "06:00"}},
+			utc(10, 3, 0), true, utc(10, 6, 0), time.Time{}},
+		{"overnight from another day", []Window{{Days: []string{"fri"}, Start: "22:00", End: "06:00"}},
+			utc(11, 3, 0), false, time.Time{}, utc(16, 22, 0)},
+		{"whole day", []Window{{Days: []string{"sat"}, Start: "00:00", End: "24:00"}},
+			utc(10, 12, 0), true, utc(11, 0, 0), time.Time{}},
+		{"adjoining days merged", []Window{
+			{Days: []string{"sat"}, Start: "00:00", End: "24:00"},
+			{Days: []string{"sun"}, Start: "00:00", End: "24:00"},
+		}, utc(10, 12, 0), true, utc(12, 0, 0), time.Time{}},
+		{"adjoining windows merged", []Window{{Start: "09:00", End: "12:00"}, {Start: "12:00", End: "17:00"}},
+			utc(5, 10, 0), true, utc(5, 17, 0), time.Time{}},
+		{"overlapping windows merged", []Window{{Start: "12:00", End: "17:00"}, {Start: "09:00", End: "13:00"}},
+			utc(5, 10, 0), true, utc(5, 17, 0), time.Time{}},
+		{"contained window", []Window{{Start: "09:00", End: "17:00"}, {Start: "10:00", End: "11:00"}},
+			utc(5, 10, 30), true, utc(5, 17, 0), time.Time{}},
+		{"no windows", nil,
+			utc(5, 10, 0), false, time.Time{}, time.Time{}},
+	} {
+		s := testSchedule(t, "", tc.windows...)
+		open, closesAt, opensAt := s.at(tc.at)
+		if open != tc.open || !closesAt.Equal(tc.closesAt) || !opensAt.Equal(tc.opensAt) {
+			t.Errorf("%s: at(%v) = %v, closes %v, opens %v, want %v, closes %v, opens %v",
+				tc.name, tc.at, open, closesAt, opensAt, tc.open, tc.closesAt, tc.opensAt)
+		}
+	}
+}
+
+// TestScheduleAtDST checks windows follow the wall clock of their timezone
+// across daylight saving changes.
+func TestScheduleAtDST(t *testing.T) {
+	// Daylight saving starts at 02:00 on 2026-03-08 in New York, when UTC-5
+	// becomes UTC-4.
+	s := testSchedule(t, "America/New_York", Window{Start: "09:00", End: "17:00"})
+
+	open, _, opensAt := s.at(time.Date(2026, 3, 7, 23, 0, 0, 0, time.UTC))
+	if want := time.Date(2026, 3, 8, 13, 0, 0, 0, time.UTC); open || !opensAt.Equal(want) {
+		t.Errorf("window opens at %v, want %v", opensAt, want)
+	}
+	open, closesAt, _ := s.at(time.Date(2026, 3, 7, 15, 0, 0, 0, time.UTC))
+	if want := time.Date(2026, 3, 7, 22, 0, 0, 0, time.UTC); !open || !closesAt.Equal(want) {
+		t.Errorf("window before the change closes at %v, want %v", closesAt, want)
+	}
+
+	// A window spanning the change is an hour shorter.
+	s = testSchedule(t, "America/New_York", Window{Days: []string{"sun"}, Start: "00:00", End: "06:00"})
+	open, closesAt, _ = s.at(time.Date(2026, 3, 8, 5, 0, 0, 0, time.UTC))
+	if want := time.Date(2026, 3, 8, 10, 0, 0, 0, time.UTC); !open || !closesAt.Equal(want) {
+		t.Errorf("window spanning the change is open %v until %v, want until %v", open, closesAt, want)
+	}
+}
+
+// closingSchedule returns a schedule whose window closes at the next second
+// boundary at least a second from now. Windows are set in minutes, so the
+// schedule's zone is offset to put the end of a minute there.
+func closingSchedule(t *testing.T, warning time.Duration) (*Schedule, time.Time) {
+	closesAt := time.Unix(time.Now().Unix()+2, 0)
+	offset := (60 - int(closesAt.Unix()%60)) % 60
+	zone := time.FixedZone("test", offset)
+
+	end := closesAt.In(zone)
+	s := testSchedule(t, "", Window{Start: end.Add(-time.Hour).Format("15:04"), End: end.Format("15:04")})
+	s.loc = zone
+	s.DisconnectOnClose = true
+	s.Warning = util.Duration(warning)
+	return s, closesAt
+}
+
+func TestWatchClientSchedule(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	eventCh := cm.SubscribeClientConnectionEvents(16)
+	defer cm.UnsubscribeClientConnectionEvents(eventCh)
+
+	schedule, closesAt := closingSchedule(t, 500*time.Millisecond)
+	if open, at, _ := schedule.at(time.Now()); !open || !at.Equal(closesAt) {
+		t.Fatalf("test window is open %v until %v, want until %v", open, at, closesAt)
+	}
+
+	desc := &ClientSessionDesc{CallbackId: "host1", RemoteAddr: "192.0.2.1:1234"}
+	reasonCh := make(chan string, 1)
+	closer := &sessionCloser{closeFn: func(reason string) { reasonCh <- reason }}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go cm.watchClientSchedule(schedule, SessionOrigin{}, nil, desc, closer, stopCh)
+
+	select {
+	case event := <-eventCh:
+		if event.EventType != EventUpdated || !strings.Contains(event.Reason, "closes at") {
+			t.Errorf("client event %s %q, want a warning", event.EventType, event.Reason)
+		}
+	case reason := <-reasonCh:
+		t.Fatalf("session closed with %q before it was warned", reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not warned")
+	}
+	if now := time.Now(); now.Before(closesAt.Add(-time.Second)) {
+		t.Errorf("session warned at %v, want at most 500ms before %v", now, closesAt)
+	}
+
+	select {
+	case reason := <-reasonCh:
+		if reason != ReasonScheduleClosed {
+			t.Errorf("closed with %q, want %q", reason, ReasonScheduleClosed)
+		}
+		if now := time.Now(); now.Before(closesAt) {
+			t.Errorf("session closed at %v, before the window closed at %v", now, closesAt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not closed when the window closed")
+	}
+}
+
+func TestWatchClientScheduleClosed(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	schedule := testSchedule(t, "")
+	schedule.DisconnectOnClose = true
+
+	reasonCh := make(chan string, 1)
+	closer := &sessionCloser{closeFn: func(reason string) { reasonCh <- reason }}
+	cm.watchClientSchedule(schedule, SessionOrigin{}, nil, &ClientSessionDesc{}, closer, make(chan struct{}))
+	if reason := closer.Reason(); reason != ReasonScheduleClosed {
+		t.Errorf("session outside any window closed with %q, want %q", reason, ReasonScheduleClosed)
+	}
+
+	// Sessions are left open without DisconnectOnClose.
+	schedule.DisconnectOnClose = false
+	closer = &sessionCloser{closeFn: func(reason string) { reasonCh <- reason }}
+	cm.watchClientSchedule(schedule, SessionOrigin{}, nil, &ClientSessionDesc{}, closer, make(chan struct{}))
+	if reason := closer.Reason(); reason != "" {
+		t.Errorf("session closed with %q without DisconnectOnClose", reason)
+	}
+}
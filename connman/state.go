@@ -0,0 +1,127 @@
+package connman
+
+import (
+	"fmt"
+	"github.com/wrouesnel/go.log"
+	"time"
+)
+
+// Callback states set by operators, extending the session states. Sessions
+// of a callback which is not active report its state once admitted.
+const (
+	// SessionDraining callbacks keep existing client sessions but refuse new
+	// ones.
+	SessionDraining = "draining"
+	// SessionDisabled callbacks also refuse registrations.
+	SessionDisabled = "disabled"
+)
+
+// ErrInvalidState is returned when setting an unknown callback state.
+type ErrInvalidState struct {
+	State string
+}
+
+func (err ErrInvalidState) Error() string {
+	return fmt.Sprintf("invalid callback state %q: must be %s, %s or %s", err.State, SessionActive, SessionDraining, SessionDisabled)
+}
+
+// ErrCallbackUnavailable is returned when connecting to a callback an
+// operator has drained or disabled.
+type ErrCallbackUnavailable struct {
+	CallbackId string
+	State      string
+	Note       string
+}
+
+func (err ErrCallbackUnavailable) Error() string {
+	if err.Note == "" {
+		return fmt.Sprintf("callback %s is %s", err.CallbackId, err.State)
+	}
+	return fmt.Sprintf("callback %s is %s: %s", err.CallbackId, err.State, err.Note)
+}
+
+// ErrCallbackDisabled is returned when registering a callback ID an operator
+// has disabled.
+type ErrCallbackDisabled struct {
+	CallbackId string
+	Note       string
+}
+
+func (err ErrCallbackDisabled) Error() string {
+	if err.Note == "" {
+		return fmt.Sprintf("callback %s is disabled", err.CallbackId)
+	}
+	return fmt.Sprintf("callback %s is disabled: %s", err.CallbackId, err.Note)
+}
+
+// callbackState returns the operator set state of a callback ID and its note.
+func (this *ConnectionManager) callbackState(callbackId string) (string, string) {
+	record, found, err := this.sessionStore.Get(callbackId)
+	if err != nil {
+		log.With("callback_id", callbackId).Errorln("Could not get callback record:", err)
+	}
+	if !found || record.State == "" {
+		return SessionActive, record.StateNote
+	}
+	return record.State, record.StateNote
+}
+
+// checkCallbackState returns an error if registration of callbackId has been
+// disabled.
+func (this *ConnectionManager) checkCallbackState(callbackId string) error {
+	if state, note := this.callbackState(callbackId); state == SessionDisabled {
+		return &ErrCallbackDisabled{callbackId, note}
+	}
+	return nil
+}
+
+// checkClientState returns an ErrCallbackUnavailable if clients may not
+// connect to callbackId, held by session, because it or the relay exporting
+// it is not active.
+func (this *ConnectionManager) checkClientState(callbackId string, session *callbackSession, exportId string) error {
+	state, note := session.getCallbackState()
+	if state == SessionActive && exportId != "" {
+		state, note = this.callbackState(callbackId)
+	}
+	if state != SessionActive {
+		return &ErrCallbackUnavailable{callbackId, state, note}
+	}
+	return nil
+}
+
+// SetCallbackState sets the state of a callback ID and a note explaining it.
+// The state of a connected session of the ID changes immediately, but its
+// existing client sessions are kept. The state is kept by this node only, so
+// in a cluster it does not apply to sessions of the ID held by other nodes.
+func (this *ConnectionManager) SetCallbackState(callbackId string, state string, note string, changedBy string) (CallbackRecord, error) {
+	switch state {
+	case SessionActive, SessionDraining, SessionDisabled:
+	default:
+		return CallbackRecord{}, &ErrInvalidState{state}
+	}
+
+	record, err := this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+		now := time.Now()
+		record.State = state
+		record.StateNote = note
+		record.StateChangedAt = &now
+		record.StateChangedBy = changedBy
+	})
+	if err != nil {
+		return record, err
+	}
+
+	this.callbackMtx.RLock()
+	session, found := this.callbackSessions[callbackId]
+	this.callbackMtx.RUnlock()
+	if found {
+		session.setCallbackState(state, note)
+		session.log.With("state", state).Infoln("Callback state changed:", note)
+		reason := "state changed to " + state
+		if note != "" {
+			reason += ": " + note
+		}
+		this.publishCallbackConnectionEvent(EventUpdated, reason, callbackId, session.copyDesc())
+	}
+	return record, nil
+}
@@ -0,0 +1,126 @@
+package connman
+
+import (
+	"testing"
+	"time"
+)
+
+// waitClients waits for callbackId to have n client sessions.
+func waitClients(t *testing.T, cm *ConnectionManager, callbackId string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count := 0
+		for _, client := range cm.ListClientSessions().Sessions {
+			if client.CallbackId == callbackId {
+				count++
+			}
+		}
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d client sessions, want %d", callbackId, count, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrainingCallback(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	eventCh := cm.SubscribeCallbackEvents(16)
+	defer cm.UnsubscribeCallbackEvents(eventCh)
+	testCallback(t, cm, "host1")
+	existing := testClient(t, cm, "host1")
+	waitClients(t, cm, "host1", 1)
+
+	record, err := cm.SetCallbackState("host1", SessionDraining, "replacing disk", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.State != SessionDraining || record.StateNote != "replacing disk" || record.StateChangedBy != "operator" || record.StateChangedAt == nil {
+		t.Errorf("record = %+v, want the state change recorded", record)
+	}
+	if desc, _ := cm.GetCallbackSession("host1"); desc.State != SessionDraining || desc.StateNote != "replacing disk" {
+		t.Errorf("session is %s (%q), want draining with the note", desc.State, desc.StateNote)
+	}
+	timeout := time.After(5 * time.Second)
+	for updated := false; !updated; {
+		select {
+		case event := <-eventCh:
+			if updated = event.EventType == EventUpdated; updated && event.Reason != "state changed to draining: replacing disk" {
+				t.Errorf("update reason = %q", event.Reason)
+			}
+		case <-timeout:
+			t.Fatal("no update was published")
+		}
+	}
+
+	// The existing client is kept, and new ones are refused.
+	select {
+	case err := <-existing:
+		t.Fatalf("existing client ended: %v", err)
+	default:
+	}
+	select {
+	case err := <-testClient(t, cm, "host1"):
+		uerr, ok := err.(*ErrCallbackUnavailable)
+		if !ok || uerr.State != SessionDraining || uerr.Note != "replacing disk" {
+			t.Errorf("new client returned %v, want the callback unavailable", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("new client was not refused")
+	}
+	waitClients(t, cm, "host1", 1)
+
+	// Draining IDs may still register.
+	if err := cm.checkCallbackState("host1"); err != nil {
+		t.Errorf("registration of a draining ID refused: %v", err)
+	}
+
+	if _, err := cm.SetCallbackState("host1", SessionActive, "", "operator"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.CheckClientConnection("host1", SessionOrigin{}); err != nil {
+		t.Errorf("client refused once the callback is active again: %v", err)
+	}
+}
+
+func TestDisabledCallback(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	testCallback(t, cm, "host1")
+
+	if _, err := cm.SetCallbackState("host1", SessionDisabled, "decommissioned", "operator"); err != nil {
+		t.Fatal(err)
+	}
+	// The connected session is kept, but refuses clients.
+	if desc, found := cm.GetCallbackSession("host1"); !found || desc.State != SessionDisabled {
+		t.Errorf("session = %+v, %v, want kept and disabled", desc, found)
+	}
+	if _, ok := cm.CheckClientConnection("host1", SessionOrigin{}).(*ErrCallbackUnavailable); !ok {
+		t.Error("client permitted to connect to a disabled callback")
+	}
+
+	err := cm.CheckCallbackConnection("host1", SessionOrigin{RemoteAddr: "192.0.2.1:1234"})
+	if derr, ok := err.(*ErrCallbackDisabled); !ok || derr.Note != "decommissioned" {
+		t.Errorf("registration returned %v, want disabled", err)
+	}
+	// IDs without a session may be disabled too.
+	if _, err := cm.SetCallbackState("host2", SessionDisabled, "", "operator"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.CheckCallbackConnection("host2", SessionOrigin{}).(*ErrCallbackDisabled); !ok {
+		t.Error("registration of an unconnected disabled ID was permitted")
+	}
+}
+
+func TestInvalidCallbackState(t *testing.T) {
+	cm := NewConnectionManager(1024)
+	if _, err := cm.SetCallbackState("host1", "paused", "", "operator"); err == nil {
+		t.Error("SetCallbackState accepted an invalid state")
+	} else if _, ok := err.(*ErrInvalidState); !ok {
+		t.Errorf("SetCallbackState returned %v, want ErrInvalidState", err)
+	}
+	if _, found, _ := cm.GetCallbackRecord("host1"); found {
+		t.Error("an invalid state created a record")
+	}
+}
@@ -0,0 +1,349 @@
+package connman
+
+import (
+	"github.com/wrouesnel/go.log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CallbackRecord is the persistent metadata of a callback ID, kept after its
+// session ends.
+type CallbackRecord struct {
+	CallbackId string `json:"callback_id"`
+	// Principal which last registered the ID.
+	Principal string `json:"principal,omitempty"`
+	// Labels reported by the last registration.
+	Labels map[string]string `json:"labels,omitempty"`
+	// FirstSeen is when the ID first registered.
+	FirstSeen time.Time `json:"first_seen"`
+	// LastSeen is when the ID last registered or disconnected.
+	LastSeen time.Time `json:"last_seen"`
+	// LastConnectedAt is when the ID last registered.
+	LastConnectedAt time.Time `json:"last_connected_at"`
+	// LastDisconnectedAt is when the last session of the ID ended. Zero if no
+	// session has ended yet.
+	LastDisconnectedAt time.Time `json:"last_disconnected_at"`
+	// LastDisconnectReason is why the last session of the ID ended.
+	LastDisconnectReason string `json:"last_disconnect_reason,omitempty"`
+	// ConnectedSeconds is the total time sessions of the ID were connected,
+	// not including a session which is still connected.
+	ConnectedSeconds float64 `json:"connected_seconds"`
+	// LastRemoteAddr is the origin of the last registration.
+	LastRemoteAddr string `json:"last_remote_addr,omitempty"`
+	// LastNode is the cluster node which last held the session.
+	LastNode string `json:"last_node,omitempty"`
+	// Notes are set by operators.
+	Notes string `json:"notes,omitempty"`
+	// Admission is the operator's decision on the ID, if approval is required.
+	Admission *Admission `json:"admission,omitempty"`
+	// State is set by operators to drain or disable the ID. Blank is active.
+	State     string `json:"state,omitempty"`
+	StateNote string `json:"state_note,omitempty"`
+	// StateChangedAt and StateChangedBy record the last change of State.
+	StateChangedAt *time.Time `json:"state_changed_at,omitempty"`
+	StateChangedBy string     `json:"state_changed_by,omitempty"`
+	// Annotations are key/value metadata set by operators, such as the owner
+	// of the ID.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// AnnotationHistory lists the most recent changes of Annotations.
+	AnnotationHistory []AnnotationChange `json:"annotation_history,omitempty"`
+	// Reservation is set if the server allocated the ID.
+	Reservation *Reservation `json:"reservation,omitempty"`
+	// Lease is the last lease of the ID, which may have expired.
+	Lease *Lease `json:"lease,omitempty"`
+}
+
+// Reservation records the allocation of a callback ID to a registrant.
+type Reservation struct {
+	// SecretHash is the hash of the secret registrations of the ID must
+	// present.
+	SecretHash string `json:"secret_hash"`
+	// AllocatedAt is when the ID was allocated.
+	AllocatedAt time.Time `json:"allocated_at"`
+}
+
+// copy makes a deep copy of the record.
+func (cr CallbackRecord) copy() CallbackRecord {
+	if cr.Labels != nil {
+		labels := make(map[string]string, len(cr.Labels))
+		for k, v := range cr.Labels {
+			labels[k] = v
+		}
+		cr.Labels = labels
+	}
+	if cr.Admission != nil {
+		admission := *cr.Admission
+		cr.Admission = &admission
+	}
+	if cr.StateChangedAt != nil {
+		changedAt := *cr.StateChangedAt
+		cr.StateChangedAt = &changedAt
+	}
+	if cr.Annotations != nil {
+		annotations := make(map[string]string, len(cr.Annotations))
+		for k, v := range cr.Annotations {
+			annotations[k] = v
+		}
+		cr.Annotations = annotations
+	}
+	if cr.AnnotationHistory != nil {
+		cr.AnnotationHistory = append([]AnnotationChange(nil), cr.AnnotationHistory...)
+	}
+	if cr.Reservation != nil {
+		reservation := *cr.Reservation
+		cr.Reservation = &reservation
+	}
+	if cr.Lease != nil {
+		lease := *cr.Lease
+		cr.Lease = &lease
+	}
+	return cr
+}
+
+// SessionStore stores the records of callback IDs. Live sessions are always
+// held by the connection manager; the store only keeps their metadata.
+type SessionStore interface {
+	// Get returns the record of a callback ID.
+	Get(callbackId string) (CallbackRecord, bool, error)
+	// List returns all records sorted by callback ID.
+	List() ([]CallbackRecord, error)
+	// Update atomically modifies the record of a callback ID with fn,
+	// creating it if it does not exist, and returns the result.
+	Update(callbackId string, fn func(record *CallbackRecord)) (CallbackRecord, error)
+	// Create atomically creates the record of a callback ID with fn if it
+	// does not exist, returning false if it does.
+	Create(callbackId string, fn func(record *CallbackRecord)) (bool, error)
+	// Delete removes the record of a callback ID.
+	Delete(callbackId string) error
+}
+
+// MemorySessionStore is a SessionStore which is not persisted. It is the
+// default store of a connection manager.
+type MemorySessionStore struct {
+	records map[string]*CallbackRecord
+	mtx     sync.RWMutex
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		records: make(map[string]*CallbackRecord),
+	}
+}
+
+func (ms *MemorySessionStore) Get(callbackId string) (CallbackRecord, bool, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	record, found := ms.records[callbackId]
+	if !found {
+		return CallbackRecord{}, false, nil
+	}
+	return record.copy(), true, nil
+}
+
+func (ms *MemorySessionStore) List() ([]CallbackRecord, error) {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	ret := make([]CallbackRecord, 0, len(ms.records))
+	for _, record := range ms.records {
+		ret = append(ret, record.copy())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CallbackId < ret[j].CallbackId })
+	return ret, nil
+}
+
+func (ms *MemorySessionStore) Update(callbackId string, fn func(record *CallbackRecord)) (CallbackRecord, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	record, found := ms.records[callbackId]
+	if !found {
+		record = &CallbackRecord{CallbackId: callbackId}
+		ms.records[callbackId] = record
+	}
+	fn(record)
+	record.CallbackId = callbackId
+	return record.copy(), nil
+}
+
+func (ms *MemorySessionStore) Create(callbackId string, fn func(record *CallbackRecord)) (bool, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if _, found := ms.records[callbackId]; found {
+		return false, nil
+	}
+	record := &CallbackRecord{}
+	fn(record)
+	record.CallbackId = callbackId
+	ms.records[callbackId] = record
+	return true, nil
+}
+
+func (ms *MemorySessionStore) Delete(callbackId string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	delete(ms.records, callbackId)
+	return nil
+}
+
+// Replace sets all records, such as when loading them from persistent
+// storage.
+func (ms *MemorySessionStore) Replace(records []CallbackRecord) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.records = make(map[string]*CallbackRecord, len(records))
+	for _, record := range records {
+		record := record.copy()
+		ms.records[record.CallbackId] = &record
+	}
+}
+
+// SetSessionStore sets the store callback records are kept in. Must be called
+// before any sessions are established.
+func (this *ConnectionManager) SetSessionStore(store SessionStore) {
+	this.sessionStore = store
+}
+
+// GetCallbackRecord returns the stored record of a callback ID.
+func (this *ConnectionManager) GetCallbackRecord(callbackId string) (CallbackRecord, bool, error) {
+	return this.sessionStore.Get(callbackId)
+}
+
+// ListCallbackRecords returns the stored records of all callback IDs.
+func (this *ConnectionManager) ListCallbackRecords() ([]CallbackRecord, error) {
+	return this.sessionStore.List()
+}
+
+// SetCallbackNotes sets the operator notes of a callback ID.
+func (this *ConnectionManager) SetCallbackNotes(callbackId string, notes string) (CallbackRecord, error) {
+	return this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+		record.Notes = notes
+	})
+}
+
+// DeleteCallbackRecord forgets a callback ID. The record is recreated if the
+// ID registers again.
+func (this *ConnectionManager) DeleteCallbackRecord(callbackId string) error {
+	if err := this.sessionStore.Delete(callbackId); err != nil {
+		return err
+	}
+
+	// The ID is active and unannotated again without its record.
+	this.callbackMtx.RLock()
+	session, found := this.callbackSessions[callbackId]
+	this.callbackMtx.RUnlock()
+	if found {
+		session.setCallbackState(SessionActive, "")
+		session.setAnnotations(nil)
+	}
+	return nil
+}
+
+// RecordRetention configures how long the records of offline callback IDs
+// are kept. Zero keeps them forever.
+type RecordRetention struct {
+	// Records is how long records are kept after the ID was last seen.
+	Records time.Duration
+	// AllocatedIds is how long a server allocated ID stays reserved after it
+	// was last seen, or allocated if it never registered.
+	AllocatedIds time.Duration
+}
+
+// expired returns true if record is older than the retention.
+func (r RecordRetention) expired(record CallbackRecord, now time.Time) bool {
+	if r.Records > 0 && !record.LastSeen.IsZero() && record.LastSeen.Before(now.Add(-r.Records)) {
+		return true
+	}
+	if r.AllocatedIds > 0 && record.Reservation != nil {
+		seen := record.LastSeen
+		if seen.IsZero() {
+			seen = record.Reservation.AllocatedAt
+		}
+		return seen.Before(now.Add(-r.AllocatedIds))
+	}
+	return false
+}
+
+// PruneCallbackRecords forgets callback IDs which are not connected and are
+// older than retention, returning how many were forgotten. IDs which an
+// operator has drained or disabled are kept: forgetting a disabled ID would
+// make it active again. So are leased IDs.
+func (this *ConnectionManager) PruneCallbackRecords(retention RecordRetention, now time.Time) (int, error) {
+	records, err := this.sessionStore.List()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, record := range records {
+		if !retention.expired(record, now) {
+			continue
+		}
+		if record.State != "" && record.State != SessionActive {
+			continue
+		}
+		if record.Lease.active(now) != nil {
+			continue
+		}
+		this.callbackMtx.RLock()
+		_, connected := this.callbackSessions[record.CallbackId]
+		this.callbackMtx.RUnlock()
+		if connected {
+			continue
+		}
+		if err := this.sessionStore.Delete(record.CallbackId); err != nil {
+			return pruned, err
+		}
+		log.With("callback_id", record.CallbackId).Infoln("Forgot callback ID last seen at", record.LastSeen.Format(time.RFC3339))
+		pruned++
+	}
+	return pruned, nil
+}
+
+// RunRecordRetention forgets callback IDs older than retention, checking
+// every interval until stopCh closes. Should be launched as a go-routine.
+func (this *ConnectionManager) RunRecordRetention(retention RecordRetention, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := this.PruneCallbackRecords(retention, time.Now()); err != nil {
+				log.Errorln("Could not prune callback records:", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// recordCallbackConnected updates the record of a newly established session.
+func (this *ConnectionManager) recordCallbackConnected(callbackId string, desc CallbackSessionDesc) {
+	_, err := this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+		if record.FirstSeen.IsZero() {
+			record.FirstSeen = desc.ConnectedAt
+		}
+		record.LastSeen = desc.ConnectedAt
+		record.LastConnectedAt = desc.ConnectedAt
+		record.Principal = desc.Principal
+		record.Labels = desc.Labels
+		record.LastRemoteAddr = desc.RemoteAddr
+		record.LastNode = desc.Node
+	})
+	if err != nil {
+		log.With("callback_id", callbackId).Errorln("Could not update callback record:", err)
+	}
+}
+
+// recordCallbackDisconnected updates the record of a session which ended.
+func (this *ConnectionManager) recordCallbackDisconnected(callbackId string, desc CallbackSessionDesc, disconnectedAt time.Time, reason string) {
+	_, err := this.sessionStore.Update(callbackId, func(record *CallbackRecord) {
+		record.LastSeen = disconnectedAt
+		record.LastDisconnectedAt = disconnectedAt
+		record.LastDisconnectReason = reason
+		record.ConnectedSeconds += disconnectedAt.Sub(desc.ConnectedAt).Seconds()
+	})
+	if err != nil {
+		log.With("callback_id", callbackId).Errorln("Could not update callback record:", err)
+	}
+}
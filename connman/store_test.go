@@ -0,0 +1,66 @@
+package connman
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPruneCallbackRecords(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	offline := now.Add(-18 * time.Hour)
+	reserved := func(allocatedAt time.Time) *Reservation {
+		return &Reservation{SecretHash: "hash", AllocatedAt: allocatedAt}
+	}
+
+	store := NewMemorySessionStore()
+	store.Replace([]CallbackRecord{
+		{CallbackId: "old", LastSeen: old},
+		{CallbackId: "old-active", LastSeen: old, State: SessionActive},
+		{CallbackId: "recent", LastSeen: now},
+		{CallbackId: "never-seen", Notes: "annotated before registering"},
+		{CallbackId: "disabled", LastSeen: old, State: SessionDisabled},
+		{CallbackId: "draining", LastSeen: old, State: SessionDraining},
+		{CallbackId: "leased", LastSeen: old, Lease: &Lease{Holder: "alice", ExpiresAt: now.Add(time.Hour)}},
+		{CallbackId: "lease-expired", LastSeen: old, Lease: &Lease{Holder: "alice", ExpiresAt: old}},
+		{CallbackId: "connected", LastSeen: old},
+		{CallbackId: "offline", LastSeen: offline},
+		{CallbackId: "allocated-offline", LastSeen: offline, Reservation: reserved(old)},
+		{CallbackId: "allocated-online", LastSeen: now, Reservation: reserved(old)},
+		{CallbackId: "allocated-unused", Reservation: reserved(old)},
+		{CallbackId: "allocated-new", Reservation: reserved(now)},
+	})
+	cm := NewConnectionManager(1024)
+	cm.SetSessionStore(store)
+	testCallback(t, cm, "connected")
+	// Registering updated LastSeen; make the connected ID look old again.
+	store.Update("connected", func(record *CallbackRecord) { record.LastSeen = old })
+
+	pruned, err := cm.PruneCallbackRecords(RecordRetention{Records: 24 * time.Hour, AllocatedIds: 12 * time.Hour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 5 {
+		t.Errorf("pruned %d records, want 5", pruned)
+	}
+
+	records, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, record := range records {
+		kept = append(kept, record.CallbackId)
+	}
+	sort.Strings(kept)
+	want := []string{"allocated-new", "allocated-online", "connected", "disabled", "draining", "leased", "never-seen", "offline", "recent"}
+	if len(kept) != len(want) {
+		t.Fatalf("kept %v, want %v", kept, want)
+	}
+	for i := range want {
+		if kept[i] != want[i] {
+			t.Fatalf("kept %v, want %v", kept, want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// control defines the control messages a callback server sends to callback
+// reverse proxies alongside the mux data. Control messages are carried as
+// websocket text messages, and are only sent to callback sessions which
+// advertised the control capability when registering (or clients which did
+// when connecting). Relays (callback
+// servers registered upstream) also send control messages to the server.
+
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// CapabilitiesHeader lists the optional protocol features supported by a
+	// registering callback reverse proxy, comma separated.
+	CapabilitiesHeader = "Callback-Capabilities"
+	// IdWildcard in the callback ID of a registration asks the server to
+	// allocate an unused ID, replacing the wildcard with a unique suffix.
+	IdWildcard = "*"
+	// CallbackIdHeader is sent in the upgrade response of a registration with
+	// the callback ID registered, which the server may have allocated.
+	CallbackIdHeader = "Callback-Id"
+	// ReclaimSecretHeader is sent in the upgrade response of a registration
+	// the server allocated a callback ID for, with the secret which must be
+	// sent back to register the ID again.
+	ReclaimSecretHeader = "Callback-Reclaim-Secret"
+	// CapabilityControl indicates control messages are understood.
+	CapabilityControl = "control"
+	// CapabilityRelay indicates the callback is a relay which exports other
+	// callback sessions, and that each stream opened to it starts with a
+	// StreamHeader.
+	CapabilityRelay = "relay"
+	// CapabilityMigrate indicates MessageMigrate is understood.
+	CapabilityMigrate = "migrate"
+
+	// maxStreamHeaderSize bounds the size of a stream header.
+	maxStreamHeaderSize = 4096
+)
+
+// MessageType identifies a control message.
+type MessageType string
+
+const (
+	// MessageDrain tells the callback to register again (with a server which
+	// is not draining). The current session continues to serve existing
+	// streams until the server closes it.
+	MessageDrain = MessageType("drain")
+	// MessageExports is sent by a relay to list the callback sessions it
+	// exports, replacing any previous list.
+	MessageExports = MessageType("exports")
+	// MessageMigrate tells the callback to register with the server at
+	// Target. The callback replies with MessageMigrated once registered, or
+	// MessageMigrateFailed, and the server then closes the current session.
+	MessageMigrate = MessageType("migrate")
+	// MessageMigrated is the reply to a successful MessageMigrate.
+	MessageMigrated = MessageType("migrated")
+	// MessageMigrateFailed is the reply to a MessageMigrate which could not
+	// be carried out. Reason describes why.
+	MessageMigrateFailed = MessageType("migrate_failed")
+	// MessageWarning is sent to clients which advertised the control
+	// capability when connecting, before the server closes their session.
+	// Reason describes why.
+	MessageWarning = MessageType("warning")
+)
+
+// Export describes a callback session exported by a relay.
+type Export struct {
+	Id          string            `json:"id"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// Message is a control message.
+type Message struct {
+	Type MessageType `json:"type"`
+	// Reason is a human readable explanation of the message.
+	Reason string `json:"reason,omitempty"`
+	// Exports are the callback sessions of a MessageExports.
+	Exports []Export `json:"exports,omitempty"`
+	// Target is the server URL of a MessageMigrate.
+	Target string `json:"target,omitempty"`
+}
+
+// Encode serializes a control message.
+func Encode(msg Message) ([]byte, error) {
+	return json.Marshal(&msg)
+}
+
+// Decode deserializes a control message.
+func Decode(data []byte) (Message, error) {
+	msg := Message{}
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// Capabilities parses the capabilities advertised by a request.
+func Capabilities(r *http.Request) []string {
+	var capabilities []string
+	for _, value := range r.Header[http.CanonicalHeaderKey(CapabilitiesHeader)] {
+		for _, capability := range strings.Split(value, ",") {
+			if capability = strings.TrimSpace(capability); capability != "" {
+				capabilities = append(capabilities, capability)
+			}
+		}
+	}
+	return capabilities
+}
+
+// HasCapability returns true if capability is in capabilities.
+func HasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamHeader is written by a callback server at the start of each stream it
+// opens to a relay, naming the exported session the stream is for.
+type StreamHeader struct {
+	CallbackId string `json:"callback_id"`
+	RemoteAddr string `json:"remote_addr"`
+	Principal  string `json:"principal,omitempty"`
+}
+
+// WriteStreamHeader writes a stream header as a single line of JSON.
+func WriteStreamHeader(w io.Writer, header StreamHeader) error {
+	data, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// ReadStreamHeader reads a stream header. It reads a byte at a time so no
+// stream data after the header is consumed.
+func ReadStreamHeader(r io.Reader) (StreamHeader, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return StreamHeader{}, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) >= maxStreamHeaderSize {
+			return StreamHeader{}, errors.New("stream header too long")
+		}
+		line = append(line, b[0])
+	}
+
+	header := StreamHeader{}
+	err := json.Unmarshal(line, &header)
+	return header, err
+}
@@ -0,0 +1,751 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expr is a compiled policy expression.
+//
+// The expression language is a small boolean language in the spirit of CEL:
+//
+//	literals:    "string" 'string' 12 1.5 true false null [list, of, values]
+//	operators:   || && ! == != < <= > >= in
+//	access:      ident  ident.field  ident["field"]
+//	functions:   glob(s, pattern) cidr(addr, cidr) startsWith(s, prefix)
+//	             endsWith(s, suffix) matches(s, regex) contains(list|s, v)
+//	             size(list|map|s)
+//
+// Missing map fields evaluate to null rather than failing, so rules can test
+// optional values such as labels. The regex of matches() must be a string
+// literal, and is compiled with the expression.
+type Expr struct {
+	source string
+	root   node
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.source
+}
+
+// ErrExpression is returned when an expression cannot be parsed or evaluated.
+type ErrExpression struct {
+	Expr   string
+	Reason string
+}
+
+func (err ErrExpression) Error() string {
+	return fmt.Sprintf("policy expression %q: %s", err.Expr, err.Reason)
+}
+
+// Compile parses an expression.
+func Compile(source string) (*Expr, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, &ErrExpression{source, err.Error()}
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, &ErrExpression{source, err.Error()}
+	}
+	if p.peek().kind != tokEOF {
+		return nil, &ErrExpression{source, fmt.Sprintf("unexpected %q at offset %d", p.peek().text, p.peek().pos)}
+	}
+
+	return &Expr{source: source, root: root}, nil
+}
+
+// EvalBool evaluates the expression against vars, which must yield a bool.
+func (e *Expr) EvalBool(vars map[string]interface{}) (bool, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return false, &ErrExpression{e.source, err.Error()}
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, &ErrExpression{e.source, fmt.Sprintf("expression yielded %T, not bool", v)}
+	}
+	return b, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lex splits an expression into tokens. Offsets are in bytes.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c, size := utf8.DecodeRuneInString(src[i:])
+		start := i
+		switch {
+		case c == utf8.RuneError && size == 1:
+			return nil, fmt.Errorf("invalid UTF-8 at offset %d", i)
+		case unicode.IsSpace(c):
+			i += size
+		case c == '"' || c == '\'':
+			s, end, err := lexString(src, i, c)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{tokString, s, start})
+		case isDigit(c):
+			for i < len(src) && (isDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, src[start:i], start})
+		case unicode.IsLetter(c) || c == '_':
+			for i < len(src) {
+				r, n := utf8.DecodeRuneInString(src[i:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+					break
+				}
+				i += n
+			}
+			tokens = append(tokens, token{tokIdent, src[start:i], start})
+		default:
+			two := ""
+			if i+1 < len(src) {
+				two = src[i : i+2]
+			}
+			switch two {
+			case "||", "&&", "==", "!=", "<=", ">=":
+				tokens = append(tokens, token{tokOp, two, start})
+				i += 2
+				continue
+			}
+			if strings.ContainsRune("!<>()[].,", c) {
+				tokens = append(tokens, token{tokOp, string(c), start})
+				i += size
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(src)}), nil
+}
+
+// lexString reads the string literal quoted by quote starting at offset
+// start, returning its value and the offset after it. A backslash escapes the
+// following character.
+func lexString(src string, start int, quote rune) (string, int, error) {
+	var sb strings.Builder
+	i := start + utf8.RuneLen(quote)
+	for i < len(src) {
+		r, n := utf8.DecodeRuneInString(src[i:])
+		i += n
+		if r == quote {
+			return sb.String(), i, nil
+		}
+		if r == '\\' && i < len(src) {
+			r, n = utf8.DecodeRuneInString(src[i:])
+			i += n
+		}
+		if r == utf8.RuneError && n == 1 {
+			return "", 0, fmt.Errorf("invalid UTF-8 at offset %d", i-n)
+		}
+		sb.WriteRune(r)
+	}
+	return "", 0, fmt.Errorf("unterminated string at offset %d", start)
+}
+
+// isDigit reports whether c is an ASCII digit. Other digits are not numbers
+// in expressions.
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parser is a recursive descent parser over a token list.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(text string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == text
+}
+
+func (p *parser) expectOp(text string) error {
+	if !p.isOp(text) {
+		return fmt.Errorf("expected %q at offset %d", text, p.peek().pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	isCmp := t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" ||
+		t.text == "<=" || t.text == ">" || t.text == ">=")
+	if isCmp || (t.kind == tokIdent && t.text == "in") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: t.text, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp("."):
+			p.next()
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, fmt.Errorf("expected field name at offset %d", t.pos)
+			}
+			n = &indexNode{target: n, index: &literalNode{t.text}}
+		case p.isOp("["):
+			p.next()
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{target: n, index: index}
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literalNode{t.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", t.text, t.pos)
+		}
+		return &literalNode{f}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if p.isOp("(") {
+			p.next()
+			fn, found := functions[t.text]
+			if !found && t.text != "matches" {
+				return nil, fmt.Errorf("unknown function %q at offset %d", t.text, t.pos)
+			}
+			args, err := p.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			if t.text == "matches" {
+				return newMatchNode(args, t.pos)
+			}
+			return &callNode{name: t.text, fn: fn, args: args}, nil
+		}
+		return &identNode{t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expectOp(")")
+		case "[":
+			items, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listNode{items}, nil
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+// parseList parses comma separated expressions up to the closing delimiter.
+func (p *parser) parseList(closing string) ([]node, error) {
+	var items []node
+	if p.isOp(closing) {
+		p.next()
+		return items, nil
+	}
+	for {
+		item, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.isOp(",") {
+			p.next()
+			continue
+		}
+		return items, p.expectOp(closing)
+	}
+}
+
+// node is an evaluatable expression tree node.
+type node interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (n *identNode) eval(vars map[string]interface{}) (interface{}, error) {
+	v, found := vars[n.name]
+	if !found {
+		return nil, fmt.Errorf("undefined variable %q", n.name)
+	}
+	return normalize(v), nil
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(vars map[string]interface{}) (interface{}, error) {
+	ret := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = v
+	}
+	return ret, nil
+}
+
+type indexNode struct {
+	target node
+	index  node
+}
+
+func (n *indexNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch t := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map index must be a string, not %T", index)
+		}
+		return normalize(t[key]), nil
+	case []interface{}:
+		f, ok := index.(float64)
+		if !ok || f < 0 || int(f) >= len(t) {
+			return nil, fmt.Errorf("list index %v out of range", index)
+		}
+		return t[int(f)], nil
+	}
+	return nil, fmt.Errorf("cannot index %T", target)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(vars map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! applied to %T", v)
+	}
+	return !b, nil
+}
+
+type logicalNode struct {
+	op          string
+	left, right node
+}
+
+func (n *logicalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	lv, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := lv.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s applied to %T", n.op, lv)
+	}
+	// Short circuit
+	if (n.op == "||" && l) || (n.op == "&&" && !l) {
+		return l, nil
+	}
+	rv, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := rv.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s applied to %T", n.op, rv)
+	}
+	return r, nil
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(vars map[string]interface{}) (interface{}, error) {
+	lv, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(lv, rv), nil
+	case "!=":
+		return !equal(lv, rv), nil
+	case "in":
+		return contains(rv, lv)
+	}
+
+	switch l := lv.(type) {
+	case float64:
+		r, ok := rv.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare number with %T", rv)
+		}
+		switch n.op {
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		}
+	case string:
+		r, ok := rv.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare string with %T", rv)
+		}
+		switch n.op {
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot order %T", lv)
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+func (n *callNode) eval(vars map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %v", n.name, err)
+	}
+	return v, nil
+}
+
+// matchNode is a call of matches(), with its regex compiled.
+type matchNode struct {
+	target node
+	re     *regexp.Regexp
+}
+
+func newMatchNode(args []node, pos int) (node, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("matches() at offset %d: expected 2 arguments, got %d", pos, len(args))
+	}
+	pattern, ok := args[1].(*literalNode)
+	if !ok {
+		return nil, fmt.Errorf("matches() at offset %d: regex must be a string literal", pos)
+	}
+	expr, ok := pattern.value.(string)
+	if !ok {
+		return nil, fmt.Errorf("matches() at offset %d: regex must be a string literal", pos)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("matches() at offset %d: %v", pos, err)
+	}
+	return &matchNode{target: args[0], re: re}, nil
+}
+
+func (n *matchNode) eval(vars map[string]interface{}) (interface{}, error) {
+	v, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	// A null argument (such as a missing label) is treated as an empty string.
+	if v == nil {
+		v = ""
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("matches(): expected string argument, got %T", v)
+	}
+	return n.re.MatchString(s), nil
+}
+
+// normalize converts Go values supplied as variables to the types the
+// evaluator operates on.
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case int:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint32:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case []string:
+		ret := make([]interface{}, len(t))
+		for i, s := range t {
+			ret[i] = s
+		}
+		return ret
+	case map[string]string:
+		ret := make(map[string]interface{}, len(t))
+		for k, s := range t {
+			ret[k] = s
+		}
+		return ret
+	}
+	return v
+}
+
+func equal(l, r interface{}) bool {
+	switch l.(type) {
+	case nil, bool, float64, string:
+		return l == r
+	}
+	return false
+}
+
+func contains(collection interface{}, v interface{}) (bool, error) {
+	switch c := collection.(type) {
+	case nil:
+		return false, nil
+	case []interface{}:
+		for _, item := range c {
+			if equal(item, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		key, ok := v.(string)
+		if !ok {
+			return false, fmt.Errorf("map key must be a string, not %T", v)
+		}
+		_, found := c[key]
+		return found, nil
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false, fmt.Errorf("substring must be a string, not %T", v)
+		}
+		return strings.Contains(c, s), nil
+	}
+	return false, fmt.Errorf("cannot search %T", collection)
+}
+
+// function is a builtin callable from expressions.
+type function func(args []interface{}) (interface{}, error)
+
+var functions = map[string]function{
+	"glob": stringFn(func(s, pattern string) (interface{}, error) {
+		return path.Match(pattern, s)
+	}),
+	"cidr": stringFn(func(addr, cidr string) (interface{}, error) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(addr)
+		return ip != nil && network.Contains(ip), nil
+	}),
+	"startsWith": stringFn(func(s, prefix string) (interface{}, error) {
+		return strings.HasPrefix(s, prefix), nil
+	}),
+	"endsWith": stringFn(func(s, suffix string) (interface{}, error) {
+		return strings.HasSuffix(s, suffix), nil
+	}),
+	"contains": func(args []interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected 2 arguments, got %d", len(args))
+		}
+		return contains(args[0], args[1])
+	},
+	"size": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected 1 argument, got %d", len(args))
+		}
+		switch t := args[0].(type) {
+		case nil:
+			return float64(0), nil
+		case string:
+			return float64(len(t)), nil
+		case []interface{}:
+			return float64(len(t)), nil
+		case map[string]interface{}:
+			return float64(len(t)), nil
+		}
+		return nil, fmt.Errorf("cannot take size of %T", args[0])
+	},
+}
+
+// stringFn adapts a two string argument function to a builtin. A null first
+// argument (such as a missing label) is treated as an empty string.
+func stringFn(fn func(a, b string) (interface{}, error)) function {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected 2 arguments, got %d", len(args))
+		}
+		if args[0] == nil {
+			args[0] = ""
+		}
+		a, aok := args[0].(string)
+		b, bok := args[1].(string)
+		if !aok || !bok {
+			return nil, fmt.Errorf("expected string arguments, got %T and %T", args[0], args[1])
+		}
+		return fn(a, b)
+	}
+}
@@ -0,0 +1,185 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+func testVars() map[string]interface{} {
+	return map[string]interface{}{
+		"principal":   "alice",
+		"scopes":      []string{"connect", "list"},
+		"callback_id": "host-1.syd",
+		"remote_addr": "10.1.2.3",
+		"labels":      map[string]string{"site": "zürich", "env": "prod"},
+		"count":       3,
+		"time": map[string]interface{}{
+			"hour":    float64(9),
+			"weekday": "Monday",
+		},
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{`true`, true},
+		{`!false`, true},
+		{`principal == "alice"`, true},
+		{`principal != 'alice'`, false},
+		{`"connect" in scopes`, true},
+		{`"admin" in scopes`, false},
+		{`"site" in labels`, true},
+		{`"ost" in callback_id`, true},
+		{`labels.site == "zürich"`, true},
+		{`labels["env"] == "prod"`, true},
+		{`labels.missing == null`, true},
+		{`size(labels.missing) == 0`, true},
+		{`count >= 3 && count < 4`, true},
+		{`count > 3 || time.hour == 9`, true},
+		{`1.5 < 2`, true},
+		{`"a" < "b"`, true},
+		{`scopes[1] == "list"`, true},
+		{`size(scopes) == 2 && size("ab") == 2`, true},
+		{`glob(callback_id, "host-*.syd")`, true},
+		{`glob(labels.missing, "*")`, true},
+		{`cidr(remote_addr, "10.0.0.0/8")`, true},
+		{`cidr(remote_addr, "192.168.0.0/16")`, false},
+		{`startsWith(callback_id, "host") && endsWith(callback_id, ".syd")`, true},
+		{`matches(callback_id, "^host-[0-9]+\\.syd$")`, true},
+		{`matches(labels.site, "^z.rich$")`, true},
+		{`matches(labels.missing, "^$")`, true},
+		{`contains(scopes, "list") && contains(callback_id, "syd")`, true},
+		{`time.weekday in ["Saturday", "Sunday"]`, false},
+		{`(principal == "bob" || principal == "alice") && !(count == 4)`, true},
+		// The right side is not evaluated once the left decides.
+		{`false && undefined_var`, false},
+		{`true || undefined_var`, true},
+	}
+
+	for _, c := range cases {
+		expr, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("Compile(%s): %v", c.expr, err)
+			continue
+		}
+		got, err := expr.EvalBool(testVars())
+		if err != nil {
+			t.Errorf("EvalBool(%s): %v", c.expr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("EvalBool(%s) = %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{``, "unexpected end of expression"},
+		{`principal ==`, "unexpected end of expression"},
+		{`principal == "alice`, "unterminated string"},
+		{`'abc\`, "unterminated string"},
+		{`principal = "alice"`, "unexpected character"},
+		{`principal == "alice" "bob"`, "unexpected"},
+		{`(true`, `expected ")"`},
+		{`[1, 2`, `expected "]"`},
+		{`labels[`, "unexpected end of expression"},
+		{`labels.`, "expected field name"},
+		{`nosuch(principal)`, `unknown function "nosuch"`},
+		{`1.2.3 == 1`, "invalid number"},
+		{`principal == "a" ; true`, "unexpected character ';'"},
+		{`principal == "a" €`, "unexpected character '€'"},
+		{"principal == \"\xff\"", "invalid UTF-8"},
+		{"\xff", "invalid UTF-8"},
+		{`matches(principal, "(")`, "error parsing regexp"},
+		{`matches(principal, labels.site)`, "regex must be a string literal"},
+		{`matches(principal)`, "expected 2 arguments"},
+	}
+
+	for _, c := range cases {
+		_, err := Compile(c.expr)
+		if err == nil {
+			t.Errorf("Compile(%s) succeeded, want error containing %q", c.expr, c.want)
+			continue
+		}
+		if _, ok := err.(*ErrExpression); !ok {
+			t.Errorf("Compile(%s) returned %T, want *ErrExpression", c.expr, err)
+		}
+		if !strings.Contains(err.Error(), c.want) {
+			t.Errorf("Compile(%s) = %v, want error containing %q", c.expr, err, c.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`undefined_var == 1`, `undefined variable "undefined_var"`},
+		{`principal`, "yielded string, not bool"},
+		{`!principal`, "! applied to string"},
+		{`principal && true`, "&& applied to string"},
+		{`true && principal`, "&& applied to string"},
+		{`count < "4"`, "cannot compare number with string"},
+		{`principal < 1`, "cannot compare string with float64"},
+		{`true < false`, "cannot order bool"},
+		{`scopes[5] == "x"`, "out of range"},
+		{`labels[1] == "x"`, "map index must be a string"},
+		{`principal.field == "x"`, "cannot index string"},
+		{`1 in labels`, "map key must be a string"},
+		{`1 in count`, "cannot search float64"},
+		{`glob(count, "*")`, "expected string arguments"},
+		{`glob(callback_id, "[")`, "syntax error in pattern"},
+		{`cidr(remote_addr, "nonsense")`, "invalid CIDR address"},
+		{`matches(count, "x")`, "expected string argument"},
+		{`size(count) == 1`, "cannot take size of float64"},
+	}
+
+	for _, c := range cases {
+		expr, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("Compile(%s): %v", c.expr, err)
+			continue
+		}
+		_, err = expr.EvalBool(testVars())
+		if err == nil {
+			t.Errorf("EvalBool(%s) succeeded, want error containing %q", c.expr, c.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.want) {
+			t.Errorf("EvalBool(%s) = %v, want error containing %q", c.expr, err, c.want)
+		}
+	}
+}
+
+func TestLexOffsets(t *testing.T) {
+	tokens, err := lex(`labels.site == "zürich" && ü_1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []token{
+		{tokIdent, "labels", 0},
+		{tokOp, ".", 6},
+		{tokIdent, "site", 7},
+		{tokOp, "==", 12},
+		{tokString, "zürich", 15},
+		{tokOp, "&&", 25},
+		{tokIdent, "ü_1", 28},
+		{tokEOF, "", 32},
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("lex returned %d tokens, want %d: %v", len(tokens), len(want), tokens)
+	}
+	for i := range want {
+		if tokens[i] != want[i] {
+			t.Errorf("token %d = %v, want %v", i, tokens[i], want[i])
+		}
+	}
+}
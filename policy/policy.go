@@ -0,0 +1,234 @@
+// policy implements an expression based rule engine which decides whether
+// callback registrations and client connections are allowed.
+
+package policy
+
+import (
+	"fmt"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/go.log"
+	"time"
+)
+
+// Action is the operation a request is attempting.
+type Action string
+
+const (
+	ActionRegister = Action("register")
+	ActionConnect  = Action("connect")
+)
+
+// Effect is the outcome of a matching rule.
+type Effect string
+
+const (
+	EffectAllow = Effect("allow")
+	EffectDeny  = Effect("deny")
+)
+
+// Request is the context a rule is evaluated against.
+type Request struct {
+	Action     Action
+	Principal  string
+	Scopes     []string
+	CallbackId string
+	// RemoteAddr is the IP address of the client, without a port.
+	RemoteAddr string
+	// ClientCert is true if the request presented a verified TLS client certificate.
+	ClientCert   bool
+	ClientCertCN string
+	// Labels of the callback session - reported by the registrant for
+	// registrations, or those of the target session for connections.
+	Labels map[string]string
+	Time   time.Time
+}
+
+// vars converts the request to expression variables, with time fields
+// calculated in loc.
+func (r *Request) vars(loc *time.Location) map[string]interface{} {
+	t := r.Time.In(loc)
+	return map[string]interface{}{
+		"action":         string(r.Action),
+		"principal":      r.Principal,
+		"scopes":         r.Scopes,
+		"callback_id":    r.CallbackId,
+		"remote_addr":    r.RemoteAddr,
+		"client_cert":    r.ClientCert,
+		"client_cert_cn": r.ClientCertCN,
+		"labels":         r.Labels,
+		"time": map[string]interface{}{
+			"hour":    float64(t.Hour()),
+			"minute":  float64(t.Minute()),
+			"weekday": t.Weekday().String(),
+			"day":     float64(t.Day()),
+			"month":   float64(t.Month()),
+			"unix":    float64(t.Unix()),
+		},
+	}
+}
+
+// Rule is a single policy rule as it appears in the policy file.
+type Rule struct {
+	Name string `json:"name"`
+	// Actions the rule applies to. Empty means all actions.
+	Actions []Action `json:"actions"`
+	// When is the expression which must be true for the rule to match.
+	When   string `json:"when"`
+	Effect Effect `json:"effect"`
+	// Timezone the time variables are calculated in. Defaults to UTC.
+	Timezone string `json:"timezone"`
+
+	expr *Expr
+	loc  *time.Location
+}
+
+// appliesTo returns true if the rule covers action.
+func (r *Rule) appliesTo(action Action) bool {
+	if len(r.Actions) == 0 {
+		return true
+	}
+	for _, a := range r.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Config is the serialization format of the policy file.
+type Config struct {
+	// Default is the effect when no rule matches. Defaults to allow.
+	Default Effect  `json:"default"`
+	Rules   []*Rule `json:"rules"`
+}
+
+// Decision is the result of evaluating a request.
+type Decision struct {
+	Effect Effect
+	// Rule is the name of the deciding rule, or blank if the default applied.
+	Rule string
+	// Err is set if a rule failed to evaluate. Evaluation errors deny.
+	Err error
+}
+
+// Allowed returns true if the decision allows the request.
+func (d Decision) Allowed() bool {
+	return d.Effect == EffectAllow
+}
+
+// String describes the decision for logs and error messages.
+func (d Decision) String() string {
+	switch {
+	case d.Err != nil:
+		return fmt.Sprintf("%s (rule %q failed: %v)", d.Effect, d.Rule, d.Err)
+	case d.Rule == "":
+		return fmt.Sprintf("%s (default)", d.Effect)
+	default:
+		return fmt.Sprintf("%s (rule %q)", d.Effect, d.Rule)
+	}
+}
+
+// Engine evaluates requests against an ordered list of rules. The first
+// matching rule decides.
+type Engine struct {
+	defaultEffect Effect
+	rules         []*Rule
+}
+
+// NewEngine compiles a policy configuration.
+func NewEngine(config Config) (*Engine, error) {
+	engine := &Engine{
+		defaultEffect: config.Default,
+		rules:         config.Rules,
+	}
+	if engine.defaultEffect == "" {
+		engine.defaultEffect = EffectAllow
+	}
+	if err := validateEffect(engine.defaultEffect); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range engine.rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if err := validateEffect(rule.Effect); err != nil {
+			return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+		}
+		for _, action := range rule.Actions {
+			if action != ActionRegister && action != ActionConnect {
+				return nil, fmt.Errorf("rule %q: unknown action %q", rule.Name, action)
+			}
+		}
+
+		expr, err := Compile(rule.When)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+		}
+		rule.expr = expr
+
+		rule.loc = time.UTC
+		if rule.Timezone != "" {
+			loc, err := time.LoadLocation(rule.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", rule.Name, err)
+			}
+			rule.loc = loc
+		}
+	}
+
+	return engine, nil
+}
+
+// LoadEngine reads and compiles a JSON policy file.
+func LoadEngine(path string) (*Engine, error) {
+	config := Config{}
+	found, err := util.ReadJSONFile(path, &config)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("policy file not found: %s", path)
+	}
+	return NewEngine(config)
+}
+
+// Evaluate decides a request and logs which rule made the decision. A nil
+// engine allows everything.
+func (e *Engine) Evaluate(req *Request) Decision {
+	if e == nil {
+		return Decision{Effect: EffectAllow}
+	}
+
+	log := log.With("action", req.Action).
+		With("callback_id", req.CallbackId).
+		With("principal", req.Principal).
+		With("remote_addr", req.RemoteAddr)
+
+	decision := Decision{Effect: e.defaultEffect}
+	for _, rule := range e.rules {
+		if !rule.appliesTo(req.Action) {
+			continue
+		}
+
+		matched, err := rule.expr.EvalBool(req.vars(rule.loc))
+		if err != nil {
+			decision = Decision{Effect: EffectDeny, Rule: rule.Name, Err: err}
+			break
+		}
+		if matched {
+			decision = Decision{Effect: rule.Effect, Rule: rule.Name}
+			break
+		}
+	}
+
+	log.With("policy_rule", decision.Rule).Infoln("Policy decision:", decision)
+	return decision
+}
+
+func validateEffect(effect Effect) error {
+	if effect != EffectAllow && effect != EffectDeny {
+		return fmt.Errorf("effect must be %q or %q, not %q", EffectAllow, EffectDeny, effect)
+	}
+	return nil
+}
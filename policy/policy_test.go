@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func testEngine(t *testing.T, config Config) *Engine {
+	engine, err := NewEngine(config)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	return engine
+}
+
+func TestEvaluate(t *testing.T) {
+	engine := testEngine(t, Config{
+		Default: EffectDeny,
+		Rules: []*Rule{
+			{Name: "admins", When: `"admin" in scopes`, Effect: EffectAllow},
+			{Name: "no-prod", Actions: []Action{ActionConnect}, When: `labels.env == "prod"`, Effect: EffectDeny},
+			{Name: "office", Actions: []Action{ActionConnect}, When: `cidr(remote_addr, "10.0.0.0/8")`, Effect: EffectAllow},
+			{Name: "ci", Actions: []Action{ActionRegister}, When: `glob(callback_id, "ci-*")`, Effect: EffectAllow},
+		},
+	})
+
+	cases := []struct {
+		name string
+		req  Request
+		want Decision
+	}{
+		{"first match decides", Request{Action: ActionConnect, Scopes: []string{"admin"}, Labels: map[string]string{"env": "prod"}},
+			Decision{Effect: EffectAllow, Rule: "admins"}},
+		{"deny rule", Request{Action: ActionConnect, RemoteAddr: "10.1.1.1", Labels: map[string]string{"env": "prod"}},
+			Decision{Effect: EffectDeny, Rule: "no-prod"}},
+		{"allow rule", Request{Action: ActionConnect, RemoteAddr: "10.1.1.1"},
+			Decision{Effect: EffectAllow, Rule: "office"}},
+		{"rule for other action", Request{Action: ActionRegister, RemoteAddr: "10.1.1.1", CallbackId: "host1"},
+			Decision{Effect: EffectDeny}},
+		{"register rule", Request{Action: ActionRegister, CallbackId: "ci-abc"},
+			Decision{Effect: EffectAllow, Rule: "ci"}},
+		{"default", Request{Action: ActionConnect, RemoteAddr: "192.168.1.1"},
+			Decision{Effect: EffectDeny}},
+	}
+
+	for _, c := range cases {
+		c.req.Time = time.Now()
+		got := engine.Evaluate(&c.req)
+		if got != c.want {
+			t.Errorf("%s: Evaluate = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestEvaluateErrorDenies(t *testing.T) {
+	engine := testEngine(t, Config{
+		Default: EffectAllow,
+		Rules: []*Rule{
+			{Name: "broken", When: `labels.env < 3`, Effect: EffectAllow},
+			{Name: "allow", When: `true`, Effect: EffectAllow},
+		},
+	})
+
+	got := engine.Evaluate(&Request{Action: ActionConnect, Labels: map[string]string{"env": "prod"}, Time: time.Now()})
+	if got.Allowed() {
+		t.Fatalf("Evaluate = %v, want deny", got)
+	}
+	if got.Rule != "broken" || got.Err == nil {
+		t.Errorf("Evaluate = %v, want an error from rule broken", got)
+	}
+}
+
+func TestEvaluateTimezone(t *testing.T) {
+	engine := testEngine(t, Config{
+		Default: EffectDeny,
+		Rules: []*Rule{
+			{Name: "business-hours", When: `time.hour >= 9 && time.hour < 17`, Timezone: "Australia/Sydney", Effect: EffectAllow},
+		},
+	})
+
+	// 00:00 UTC is 10:00 or 11:00 in Sydney.
+	at := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	if got := engine.Evaluate(&Request{Action: ActionConnect, Time: at}); !got.Allowed() {
+		t.Errorf("Evaluate at %v = %v, want allow", at, got)
+	}
+	at = time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	if got := engine.Evaluate(&Request{Action: ActionConnect, Time: at}); got.Allowed() {
+		t.Errorf("Evaluate at %v = %v, want deny", at, got)
+	}
+}
+
+func TestNilEngineAllows(t *testing.T) {
+	var engine *Engine
+	if got := engine.Evaluate(&Request{Action: ActionRegister}); !got.Allowed() {
+		t.Errorf("Evaluate = %v, want allow", got)
+	}
+}
+
+func TestNewEngineErrors(t *testing.T) {
+	configs := map[string]Config{
+		"bad default":  {Default: "maybe"},
+		"bad effect":   {Rules: []*Rule{{When: "true", Effect: "maybe"}}},
+		"bad action":   {Rules: []*Rule{{When: "true", Effect: EffectAllow, Actions: []Action{"delete"}}}},
+		"bad when":     {Rules: []*Rule{{When: "true &&", Effect: EffectAllow}}},
+		"bad regex":    {Rules: []*Rule{{When: `matches(principal, "[")`, Effect: EffectAllow}}},
+		"bad timezone": {Rules: []*Rule{{When: "true", Effect: EffectAllow, Timezone: "Nowhere/Special"}}},
+	}
+	for name, config := range configs {
+		if _, err := NewEngine(config); err == nil {
+			t.Errorf("%s: NewEngine succeeded, want error", name)
+		}
+	}
+}
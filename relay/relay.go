@@ -0,0 +1,247 @@
+// relay implements edge relay mode, in which a callback server registers with
+// an upstream callback server and exports its callback sessions there over a
+// single connection.
+
+package relay
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/control"
+	"github.com/wrouesnel/callback/util/websocketrwc"
+	"github.com/wrouesnel/go.log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CallbackApiPath is the upstream path the relay registers at.
+const CallbackApiPath = "api/v1/callback"
+
+// Config configures a relay.
+type Config struct {
+	// Upstream is the URL of the upstream callback server.
+	Upstream *url.URL
+	// Id is the callback ID the relay registers as. Local sessions are
+	// reachable upstream as <Id>.<local callback ID>.
+	Id string
+	// Token authenticates to the upstream server.
+	Token string
+	// HandshakeTimeout bounds connecting to the upstream server.
+	HandshakeTimeout time.Duration
+	// ReconnectInterval is how long to wait before reconnecting after the
+	// upstream connection fails.
+	ReconnectInterval time.Duration
+}
+
+// Relay exports the sessions of a connection manager to an upstream server.
+type Relay struct {
+	config Config
+	cm     *connman.ConnectionManager
+	apiUrl string
+}
+
+// New returns a relay exporting the sessions of cm.
+func New(config Config, cm *connman.ConnectionManager) (*Relay, error) {
+	if config.Id == "" {
+		return nil, fmt.Errorf("relay ID must not be blank")
+	}
+	if strings.Contains(config.Id, "/") {
+		return nil, fmt.Errorf("relay ID must not contain /: %q", config.Id)
+	}
+
+	base := *config.Upstream
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	ref, err := url.Parse(CallbackApiPath + "/" + url.PathEscape(config.Id))
+	if err != nil {
+		return nil, err
+	}
+	apiUri := base.ResolveReference(ref)
+	switch apiUri.Scheme {
+	case "http":
+		apiUri.Scheme = "ws"
+	case "https":
+		apiUri.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return nil, fmt.Errorf("unrecognized URI scheme for upstream server: %s", apiUri.Scheme)
+	}
+
+	return &Relay{
+		config: config,
+		cm:     cm,
+		apiUrl: apiUri.String(),
+	}, nil
+}
+
+// Run keeps the relay registered upstream until stopCh closes, reconnecting
+// when the connection fails. When the upstream server drains, a new
+// registration is made while the old one finishes serving its streams.
+func (r *Relay) Run(stopCh <-chan struct{}) {
+	log := log.With("upstream", r.apiUrl)
+	reregisterCh := make(chan struct{}, 1)
+
+	exitCh := r.serve(stopCh, reregisterCh)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-reregisterCh:
+			log.Infoln("Registering upstream again at server request.")
+			exitCh = r.serve(stopCh, reregisterCh)
+			continue
+		case err := <-exitCh:
+			log.Errorln("Upstream relay connection ended:", err)
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(r.config.ReconnectInterval):
+		}
+		exitCh = r.serve(stopCh, reregisterCh)
+	}
+}
+
+// serve makes one registration upstream. The returned channel receives the
+// error which ended it.
+func (r *Relay) serve(stopCh <-chan struct{}, reregisterCh chan<- struct{}) <-chan error {
+	// Buffered so a registration which has been replaced can still exit.
+	exitCh := make(chan error, 1)
+
+	go func() {
+		exitCh <- r.session(stopCh, reregisterCh)
+	}()
+	return exitCh
+}
+
+func (r *Relay) session(stopCh <-chan struct{}, reregisterCh chan<- struct{}) error {
+	log := log.With("upstream", r.apiUrl)
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: r.config.HandshakeTimeout,
+	}
+	headers := http.Header{}
+	headers.Set(control.CapabilitiesHeader, strings.Join([]string{control.CapabilityControl, control.CapabilityRelay}, ","))
+	if r.config.Token != "" {
+		headers.Set("Authorization", "Bearer "+r.config.Token)
+	}
+
+	wconn, _, err := dialer.Dial(r.apiUrl, headers)
+	if err != nil {
+		return err
+	}
+	rwc, err := websocketrwc.WrapClientWebsocket(wconn)
+	if err != nil {
+		wconn.Close()
+		return err
+	}
+	defer rwc.Close()
+
+	rwc.SetControlHandler(func(data []byte) {
+		msg, derr := control.Decode(data)
+		if derr != nil {
+			log.Errorln("Could not decode control message:", derr)
+			return
+		}
+		switch msg.Type {
+		case control.MessageDrain:
+			log.Infoln("Upstream server is draining:", msg.Reason)
+			select {
+			case reregisterCh <- struct{}{}:
+			default:
+			}
+		default:
+			log.Debugln("Ignoring unknown control message:", msg.Type)
+		}
+	})
+
+	muxServer, err := yamux.Server(rwc, nil)
+	if err != nil {
+		return err
+	}
+	defer muxServer.Close()
+	log.Infoln("Registered with upstream server.")
+
+	sessionDoneCh := make(chan struct{})
+	defer close(sessionDoneCh)
+	go func() {
+		select {
+		case <-stopCh:
+			muxServer.Close()
+		case <-sessionDoneCh:
+		}
+	}()
+	go r.sendExports(rwc, sessionDoneCh)
+
+	for {
+		stream, aerr := muxServer.Accept()
+		if aerr != nil {
+			return aerr
+		}
+		go r.handleStream(stream)
+	}
+}
+
+// sendExports sends the list of exported sessions upstream on connection and
+// whenever it changes.
+func (r *Relay) sendExports(rwc *websocketrwc.Conn, doneCh <-chan struct{}) {
+	eventCh := r.cm.SubscribeCallbackEvents(16)
+	defer r.cm.UnsubscribeCallbackEvents(eventCh)
+
+	for {
+		sessions := r.cm.ListCallbackSessions().Sessions
+		exports := make([]control.Export, 0, len(sessions))
+		for id, desc := range sessions {
+			exports = append(exports, control.Export{Id: id, ConnectedAt: desc.ConnectedAt, Labels: desc.Labels})
+		}
+		sort.Slice(exports, func(i, j int) bool { return exports[i].Id < exports[j].Id })
+
+		data, err := control.Encode(control.Message{Type: control.MessageExports, Exports: exports})
+		if err != nil {
+			log.Errorln("Could not encode exports:", err)
+			return
+		}
+		if err := rwc.WriteControlMessage(data); err != nil {
+			log.Errorln("Could not send exports upstream:", err)
+			return
+		}
+
+		select {
+		case <-doneCh:
+			return
+		case <-eventCh:
+		}
+	}
+}
+
+// handleStream connects a stream opened by the upstream server to the local
+// session named by its stream header.
+func (r *Relay) handleStream(stream net.Conn) {
+	header, err := control.ReadStreamHeader(stream)
+	if err != nil {
+		log.Errorln("Could not read stream header from upstream:", err)
+		stream.Close()
+		return
+	}
+
+	origin := connman.SessionOrigin{
+		RemoteAddr: header.RemoteAddr,
+		Principal:  header.Principal,
+	}
+	log := log.With("remote_addr", header.RemoteAddr).With("callback_id", header.CallbackId)
+	log.Debugln("Relaying upstream client connection.")
+
+	if err := <-r.cm.ClientConnection(header.CallbackId, origin, stream, nil); err != nil {
+		log.Errorln("Relayed client session error:", err)
+		stream.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"github.com/wrouesnel/callback/connman"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestHandshakeTimeout checks an upstream which accepts the connection but
+// never answers the websocket handshake is given up on.
+func TestHandshakeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Accept connections and read the request, but never respond.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	upstream, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := 200 * time.Millisecond
+	r, err := New(Config{Upstream: upstream, Id: "relay1", HandshakeTimeout: timeout}, connman.NewConnectionManager(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.session(make(chan struct{}), make(chan struct{}, 1))
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("session succeeded against a silent upstream")
+		}
+		netErr, ok := err.(net.Error)
+		if !ok || !netErr.Timeout() {
+			t.Errorf("session returned %v, want a timeout", err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("session gave up after %v, before the %v timeout", elapsed, timeout)
+		}
+	case <-time.After(10 * timeout):
+		t.Fatal("handshake did not time out")
+	}
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	upstream, _ := url.Parse("http://upstream.example")
+	ftp, _ := url.Parse("ftp://upstream.example")
+
+	configs := map[string]Config{
+		"blank ID":   {Upstream: upstream},
+		"ID with /":  {Upstream: upstream, Id: "a/b"},
+		"bad scheme": {Upstream: ftp, Id: "relay1"},
+	}
+	for name, config := range configs {
+		if _, err := New(config, nil); err == nil {
+			t.Errorf("%s: New succeeded, want error", name)
+		}
+	}
+}
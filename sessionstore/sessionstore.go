@@ -0,0 +1,348 @@
+// sessionstore implements persistent storage of callback records.
+
+package sessionstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/callback/util/journal"
+	"github.com/wrouesnel/go.log"
+	"sync"
+)
+
+const (
+	// FileVersion is the format version of stored records.
+	FileVersion = 3
+
+	// compactAfter is the number of journal entries after which the store is
+	// compacted into a new snapshot.
+	compactAfter = 1000
+)
+
+// migrations are keyed by the version they upgrade from. When the format of
+// CallbackRecord changes incompatibly, FileVersion is incremented and a
+// migration from the previous version added here. Records in the snapshot and
+// its journal are both migrated.
+var migrations = journal.Migrations{
+	// Version 2 writes changes to a journal as they are made rather than
+	// periodically. Records are unchanged.
+	1: func(record json.RawMessage) (json.RawMessage, error) {
+		return record, nil
+	},
+	// Version 3 moves the reclaim secret of an allocated ID into a
+	// reservation, which records when the ID was allocated. IDs allocated
+	// before are taken to have been allocated when they were first seen.
+	2: func(record json.RawMessage) (json.RawMessage, error) {
+		fields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(record, &fields); err != nil {
+			return nil, err
+		}
+		secretHash, found := fields["reclaim_secret_hash"]
+		if !found {
+			return record, nil
+		}
+		reservation := struct {
+			SecretHash  json.RawMessage `json:"secret_hash"`
+			AllocatedAt json.RawMessage `json:"allocated_at,omitempty"`
+		}{secretHash, fields["first_seen"]}
+		data, err := json.Marshal(reservation)
+		if err != nil {
+			return nil, err
+		}
+		delete(fields, "reclaim_secret_hash")
+		fields["reservation"] = data
+		return json.Marshal(fields)
+	},
+}
+
+// storeFile is the format of the snapshot. Records are decoded only once they
+// have been migrated to the current version.
+type storeFile struct {
+	Version int `json:"version"`
+	// Generation ties the snapshot to the journal which follows it.
+	Generation uint64            `json:"generation"`
+	Records    []json.RawMessage `json:"records"`
+}
+
+// Journal operations.
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// journalEntry records a change of a record. Puts hold the whole record, so
+// entries can be replayed more than once.
+type journalEntry struct {
+	Op         string          `json:"op"`
+	CallbackId string          `json:"callback_id"`
+	Record     json.RawMessage `json:"record,omitempty"`
+}
+
+// ErrUnsupportedVersion is returned when the store file was written by a newer
+// version of the server.
+type ErrUnsupportedVersion struct {
+	version int
+}
+
+func (err ErrUnsupportedVersion) Error() string {
+	return fmt.Sprintf("session store file version %d is newer than the supported version %d", err.version, FileVersion)
+}
+
+// FileStore is a connman.SessionStore held in memory and written through to
+// a journal on disk, so a change is persisted before it is returned.
+type FileStore struct {
+	*connman.MemorySessionStore
+
+	path string
+	// journal is nil while the store is closed.
+	journal *journal.Journal
+	// generation of the last snapshot written.
+	generation uint64
+	// mtx serializes changes, so they are journaled in the order they are
+	// made.
+	mtx sync.Mutex
+}
+
+// NewFileStore loads the store at path, if it exists, migrating it to the
+// current version. The snapshot is backed up before a migrated version is
+// first written.
+func NewFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{
+		MemorySessionStore: connman.NewMemorySessionStore(),
+		path:               path,
+	}
+
+	j, err := journal.Open(path, fs.load)
+	if err != nil {
+		return nil, err
+	}
+	fs.journal = j
+	return fs, nil
+}
+
+// load implements journal.CompactFunc by reading the snapshot and journal on
+// disk into memory, and writing them as a new snapshot.
+func (fs *FileStore) load(replay journal.ReplayFunc) (uint64, error) {
+	f := storeFile{Version: FileVersion}
+	found, err := util.ReadJSONFile(fs.path, &f)
+	if err != nil {
+		return 0, err
+	}
+	if f.Version > FileVersion {
+		return 0, &ErrUnsupportedVersion{f.Version}
+	}
+
+	records := make(map[string]connman.CallbackRecord)
+	for _, data := range f.Records {
+		record, err := decode(f.Version, data)
+		if err != nil {
+			return 0, err
+		}
+		records[record.CallbackId] = record
+	}
+	err = replay(f.Generation, func(data json.RawMessage) error {
+		entry := journalEntry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		switch entry.Op {
+		case opPut:
+			record, err := decode(f.Version, entry.Record)
+			if err != nil {
+				return err
+			}
+			record.CallbackId = entry.CallbackId
+			records[entry.CallbackId] = record
+		case opDelete:
+			delete(records, entry.CallbackId)
+		default:
+			return fmt.Errorf("unknown operation %q", entry.Op)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if found && f.Version < FileVersion {
+		if err := journal.Backup(fs.path, f.Version); err != nil {
+			return 0, err
+		}
+		log.With("path", fs.path).Infof("Migrated session store from version %d to %d.", f.Version, FileVersion)
+	}
+
+	list := make([]connman.CallbackRecord, 0, len(records))
+	for _, record := range records {
+		list = append(list, record)
+	}
+	fs.Replace(list)
+	fs.generation = f.Generation
+	return fs.snapshot(nil)
+}
+
+// decode migrates a record from version to FileVersion and decodes it.
+func decode(version int, data json.RawMessage) (connman.CallbackRecord, error) {
+	record := connman.CallbackRecord{}
+	if err := migrations.Decode(version, FileVersion, data, &record); err != nil {
+		return record, fmt.Errorf("session store record: %v", err)
+	}
+	return record, nil
+}
+
+// snapshot implements journal.CompactFunc by writing the records held in
+// memory. Only one process writes records at a time, so the journal does not
+// need to be replayed.
+func (fs *FileStore) snapshot(replay journal.ReplayFunc) (uint64, error) {
+	records, err := fs.List()
+	if err != nil {
+		return 0, err
+	}
+	f := storeFile{
+		Version:    FileVersion,
+		Generation: fs.generation + 1,
+		Records:    make([]json.RawMessage, 0, len(records)),
+	}
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return 0, err
+		}
+		f.Records = append(f.Records, data)
+	}
+	if err := util.WriteJSONFile(fs.path, &f, 0600); err != nil {
+		return 0, err
+	}
+	fs.generation = f.Generation
+	return f.Generation, nil
+}
+
+// Update implements connman.SessionStore. The change is undone if it cannot
+// be journaled.
+func (fs *FileStore) Update(callbackId string, fn func(record *connman.CallbackRecord)) (connman.CallbackRecord, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	old, found, err := fs.MemorySessionStore.Get(callbackId)
+	if err != nil {
+		return connman.CallbackRecord{}, err
+	}
+	record, err := fs.MemorySessionStore.Update(callbackId, fn)
+	if err != nil {
+		return record, err
+	}
+
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = fs.append(journalEntry{Op: opPut, CallbackId: callbackId, Record: data})
+	}
+	if err != nil {
+		if found {
+			fs.MemorySessionStore.Update(callbackId, func(record *connman.CallbackRecord) { *record = old })
+		} else {
+			fs.MemorySessionStore.Delete(callbackId)
+		}
+		return connman.CallbackRecord{}, err
+	}
+	return record, nil
+}
+
+// Create implements connman.SessionStore.
+func (fs *FileStore) Create(callbackId string, fn func(record *connman.CallbackRecord)) (bool, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	created, err := fs.MemorySessionStore.Create(callbackId, fn)
+	if err != nil || !created {
+		return created, err
+	}
+	record, _, err := fs.MemorySessionStore.Get(callbackId)
+	if err != nil {
+		return false, err
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = fs.append(journalEntry{Op: opPut, CallbackId: callbackId, Record: data})
+	}
+	if err != nil {
+		fs.MemorySessionStore.Delete(callbackId)
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete implements connman.SessionStore.
+func (fs *FileStore) Delete(callbackId string) error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	if _, found, err := fs.MemorySessionStore.Get(callbackId); err != nil || !found {
+		return err
+	}
+	if err := fs.append(journalEntry{Op: opDelete, CallbackId: callbackId}); err != nil {
+		return err
+	}
+	return fs.MemorySessionStore.Delete(callbackId)
+}
+
+// append journals a change, compacting the journal once it is long enough.
+// Changes are only held in memory while the store is closed. Must be called
+// with mtx held.
+func (fs *FileStore) append(entry journalEntry) error {
+	if fs.journal == nil {
+		log.With("callback_id", entry.CallbackId).Debugln("Session store is closed. Change is not persisted.")
+		return nil
+	}
+	if err := fs.journal.Append(entry); err != nil {
+		return err
+	}
+	if fs.journal.Appended() >= compactAfter {
+		if err := fs.journal.Compact(fs.snapshot); err != nil {
+			log.Errorln("Could not compact session store:", err)
+		}
+	}
+	return nil
+}
+
+// Close compacts the store and stops persisting changes, such as before
+// another process takes it over. Changes made after are held in memory only.
+func (fs *FileStore) Close() error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	if fs.journal == nil {
+		return nil
+	}
+	err := fs.journal.Compact(fs.snapshot)
+	if cerr := fs.journal.Close(); err == nil {
+		err = cerr
+	}
+	fs.journal = nil
+	return err
+}
+
+// Reopen resumes persisting changes after Close, writing the records held in
+// memory.
+func (fs *FileStore) Reopen() error {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	if fs.journal != nil {
+		return nil
+	}
+	// Another process may have compacted the store while it was closed.
+	f := storeFile{}
+	if _, err := util.ReadJSONFile(fs.path, &f); err != nil {
+		return err
+	}
+	if f.Generation > fs.generation {
+		fs.generation = f.Generation
+	}
+	j, err := journal.Open(fs.path, fs.snapshot)
+	if err != nil {
+		return err
+	}
+	fs.journal = j
+	return nil
+}
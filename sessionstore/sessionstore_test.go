@@ -0,0 +1,215 @@
+package sessionstore
+
+import (
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T, path string) *FileStore {
+	fs, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+func setNotes(t *testing.T, fs *FileStore, callbackId string, notes string) {
+	if _, err := fs.Update(callbackId, func(record *connman.CallbackRecord) { record.Notes = notes }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getNotes(t *testing.T, fs *FileStore, callbackId string) (string, bool) {
+	record, found, err := fs.Get(callbackId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record.Notes, found
+}
+
+// TestWriteThrough checks changes are persisted as they are made, without
+// the store being closed.
+func TestWriteThrough(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+
+	fs := openStore(t, path)
+	setNotes(t, fs, "host1", "first")
+	setNotes(t, fs, "host2", "second")
+	setNotes(t, fs, "host1", "changed")
+	if err := fs.Delete("host2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Delete("missing"); err != nil {
+		t.Errorf("Delete of a missing record: %v", err)
+	}
+
+	reopened := openStore(t, path)
+	if notes, found := getNotes(t, reopened, "host1"); !found || notes != "changed" {
+		t.Errorf("host1 notes = %q, %v, want %q", notes, found, "changed")
+	}
+	if _, found := getNotes(t, reopened, "host2"); found {
+		t.Error("deleted record host2 was loaded")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+
+	fs := openStore(t, path)
+	for i := 0; i < compactAfter+10; i++ {
+		setNotes(t, fs, "host1", time.Duration(i).String())
+	}
+
+	// The snapshot holds the record as of compaction, and the journal the
+	// changes since.
+	f := storeFile{}
+	if _, err := util.ReadJSONFile(path, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != FileVersion || len(f.Records) != 1 {
+		t.Errorf("snapshot has version %d and %d records, want %d and 1", f.Version, len(f.Records), FileVersion)
+	}
+
+	reopened := openStore(t, path)
+	want := time.Duration(compactAfter + 9).String()
+	if notes, _ := getNotes(t, reopened, "host1"); notes != want {
+		t.Errorf("host1 notes = %q, want %q", notes, want)
+	}
+}
+
+func TestMigrateVersion1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	v1 := `{"version": 1, "records": [{"callback_id": "host1", "notes": "kept"}]}`
+	if err := ioutil.WriteFile(path, []byte(v1), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := openStore(t, path)
+	if notes, found := getNotes(t, fs, "host1"); !found || notes != "kept" {
+		t.Errorf("host1 notes = %q, %v, want %q", notes, found, "kept")
+	}
+
+	backup, err := ioutil.ReadFile(path + ".v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != v1 {
+		t.Errorf("backup is %q, want %q", backup, v1)
+	}
+	f := storeFile{}
+	if _, err := util.ReadJSONFile(path, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != FileVersion {
+		t.Errorf("migrated file has version %d, want %d", f.Version, FileVersion)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	newer := `{"version": 99, "records": []}`
+	if err := ioutil.WriteFile(path, []byte(newer), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewFileStore(path)
+	if _, ok := err.(*ErrUnsupportedVersion); !ok {
+		t.Fatalf("NewFileStore returned %v, want ErrUnsupportedVersion", err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != newer {
+		t.Error("file of a newer version was overwritten")
+	}
+}
+
+// TestCloseReopen checks changes made while the store is closed, such as
+// while another process takes it over, are written when it is reopened.
+func TestCloseReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+
+	fs := openStore(t, path)
+	setNotes(t, fs, "host1", "before")
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := openStore(t, path)
+	setNotes(t, fs, "host1", "while closed")
+	if notes, _ := getNotes(t, openStore(t, path), "host1"); notes != "before" {
+		t.Errorf("closed store persisted a change: notes = %q", notes)
+	}
+	other.Close()
+
+	if err := fs.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	setNotes(t, fs, "host2", "after")
+
+	reopened := openStore(t, path)
+	if notes, _ := getNotes(t, reopened, "host1"); notes != "while closed" {
+		t.Errorf("host1 notes = %q, want %q", notes, "while closed")
+	}
+	if _, found := getNotes(t, reopened, "host2"); !found {
+		t.Error("host2 was not persisted after reopening")
+	}
+}
+
+func TestMigrateVersion2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+	v2 := `{"version": 2, "generation": 1, "records": [
+		{"callback_id": "allocated", "first_seen": "2024-01-01T00:00:00Z", "reclaim_secret_hash": "abc"},
+		{"callback_id": "static", "notes": "kept"}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(v2), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := openStore(t, path)
+	record, _, err := fs.Get("allocated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if record.Reservation == nil || record.Reservation.SecretHash != "abc" || !record.Reservation.AllocatedAt.Equal(want) {
+		t.Errorf("reservation = %+v, want secret hash abc allocated at %v", record.Reservation, want)
+	}
+	record, _, err = fs.Get("static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Reservation != nil || record.Notes != "kept" {
+		t.Errorf("static record = %+v", record)
+	}
+	if _, err := ioutil.ReadFile(path + ".v2"); err != nil {
+		t.Errorf("version 2 file was not backed up: %v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+
+	fs := openStore(t, path)
+	create := func(notes string) bool {
+		created, err := fs.Create("host1", func(record *connman.CallbackRecord) { record.Notes = notes })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created
+	}
+	if !create("first") {
+		t.Fatal("record was not created")
+	}
+	if create("second") {
+		t.Error("existing record was replaced")
+	}
+
+	reopened := openStore(t, path)
+	if notes, _ := getNotes(t, reopened, "host1"); notes != "first" {
+		t.Errorf("host1 notes = %q, want %q", notes, "first")
+	}
+}
@@ -0,0 +1,504 @@
+// usage implements persistent traffic accounting of client sessions per
+// callback ID and principal.
+
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/wrouesnel/callback/connman"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/callback/util/journal"
+	"github.com/wrouesnel/go.log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// usageFileVersion is the on-disk format version of the usage file.
+	usageFileVersion = 2
+
+	// compactAfter is the number of sessions journaled after which the usage
+	// file is rewritten.
+	compactAfter = 1000
+)
+
+// migrations upgrade stored entries, keyed by the version they upgrade from.
+var migrations = journal.Migrations{
+	// Version 2 journals sessions as they end rather than writing the file
+	// periodically. Entries are unchanged.
+	1: func(entry json.RawMessage) (json.RawMessage, error) {
+		return entry, nil
+	},
+}
+
+// Period is the granularity usage is rolled up to.
+type Period string
+
+const (
+	PeriodHour  = Period("hour")
+	PeriodDay   = Period("day")
+	PeriodMonth = Period("month")
+)
+
+// periods lists every period usage is accumulated in.
+var periods = []Period{PeriodHour, PeriodDay, PeriodMonth}
+
+// ParsePeriod validates a period name.
+func ParsePeriod(s string) (Period, error) {
+	switch period := Period(s); period {
+	case PeriodHour, PeriodDay, PeriodMonth:
+		return period, nil
+	default:
+		return "", &ErrInvalidPeriod{s}
+	}
+}
+
+// start returns the start of the period containing t, in UTC.
+func (p Period) start(t time.Time) time.Time {
+	t = t.UTC()
+	switch p {
+	case PeriodHour:
+		return t.Truncate(time.Hour)
+	case PeriodDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+type ErrInvalidPeriod struct {
+	period string
+}
+
+func (err ErrInvalidPeriod) Error() string {
+	return "invalid usage period: " + err.period
+}
+
+type ErrInvalidGroupBy struct {
+	field string
+}
+
+func (err ErrInvalidGroupBy) Error() string {
+	return "invalid usage group_by field: " + err.field
+}
+
+// Fields usage can be grouped by.
+const (
+	GroupByCallbackId = "callback_id"
+	GroupByPrincipal  = "principal"
+)
+
+// Counters are the accumulated usage of a group.
+type Counters struct {
+	// BytesOut is data sent by clients to callbacks.
+	BytesOut uint64 `json:"bytes_out"`
+	// BytesIn is data sent by callbacks to clients.
+	BytesIn uint64 `json:"bytes_in"`
+	// Sessions is the number of client sessions started.
+	Sessions uint64 `json:"sessions"`
+	// ConnectedSeconds is the total time client sessions were connected.
+	ConnectedSeconds float64 `json:"connected_seconds"`
+}
+
+func (c *Counters) add(other Counters) {
+	c.BytesOut += other.BytesOut
+	c.BytesIn += other.BytesIn
+	c.Sessions += other.Sessions
+	c.ConnectedSeconds += other.ConnectedSeconds
+}
+
+// Entry is the usage of a callback ID by a principal in one period.
+type Entry struct {
+	Period     Period    `json:"period"`
+	Start      time.Time `json:"start"`
+	CallbackId string    `json:"callback_id,omitempty"`
+	Principal  string    `json:"principal,omitempty"`
+	Counters
+}
+
+type entryKey struct {
+	period     Period
+	start      int64
+	callbackId string
+	principal  string
+}
+
+func (e *Entry) key() entryKey {
+	return entryKey{e.Period, e.Start.Unix(), e.CallbackId, e.Principal}
+}
+
+// usageFile is the serialization format of the usage file. Entries are
+// decoded only once they have been migrated to the current version.
+type usageFile struct {
+	Version int `json:"version"`
+	// Generation ties the file to the journal of sessions which follows it.
+	Generation uint64            `json:"generation"`
+	Entries    []json.RawMessage `json:"entries"`
+}
+
+// session is the journal entry of a finished client session. Sessions are
+// journaled rather than the rollups they change, so several processes can
+// append to the same journal, such as while one hands over to another.
+type session struct {
+	CallbackId     string    `json:"callback_id"`
+	Principal      string    `json:"principal,omitempty"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	DisconnectedAt time.Time `json:"disconnected_at"`
+	BytesOut       uint64    `json:"bytes_out"`
+	BytesIn        uint64    `json:"bytes_in"`
+}
+
+// Retention configures how long rollups are kept. Zero keeps them forever.
+type Retention struct {
+	Hourly  time.Duration
+	Daily   time.Duration
+	Monthly time.Duration
+}
+
+func (r Retention) of(period Period) time.Duration {
+	switch period {
+	case PeriodHour:
+		return r.Hourly
+	case PeriodDay:
+		return r.Daily
+	default:
+		return r.Monthly
+	}
+}
+
+// rollups holds usage by period, callback ID and principal.
+type rollups map[entryKey]*Entry
+
+// Store accumulates usage and persists it to a file. It implements
+// connman.UsageRecorder.
+type Store struct {
+	// path of the usage file. Usage is not persisted if blank.
+	path      string
+	retention Retention
+
+	entries rollups
+	// journal is nil if usage is not persisted, or once the store is closed.
+	journal *journal.Journal
+	mtx     sync.Mutex
+}
+
+// NewStore loads the usage file at path, if it exists, migrating it to the
+// current version. The file is backed up before a migrated version is first
+// written.
+func NewStore(path string, retention Retention) (*Store, error) {
+	s := &Store{
+		path:      path,
+		retention: retention,
+		entries:   make(rollups),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	j, err := journal.Open(path, s.compact)
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+	return s, nil
+}
+
+// compact implements journal.CompactFunc. Usage is reloaded from the file and
+// journal rather than written from memory, so sessions journaled by other
+// processes are kept. Expired rollups are pruned.
+func (s *Store) compact(replay journal.ReplayFunc) (uint64, error) {
+	f := usageFile{Version: usageFileVersion}
+	found, err := util.ReadJSONFile(s.path, &f)
+	if err != nil {
+		return 0, err
+	}
+	if f.Version > usageFileVersion {
+		return 0, fmt.Errorf("unsupported usage file version: %d", f.Version)
+	}
+
+	entries := make(rollups)
+	for _, data := range f.Entries {
+		entry, err := decode(f.Version, data)
+		if err != nil {
+			return 0, err
+		}
+		entries[entry.key()] = entry
+	}
+	err = replay(f.Generation, func(data json.RawMessage) error {
+		sess := session{}
+		if err := json.Unmarshal(data, &sess); err != nil {
+			return err
+		}
+		entries.record(sess)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	entries.prune(s.retention, time.Now())
+
+	if found && f.Version < usageFileVersion {
+		if err := journal.Backup(s.path, f.Version); err != nil {
+			return 0, err
+		}
+		log.With("path", s.path).Infof("Migrated usage file from version %d to %d.", f.Version, usageFileVersion)
+	}
+
+	next := usageFile{
+		Version:    usageFileVersion,
+		Generation: f.Generation + 1,
+		Entries:    make([]json.RawMessage, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return 0, err
+		}
+		next.Entries = append(next.Entries, data)
+	}
+	if err := util.WriteJSONFile(s.path, &next, 0600); err != nil {
+		return 0, err
+	}
+	s.entries = entries
+	return next.Generation, nil
+}
+
+// decode migrates an entry from version to usageFileVersion and decodes it.
+func decode(version int, data json.RawMessage) (*Entry, error) {
+	entry := &Entry{}
+	if err := migrations.Decode(version, usageFileVersion, data, entry); err != nil {
+		return nil, fmt.Errorf("usage entry: %v", err)
+	}
+	return entry, nil
+}
+
+// RecordClientSession implements connman.UsageRecorder. The session is synced
+// to the journal before it is accounted.
+func (s *Store) RecordClientSession(desc connman.ClientSessionDesc, disconnectedAt time.Time) {
+	sess := session{
+		CallbackId:     desc.CallbackId,
+		Principal:      desc.Principal,
+		ConnectedAt:    desc.ConnectedAt,
+		DisconnectedAt: disconnectedAt,
+		BytesOut:       desc.BytesOut,
+		BytesIn:        desc.BytesIn,
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.journal != nil {
+		if err := s.journal.Append(sess); err != nil {
+			log.With("callback_id", sess.CallbackId).Errorln("Could not write usage of client session:", err)
+		} else if s.journal.Appended() >= compactAfter {
+			// Compaction reloads the session from the journal.
+			err := s.journal.Compact(s.compact)
+			if err == nil {
+				return
+			}
+			log.Errorln("Could not compact usage file:", err)
+		}
+	}
+	s.entries.record(sess)
+}
+
+// record accounts a finished session. Traffic and connected time are spread
+// evenly over the hours the session was connected, and the session is counted
+// in the period it started.
+func (r rollups) record(sess session) {
+	start := sess.ConnectedAt
+	end := sess.DisconnectedAt
+	if end.Before(start) {
+		end = start
+	}
+	total := end.Sub(start)
+
+	var remainingOut, remainingIn = sess.BytesOut, sess.BytesIn
+	first := true
+	for sliceStart := start; ; {
+		sliceEnd := PeriodHour.start(sliceStart).Add(time.Hour)
+		last := !sliceEnd.Before(end)
+		if last {
+			sliceEnd = end
+		}
+
+		slice := Counters{ConnectedSeconds: sliceEnd.Sub(sliceStart).Seconds()}
+		if last {
+			// Assign what is left so rounding never loses bytes.
+			slice.BytesOut, slice.BytesIn = remainingOut, remainingIn
+		} else {
+			fraction := float64(sliceEnd.Sub(sliceStart)) / float64(total)
+			slice.BytesOut = uint64(float64(sess.BytesOut) * fraction)
+			slice.BytesIn = uint64(float64(sess.BytesIn) * fraction)
+			remainingOut -= slice.BytesOut
+			remainingIn -= slice.BytesIn
+		}
+		if first {
+			slice.Sessions = 1
+			first = false
+		}
+
+		for _, period := range periods {
+			r.add(period, sliceStart, sess.CallbackId, sess.Principal, slice)
+		}
+
+		if last {
+			break
+		}
+		sliceStart = sliceEnd
+	}
+}
+
+func (r rollups) add(period Period, t time.Time, callbackId string, principal string, counters Counters) {
+	entry := &Entry{
+		Period:     period,
+		Start:      period.start(t),
+		CallbackId: callbackId,
+		Principal:  principal,
+	}
+	if existing, found := r[entry.key()]; found {
+		entry = existing
+	} else {
+		r[entry.key()] = entry
+	}
+	entry.add(counters)
+}
+
+// Query selects usage to report.
+type Query struct {
+	Period Period
+	// From and To bound the start of the periods reported (inclusive and
+	// exclusive respectively).
+	From time.Time
+	To   time.Time
+	// GroupBy lists the fields rows are grouped by. Usage is summed over
+	// fields not listed.
+	GroupBy []string
+}
+
+// ParseGroupBy parses a comma separated list of group_by fields.
+func ParseGroupBy(s string) ([]string, error) {
+	fields := []string{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		switch field {
+		case "":
+			continue
+		case GroupByCallbackId, GroupByPrincipal:
+			fields = append(fields, field)
+		default:
+			return nil, &ErrInvalidGroupBy{field}
+		}
+	}
+	return fields, nil
+}
+
+// Query returns the usage matching q, ordered by period start then group.
+func (s *Store) Query(q Query) []Entry {
+	byCallbackId, byPrincipal := false, false
+	for _, field := range q.GroupBy {
+		switch field {
+		case GroupByCallbackId:
+			byCallbackId = true
+		case GroupByPrincipal:
+			byPrincipal = true
+		}
+	}
+
+	s.mtx.Lock()
+	grouped := make(map[entryKey]*Entry)
+	for _, entry := range s.entries {
+		if entry.Period != q.Period || entry.Start.Before(q.From) || !entry.Start.Before(q.To) {
+			continue
+		}
+		row := Entry{Period: entry.Period, Start: entry.Start}
+		if byCallbackId {
+			row.CallbackId = entry.CallbackId
+		}
+		if byPrincipal {
+			row.Principal = entry.Principal
+		}
+		if existing, found := grouped[row.key()]; found {
+			existing.add(entry.Counters)
+		} else {
+			row.Counters = entry.Counters
+			grouped[row.key()] = &row
+		}
+	}
+	s.mtx.Unlock()
+
+	rows := make([]Entry, 0, len(grouped))
+	for _, row := range grouped {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Start.Equal(rows[j].Start) {
+			return rows[i].Start.Before(rows[j].Start)
+		}
+		if rows[i].CallbackId != rows[j].CallbackId {
+			return rows[i].CallbackId < rows[j].CallbackId
+		}
+		return rows[i].Principal < rows[j].Principal
+	})
+	return rows
+}
+
+// prune discards rollups older than their retention.
+func (r rollups) prune(retention Retention, now time.Time) {
+	for key, entry := range r {
+		if keep := retention.of(entry.Period); keep > 0 && entry.Start.Before(now.Add(-keep)) {
+			delete(r, key)
+		}
+	}
+}
+
+// Compact prunes expired rollups and rewrites the usage file, folding in the
+// journal of sessions.
+func (s *Store) Compact() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.journal == nil {
+		s.entries.prune(s.retention, time.Now())
+		return nil
+	}
+	return s.journal.Compact(s.compact)
+}
+
+// Run compacts the store every interval until stopCh closes. Should be
+// launched as a go-routine.
+func (s *Store) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Compact(); err != nil {
+				log.Errorln("Could not compact usage file:", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Close compacts the store and stops persisting usage. Sessions recorded
+// after are held in memory only.
+func (s *Store) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.Compact(s.compact)
+	if cerr := s.journal.Close(); err == nil {
+		err = cerr
+	}
+	s.journal = nil
+	return err
+}
@@ -0,0 +1,167 @@
+package usage
+
+import (
+	"encoding/json"
+	"github.com/wrouesnel/callback/connman"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func openStore(t *testing.T, path string, retention Retention) *Store {
+	s, err := NewStore(path, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func recordSession(s *Store, callbackId string, start time.Time, length time.Duration, bytes uint64) {
+	s.RecordClientSession(connman.ClientSessionDesc{
+		CallbackId:  callbackId,
+		Principal:   "alice",
+		ConnectedAt: start,
+		BytesOut:    bytes,
+		BytesIn:     bytes,
+	}, start.Add(length))
+}
+
+func total(s *Store, period Period) Counters {
+	counters := Counters{}
+	for _, row := range s.Query(Query{Period: period, From: epoch.Add(-24 * time.Hour), To: epoch.Add(24 * time.Hour)}) {
+		counters.add(row.Counters)
+	}
+	return counters
+}
+
+func TestRecordClientSession(t *testing.T) {
+	s := openStore(t, "", Retention{})
+	// 30 minutes in the first hour, 60 in the second and 10 in the third.
+	recordSession(s, "host1", epoch.Add(30*time.Minute), 100*time.Minute, 1000)
+
+	rows := s.Query(Query{Period: PeriodHour, From: epoch, To: epoch.Add(24 * time.Hour), GroupBy: []string{GroupByCallbackId}})
+	if len(rows) != 3 {
+		t.Fatalf("got %d hourly rows, want 3", len(rows))
+	}
+	wantOut := []uint64{300, 600, 100}
+	wantSessions := []uint64{1, 0, 0}
+	for i, row := range rows {
+		if row.BytesOut != wantOut[i] || row.Sessions != wantSessions[i] {
+			t.Errorf("hour %d: bytes_out %d, sessions %d, want %d, %d", i, row.BytesOut, row.Sessions, wantOut[i], wantSessions[i])
+		}
+	}
+	if day := total(s, PeriodDay); day.BytesOut != 1000 || day.Sessions != 1 || day.ConnectedSeconds != 6000 {
+		t.Errorf("day total = %+v", day)
+	}
+}
+
+// TestPersistedWithoutClose checks usage is kept when the server stops
+// without closing the store, such as on a crash.
+func TestPersistedWithoutClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	s := openStore(t, path, Retention{})
+	recordSession(s, "host1", epoch, time.Minute, 10)
+	recordSession(s, "host2", epoch, time.Minute, 20)
+
+	reopened := openStore(t, path, Retention{})
+	if day := total(reopened, PeriodDay); day.BytesOut != 30 || day.Sessions != 2 {
+		t.Errorf("day total after reopening = %+v, want 30 bytes out in 2 sessions", day)
+	}
+}
+
+// TestSharedJournal checks sessions recorded by two processes using the same
+// usage file, as during a handoff, are all kept and counted once.
+func TestSharedJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	parent := openStore(t, path, Retention{})
+	child := openStore(t, path, Retention{})
+	recordSession(parent, "host1", epoch, time.Minute, 1)
+	recordSession(child, "host1", epoch, time.Minute, 10)
+	if err := child.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	recordSession(parent, "host1", epoch, time.Minute, 100)
+	if err := parent.Close(); err != nil {
+		t.Fatal(err)
+	}
+	recordSession(child, "host1", epoch, time.Minute, 1000)
+
+	reopened := openStore(t, path, Retention{})
+	if day := total(reopened, PeriodDay); day.BytesOut != 1111 || day.Sessions != 4 {
+		t.Errorf("day total = %+v, want 1111 bytes out in 4 sessions", day)
+	}
+}
+
+func TestCompactPrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	s := openStore(t, path, Retention{Hourly: time.Hour})
+	// Sessions start on the hour so they do not straddle rollup periods.
+	now := time.Now().Truncate(time.Hour)
+	recordSession(s, "host1", now.Add(-48*time.Hour), time.Minute, 10)
+	recordSession(s, "host1", now, time.Minute, 10)
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	hourly := s.Query(Query{Period: PeriodHour, From: time.Now().Add(-72 * time.Hour), To: time.Now().Add(time.Hour)})
+	if len(hourly) != 1 {
+		t.Errorf("got %d hourly rows after pruning, want 1", len(hourly))
+	}
+	daily := s.Query(Query{Period: PeriodDay, From: time.Now().Add(-72 * time.Hour), To: time.Now().Add(24 * time.Hour)})
+	if len(daily) != 2 {
+		t.Errorf("got %d daily rows, want 2", len(daily))
+	}
+}
+
+func TestMigrateVersion1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	v1 := `{"version": 1, "entries": [{"period": "day", "start": "2024-01-01T00:00:00Z", "callback_id": "host1", "bytes_out": 5, "sessions": 1}]}`
+	if err := ioutil.WriteFile(path, []byte(v1), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openStore(t, path, Retention{})
+	if day := total(s, PeriodDay); day.BytesOut != 5 || day.Sessions != 1 {
+		t.Errorf("day total after migration = %+v", day)
+	}
+	if backup, err := ioutil.ReadFile(path + ".v1"); err != nil || string(backup) != v1 {
+		t.Errorf("backup is %q (%v), want the version 1 file", backup, err)
+	}
+
+	// Counters are serialized alongside the other fields of an entry.
+	f := usageFile{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != usageFileVersion || len(f.Entries) != 1 {
+		t.Fatalf("migrated file has version %d and %d entries", f.Version, len(f.Entries))
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(f.Entries[0], &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["bytes_out"] != float64(5) {
+		t.Errorf("entry is %s, want bytes_out at the top level", f.Entries[0])
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	if err := ioutil.WriteFile(path, []byte(`{"version": 99, "entries": []}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStore(path, Retention{}); err == nil {
+		t.Fatal("NewStore loaded a file of a newer version")
+	}
+}
@@ -0,0 +1,192 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// listenFdsStart is the first file descriptor passed by systemd or a
+	// parent process.
+	listenFdsStart = 3
+
+	// handoffFdsEnv holds the number of listeners handed over by a parent
+	// process.
+	handoffFdsEnv = "CALLBACK_HANDOFF_FDS"
+	// handoffReadyFdEnv holds the file descriptor the child reports readiness
+	// on.
+	handoffReadyFdEnv = "CALLBACK_HANDOFF_READY_FD"
+)
+
+// handoffReady is the pipe a parent process is waiting on for us to report
+// we are serving. nil if we were not started by a handoff.
+var handoffReady *os.File
+
+// InheritedListeners returns listening sockets passed by systemd socket
+// activation (LISTEN_FDS) or by a parent process handing over its listeners
+// (see StartHandoff). Returns no listeners if none were passed. The
+// environment variables are cleared so they are not inherited by children.
+func InheritedListeners() ([]net.Listener, error) {
+	defer func() {
+		for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", handoffFdsEnv, handoffReadyFdEnv} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	numFds := 0
+	if s := os.Getenv(handoffFdsEnv); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", handoffFdsEnv, s)
+		}
+		numFds = n
+
+		readyFd, err := strconv.Atoi(os.Getenv(handoffReadyFdEnv))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", handoffReadyFdEnv, os.Getenv(handoffReadyFdEnv))
+		}
+		handoffReady = os.NewFile(uintptr(readyFd), "handoff-ready")
+	} else if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+		}
+		numFds = n
+	}
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+numFds; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listener-%d", fd))
+		// FileListener duplicates the descriptor, so the original is closed.
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited file descriptor %d is not a listening socket: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// ServeHTTP serves each of the given listeners with server. TCP listeners
+// have keep-alives enabled on accepted connections.
+func ServeHTTP(listeners []net.Listener, server *http.Server) {
+	for _, listener := range listeners {
+		if tcpListener, ok := listener.(*net.TCPListener); ok {
+			listener = tcpKeepAliveListener{tcpListener}
+		}
+		go server.Serve(listener)
+	}
+}
+
+// filer is implemented by listeners whose socket can be duplicated.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// StartHandoff starts a new instance of the running executable with the same
+// arguments and environment, passing it listeners. It returns once the new
+// process reports it is serving (see NotifyHandoffReady). If it does not do
+// so within timeout it is killed and an error returned. Once handed over,
+// unix socket listeners are no longer unlinked when closed, since the new
+// process serves them.
+func StartHandoff(listeners []net.Listener, timeout time.Duration) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		fl, ok := listener.(filer)
+		if !ok {
+			return nil, fmt.Errorf("listener %v cannot be handed over", listener.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", handoffFdsEnv, len(listeners)),
+		fmt.Sprintf("%s=%d", handoffReadyFdEnv, listenFdsStart+len(listeners)),
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Close our copy of the write end so we see EOF if the child exits.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	readyCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, rerr := readyR.Read(buf)
+		readyCh <- rerr
+	}()
+
+	select {
+	case rerr := <-readyCh:
+		if rerr != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("new process exited before serving: %v", rerr)
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("new process did not start serving within %v", timeout)
+	}
+
+	for _, listener := range listeners {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+
+	// Reap the child when it eventually exits.
+	go cmd.Wait()
+	return cmd.Process, nil
+}
+
+// NotifyHandoffReady tells the parent process which started us with
+// StartHandoff that we are serving. Does nothing if there is no parent
+// waiting.
+func NotifyHandoffReady() error {
+	if handoffReady == nil {
+		return nil
+	}
+	_, err := handoffReady.Write([]byte{1})
+	if cerr := handoffReady.Close(); err == nil {
+		err = cerr
+	}
+	handoffReady = nil
+	return err
+}
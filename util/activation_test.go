@@ -0,0 +1,127 @@
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// handoffTestEnv makes the test binary act as the process started by
+// StartHandoff, failing before it serves if set to "fail".
+const handoffTestEnv = "CALLBACK_HANDOFF_TEST"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(handoffTestEnv); mode != "" {
+		os.Exit(handoffChild(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// handoffChild serves one connection on each inherited listener by writing
+// the network of the listener.
+func handoffChild(mode string) int {
+	if mode == "fail" {
+		return 1
+	}
+	time.AfterFunc(30*time.Second, func() { os.Exit(2) })
+
+	listeners, err := InheritedListeners()
+	if err != nil || len(listeners) == 0 {
+		return 1
+	}
+	if os.Getenv(handoffFdsEnv) != "" {
+		// The environment must not be inherited by our own children.
+		return 1
+	}
+	if err := NotifyHandoffReady(); err != nil {
+		return 1
+	}
+	for _, listener := range listeners {
+		conn, err := listener.Accept()
+		if err != nil {
+			return 1
+		}
+		conn.Write([]byte(listener.Addr().Network()))
+		conn.Close()
+	}
+	return 0
+}
+
+func TestStartHandoff(t *testing.T) {
+	t.Setenv(handoffTestEnv, "serve")
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	socketPath := filepath.Join(t.TempDir(), "callback.sock")
+	unixListener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+
+	if _, err := StartHandoff([]net.Listener{tcpListener, unixListener}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parent stops serving, and the socket remains for the new process.
+	tcpListener.Close()
+	unixListener.Close()
+	if _, err := os.Stat(socketPath); err != nil {
+		t.Fatal("unix socket was removed after handoff:", err)
+	}
+
+	for _, tc := range []struct {
+		network string
+		address string
+	}{
+		{"tcp", tcpListener.Addr().String()},
+		{"unix", socketPath},
+	} {
+		conn, err := net.DialTimeout(tc.network, tc.address, 5*time.Second)
+		if err != nil {
+			t.Fatalf("could not connect to the new process on %s: %v", tc.network, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.network {
+			t.Errorf("new process served %q on the %s listener", data, tc.network)
+		}
+	}
+}
+
+func TestStartHandoffFailure(t *testing.T) {
+	t.Setenv(handoffTestEnv, "fail")
+
+	socketPath := filepath.Join(t.TempDir(), "callback.sock")
+	unixListener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := StartHandoff([]net.Listener{unixListener}, 10*time.Second); err == nil {
+		t.Fatal("StartHandoff succeeded although the new process exited")
+	}
+
+	// The parent keeps serving, and still owns the socket.
+	unixListener.Close()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Error("unix socket was not removed when the parent closed it:", err)
+	}
+}
+
+func TestInheritedListenersNone(t *testing.T) {
+	listeners, err := InheritedListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("InheritedListeners = %v, %v, want none", listeners, err)
+	}
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration which serializes to and from JSON as a Go
+// duration string such as "90s" or "1h30m".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Plain numbers are interpreted as
+// nanoseconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if nerr := json.Unmarshal(data, &n); nerr != nil {
+			return err
+		}
+		*d = Duration(n)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,240 @@
+// journal implements write-through persistence of state as a snapshot file
+// and a journal of the changes made since the snapshot was written. Changes
+// are synced to disk as they are appended.
+//
+// Several processes may append to the same journal, such as while one hands
+// over to another. Compaction excludes them, so entries appended by any of
+// them are folded into the next snapshot.
+
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/wrouesnel/callback/util"
+	"github.com/wrouesnel/go.log"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	// journalSuffix is appended to the snapshot path to name the journal.
+	journalSuffix = ".journal"
+	// lockSuffix is appended to the snapshot path to name the file locked
+	// while appending (shared) and compacting (exclusive).
+	lockSuffix = ".lock"
+)
+
+// header is the first line of a journal, tying it to the snapshot it
+// follows.
+type header struct {
+	Generation uint64 `json:"generation"`
+}
+
+// ReplayFunc calls fn with each entry of the journal following the snapshot
+// of generation. A journal left behind by an older snapshot is ignored.
+type ReplayFunc func(generation uint64, fn func(entry json.RawMessage) error) error
+
+// CompactFunc writes a new snapshot and returns its generation, which must
+// be greater than that of the snapshot it replaces. The entries of the
+// current journal can be folded in with replay. It is called with other
+// writers of the journal excluded.
+type CompactFunc func(replay ReplayFunc) (uint64, error)
+
+// Journal is an append-only log of JSON entries. It is not safe for
+// concurrent use within a process; callers serialize access.
+type Journal struct {
+	path string
+	lock *os.File
+	file *os.File
+	// appended counts the entries this process appended since it last
+	// compacted the journal.
+	appended int
+}
+
+// Open opens the journal of the snapshot at path and compacts it, so the
+// state held by the caller is that on disk.
+func Open(path string, compact CompactFunc) (*Journal, error) {
+	lock, err := os.OpenFile(path+lockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{path: path, lock: lock}
+	if err := j.Compact(compact); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Appended returns the number of entries appended since the journal was last
+// compacted by this process.
+func (j *Journal) Appended() int {
+	return j.appended
+}
+
+// Append writes entry to the journal and syncs it to disk.
+func (j *Journal) Append(entry interface{}) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if err := j.flock(syscall.LOCK_SH); err != nil {
+		return err
+	}
+	defer j.flock(syscall.LOCK_UN)
+
+	if err := j.reopen(); err != nil {
+		return err
+	}
+	// Appends are a single write, so do not interleave with those of other
+	// processes.
+	if _, err := j.file.Write(data); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.appended++
+	return nil
+}
+
+// Compact writes a new snapshot with compact and starts an empty journal
+// following it.
+func (j *Journal) Compact(compact CompactFunc) error {
+	if err := j.flock(syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer j.flock(syscall.LOCK_UN)
+
+	generation, err := compact(j.replay)
+	if err != nil {
+		return err
+	}
+
+	// The new journal replaces the old one only after the snapshot is
+	// written. If we stop in between, the old journal is of an older
+	// generation than the snapshot and is ignored.
+	data, err := json.Marshal(header{generation})
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(j.path+journalSuffix, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	if err := j.reopen(); err != nil {
+		return err
+	}
+	j.appended = 0
+	return nil
+}
+
+// Close closes the journal. Entries can no longer be appended.
+func (j *Journal) Close() error {
+	var err error
+	if j.file != nil {
+		err = j.file.Close()
+		j.file = nil
+	}
+	if cerr := j.lock.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (j *Journal) flock(how int) error {
+	return syscall.Flock(int(j.lock.Fd()), how)
+}
+
+// reopen opens the journal for appending if it is not open, or has been
+// replaced by another process compacting it.
+func (j *Journal) reopen() error {
+	current, err := os.Stat(j.path + journalSuffix)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		open, err := j.file.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(current, open) {
+			return nil
+		}
+	}
+
+	f, err := os.OpenFile(j.path+journalSuffix, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	return nil
+}
+
+// replay implements ReplayFunc. An entry cut short by a crash, or which is not
+// valid JSON, is skipped.
+func (j *Journal) replay(generation uint64, fn func(entry json.RawMessage) error) error {
+	log := log.With("path", j.path+journalSuffix)
+
+	f, err := os.Open(j.path + journalSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("reading journal header: %v", err)
+	}
+	h := header{}
+	if err := json.Unmarshal(line, &h); err != nil {
+		return fmt.Errorf("reading journal header: %v", err)
+	}
+	if h.Generation < generation {
+		log.Infof("Ignoring journal of generation %d older than its snapshot of generation %d.", h.Generation, generation)
+		return nil
+	}
+	if h.Generation > generation {
+		// The snapshot was removed or replaced by an older one. Replaying
+		// the journal on its own would lose the changes before it.
+		return fmt.Errorf("journal %s of generation %d is newer than its snapshot of generation %d: remove it to discard its changes", j.path+journalSuffix, h.Generation, generation)
+	}
+
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Warnf("Ignoring incomplete journal entry %d.", n)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		if !json.Valid(line) {
+			log.Warnf("Ignoring corrupt journal entry %d.", n)
+			continue
+		}
+		if err := fn(json.RawMessage(line)); err != nil {
+			return fmt.Errorf("journal entry %d: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package journal
+
+import (
+	"encoding/json"
+	"github.com/wrouesnel/callback/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// counter is the state under test: a snapshot of a sum, and a journal of
+// increments.
+type counter struct {
+	path       string
+	sum        int
+	generation uint64
+}
+
+type counterFile struct {
+	Generation uint64 `json:"generation"`
+	Sum        int    `json:"sum"`
+}
+
+// compact implements CompactFunc by reloading the snapshot, replaying the
+// journal and writing the sum as the next snapshot.
+func (c *counter) compact(replay ReplayFunc) (uint64, error) {
+	f := counterFile{}
+	if data, err := ioutil.ReadFile(c.path); err == nil {
+		if err := json.Unmarshal(data, &f); err != nil {
+			return 0, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	err := replay(f.Generation, func(entry json.RawMessage) error {
+		n := 0
+		if err := json.Unmarshal(entry, &n); err != nil {
+			return err
+		}
+		f.Sum += n
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	f.Generation++
+	data, err := json.Marshal(f)
+	if err != nil {
+		return 0, err
+	}
+	if err := util.WriteFileAtomic(c.path, data, 0600); err != nil {
+		return 0, err
+	}
+	c.sum, c.generation = f.Sum, f.Generation
+	return f.Generation, nil
+}
+
+func openCounter(t *testing.T, path string) (*counter, *Journal) {
+	c := &counter{path: path}
+	j, err := Open(path, c.compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.Close() })
+	return c, j
+}
+
+func appendN(t *testing.T, j *Journal, entries ...int) {
+	for _, n := range entries {
+		if err := j.Append(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplayAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+
+	_, j := openCounter(t, path)
+	appendN(t, j, 1, 2, 3)
+	if j.Appended() != 3 {
+		t.Errorf("Appended() = %d, want 3", j.Appended())
+	}
+	// The journal is not compacted or closed, as if the process crashed.
+
+	c, _ := openCounter(t, path)
+	if c.sum != 6 {
+		t.Errorf("sum = %d, want 6", c.sum)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+
+	c, j := openCounter(t, path)
+	appendN(t, j, 1, 2)
+	if err := j.Compact(c.compact); err != nil {
+		t.Fatal(err)
+	}
+	if c.sum != 3 || j.Appended() != 0 {
+		t.Errorf("after compaction sum = %d, appended = %d, want 3, 0", c.sum, j.Appended())
+	}
+	appendN(t, j, 4)
+
+	c, _ = openCounter(t, path)
+	if c.sum != 7 {
+		t.Errorf("sum = %d, want 7", c.sum)
+	}
+}
+
+func TestIncompleteEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+
+	_, j := openCounter(t, path)
+	appendN(t, j, 1, 2)
+	j.Close()
+
+	// A corrupt entry, and a last entry cut short by a crash, are skipped.
+	f, err := os.OpenFile(path+journalSuffix, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{garbage\n4\n12")
+	f.Close()
+
+	c, _ := openCounter(t, path)
+	if c.sum != 7 {
+		t.Errorf("sum = %d, want 7", c.sum)
+	}
+}
+
+// TestStaleJournal checks a journal left behind by a compaction which wrote
+// the snapshot but stopped before replacing the journal is not replayed
+// again.
+func TestStaleJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+
+	c, j := openCounter(t, path)
+	appendN(t, j, 5)
+	stale, err := ioutil.ReadFile(path + journalSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Compact(c.compact); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if err := ioutil.WriteFile(path+journalSuffix, stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ = openCounter(t, path)
+	if c.sum != 5 {
+		t.Errorf("sum = %d, want 5", c.sum)
+	}
+}
+
+func TestJournalNewerThanSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+	if err := ioutil.WriteFile(path+journalSuffix, []byte(`{"generation":7}`+"\n1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &counter{path: path}
+	if _, err := Open(path, c.compact); err == nil {
+		t.Fatal("Open succeeded with a journal newer than its snapshot")
+	}
+}
+
+// TestSharedAppends checks entries appended by two writers of the same
+// journal, one of which compacts it, are all kept.
+func TestSharedAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+
+	parent, pj := openCounter(t, path)
+	_, cj := openCounter(t, path)
+
+	appendN(t, pj, 1)
+	appendN(t, cj, 10)
+	if err := pj.Compact(parent.compact); err != nil {
+		t.Fatal(err)
+	}
+	if parent.sum != 11 {
+		t.Errorf("sum after compaction = %d, want 11", parent.sum)
+	}
+	// The other writer follows the journal replaced by compaction.
+	appendN(t, cj, 100)
+	appendN(t, pj, 1000)
+
+	c, _ := openCounter(t, path)
+	if c.sum != 1111 {
+		t.Errorf("sum = %d, want 1111", c.sum)
+	}
+}
+
+func TestReplayOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+
+	_, j := openCounter(t, path)
+	var want []string
+	for i := 0; i < 10; i++ {
+		appendN(t, j, i)
+		want = append(want, strconv.Itoa(i))
+	}
+
+	var got []string
+	err := j.Compact(func(replay ReplayFunc) (uint64, error) {
+		err := replay(1, func(entry json.RawMessage) error {
+			got = append(got, string(entry))
+			return nil
+		})
+		return 2, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
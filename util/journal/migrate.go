@@ -0,0 +1,39 @@
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Migration upgrades a stored record from one version of a format to the
+// next.
+type Migration func(record json.RawMessage) (json.RawMessage, error)
+
+// Migrations are keyed by the version they upgrade from.
+type Migrations map[int]Migration
+
+// Decode migrates a record from version to latest and decodes it into v.
+func (ms Migrations) Decode(version int, latest int, record json.RawMessage, v interface{}) error {
+	for ; version < latest; version++ {
+		m, found := ms[version]
+		if !found {
+			return fmt.Errorf("no migration from version %d", version)
+		}
+		var err error
+		if record, err = m(record); err != nil {
+			return fmt.Errorf("migrating record from version %d: %v", version, err)
+		}
+	}
+	return json.Unmarshal(record, v)
+}
+
+// Backup copies the snapshot at path to path.v<version>, so a snapshot in an
+// older format is kept when it is first replaced by a migrated one.
+func Backup(path string, version int) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fmt.Sprintf("%s.v%d", path, version), data, 0600)
+}
@@ -0,0 +1,84 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// renameField returns a migration renaming a field of a record.
+func renameField(from, to string) Migration {
+	return func(record json.RawMessage) (json.RawMessage, error) {
+		fields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(record, &fields); err != nil {
+			return nil, err
+		}
+		fields[to] = fields[from]
+		delete(fields, from)
+		return json.Marshal(fields)
+	}
+}
+
+func TestMigrationsDecode(t *testing.T) {
+	migrations := Migrations{
+		1: renameField("a", "b"),
+		2: renameField("b", "c"),
+		4: func(record json.RawMessage) (json.RawMessage, error) {
+			return nil, errors.New("bad record")
+		},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		version int
+		latest  int
+		record  string
+		want    int
+		wantErr string
+	}{
+		{"chained", 1, 3, `{"a":1}`, 1, ""},
+		{"partial", 2, 3, `{"b":2}`, 2, ""},
+		{"current", 3, 3, `{"c":3}`, 3, ""},
+		{"missing", 3, 5, `{"c":3}`, 0, "no migration from version 3"},
+		{"failed", 4, 5, `{"c":4}`, 0, "migrating record from version 4: bad record"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := struct {
+				C int `json:"c"`
+			}{}
+			err := migrations.Decode(tc.version, tc.latest, json.RawMessage(tc.record), &v)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Decode returned %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.C != tc.want {
+				t.Errorf("decoded %d, want %d", v.C, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	if err := ioutil.WriteFile(path, []byte(`{"version":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Backup(path, 1); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path + ".v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"version":1}` {
+		t.Errorf("backup contains %q", data)
+	}
+}
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ReadJSONFile decodes the JSON document at path into v. It returns false (and
+// no error) if the file does not exist yet.
+func ReadJSONFile(path string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// WriteJSONFile atomically replaces the file at path with the JSON encoding of
+// v (see WriteFileAtomic).
+func WriteJSONFile(path string, v interface{}, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, perm)
+}
+
+// WriteFileAtomic replaces the file at path with data. The data is written and
+// synced to a temporary file in the same directory, which is renamed into place
+// so readers never observe a partial write.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
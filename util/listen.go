@@ -0,0 +1,49 @@
+package util
+
+import (
+	"github.com/wrouesnel/multihttp"
+	"net"
+	"net/http"
+	"time"
+)
+
+// tcpKeepAliveListener sets TCP keep-alive timeouts on accepted connections.
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+}
+
+func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
+	tc, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(3 * time.Minute)
+	return tc, nil
+}
+
+// ListenHTTP listens on each of the given addresses (in multihttp URL format,
+// e.g. tcp://0.0.0.0:8080 or unix:///run/callback.sock) and serves them with
+// server. Unlike multihttp.Listen this allows server timeouts to be set.
+// Even in the case of errors, successfully listening interfaces are returned
+// to allow for clean up.
+func ListenHTTP(addresses []string, server *http.Server) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	for _, address := range addresses {
+		protocol, address, err := multihttp.ParseAddress(address)
+		if err != nil {
+			return listeners, err
+		}
+
+		listener, err := net.Listen(protocol, address)
+		if err != nil {
+			return listeners, err
+		}
+
+		listeners = append(listeners, listener)
+		ServeHTTP([]net.Listener{listener}, server)
+	}
+
+	return listeners, nil
+}
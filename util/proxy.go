@@ -1,6 +1,7 @@
 package util
 
 import (
+	"github.com/wrouesnel/callback/util/ratelimit"
 	"github.com/wrouesnel/go.log"
 	"io"
 	"sync/atomic"
@@ -25,30 +26,48 @@ func NewReadWriteCloser(r io.Reader, w io.Writer, closeFn func() error) io.ReadW
 // HandleProxy connects an incoming io.ReadWriteCloser to and outgoing
 // io.ReadWriteCloser and sets up copy pipes between them. It returns a channel
 // which yields the exit status as an error type - nil is returned if the
-// connection closes normally.
-// TODO: if one side is closed, there's no point continuing to write with the
-// other.
+// connection closes normally. If either direction fails with an error both
+// connections are closed, since there's no point continuing with the other.
 func HandleProxy(log log.Logger, bufferSize int, incoming, outgoing io.ReadWriteCloser, shutdownCh <-chan struct{}, bytesOut, bytesIn *uint64) <-chan error {
+	return HandleThrottledProxy(log, bufferSize, incoming, outgoing, shutdownCh, bytesOut, bytesIn, nil, nil)
+}
+
+// HandleThrottledProxy is HandleProxy with data from incoming to outgoing
+// rate limited by throttleOut, and from outgoing to incoming by throttleIn.
+// Bucket tokens are bytes.
+func HandleThrottledProxy(log log.Logger, bufferSize int, incoming, outgoing io.ReadWriteCloser, shutdownCh <-chan struct{}, bytesOut, bytesIn *uint64, throttleOut, throttleIn ratelimit.Buckets) <-chan error {
 	resultCh := make(chan error)
 
 	go func() {
-		defer func() { LogErr(log, incoming.Close()) }()
-		defer func() { LogErr(log, outgoing.Close()) }()
-
 		var proxyErr error
+		closed := false
+		closeBoth := func() {
+			if !closed {
+				closed = true
+				LogErr(log, incoming.Close())
+				LogErr(log, outgoing.Close())
+			}
+		}
+		defer closeBoth()
 
 		// Forward data between connections
 		// TODO: possibly allow shutting down the pipes.
-		closedSrcDest := pipe(log, bufferSize, incoming, outgoing, shutdownCh, bytesOut)
-		closedDestSrc := pipe(log, bufferSize, outgoing, incoming, shutdownCh, bytesIn)
+		closedSrcDest := pipe(log, bufferSize, incoming, outgoing, shutdownCh, bytesOut, throttleOut)
+		closedDestSrc := pipe(log, bufferSize, outgoing, incoming, shutdownCh, bytesIn, throttleIn)
 		for {
 			select {
 			case sderr := <-closedSrcDest:
+				if sderr != nil {
+					closeBoth()
+				}
 				if proxyErr == nil {
 					proxyErr = sderr
 				}
 				closedSrcDest = nil
 			case dserr := <-closedDestSrc:
+				if dserr != nil {
+					closeBoth()
+				}
 				if proxyErr == nil {
 					proxyErr = dserr
 				}
@@ -77,10 +96,9 @@ func (err ErrIncompleteWrite) Error() string {
 }
 
 // pipe sets up a goroutine which proxies data between an io.Reader and io.Writer
-// using a buffer of bufferSize.
-// TODO: it feels like there should be windowing being done here?
+// using a buffer of bufferSize. Writes wait for throttle to admit the data.
 // TODO: this function could be a lot cleaner
-func pipe(log log.Logger, bufferSize int, src io.Reader, dst io.Writer, shutdownCh <-chan struct{}, bytesXfer *uint64) <-chan error {
+func pipe(log log.Logger, bufferSize int, src io.Reader, dst io.Writer, shutdownCh <-chan struct{}, bytesXfer *uint64, throttle ratelimit.Buckets) <-chan error {
 	closeCh := make(chan error)
 
 	go func() {
@@ -106,6 +124,12 @@ func pipe(log log.Logger, bufferSize int, src io.Reader, dst io.Writer, shutdown
 					log.Debugln("Proxy shutting down during read phase.")
 					return
 				}
+				if !throttle.Wait(float64(readBytes), shutdownCh) {
+					closeCh <- nil
+					close(closeCh)
+					log.Debugln("Pipe process shutting down on user request while throttled")
+					return
+				}
 				writtenBytes, werr := dst.Write(data[:readBytes])
 				if werr != nil {
 					if werr != io.EOF {
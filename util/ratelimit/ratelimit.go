@@ -0,0 +1,273 @@
+// Package ratelimit implements token bucket rate limiters.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a token refill rate and bucket size. A zero Rate is unlimited.
+type Rate struct {
+	// PerSecond is the number of tokens added to the bucket each second.
+	PerSecond float64
+	// Burst is the size of the bucket.
+	Burst float64
+}
+
+// Unlimited returns true if the rate does not limit anything.
+func (r Rate) Unlimited() bool {
+	return r.PerSecond <= 0
+}
+
+// String formats the rate in the format accepted by ParseRate.
+func (r Rate) String() string {
+	if r.Unlimited() {
+		return "0"
+	}
+	return fmt.Sprintf("%s/1s:%s", strconv.FormatFloat(r.PerSecond, 'f', -1, 64),
+		strconv.FormatFloat(r.Burst, 'f', -1, 64))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler using ParseRate.
+func (r *Rate) UnmarshalText(text []byte) error {
+	rate, err := ParseRate(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// ParseRate parses a rate of the form COUNT[/PERIOD][:BURST], for example
+// "10/1m:5" is 10 per minute with a burst of 5. PERIOD defaults to 1s and
+// BURST defaults to COUNT (minimum 1), and must be at least 1 since a smaller
+// bucket never holds a whole token. "0" or a blank string is unlimited.
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Rate{}, nil
+	}
+
+	burst := ""
+	if idx := strings.LastIndex(s, ":"); idx != -1 {
+		burst = s[idx+1:]
+		s = s[:idx]
+	}
+
+	period := time.Second
+	if idx := strings.Index(s, "/"); idx != -1 {
+		var err error
+		period, err = time.ParseDuration(s[idx+1:])
+		if err != nil || period <= 0 {
+			return Rate{}, fmt.Errorf("invalid rate period: %q", s[idx+1:])
+		}
+		s = s[:idx]
+	}
+
+	count, err := strconv.ParseFloat(s, 64)
+	if err != nil || count < 0 {
+		return Rate{}, fmt.Errorf("invalid rate count: %q", s)
+	}
+
+	rate := Rate{PerSecond: count / period.Seconds(), Burst: math.Max(count, 1)}
+	if burst != "" {
+		rate.Burst, err = strconv.ParseFloat(burst, 64)
+		if err != nil || rate.Burst < 1 {
+			return Rate{}, fmt.Errorf("invalid rate burst: %q", burst)
+		}
+	}
+	return rate, nil
+}
+
+// Bucket is a thread-safe token bucket. A nil Bucket never limits.
+type Bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+	mtx    sync.Mutex
+}
+
+// NewBucket returns a full bucket with the given rate.
+func NewBucket(rate Rate) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		tokens: rate.Burst,
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the rate of the bucket. Accumulated tokens are capped to the
+// new burst size.
+func (b *Bucket) SetRate(rate Rate) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	if b.tokens > rate.Burst {
+		b.tokens = rate.Burst
+	}
+}
+
+// Rate returns the current rate of the bucket.
+func (b *Bucket) Rate() Rate {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.rate
+}
+
+// refill adds tokens accumulated since the last refill. Must be called with
+// the lock held.
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if elapsed > 0 {
+		b.tokens = math.Min(b.rate.Burst, b.tokens+elapsed*b.rate.PerSecond)
+	}
+}
+
+// Take removes n tokens if they are available. If not, it returns false and
+// how long to wait before n tokens will be available.
+func (b *Bucket) Take(n float64) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.rate.Unlimited() {
+		return true, 0
+	}
+
+	b.refill(time.Now())
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+
+	return false, time.Duration((n - b.tokens) / b.rate.PerSecond * float64(time.Second))
+}
+
+// reserve removes up to n tokens, allowing the balance to go negative, and
+// returns how long the caller must wait for the debt to be repaid.
+func (b *Bucket) reserve(n float64) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.rate.Unlimited() {
+		return 0
+	}
+
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate.PerSecond * float64(time.Second))
+}
+
+// Wait blocks until n tokens have been consumed from the bucket or cancelCh
+// closes. Returns false if cancelled.
+func (b *Bucket) Wait(n float64, cancelCh <-chan struct{}) bool {
+	if b == nil {
+		return true
+	}
+
+	wait := b.reserve(n)
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancelCh:
+		return false
+	}
+}
+
+// Buckets is a set of buckets which must all admit tokens, such as a per
+// session bucket and a shared global bucket.
+type Buckets []*Bucket
+
+// Wait blocks until n tokens have been consumed from every bucket or cancelCh
+// closes. Returns false if cancelled.
+func (bs Buckets) Wait(n float64, cancelCh <-chan struct{}) bool {
+	for _, b := range bs {
+		if !b.Wait(n, cancelCh) {
+			return false
+		}
+	}
+	return true
+}
+
+// full returns true if the bucket has refilled completely.
+func (b *Bucket) full(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill(now)
+	return b.tokens >= b.rate.Burst
+}
+
+const sweepInterval = time.Minute
+
+// Limiter maintains a bucket per key, such as a remote IP or principal. Full
+// buckets are periodically discarded so idle keys do not accumulate. A nil
+// Limiter never limits.
+type Limiter struct {
+	rate      Rate
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+	mtx       sync.Mutex
+}
+
+// NewLimiter returns a keyed limiter with rate, or nil if rate is unlimited.
+func NewLimiter(rate Rate) *Limiter {
+	if rate.Unlimited() {
+		return nil
+	}
+	return &Limiter{
+		rate:      rate,
+		buckets:   make(map[string]*Bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket. If none is available it returns
+// false and how long until one will be.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mtx.Lock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = NewBucket(l.rate)
+		l.buckets[key] = bucket
+	}
+	l.mtx.Unlock()
+
+	return bucket.Take(1)
+}
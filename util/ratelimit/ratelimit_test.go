@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    Rate
+		invalid bool
+	}{
+		{s: "", want: Rate{}},
+		{s: "0", want: Rate{}},
+		{s: "10", want: Rate{PerSecond: 10, Burst: 10}},
+		{s: "6/1m:3", want: Rate{PerSecond: 0.1, Burst: 3}},
+		{s: "0.5", want: Rate{PerSecond: 0.5, Burst: 1}},
+		{s: "10:1", want: Rate{PerSecond: 10, Burst: 1}},
+		{s: "10:0.5", invalid: true},
+		{s: "10:0", invalid: true},
+		{s: "10:-1", invalid: true},
+		{s: "-1", invalid: true},
+		{s: "10/0s", invalid: true},
+		{s: "ten", invalid: true},
+	} {
+		rate, err := ParseRate(tc.s)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%q: parsed an invalid rate as %+v", tc.s, rate)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.s, err)
+		} else if rate != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.s, rate, tc.want)
+		}
+	}
+}
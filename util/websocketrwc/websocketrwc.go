@@ -4,9 +4,9 @@
 package websocketrwc
 
 import (
-	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"sync"
 	"time"
@@ -38,77 +38,67 @@ var (
 	// PingInterval determins the interval at which Pings are sent to the
 	// client.
 	PingInterval = (PongTimeout * 9) / 10
+	// ReadLimit is the maximum size in bytes of a websocket message accepted
+	// from the peer. Larger messages fail the connection. 0 is unlimited.
+	ReadLimit int64 = 0
 )
 
-// safeBuffer adds thread-safety to *bytes.Buffer
-type safeBuffer struct {
-	buf *bytes.Buffer
-	sync.Mutex
-}
-
-// Read reads the next len(p) bytes from the buffer or until the buffer is drained.
-func (s *safeBuffer) Read(p []byte) (int, error) {
-	s.Lock()
-	defer s.Unlock()
-	return s.buf.Read(p)
-}
-
-// Write appends the contents of p to the buffer.
-func (s *safeBuffer) Write(p []byte) (int, error) {
-	s.Lock()
-	defer s.Unlock()
-	return s.buf.Write(p)
-}
-
-// Len returns the number of bytes of the unread portion of the buffer.
-func (s *safeBuffer) Len() int {
-	s.Lock()
-	defer s.Unlock()
-	return s.buf.Len()
-}
-
-// Reset resets the buffer to be empty.
-func (s *safeBuffer) Reset() {
-	s.Lock()
-	s.buf.Reset()
-	s.Unlock()
-}
-
 // Conn wraps gorilla websocket to provide io.ReadWriteCloser.
 type Conn struct {
-	ws     *websocket.Conn
-	buf    *safeBuffer
-	done   chan struct{}
-	wmutex sync.Mutex
-	rmutex sync.Mutex
+	ws *websocket.Conn
+	// reader is the reader of the websocket message currently being consumed.
+	reader io.Reader
+	// controlHandler receives text messages. If nil text messages are data.
+	controlHandler func([]byte)
+	done           chan struct{}
+	wmutex         sync.Mutex
+	rmutex         sync.Mutex
 }
 
-// Read implements io.Reader by wrapping websocket messages in a buffer.
+// Read implements io.Reader by reading through websocket messages in turn.
+// Messages are streamed rather than buffered, so a message is never held in
+// memory in full.
 func (c *Conn) Read(p []byte) (n int, err error) {
-	if c.buf.Len() == 0 {
-		var r io.Reader
-		c.buf.Reset()
-		c.rmutex.Lock()
-		defer c.rmutex.Unlock()
-		select {
-		case <-c.done:
-			err = ErrClosing
-		default:
-			err = c.ws.SetReadDeadline(time.Now().Add(PongTimeout))
-			if err == nil {
-				_, r, err = c.ws.NextReader()
+	c.rmutex.Lock()
+	defer c.rmutex.Unlock()
+
+	for {
+		if c.reader == nil {
+			select {
+			case <-c.done:
+				return 0, ErrClosing
+			default:
+			}
+			if err = c.ws.SetReadDeadline(time.Now().Add(PongTimeout)); err != nil {
+				return 0, err
+			}
+			var messageType int
+			if messageType, c.reader, err = c.ws.NextReader(); err != nil {
+				c.reader = nil
+				return 0, err
+			}
+			if messageType == websocket.TextMessage && c.controlHandler != nil {
+				msg, rerr := ioutil.ReadAll(c.reader)
+				c.reader = nil
+				if rerr != nil {
+					return 0, rerr
+				}
+				c.controlHandler(msg)
+				continue
 			}
 		}
-		if err != nil {
-			return n, err
-		}
-		_, err = io.Copy(c.buf, r)
-		if err != nil {
-			return n, err
+
+		n, err = c.reader.Read(p)
+		if err == io.EOF {
+			// End of this message - continue with the next one.
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
 		}
+		return n, err
 	}
-
-	return c.buf.Read(p)
 }
 
 // Write implements io.Writer and sends binary messages only.
@@ -135,23 +125,46 @@ func (c *Conn) write(messageType int, p []byte) (n int, err error) {
 	return n, err
 }
 
-// Close implements io.Closer and closes the underlying connection.
+// Close implements io.Closer and closes the underlying connection. It does not
+// wait for a blocked Read, which will fail once the connection is closed.
+// Closing an already closed connection does nothing.
 func (c *Conn) Close() error {
-	c.rmutex.Lock()
 	c.wmutex.Lock()
-	defer func() {
-		c.rmutex.Unlock()
-		c.wmutex.Unlock()
-	}()
+	defer c.wmutex.Unlock()
 	select {
 	case <-c.done:
-		return ErrClosing
+		return nil
 	default:
 		close(c.done)
 	}
 	return c.ws.Close()
 }
 
+// SetControlHandler sets a function which receives the payload of text
+// messages, separating them from the binary data stream. Must be called
+// before the connection is read from. The handler is called from Read and
+// should not block.
+func (c *Conn) SetControlHandler(handler func([]byte)) {
+	c.rmutex.Lock()
+	defer c.rmutex.Unlock()
+	c.controlHandler = handler
+}
+
+// WriteControlMessage sends p as a text message, which the peer receives
+// through its control handler.
+func (c *Conn) WriteControlMessage(p []byte) error {
+	_, err := c.write(websocket.TextMessage, p)
+	return err
+}
+
+// SendClose sends a close frame with the given code and reason to the peer,
+// telling it why the connection is ending. The connection should still be
+// closed with Close.
+func (c *Conn) SendClose(code int, reason string) error {
+	return c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(WriteTimeout))
+}
+
 // pinger sends ping messages on an interval for client keep-alive.
 func (c *Conn) pinger() {
 	ticker := time.NewTicker(PingInterval)
@@ -168,13 +181,6 @@ func (c *Conn) pinger() {
 	}
 }
 
-// newSafeBuffer instantiates a new safeBuffer
-func newSafeBuffer() *safeBuffer {
-	return &safeBuffer{
-		buf: bytes.NewBuffer(nil),
-	}
-}
-
 // Upgrade a HTTP connection to return the wrapped Conn. Returns the conn,
 // errors during the upgrade, and a channel which will be closed when the
 // underlying connection is closed.
@@ -189,10 +195,13 @@ func Upgrade(w http.ResponseWriter, r *http.Request, h http.Header, upgrader *we
 
 	conn := &Conn{
 		ws:   ws,
-		buf:  newSafeBuffer(),
 		done: make(chan struct{}),
 	}
 
+	if ReadLimit > 0 {
+		conn.ws.SetReadLimit(ReadLimit)
+	}
+
 	// Set read deadline to detect failed clients.
 	if err = conn.ws.SetReadDeadline(time.Now().Add(PongTimeout)); err != nil {
 		return nil, err, nil
@@ -212,9 +221,12 @@ func Upgrade(w http.ResponseWriter, r *http.Request, h http.Header, upgrader *we
 func WrapClientWebsocket(ws *websocket.Conn) (*Conn, error) {
 	conn := &Conn{
 		ws:   ws,
-		buf:  newSafeBuffer(),
 		done: make(chan struct{}),
 	}
 
+	if ReadLimit > 0 {
+		conn.ws.SetReadLimit(ReadLimit)
+	}
+
 	return conn, nil
 }
@@ -0,0 +1,165 @@
+package websocketrwc
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serve starts a server which upgrades every request and sends the result
+// on connCh.
+func serve(t *testing.T, connCh chan<- *Conn) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err, _ := Upgrade(w, r, nil, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		connCh <- conn
+	}))
+	return server
+}
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return ws
+}
+
+func setReadLimit(t *testing.T, limit int64) {
+	old := ReadLimit
+	ReadLimit = limit
+	t.Cleanup(func() { ReadLimit = old })
+}
+
+func TestReadLimitRejectsOversizedMessage(t *testing.T) {
+	setReadLimit(t, 1024)
+
+	connCh := make(chan *Conn, 1)
+	server := serve(t, connCh)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	conn := <-connCh
+	defer conn.Close()
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, bytes.Repeat([]byte("a"), 1024)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, bytes.Repeat([]byte("b"), 1025)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	// A message at the limit is accepted.
+	buf := make([]byte, 1024)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("reading message at the limit: %v", err)
+	}
+
+	// The oversized message fails the connection rather than being read.
+	_, err := conn.Read(buf)
+	if err != websocket.ErrReadLimit {
+		t.Fatalf("reading oversized message returned %v, want %v", err, websocket.ErrReadLimit)
+	}
+
+	// The peer is told why with a close frame.
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("peer read returned %v, want close %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestReadLimitRejectsOversizedControlMessage(t *testing.T) {
+	setReadLimit(t, 64)
+
+	connCh := make(chan *Conn, 1)
+	server := serve(t, connCh)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	conn := <-connCh
+	defer conn.Close()
+
+	handled := false
+	conn.SetControlHandler(func([]byte) { handled = true })
+
+	if err := ws.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("c"), 65)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 64)); err != websocket.ErrReadLimit {
+		t.Fatalf("Read returned %v, want %v", err, websocket.ErrReadLimit)
+	}
+	if handled {
+		t.Error("oversized control message was passed to the handler")
+	}
+}
+
+func TestReadLimitAppliesToClients(t *testing.T) {
+	setReadLimit(t, 16)
+
+	connCh := make(chan *Conn, 1)
+	server := serve(t, connCh)
+	defer server.Close()
+
+	ws := dial(t, server)
+	client, err := WrapClientWebsocket(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-connCh
+	defer conn.Close()
+
+	if _, err := conn.Write(bytes.Repeat([]byte("d"), 17)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 17)); err != websocket.ErrReadLimit {
+		t.Fatalf("Read returned %v, want %v", err, websocket.ErrReadLimit)
+	}
+}
+
+func TestReadStreamsLargeMessages(t *testing.T) {
+	setReadLimit(t, 0)
+
+	connCh := make(chan *Conn, 1)
+	server := serve(t, connCh)
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	conn := <-connCh
+	defer conn.Close()
+
+	msg := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	// Small reads consume the message in pieces.
+	got := make([]byte, len(msg))
+	buf := make([]byte, 100)
+	for read := 0; read < len(msg); {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read after %d bytes: %v", read, err)
+		}
+		copy(got[read:], buf[:n])
+		read += n
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("message was corrupted")
+	}
+}
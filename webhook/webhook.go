@@ -0,0 +1,146 @@
+// webhook implements an HTTP admission webhook which decides callback
+// registrations, such as by checking them against an external inventory.
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/wrouesnel/callback/control"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Request is posted to the webhook for each registration.
+type Request struct {
+	CallbackId string `json:"callback_id"`
+	// RemoteAddr is the IP address of the registrant, without a port.
+	RemoteAddr string `json:"remote_addr"`
+	Principal  string `json:"principal,omitempty"`
+	// Headers of the registration request. Credentials are removed.
+	Headers      http.Header       `json:"headers"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+}
+
+// Response is the webhook's decision on a registration.
+type Response struct {
+	Allowed bool `json:"allowed"`
+	// Reason is reported to the registrant if the registration is denied.
+	Reason string `json:"reason,omitempty"`
+	// Labels are added to the labels reported by the registrant, replacing
+	// any with the same key.
+	Labels map[string]string `json:"labels,omitempty"`
+	// CallbackId, if set, replaces the callback ID being registered.
+	CallbackId string `json:"callback_id,omitempty"`
+}
+
+// ErrWebhook is returned when the webhook could not be called or its response
+// was invalid.
+type ErrWebhook struct {
+	reason string
+}
+
+func (err ErrWebhook) Error() string {
+	return "admission webhook failed: " + err.reason
+}
+
+// maxResponseSize bounds how much of a webhook response is read.
+const maxResponseSize = 64 * 1024
+
+// redactedHeaders are not sent to the webhook.
+var redactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Sec-Websocket-Key",
+	control.ReclaimSecretHeader,
+}
+
+// Config configures a Webhook.
+type Config struct {
+	// URL the requests are posted to.
+	URL string
+	// Token, if not blank, is sent as a bearer token.
+	Token string
+	// Timeout bounds each call.
+	Timeout time.Duration
+	// FailOpen allows registrations when the webhook fails, rather than
+	// refusing them.
+	FailOpen bool
+}
+
+// Webhook calls an admission webhook.
+type Webhook struct {
+	config Config
+	client *http.Client
+}
+
+// New returns a Webhook.
+func New(config Config) *Webhook {
+	return &Webhook{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+// FailOpen returns true if registrations are allowed when the webhook fails.
+func (wh *Webhook) FailOpen() bool {
+	return wh.config.FailOpen
+}
+
+// NewRequest builds the webhook request of a registration.
+func NewRequest(r *http.Request, callbackId string, remoteAddr string, principal string, labels map[string]string, capabilities []string) *Request {
+	headers := r.Header.Clone()
+	for _, name := range redactedHeaders {
+		headers.Del(name)
+	}
+	return &Request{
+		CallbackId:   callbackId,
+		RemoteAddr:   remoteAddr,
+		Principal:    principal,
+		Headers:      headers,
+		Labels:       labels,
+		Capabilities: capabilities,
+	}
+}
+
+// Review asks the webhook to decide a registration. Any response other than
+// a 200 with a valid decision, of at most maxResponseSize bytes, is an error.
+func (wh *Webhook) Review(req *Request) (*Response, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequest("POST", wh.config.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if wh.config.Token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+wh.config.Token)
+	}
+
+	resp, err := wh.client.Do(hreq)
+	if err != nil {
+		return nil, &ErrWebhook{err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+		return nil, &ErrWebhook{fmt.Sprintf("webhook returned %s", resp.Status)}
+	}
+
+	ret := &Response{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(ret); err != nil {
+		return nil, &ErrWebhook{fmt.Sprintf("could not decode response: %v", err)}
+	}
+	if ret.Allowed && ret.CallbackId != "" && strings.Contains(ret.CallbackId, "/") {
+		return nil, &ErrWebhook{fmt.Sprintf("rewritten callback ID must not contain /: %q", ret.CallbackId)}
+	}
+	return ret, nil
+}
@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/wrouesnel/callback/control"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWebhook returns a Webhook calling handler.
+func testWebhook(t *testing.T, handler http.HandlerFunc) *Webhook {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return New(Config{URL: server.URL, Token: "secret", Timeout: 5 * time.Second})
+}
+
+// respond returns a handler replying with resp.
+func respond(resp Response) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func TestReview(t *testing.T) {
+	var received Request
+	wh := testWebhook(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s (%s)", r.Method, r.Header.Get("Content-Type"))
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("webhook called with Authorization %q", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("could not decode request: %v", err)
+		}
+		json.NewEncoder(w).Encode(Response{Allowed: true, Labels: map[string]string{"site": "syd"}, CallbackId: "syd-host1"})
+	})
+
+	resp, err := wh.Review(&Request{CallbackId: "host1", RemoteAddr: "192.0.2.1", Labels: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.CallbackId != "host1" || received.RemoteAddr != "192.0.2.1" || received.Labels["env"] != "prod" {
+		t.Errorf("webhook received %+v", received)
+	}
+	if !resp.Allowed || resp.Labels["site"] != "syd" || resp.CallbackId != "syd-host1" {
+		t.Errorf("response = %+v", resp)
+	}
+}
+
+func TestReviewDenied(t *testing.T) {
+	wh := testWebhook(t, respond(Response{Allowed: false, Reason: "unknown host"}))
+	resp, err := wh.Review(&Request{CallbackId: "host1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Allowed || resp.Reason != "unknown host" {
+		t.Errorf("response = %+v, want denied", resp)
+	}
+
+	// A denial may name any ID, since it is not registered.
+	wh = testWebhook(t, respond(Response{Allowed: false, CallbackId: "a/b"}))
+	if _, err := wh.Review(&Request{CallbackId: "host1"}); err != nil {
+		t.Errorf("denial with an invalid ID failed: %v", err)
+	}
+}
+
+func TestReviewErrors(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"status": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		},
+		"invalid response": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("allowed"))
+		},
+		"oversized response": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"allowed": true, "reason": "` + strings.Repeat("x", maxResponseSize) + `"}`))
+		},
+		"invalid callback ID": respond(Response{Allowed: true, CallbackId: "a/b"}),
+	} {
+		wh := testWebhook(t, handler)
+		_, err := wh.Review(&Request{CallbackId: "host1"})
+		if _, ok := err.(*ErrWebhook); !ok {
+			t.Errorf("%s: Review returned %v, want a webhook error", name, err)
+		}
+	}
+
+	server := httptest.NewServer(respond(Response{Allowed: true}))
+	server.Close()
+	wh := New(Config{URL: server.URL, Timeout: time.Second})
+	if _, err := wh.Review(&Request{CallbackId: "host1"}); err == nil {
+		t.Error("Review succeeded although the webhook is down")
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/callback/host1", nil)
+	for _, name := range append([]string{"User-Agent"}, redactedHeaders...) {
+		r.Header.Set(name, "value")
+	}
+
+	req := NewRequest(r, "host1", "192.0.2.1", "ci", nil, []string{"reclaim"})
+	if req.Headers.Get("User-Agent") != "value" {
+		t.Errorf("headers = %v, want other headers sent", req.Headers)
+	}
+	for _, name := range redactedHeaders {
+		if _, found := req.Headers[http.CanonicalHeaderKey(name)]; found {
+			t.Errorf("%s was sent to the webhook", name)
+		}
+	}
+	if r.Header.Get(control.ReclaimSecretHeader) != "value" {
+		t.Error("redacting headers changed the registration request")
+	}
+	if req.CallbackId != "host1" || req.RemoteAddr != "192.0.2.1" || req.Principal != "ci" {
+		t.Errorf("request = %+v", req)
+	}
+}